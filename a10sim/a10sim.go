@@ -0,0 +1,756 @@
+// Package a10sim simulates an A10 device speaking aXAPI v2.1,
+// keeping slb objects in memory.
+//
+// Only the methods used by a10go are implemented:
+// authenticate, session.close, slb.server.*, slb.service_group.*, slb.virtual_server.*
+//
+// aXAPI v2.1 request:
+//
+// POST https://<host>/services/rest/v2.1/?format=json&method=<method>&session_id=<id>
+package a10sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Path is the aXAPI v2.1 endpoint path
+const Path = "/services/rest/v2.1/"
+
+// aXAPI error codes
+const (
+	CodeInvalidSession = 1009
+	CodeNoSuchServer   = 67174402
+	CodeNoSuchGroup    = 67305473
+	CodeNoSuchVirtual  = 67239937
+	CodeAlreadyExists  = 402653200
+	CodeBadRequest     = 1
+	CodeBadLogin       = 520486915
+)
+
+// Int decodes aXAPI integers sent either as number or string
+type Int int
+
+// UnmarshalJSON accepts 80 or "80"
+func (i *Int) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*i = 0
+		return nil
+	}
+	v, errConv := strconv.Atoi(s)
+	if errConv != nil {
+		return fmt.Errorf("bad integer: %s", string(data))
+	}
+	*i = Int(v)
+	return nil
+}
+
+// Port is a server port
+type Port struct {
+	PortNum   Int  `json:"port_num" yaml:"port_num"`
+	Protocol  Int  `json:"protocol" yaml:"protocol"`    // 2=tcp 3=udp
+	Disabled  bool `json:"-" yaml:"disabled,omitempty"` // aXAPI status: 1=enabled 0=disabled
+	Weight    Int  `json:"-" yaml:"weight,omitempty"`
+	ConnLimit Int  `json:"-" yaml:"conn_limit,omitempty"`
+}
+
+type portJSON struct {
+	PortNum   Int  `json:"port_num"`
+	Protocol  Int  `json:"protocol"`
+	Status    *Int `json:"status,omitempty"`
+	Weight    Int  `json:"weight,omitempty"`
+	ConnLimit Int  `json:"conn_limit,omitempty"`
+}
+
+// MarshalJSON sends status as aXAPI does
+func (p Port) MarshalJSON() ([]byte, error) {
+	status := Int(1)
+	if p.Disabled {
+		status = 0
+	}
+	return json.Marshal(portJSON{PortNum: p.PortNum, Protocol: p.Protocol, Status: &status, Weight: p.Weight, ConnLimit: p.ConnLimit})
+}
+
+// UnmarshalJSON accepts missing status as enabled
+func (p *Port) UnmarshalJSON(data []byte) error {
+	var j portJSON
+	if errJSON := json.Unmarshal(data, &j); errJSON != nil {
+		return errJSON
+	}
+	*p = Port{PortNum: j.PortNum, Protocol: j.Protocol, Disabled: j.Status != nil && *j.Status == 0, Weight: j.Weight, ConnLimit: j.ConnLimit}
+	return nil
+}
+
+// Server is a real server
+type Server struct {
+	Name     string `json:"name" yaml:"name"`
+	Host     string `json:"host" yaml:"host"`
+	Status   Int    `json:"status" yaml:"status"`
+	PortList []Port `json:"port_list" yaml:"port_list"`
+}
+
+// Member is a service group member
+type Member struct {
+	Server   string `json:"server" yaml:"server"`
+	Port     Int    `json:"port" yaml:"port"`
+	Disabled bool   `json:"-" yaml:"disabled,omitempty"` // aXAPI status: 1=enabled 0=disabled
+	Priority Int    `json:"-" yaml:"priority,omitempty"`
+}
+
+type memberJSON struct {
+	Server   string `json:"server"`
+	Port     Int    `json:"port"`
+	Status   *Int   `json:"status,omitempty"`
+	Priority Int    `json:"priority,omitempty"`
+}
+
+// MarshalJSON sends status as aXAPI does
+func (m Member) MarshalJSON() ([]byte, error) {
+	status := Int(1)
+	if m.Disabled {
+		status = 0
+	}
+	return json.Marshal(memberJSON{Server: m.Server, Port: m.Port, Status: &status, Priority: m.Priority})
+}
+
+// UnmarshalJSON accepts missing status as enabled
+func (m *Member) UnmarshalJSON(data []byte) error {
+	var j memberJSON
+	if errJSON := json.Unmarshal(data, &j); errJSON != nil {
+		return errJSON
+	}
+	*m = Member{Server: j.Server, Port: j.Port, Disabled: j.Status != nil && *j.Status == 0, Priority: j.Priority}
+	return nil
+}
+
+// same checks member identity, ignoring status and priority
+func (m Member) same(other Member) bool {
+	return m.Server == other.Server && m.Port == other.Port
+}
+
+// MemberStat is the simulated traffic for a service group member
+type MemberStat struct {
+	CurConns  int
+	TotConns  int
+	ReqBytes  int
+	RespBytes int
+}
+
+// ServiceGroup is a service group
+type ServiceGroup struct {
+	Name       string   `json:"name" yaml:"name"`
+	Protocol   Int      `json:"protocol" yaml:"protocol"`
+	MemberList []Member `json:"member_list" yaml:"member_list"`
+}
+
+// VirtualPort is a virtual server port
+type VirtualPort struct {
+	Port         Int    `json:"port" yaml:"port"`
+	Protocol     Int    `json:"protocol" yaml:"protocol"`
+	ServiceGroup string `json:"service_group" yaml:"service_group"`
+}
+
+// VirtualServer is a virtual server
+type VirtualServer struct {
+	Name      string        `json:"name" yaml:"name"`
+	Address   string        `json:"address" yaml:"address"`
+	Status    Int           `json:"status" yaml:"status"`
+	VportList []VirtualPort `json:"vport_list" yaml:"vport_list"`
+}
+
+// State is the full device configuration
+type State struct {
+	ServerList        []Server        `json:"server_list" yaml:"server_list"`
+	ServiceGroupList  []ServiceGroup  `json:"service_group_list" yaml:"service_group_list"`
+	VirtualServerList []VirtualServer `json:"virtual_server_list" yaml:"virtual_server_list"`
+}
+
+// Device is a simulated A10 device
+type Device struct {
+	mutex       sync.Mutex
+	users       map[string]string // username => password
+	sessions    map[string]string // session id => username
+	nextSession int
+	servers     map[string]Server
+	groups      map[string]ServiceGroup
+	virtuals    map[string]VirtualServer
+	faults      map[string]string     // method => error message
+	calls       []string              // methods called
+	merge       bool                  // service group update merges member list, instead of replacing
+	stats       map[string]MemberStat // "group server,port" => traffic
+	down        map[string]bool       // "server,port" => failing health check
+}
+
+// New creates device with user admin:a10
+func New() *Device {
+	d := &Device{
+		users:    map[string]string{},
+		sessions: map[string]string{},
+		servers:  map[string]Server{},
+		groups:   map[string]ServiceGroup{},
+		virtuals: map[string]VirtualServer{},
+		faults:   map[string]string{},
+		stats:    map[string]MemberStat{},
+		down:     map[string]bool{},
+	}
+	d.AddUser("admin", "a10")
+	return d
+}
+
+// AddUser adds admin user
+func (d *Device) AddUser(username, password string) {
+	d.mutex.Lock()
+	d.users[username] = password
+	d.mutex.Unlock()
+}
+
+// Load replaces device configuration
+func (d *Device) Load(s State) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.servers = map[string]Server{}
+	d.groups = map[string]ServiceGroup{}
+	d.virtuals = map[string]VirtualServer{}
+	for _, server := range s.ServerList {
+		d.servers[server.Name] = server
+	}
+	for _, sg := range s.ServiceGroupList {
+		d.groups[sg.Name] = sg
+	}
+	for _, vs := range s.VirtualServerList {
+		d.virtuals[vs.Name] = vs
+	}
+}
+
+// State returns device configuration, sorted by name
+func (d *Device) State() State {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.state()
+}
+
+func (d *Device) state() State {
+	s := State{ServerList: []Server{}, ServiceGroupList: []ServiceGroup{}, VirtualServerList: []VirtualServer{}}
+	for _, server := range d.servers {
+		s.ServerList = append(s.ServerList, server)
+	}
+	for _, sg := range d.groups {
+		s.ServiceGroupList = append(s.ServiceGroupList, sg)
+	}
+	for _, vs := range d.virtuals {
+		s.VirtualServerList = append(s.VirtualServerList, vs)
+	}
+	sort.Slice(s.ServerList, func(i, j int) bool { return s.ServerList[i].Name < s.ServerList[j].Name })
+	sort.Slice(s.ServiceGroupList, func(i, j int) bool { return s.ServiceGroupList[i].Name < s.ServiceGroupList[j].Name })
+	sort.Slice(s.VirtualServerList, func(i, j int) bool { return s.VirtualServerList[i].Name < s.VirtualServerList[j].Name })
+	return s
+}
+
+// Fail makes method fail with message, until Heal is called.
+func (d *Device) Fail(method, msg string) {
+	d.mutex.Lock()
+	d.faults[method] = msg
+	d.mutex.Unlock()
+}
+
+// Heal removes failure set by Fail
+func (d *Device) Heal(method string) {
+	d.mutex.Lock()
+	delete(d.faults, method)
+	d.mutex.Unlock()
+}
+
+func statKey(group, server string, port int) string {
+	return fmt.Sprintf("%s %s,%d", group, server, port)
+}
+
+// SetStat sets simulated traffic for service group member, reported by slb.service_group.fetchStatistics
+func (d *Device) SetStat(group, server string, port int, stat MemberStat) {
+	d.mutex.Lock()
+	d.stats[statKey(group, server, port)] = stat
+	d.mutex.Unlock()
+}
+
+// SetDown makes server port fail (down=true) or pass its health check, reported by fetchStatistics
+func (d *Device) SetDown(server string, port int, down bool) {
+	d.mutex.Lock()
+	d.down[fmt.Sprintf("%s,%d", server, port)] = down
+	d.mutex.Unlock()
+}
+
+// MergeGroupUpdate makes slb.service_group.update add members, instead of replacing member list.
+// Some ACOS releases behave like this.
+func (d *Device) MergeGroupUpdate(merge bool) {
+	d.mutex.Lock()
+	d.merge = merge
+	d.mutex.Unlock()
+}
+
+// ExpireSessions drops all sessions, like a device reboot or idle timeout
+func (d *Device) ExpireSessions() {
+	d.mutex.Lock()
+	d.sessions = map[string]string{}
+	d.mutex.Unlock()
+}
+
+// Sessions returns number of open sessions
+func (d *Device) Sessions() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.sessions)
+}
+
+// Calls returns methods called so far
+func (d *Device) Calls() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string{}, d.calls...)
+}
+
+type apiError struct {
+	code int
+	msg  string
+}
+
+func fail(code int, format string, v ...interface{}) *apiError {
+	return &apiError{code: code, msg: fmt.Sprintf(format, v...)}
+}
+
+// ServeHTTP implements aXAPI v2.1
+func (d *Device) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != Path && r.URL.Path+"/" != Path {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	method := query.Get("method")
+
+	body, errRead := ioutil.ReadAll(r.Body)
+	if errRead != nil {
+		http.Error(w, errRead.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.calls = append(d.calls, method)
+
+	resp, errAPI := d.call(method, query.Get("session_id"), body)
+	if errAPI != nil {
+		log.Printf("a10sim: method=%s error: code=%d msg=%s", method, errAPI.code, errAPI.msg)
+		resp = map[string]interface{}{
+			"response": map[string]interface{}{
+				"status": "fail",
+				"err":    map[string]interface{}{"code": errAPI.code, "msg": errAPI.msg},
+			},
+		}
+	}
+	if resp == nil {
+		resp = map[string]interface{}{"response": map[string]interface{}{"status": "OK"}}
+	}
+
+	buf, errMarshal := json.Marshal(resp)
+	if errMarshal != nil {
+		http.Error(w, errMarshal.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// call runs aXAPI method - device must be locked. nil response means status OK.
+func (d *Device) call(method, sessionID string, body []byte) (interface{}, *apiError) {
+
+	if msg, found := d.faults[method]; found {
+		return nil, fail(CodeBadRequest, "%s", msg)
+	}
+
+	switch method {
+	case "authenticate":
+		return d.authenticate(body)
+	case "":
+		return nil, fail(CodeBadRequest, "missing method")
+	}
+
+	if _, found := d.sessions[sessionID]; !found {
+		return nil, fail(CodeInvalidSession, "Invalid session ID")
+	}
+
+	switch method {
+	case "session.close":
+		delete(d.sessions, sessionID)
+		return nil, nil
+	case "slb.server.getAll":
+		return map[string]interface{}{"server_list": d.state().ServerList}, nil
+	case "slb.service_group.getAll":
+		return map[string]interface{}{"service_group_list": d.state().ServiceGroupList}, nil
+	case "slb.virtual_server.getAll":
+		return map[string]interface{}{"virtual_server_list": d.state().VirtualServerList}, nil
+	case "slb.server.create", "slb.server.update":
+		return nil, d.serverWrite(method, body)
+	case "slb.server.delete":
+		return nil, d.serverDelete(body)
+	case "slb.service_group.create", "slb.service_group.update":
+		return nil, d.groupWrite(method, body)
+	case "slb.service_group.delete":
+		return nil, d.groupDelete(body)
+	case "slb.service_group.member.delete":
+		return nil, d.memberDelete(body)
+	case "slb.service_group.member.update":
+		return nil, d.memberUpdate(body)
+	case "slb.server.fetchStatistics":
+		return d.serverStatistics(body)
+	case "slb.service_group.fetchStatistics":
+		return d.groupStatistics(body)
+	case "slb.virtual_server.create", "slb.virtual_server.update":
+		return nil, d.virtualWrite(method, body)
+	case "slb.virtual_server.delete":
+		return nil, d.virtualDelete(body)
+	}
+
+	return nil, fail(CodeBadRequest, "unsupported method: %s", method)
+}
+
+func decode(body []byte, v interface{}) *apiError {
+	if errJSON := json.Unmarshal(body, v); errJSON != nil {
+		return fail(CodeBadRequest, "bad request body: %v", errJSON)
+	}
+	return nil
+}
+
+func (d *Device) authenticate(body []byte) (interface{}, *apiError) {
+	var auth struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if errDecode := decode(body, &auth); errDecode != nil {
+		return nil, errDecode
+	}
+	if password, found := d.users[auth.Username]; !found || password != auth.Password {
+		return nil, fail(CodeBadLogin, "Invalid username or password")
+	}
+	d.nextSession++
+	id := fmt.Sprintf("%032x", d.nextSession)
+	d.sessions[id] = auth.Username
+	return map[string]interface{}{"session_id": id}, nil
+}
+
+func (d *Device) serverWrite(method string, body []byte) *apiError {
+	var req struct {
+		Server Server `json:"server"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return errDecode
+	}
+	s := req.Server
+	if s.Name == "" {
+		return fail(CodeBadRequest, "missing server name")
+	}
+	_, found := d.servers[s.Name]
+	switch {
+	case method == "slb.server.create" && found:
+		return fail(CodeAlreadyExists, "Server %s already exists", s.Name)
+	case method == "slb.server.update" && !found:
+		return fail(CodeNoSuchServer, " No such Server")
+	}
+	if s.Host == "" {
+		return fail(CodeBadRequest, "missing server host")
+	}
+	// like the device, refuse to drop ports used by service group members
+	old := d.servers[s.Name]
+	for _, sg := range d.groups {
+		for _, m := range sg.MemberList {
+			if m.Server == s.Name && hasPort(old.PortList, m.Port) && !hasPort(s.PortList, m.Port) {
+				return fail(CodeBadRequest, "Server %s port %d is used by service group %s", s.Name, m.Port, sg.Name)
+			}
+		}
+	}
+	d.servers[s.Name] = s
+	return nil
+}
+
+func hasPort(ports []Port, port Int) bool {
+	for _, p := range ports {
+		if p.PortNum == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Device) serverDelete(body []byte) *apiError {
+	var req struct {
+		Server Server `json:"server"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return errDecode
+	}
+	name := req.Server.Name
+	if _, found := d.servers[name]; !found {
+		return fail(CodeNoSuchServer, " No such Server")
+	}
+	delete(d.servers, name)
+	// deleted server leaves service groups
+	for _, sg := range d.groups {
+		var keep []Member
+		for _, m := range sg.MemberList {
+			if m.Server != name {
+				keep = append(keep, m)
+			}
+		}
+		sg.MemberList = keep
+		d.groups[sg.Name] = sg
+	}
+	return nil
+}
+
+func (d *Device) checkMembers(members []Member) *apiError {
+	for _, m := range members {
+		if _, found := d.servers[m.Server]; !found {
+			return fail(CodeNoSuchServer, " No such Server: %s", m.Server)
+		}
+	}
+	return nil
+}
+
+func (d *Device) groupWrite(method string, body []byte) *apiError {
+	var req struct {
+		ServiceGroup ServiceGroup `json:"service_group"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return errDecode
+	}
+	sg := req.ServiceGroup
+	if sg.Name == "" {
+		return fail(CodeBadRequest, "missing service group name")
+	}
+	old, found := d.groups[sg.Name]
+	switch {
+	case method == "slb.service_group.create" && found:
+		return fail(CodeAlreadyExists, "Service group %s already exists", sg.Name)
+	case method == "slb.service_group.update" && !found:
+		return fail(CodeNoSuchGroup, "No such service group")
+	}
+	if errMembers := d.checkMembers(sg.MemberList); errMembers != nil {
+		return errMembers
+	}
+	if found && d.merge {
+		merged := old.MemberList
+	LOOP:
+		for _, m := range sg.MemberList {
+			for _, o := range old.MemberList {
+				if o.same(m) {
+					continue LOOP
+				}
+			}
+			merged = append(merged, m)
+		}
+		sg.MemberList = merged
+	}
+	d.groups[sg.Name] = sg
+	return nil
+}
+
+func (d *Device) groupDelete(body []byte) *apiError {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return errDecode
+	}
+	if _, found := d.groups[req.Name]; !found {
+		return fail(CodeNoSuchGroup, "No such service group")
+	}
+	delete(d.groups, req.Name)
+	return nil
+}
+
+func (d *Device) memberDelete(body []byte) *apiError {
+	var req struct {
+		Name   string `json:"name"`
+		Member Member `json:"member"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return errDecode
+	}
+	sg, found := d.groups[req.Name]
+	if !found {
+		return fail(CodeNoSuchGroup, "No such service group")
+	}
+	for i, m := range sg.MemberList {
+		if m.same(req.Member) {
+			sg.MemberList = append(sg.MemberList[:i:i], sg.MemberList[i+1:]...)
+			d.groups[sg.Name] = sg
+			return nil
+		}
+	}
+	return fail(CodeNoSuchServer, "No such member: %s,%d", req.Member.Server, req.Member.Port)
+}
+
+func (d *Device) memberUpdate(body []byte) *apiError {
+	var req struct {
+		Name   string `json:"name"`
+		Member Member `json:"member"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return errDecode
+	}
+	sg, found := d.groups[req.Name]
+	if !found {
+		return fail(CodeNoSuchGroup, "No such service group")
+	}
+	for i, m := range sg.MemberList {
+		if m.same(req.Member) {
+			members := append([]Member{}, sg.MemberList...)
+			members[i] = req.Member
+			sg.MemberList = members
+			d.groups[sg.Name] = sg
+			return nil
+		}
+	}
+	return fail(CodeNoSuchServer, "No such member: %s,%d", req.Member.Server, req.Member.Port)
+}
+
+func (d *Device) groupStatistics(body []byte) (interface{}, *apiError) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return nil, errDecode
+	}
+	sg, found := d.groups[req.Name]
+	if !found {
+		return nil, fail(CodeNoSuchGroup, "No such service group")
+	}
+	memberStats := []map[string]interface{}{}
+	for _, m := range sg.MemberList {
+		stat := d.stats[statKey(sg.Name, m.Server, int(m.Port))]
+		status := 1
+		if m.Disabled || d.down[fmt.Sprintf("%s,%d", m.Server, m.Port)] {
+			status = 0
+		}
+		memberStats = append(memberStats, map[string]interface{}{
+			"server":     m.Server,
+			"port":       m.Port,
+			"status":     status,
+			"cur_conns":  stat.CurConns,
+			"tot_conns":  stat.TotConns,
+			"req_bytes":  stat.ReqBytes,
+			"resp_bytes": stat.RespBytes,
+		})
+	}
+	return map[string]interface{}{"service_group_stat": map[string]interface{}{"name": sg.Name, "member_stat_list": memberStats}}, nil
+}
+
+// serverStatistics reports server and port traffic as the sum of traffic of their group members
+func (d *Device) serverStatistics(body []byte) (interface{}, *apiError) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return nil, errDecode
+	}
+	s, found := d.servers[req.Name]
+	if !found {
+		return nil, fail(CodeNoSuchServer, "No such Server")
+	}
+	var server MemberStat
+	serverStatus := 0
+	portStats := []map[string]interface{}{}
+	for _, p := range s.PortList {
+		var port MemberStat
+		for _, sg := range d.groups {
+			stat := d.stats[statKey(sg.Name, s.Name, int(p.PortNum))]
+			port.CurConns += stat.CurConns
+			port.TotConns += stat.TotConns
+			port.ReqBytes += stat.ReqBytes
+			port.RespBytes += stat.RespBytes
+		}
+		status := 1
+		if s.Status == 0 || p.Disabled || d.down[fmt.Sprintf("%s,%d", s.Name, p.PortNum)] {
+			status = 0
+		}
+		if status == 1 {
+			serverStatus = 1 // server is up while some port is up
+		}
+		server.CurConns += port.CurConns
+		server.TotConns += port.TotConns
+		server.ReqBytes += port.ReqBytes
+		server.RespBytes += port.RespBytes
+		portStats = append(portStats, map[string]interface{}{
+			"port_num":   p.PortNum,
+			"protocol":   p.Protocol,
+			"status":     status,
+			"cur_conns":  port.CurConns,
+			"tot_conns":  port.TotConns,
+			"req_bytes":  port.ReqBytes,
+			"resp_bytes": port.RespBytes,
+		})
+	}
+	if len(s.PortList) == 0 && s.Status != 0 {
+		serverStatus = 1
+	}
+	return map[string]interface{}{"server_stat": map[string]interface{}{
+		"name":           s.Name,
+		"host":           s.Host,
+		"status":         serverStatus,
+		"cur_conns":      server.CurConns,
+		"tot_conns":      server.TotConns,
+		"req_bytes":      server.ReqBytes,
+		"resp_bytes":     server.RespBytes,
+		"port_stat_list": portStats,
+	}}, nil
+}
+
+func (d *Device) virtualWrite(method string, body []byte) *apiError {
+	var req struct {
+		VirtualServer VirtualServer `json:"virtual_server"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return errDecode
+	}
+	vs := req.VirtualServer
+	if vs.Name == "" {
+		return fail(CodeBadRequest, "missing virtual server name")
+	}
+	_, found := d.virtuals[vs.Name]
+	switch {
+	case method == "slb.virtual_server.create" && found:
+		return fail(CodeAlreadyExists, "Virtual server %s already exists", vs.Name)
+	case method == "slb.virtual_server.update" && !found:
+		return fail(CodeNoSuchVirtual, "No such virtual server")
+	}
+	for _, vp := range vs.VportList {
+		if _, groupFound := d.groups[vp.ServiceGroup]; vp.ServiceGroup != "" && !groupFound {
+			return fail(CodeNoSuchGroup, "No such service group: %s", vp.ServiceGroup)
+		}
+	}
+	d.virtuals[vs.Name] = vs
+	return nil
+}
+
+func (d *Device) virtualDelete(body []byte) *apiError {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if errDecode := decode(body, &req); errDecode != nil {
+		return errDecode
+	}
+	if _, found := d.virtuals[req.Name]; !found {
+		return fail(CodeNoSuchVirtual, "No such virtual server")
+	}
+	delete(d.virtuals, req.Name)
+	return nil
+}
@@ -0,0 +1,43 @@
+package a10sim
+
+import (
+	"testing"
+
+	"github.com/udhos/a10-go-rest-client/a10go"
+)
+
+func TestSession(t *testing.T) {
+	d := New()
+	server := NewTLSServer(d)
+	defer server.Close()
+
+	c := a10go.New(Host(server), a10go.Options{})
+
+	if errLogin := c.Login("admin", "bad"); errLogin == nil {
+		t.Errorf("login with bad password: missing error")
+	}
+	if errLogin := c.Login("admin", "a10"); errLogin != nil {
+		t.Fatalf("login: %v", errLogin)
+	}
+	if d.Sessions() != 1 {
+		t.Errorf("expected 1 session, got %d", d.Sessions())
+	}
+
+	if errCreate := c.ServerCreate("s1", "1.1.1.1", []string{"80,2"}); errCreate != nil {
+		t.Errorf("server create: %v", errCreate)
+	}
+	if errCreate := c.ServerCreate("s1", "1.1.1.1", nil); errCreate == nil {
+		t.Errorf("server create duplicate: missing error")
+	}
+
+	d.ExpireSessions()
+
+	if errUpdate := c.ServerUpdate("s1", "2.2.2.2", nil); errUpdate == nil {
+		t.Errorf("server update with expired session: missing error")
+	}
+
+	state := d.State()
+	if len(state.ServerList) != 1 || state.ServerList[0].Host != "1.1.1.1" || state.ServerList[0].PortList[0].PortNum != 80 {
+		t.Errorf("unexpected state: %v", state)
+	}
+}
@@ -0,0 +1,116 @@
+// balance-admin manages balance-service secrets.
+//
+// Usage:
+//
+// balance-admin genkey                    print new credential store key
+// balance-admin token <user>              print new API token and users file entry for it
+// balance-admin cred-list                 list devices in credential store
+// balance-admin cred-set <device> <user>  store device credential (password read from stdin)
+// balance-admin cred-delete <device>      remove device credential
+//
+// Env vars for cred-* commands:
+//
+// CREDENTIALS=credentials.enc   credential store file
+// CREDENTIALS_KEY=...           credential store key (from genkey)
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/udhos/balance-api-service/credstore"
+)
+
+func usage() {
+	log.Fatalf("usage: %s genkey | token <user> | cred-list | cred-set <device> <username> | cred-delete <device>", os.Args[0])
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch cmd := os.Args[1]; cmd {
+	case "genkey":
+		key, errKey := credstore.GenerateKey()
+		if errKey != nil {
+			log.Fatalf("genkey: %v", errKey)
+		}
+		fmt.Println(key)
+	case "token":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		token := make([]byte, 24)
+		if _, errRand := io.ReadFull(rand.Reader, token); errRand != nil {
+			log.Fatalf("token: %v", errRand)
+		}
+		t := hex.EncodeToString(token)
+		sum := sha256.Sum256([]byte(t))
+		fmt.Printf("token: %s\n", t)
+		fmt.Printf("users file entry:\n- name: %s\n  token_sha256: %s\n", os.Args[2], hex.EncodeToString(sum[:]))
+	case "cred-list":
+		s := openStore()
+		for _, d := range s.Devices() {
+			c, _ := s.Get(d)
+			fmt.Printf("%s %s\n", d, c.Username)
+		}
+	case "cred-set":
+		if len(os.Args) < 4 {
+			usage()
+		}
+		s := openStore()
+		fmt.Fprintf(os.Stderr, "password for %s@%s: ", os.Args[3], os.Args[2])
+		password, errRead := bufio.NewReader(os.Stdin).ReadString('\n')
+		if errRead != nil && errRead != io.EOF {
+			log.Fatalf("password: %v", errRead)
+		}
+		c := credstore.Credential{Username: os.Args[3], Password: strings.TrimRight(password, "\r\n")}
+		if errSet := s.Set(os.Args[2], c); errSet != nil {
+			log.Fatalf("cred-set: %v", errSet)
+		}
+		saveStore(s)
+	case "cred-delete":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		s := openStore()
+		if !s.Delete(os.Args[2]) {
+			log.Fatalf("cred-delete: device not found: %s", os.Args[2])
+		}
+		saveStore(s)
+	default:
+		log.Printf("unknown command: %s", cmd)
+		usage()
+	}
+}
+
+func openStore() *credstore.Store {
+	file := os.Getenv("CREDENTIALS")
+	if file == "" {
+		file = "credentials.enc"
+	}
+	key, errKey := credstore.ParseKey(os.Getenv("CREDENTIALS_KEY"))
+	if errKey != nil {
+		log.Fatalf("env var CREDENTIALS_KEY: %v", errKey)
+	}
+	s, errOpen := credstore.Open(file, key)
+	if errOpen != nil {
+		log.Fatalf("open: %v", errOpen)
+	}
+	return s
+}
+
+func saveStore(s *credstore.Store) {
+	if errSave := s.Save(); errSave != nil {
+		log.Fatalf("save: %v", errSave)
+	}
+}
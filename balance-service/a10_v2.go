@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"strings"
+
+	"github.com/udhos/a10-go-rest-client/a10go"
 )
 
 func isYaml(s string) bool {
@@ -98,164 +100,157 @@ func handlerNodeA10v2Health(w http.ResponseWriter, r *http.Request, path string)
 // ^^^^^^^^^^^^^
 // prefix
 func handlerNodeA10v2(debug, dry bool, w http.ResponseWriter, r *http.Request, path string) {
+	handlerNode(debug, dry, "a10v2", w, r, path)
+}
 
-	me := "handlerNodeA10v2"
-
-	if !strings.HasPrefix(r.URL.Path, path) {
-		sendNotFound(me, w, r)
-		return
-	}
-
-	suffix := strings.TrimPrefix(r.URL.Path, path)
+// /v1/at2/node/<host>/virtual/
+// GET: full virtual server layout
+// PUT: body is the complete desired virtual server layout for the device
 
-	log.Printf(me+": TLS=%v method=%s url=%s from=%s suffix=[%s]", r.TLS != nil, r.Method, r.URL.Path, r.RemoteAddr, suffix)
-	forwarded(me, r)
+func nodeVirtual(debug, dry bool, vendor string, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
 
-	fields := strings.FieldsFunc(suffix, func(r rune) bool { return r == '/' })
+	me := "nodeVirtual"
 
-	if len(fields) < 2 {
-		reason := fmt.Sprintf("missing path fields: %d < %d", len(fields), 2)
-		sendBadRequest(me, reason, w, r)
+	if vendor != "a10v2" {
+		sendNotImplemented(me+":"+vendor, w, r)
 		return
 	}
 
-	node := fields[0]
-	realm := "node-" + node
-	log.Printf(me+": method=%s url=%s from=%s suffix=[%s] auth realm=[%s]", r.Method, r.URL.Path, r.RemoteAddr, suffix, realm)
-	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
-	username, password, authOK := r.BasicAuth()
-	if !authOK {
-		http.Error(w, "not authorized", http.StatusUnauthorized) // 401
-		return
-	}
-	log.Printf(me+": method=%s url=%s from=%s suffix=[%s] auth realm=[%s] auth=[%s:%s]", r.Method, r.URL.Path, r.RemoteAddr, suffix, realm, username, hidePassword(password))
-
-	log.Printf("handlerNodeA10v2: FIXME? Access-Control-Allow-Origin")
-	w.Header().Set("Access-Control-Allow-Origin", "*") // FIXME?
-
-	optionField := fields[1]
-	switch optionField {
-	/*
-		case "rule":
-			nodeA10v2Rule(debug, dry, w, r, username, password, fields)
-	*/
-	case "backend":
-		nodeA10v2Backend(debug, dry, w, r, username, password, fields)
-	case "healthcheck":
-		writeStr(me, w, "node health ok\n")
-	default:
-		reason := fmt.Sprintf("unexpected option field: [%s]", optionField)
-		sendBadRequest(me, reason, w, r)
-	}
-}
-
-/*
-func nodeA10v2Rule(debug, dry bool, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
-
-	me := "nodeA10v2Rule"
-
 	switch r.Method {
 	case http.MethodGet:
-		nodeA10v2RuleGet(w, r, username, password, fields)
+		if authorize(me, fields[0], policyRead, nil, w, r) {
+			nodeA10v2VirtualGet(debug, w, r, username, password, fields)
+		}
 	case http.MethodPut:
-		nodeA10v2RulePut(debug, dry, w, r, username, password, fields)
+		if authorize(me, fields[0], policyVirtual, nil, w, r) {
+			nodeA10v2VirtualPut(debug, dry, w, r, username, password, fields)
+		}
 	default:
 		sendNotSupported(me, w, r)
 	}
 }
 
-func nodeA10v2RuleGet(w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+func nodeA10v2VirtualGet(debug bool, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
 
-	me := "nodeA10v2RuleGet"
+	me := "nodeA10v2VirtualGet"
 
 	host := fields[0]
 
-	c := a10go.New(host, a10go.Options{})
-
-	errLogin := c.Login(username, password)
+	s, errLogin := a10Pool.get(host, username, password, a10go.Options{Debug: debug})
 	if errLogin != nil {
 		log.Printf(me+": method=%s url=%s from=%s auth: %v", r.Method, r.URL.Path, r.RemoteAddr, errLogin)
 		http.Error(w, host+" bad gateway - auth", http.StatusBadGateway) // 502
+		return
 	}
 
-	vList := fetchVirtualList(c)
-
-	if errClose := c.Logout(); errClose != nil {
-		log.Printf(me+": method=%s url=%s from=%s close error: %v", r.Method, r.URL.Path, r.RemoteAddr, errClose)
-		// log warning only
-	}
-
-	sendVirtualList(me, w, r, vList)
-}
+	vList, errList := fetchVirtualList(s.c)
 
-func sendVirtualList(me string, w http.ResponseWriter, r *http.Request, vList []virtual) {
+	a10Pool.put(s, !a10SessionExpired(errList))
 
-	query := r.URL.Query()
-	if _, found := query["debug"]; found {
-		writeStr(me, w, litter.Sdump(vList))
+	if errList != nil {
+		sendDriverError(me, host, "virtual list", errList, w, r)
 		return
 	}
 
-	buf, errMarshal := json.MarshalIndent(vList, "", " ")
-	if errMarshal != nil {
-		log.Printf(me+": method=%s url=%s from=%s json error: %v", r.Method, r.URL.Path, r.RemoteAddr, errMarshal)
-		sendInternalError(me, w, r) // http 500
-		return
-	}
-	writeBuf(me, w, buf)
+	acceptYAML, _ := clientOptions(debug, r)
+
+	sendList(me, w, r, vList, acceptYAML)
 }
 
-func nodeA10v2RulePut(debug, dry bool, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+func nodeA10v2VirtualPut(debug, dry bool, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
 
-	me := "nodeA10v2RulePut"
+	me := "nodeA10v2VirtualPut"
 
 	var newList []virtual
 
-	dec := json.NewDecoder(r.Body)
-
-	errJson := dec.Decode(&newList)
-	if errJson != nil {
-		reason := fmt.Sprintf("json error: %v", errJson)
-		sendBadRequest(me, reason, w, r)
+	if errDecode := decodeRequest(debug, w, r, &newList); errDecode != nil {
 		return
 	}
 
-	log.Printf("newList: %v", newList)
+	log.Printf(me+": newList: %v", newList)
 
-	host := fields[0]
+	replaceVirtualList(me, debug, dry, fields[0], username, password, newList, nil, w, r)
+}
 
-	log.Printf("nodeA10v2RulePut: debug=%v", debug)
-	c := a10go.New(host, a10go.Options{Debug: debug, Dry: dry})
+// replaceVirtualList replaces virtual server layout on device and responds with layout after change.
+// Optional check may refuse the current layout, writing the response itself.
+func replaceVirtualList(me string, debug, dry bool, host, username, password string, newList []virtual, check func(oldList []virtual) bool, w http.ResponseWriter, r *http.Request) {
 
-	errLogin := c.Login(username, password)
+	defer lockDevice(host)() // serialize writes to device
+
+	s, errLogin := a10Pool.get(host, username, password, a10go.Options{Debug: debug, Dry: dry})
 	if errLogin != nil {
 		log.Printf(me+": method=%s url=%s from=%s auth: %v", r.Method, r.URL.Path, r.RemoteAddr, errLogin)
 		http.Error(w, host+" bad gateway - auth", http.StatusBadGateway) // 502
+		return
 	}
 
-	oldList := fetchVirtualList(c) // oldList: before change
+	healthy := true
+	defer func() { a10Pool.put(s, healthy) }()
 
-	log.Printf("oldList: %v", oldList)
+	c := s.c
+
+	oldList, errOld := fetchVirtualList(c) // oldList: before change
+	if errOld != nil {
+		healthy = !a10SessionExpired(errOld)
+		sendDriverError(me, host, "virtual list", errOld, w, r)
+		return
+	}
+
+	log.Printf(me+": oldList: %v", oldList)
+
+	if check != nil && !check(oldList) {
+		return
+	}
 
 	// newList: perform change here
 
-	put(c, oldList, newList)
+	errList := put(debug, c, oldList, newList)
+
+	if len(errList) > 0 {
+		msg := fmt.Sprintf("%s bad gateway - put virtual: errors:%d", host, len(errList))
+		for _, e := range errList {
+			msg += "\n" + e.Error()
+		}
+		log.Printf(me+": method=%s url=%s from=%s %s", r.Method, r.URL.Path, r.RemoteAddr, msg)
+		if !dry {
+			partialList, _ := fetchVirtualList(c) // partial change
+			auditVirtual(r, host, oldList, partialList, http.StatusBadGateway, msg, len(errList))
+		}
+		http.Error(w, msg, http.StatusBadGateway) // 502
+		return
+	}
 
-	finalList := fetchVirtualList(c) // finalList: after change
+	finalList, errFinal := fetchVirtualList(c) // finalList: after change
+	if errFinal != nil {
+		healthy = !a10SessionExpired(errFinal)
+		sendDriverError(me, host, "virtual list after put", errFinal, w, r)
+		return
+	}
 
-	if errClose := c.Logout(); errClose != nil {
-		log.Printf(me+": method=%s url=%s from=%s close error: %v", r.Method, r.URL.Path, r.RemoteAddr, errClose)
-		// log warning only
+	if !dry {
+		auditVirtual(r, host, oldList, finalList, http.StatusOK, "virtual layout replaced", 0)
 	}
 
-	sendVirtualList(me, w, r, finalList)
+	acceptYAML, _ := clientOptions(debug, r)
+
+	sendList(me, w, r, finalList, acceptYAML)
 }
 
-func fetchVirtualList(c *a10go.Client) []virtual {
+func fetchVirtualList(c *a10go.Client) ([]virtual, error) {
 
-	vsList := c.VirtualServerList()
-	sgList := c.ServiceGroupList()
-	sList := c.ServerList()
+	vsList, errVirtual := a10VirtualServerList(c)
+	if errVirtual != nil {
+		return nil, errVirtual
+	}
+	sgList, errGroups := a10ServiceGroupList(c)
+	if errGroups != nil {
+		return nil, errGroups
+	}
+	sList, errServers := a10ServerList(c)
+	if errServers != nil {
+		return nil, errServers
+	}
 
 	log.Printf("fetchVirtualList: total: vServers=%d groups=%d servers=%d", len(vsList), len(sgList), len(sList))
 
@@ -265,20 +260,14 @@ func fetchVirtualList(c *a10go.Client) []virtual {
 	for _, vs := range vsList {
 		v := virtual{Name: vs.Name, Address: vs.Address}
 
-		//log.Printf("fetchVirtualList: v=%s", vs.Name)
-
 		for _, vp := range vs.VirtualPorts {
 
-			//log.Printf("fetchVirtualList: v=%s p=%s", vs.Name, vp.Port)
-
 			for _, sg := range sgList {
 				if sg.Name != vp.ServiceGroup {
 					continue
 				}
 
-				p := pool{Name: vp.ServiceGroup, Port: vp.Port, Protocol: vp.Protocol}
-
-				//log.Printf("fetchVirtualList: v=%s p=%s g=%s", vs.Name, vp.Port, sg.Name)
+				p := pool{Name: vp.ServiceGroup, Port: vp.Port, Protocol: A10ProtocolName(vp.Protocol)}
 
 				for _, sgm := range sg.Members {
 					for _, s := range sList {
@@ -286,11 +275,8 @@ func fetchVirtualList(c *a10go.Client) []virtual {
 							continue
 						}
 
-						//log.Printf("fetchVirtualList: v=%s p=%s g=%s m=%s", vs.Name, vp.Port, sg.Name, sgm.Name)
-
 						host := server{Name: s.Name, Address: s.Host}
 						for _, port := range s.Ports {
-							//log.Printf("fetchVirtualList: v=%s p=%s g=%s m=%s p=%s", vs.Name, vp.Port, sg.Name, sgm.Name, port.Number)
 							protoName := A10ProtocolName(port.Protocol)
 							host.Ports = append(host.Ports, serverPort{Port: port.Number, Protocol: protoName})
 						}
@@ -309,6 +295,5 @@ func fetchVirtualList(c *a10go.Client) []virtual {
 
 	log.Printf("fetchVirtualList: linked: vServers=%d groups=%d servers=%d", len(vsList), countGroups, countServers)
 
-	return vList
+	return vList, nil
 }
-*/
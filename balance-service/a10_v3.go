@@ -7,10 +7,11 @@ import (
 	"strings"
 )
 
-// /v1/at/node/<host>/rule/<rule>
-// ^^^^^^^^^^^^
+// /v1/at3/node/<host>/rule/<rule>
+// /v1/at3/node/<host>/backend/
+// ^^^^^^^^^^^^^
 // prefix
-func handlerNodeA10v3(w http.ResponseWriter, r *http.Request, path string) {
+func handlerNodeA10v3(debug, dry bool, w http.ResponseWriter, r *http.Request, path string) {
 
 	me := "handlerNodeA10v3"
 
@@ -33,28 +34,37 @@ func handlerNodeA10v3(w http.ResponseWriter, r *http.Request, path string) {
 	}
 
 	node := fields[0]
-	realm := "node-" + node
-	log.Printf(me+": method=%s url=%s from=%s suffix=[%s] auth realm=[%s]", r.Method, r.URL.Path, r.RemoteAddr, suffix, realm)
-	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
-	username, password, authOK := r.BasicAuth()
+	if !checkInventory(me, "a10v3", node, w, r) {
+		return
+	}
+	r, username, password, authOK := deviceAuth(me, node, suffix, w, r)
 	if !authOK {
-		http.Error(w, "not authorized", http.StatusUnauthorized) // 401
 		return
 	}
-	log.Printf(me+": method=%s url=%s from=%s suffix=[%s] auth realm=[%s] auth=[%s:%s]", r.Method, r.URL.Path, r.RemoteAddr, suffix, realm, username, hidePassword(password))
+
+	w.Header().Set("Access-Control-Allow-Origin", "*") // FIXME??
 
 	ruleField := fields[1]
-	if ruleField != "rule" {
+	switch ruleField {
+	case "rule":
+		// handled below
+	case "backend":
+		nodeBackend(debug, dry, "a10v3", w, r, username, password, fields)
+		return
+	case "shift":
+		nodeShift(debug, dry, "a10v3", w, r, username, password, fields)
+		return
+	default:
 		reason := fmt.Sprintf("missing rule field: [%s]", ruleField)
 		sendBadRequest(me, reason, w, r)
 		return
 	}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*") // FIXME??
-
 	switch r.Method {
 	case http.MethodGet:
-		nodeA10v3RuleGet(w, r, username, password, fields)
+		if authorize(me, node, policyRead, nil, w, r) {
+			nodeA10v3RuleGet(w, r, username, password, fields)
+		}
 	default:
 		w.Header().Set("Allow", "POST") // required by 405 error
 		http.Error(w, r.Method+" method not supported", 405)
@@ -80,7 +90,7 @@ func nodeA10v3RuleGet(w http.ResponseWriter, r *http.Request, username, password
 
 	host := fields[0]
 
-	a10host := "https://" + host
+	a10host := "https://" + deviceHost(host)
 	api := a10host + "/axapi/v3/auth"
 
 	log.Printf(me+": method=%s url=%s from=%s opening: %s", r.Method, r.URL.Path, r.RemoteAddr, api)
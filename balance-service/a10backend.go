@@ -3,414 +3,662 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
+	"strings"
 
-	"github.com/sanity-io/litter"
 	"github.com/udhos/a10-go-rest-client/a10go"
-	"gopkg.in/yaml.v2"
 )
 
-// backend is the main type for the /backend/ route
-// A10 full backend path is:
-// virtual server -> virtual port list -> service group -> list of {backend_name, backend_port} -> server (has own list of ports)
-
-type backend struct {
-	VirtualServers []backendVirtualServer
-	ServiceGroups  []backendServiceGroup
-	BackendName    string
-	BackendAddress string
-	BackendPorts   []backendPort
+// a10v2 is the load balancer driver for A10 aXAPI v2
+// Device sessions are taken from a10Pool on Login and returned on Logout.
+type a10v2 struct {
+	opRecorder
+	host     string
+	opt      a10go.Options
+	session  *a10Session
+	c        *a10go.Client
+	dry      bool
+	username string
+	password string
+	broken   bool // session could not be renewed - do not return to pool
 }
 
-type backendVirtualServer struct {
-	Name         string
-	Address      string
-	VirtualPorts []backendVirtualPort
+func newA10v2(host string, opt lbOptions) loadBalancer {
+	if opt.TLSVerify {
+		log.Printf("newA10v2: host=%s: a10go does not verify device certificates - ignoring tls verify", host)
+	}
+	return &a10v2{
+		opRecorder: opRecorder{plan: opt.Plan},
+		host:       host,
+		opt:        a10go.Options{Debug: opt.Debug, Dry: opt.Dry},
+		dry:        opt.Dry,
+	}
 }
 
-type backendVirtualPort struct {
-	Port         string
-	Protocol     string
-	ServiceGroup string
+func (a *a10v2) Login(username, password string) error {
+	s, errGet := a10Pool.get(a.host, username, password, a.opt)
+	if errGet != nil {
+		return errGet
+	}
+	a.session = s
+	a.c = s.c
+	a.username = username
+	a.password = password
+	return nil
 }
 
-type backendServiceGroup struct {
-	Name     string
-	Protocol string
-	Members  []backendSGMember // list of members
+func (a *a10v2) Logout() error {
+	if a.session == nil {
+		return nil // not logged in
+	}
+	a10Pool.put(a.session, !a.broken)
+	return nil
 }
 
-type backendSGMember struct {
-	Name string
-	Port string
+// retry performs call, logging in again once if the pooled session has expired on device
+func (a *a10v2) retry(call func() error) error {
+	err := call()
+	if !a10SessionExpired(err) {
+		return err
+	}
+	log.Printf("a10v2: host=%s session expired: %v - logging in again", a.host, err)
+	if errLogin := a.c.Login(a.username, a.password); errLogin != nil {
+		log.Printf("a10v2: host=%s login again: %v", a.host, errLogin)
+		a.broken = true
+		return err
+	}
+	return call()
 }
 
-type backendPort struct {
-	Port     string
-	Protocol string
+// write performs device write operation, see opRecorder.run
+func (a *a10v2) write(op deviceOp, call func() error) error {
+	return a.run(op, func() error { return a.retry(call) })
 }
 
-// /v1/at/node/<host>/backend/
-// ^^^^^^^^^^^^
-// prefix
+// post performs aXAPI v2 method, checking response status
+func (a *a10v2) post(method, payload string) error {
+	return a10PostRaw(a.c, method, payload)
+}
 
-func nodeA10v2Backend(debug, dry bool, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+func (a *a10v2) serviceGroups() ([]a10ServiceGroup, error) {
+	var sgList []a10ServiceGroup
+	err := a.retry(func() error {
+		var errList error
+		sgList, errList = a10ServiceGroupList(a.c)
+		return errList
+	})
+	return sgList, err
+}
 
-	me := "nodeA10v2Backend"
+func (a *a10v2) BackendList() (map[string]*backend, error) {
+	var tab map[string]*backend
+	err := a.retry(func() error {
+		var errFetch error
+		tab, errFetch = fetchBackendTable(a.c)
+		return errFetch
+	})
+	return tab, err
+}
 
-	switch r.Method {
-	case http.MethodGet:
-		nodeA10v2BackendGet(debug, w, r, username, password, fields)
-	case http.MethodDelete:
-		nodeA10v2BackendDelete(debug, dry, w, r, username, password, fields)
-	case http.MethodPost:
-		nodeA10v2BackendPost(debug, dry, w, r, username, password, fields)
-	default:
-		sendNotSupported(me, w, r)
+func (a *a10v2) ServiceGroupList() ([]backendServiceGroup, error) {
+	sgList, errList := a.serviceGroups()
+	if errList != nil {
+		return nil, errList
 	}
+	var list []backendServiceGroup
+	for _, sg := range sgList {
+		bsg := backendServiceGroup{Name: sg.Name, Protocol: A10ProtocolName(sg.Protocol)}
+		for _, m := range sg.Members {
+			bsg.Members = append(bsg.Members, backendSGMember{Name: m.Name, Port: m.Port, State: m.State, Priority: m.Priority})
+		}
+		list = append(list, bsg)
+	}
+	return list, nil
 }
 
-func nodeA10v2BackendGet(debug bool, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
-	me := "nodeA10v2BackendGet"
+// withState appends state to operation detail, unless enabled
+func withState(detail, state string) string {
+	if stateOf(state) == stateEnabled {
+		return detail
+	}
+	return detail + "," + state
+}
 
-	host := fields[0]
-	c := a10go.New(host, a10go.Options{})
+// a10PortDetail appends state, weight and connection limit to operation detail
+func a10PortDetail(p a10Port) string {
+	detail := withState(p.Number+","+p.Protocol, p.State)
+	if p.Weight != 0 {
+		detail += fmt.Sprintf(",weight=%d", p.Weight)
+	}
+	if p.ConnLimit != 0 {
+		detail += fmt.Sprintf(",conn_limit=%d", p.ConnLimit)
+	}
+	return detail
+}
 
-	errLogin := c.Login(username, password)
-	if errLogin != nil {
-		log.Printf(me+": method=%s url=%s from=%s auth: %v", r.Method, r.URL.Path, r.RemoteAddr, errLogin)
-		http.Error(w, host+" bad gateway - auth", http.StatusBadGateway) // 502
-		return
+// a10ServerDetail describes server for operation detail
+func a10ServerDetail(s a10Server) []string {
+	detail := []string{withState(s.Host, s.State)}
+	for _, p := range s.Ports {
+		detail = append(detail, a10PortDetail(p))
 	}
+	return detail
+}
 
-	backendTab := fetchBackendTable(c)
+// a10ServerFrom builds server from backend.
+// Backend ports carry no weight nor connection limit, hence these are kept from current server (nil if missing).
+func a10ServerFrom(be backend, current *a10Server) a10Server {
+	s := a10Server{Name: be.BackendName, Host: be.BackendAddress, State: be.State}
+	for _, p := range be.BackendPorts {
+		port := a10Port{Number: p.Port, Protocol: A10ProtocolNumber(p.Protocol), State: p.State}
+		if current != nil {
+			for _, c := range current.Ports {
+				if c.Number == port.Number && c.Protocol == port.Protocol {
+					port.Weight, port.ConnLimit = c.Weight, c.ConnLimit
+				}
+			}
+		}
+		s.Ports = append(s.Ports, port)
+	}
+	return s
+}
 
-	if errClose := c.Logout(); errClose != nil {
-		log.Printf(me+": method=%s url=%s from=%s close error: %v", r.Method, r.URL.Path, r.RemoteAddr, errClose)
-		// log warning only
+// a10ServerPayload builds slb.server.create/update request.
+// a10go ServerCreate/ServerUpdate always send status enabled, hence payload is built here.
+func a10ServerPayload(s a10Server) string {
+	var portList []string
+	for _, p := range s.Ports {
+		var settings string
+		if p.Weight != 0 {
+			settings += fmt.Sprintf(`, "weight": %d`, p.Weight)
+		}
+		if p.ConnLimit != 0 {
+			settings += fmt.Sprintf(`, "conn_limit": %d`, p.ConnLimit)
+		}
+		portList = append(portList, fmt.Sprintf(`{"port_num": %s, "protocol": %s, "status": %d%s}`, p.Number, p.Protocol, a10Status(p.State), settings))
 	}
+	format := `{"server": {"name": "%s", "host": "%s", "status": %d, "port_list": [%s]}}`
+	return fmt.Sprintf(format, s.Name, s.Host, a10Status(s.State), strings.Join(portList, ", "))
+}
 
-	acceptYAML, _ := clientOptions(debug, r)
+func (a *a10v2) servers() ([]a10Server, error) {
+	var sList []a10Server
+	err := a.retry(func() error {
+		var errList error
+		sList, errList = a10ServerList(a.c)
+		return errList
+	})
+	return sList, err
+}
 
-	sendBackendList(me, w, r, backendTab, acceptYAML)
+// findA10Server finds server by name in sList
+func findA10Server(sList []a10Server, name string) *a10Server {
+	for i := range sList {
+		if sList[i].Name == name {
+			return &sList[i]
+		}
+	}
+	return nil
 }
 
-func sendBackendList(me string, w http.ResponseWriter, r *http.Request, tab map[string]*backend, acceptYAML bool) {
+// serverUpdate replaces server
+func (a *a10v2) serverUpdate(s a10Server) error {
+	op := deviceOp{Operation: "server update", Target: s.Name, Detail: a10ServerDetail(s)}
+	return a.write(op, func() error { return a.post("slb.server.update", a10ServerPayload(s)) })
+}
 
-	list := []*backend{}
+func (a *a10v2) BackendCreate(be backend) error {
+	s := a10ServerFrom(be, nil)
+	op := deviceOp{Operation: "server create", Target: be.BackendName, Detail: a10ServerDetail(s)}
+	return a.write(op, func() error { return a.post("slb.server.create", a10ServerPayload(s)) })
+}
 
-	for _, b := range tab {
-		list = append(list, b)
+func (a *a10v2) BackendUpdate(be backend) error {
+	sList, errList := a.servers()
+	if errList != nil {
+		return errList
 	}
+	return a.serverUpdate(a10ServerFrom(be, findA10Server(sList, be.BackendName)))
+}
 
-	// force litter
-	query := r.URL.Query()
-	if _, found := query["debug"]; found {
-		w.Header().Set("Content-Type", "text/plain")
-		writeStr(me, w, litter.Sdump(list))
-		writeLine(me, w)
-		return
-	}
+func (a *a10v2) BackendDelete(name string) error {
+	return a.write(deviceOp{Operation: "server delete", Target: name}, func() error { return a.c.ServerDelete(name) })
+}
 
-	// force YAML if supported
-	if acceptYAML {
-		buf, errMarshal := yaml.Marshal(list)
-		if errMarshal != nil {
-			log.Printf(me+": method=%s url=%s from=%s yaml error: %v", r.Method, r.URL.Path, r.RemoteAddr, errMarshal)
-			sendInternalError(me, w, r) // http 500
-			return
-		}
-		w.Header().Set("Content-Type", "text/x-yaml")
-		writeBuf(me, w, buf)
-		writeLine(me, w)
-		return
+// a10MemberPayload builds service group member entry
+func a10MemberPayload(m a10SGMember) string {
+	var priority string
+	if m.Priority != 0 {
+		priority = fmt.Sprintf(`, "priority": %d`, m.Priority)
 	}
+	return fmt.Sprintf(`{"server": "%s", "port": %s, "status": %d%s}`, m.Name, m.Port, a10Status(m.State), priority)
+}
 
-	// default to JSON
-	buf, errMarshal := json.MarshalIndent(list, "", " ")
-	if errMarshal != nil {
-		log.Printf(me+": method=%s url=%s from=%s json error: %v", r.Method, r.URL.Path, r.RemoteAddr, errMarshal)
-		sendInternalError(me, w, r) // http 500
-		return
+// groupUpdate replaces service group member list.
+// a10go ServiceGroupUpdate drops member status and priority, hence payload is built here.
+func (a *a10v2) groupUpdate(sg a10ServiceGroup, memberList []a10SGMember) error {
+	var detail []string
+	for _, m := range memberList {
+		detail = append(detail, withState(m.Name+","+m.Port, m.State))
 	}
-	w.Header().Set("Content-Type", "application/json")
-	writeBuf(me, w, buf)
-	writeLine(me, w)
+	op := deviceOp{Operation: "group update", Target: sg.Name, Detail: detail}
+	payload := a10GroupPayload(sg.Name, sg.Protocol, memberList)
+	return a.write(op, func() error { return a.post("slb.service_group.update", payload) })
 }
 
-func decodeBackend(debug bool, body io.Reader, bodyYAML bool, be *backend) error {
-	me := "decodeBackend"
-
-	// force YAML if supported
-	if bodyYAML {
-		log.Printf(me + ": decoding YAML request body")
+// a10GroupPayload builds service group with member list, keeping member status and priority
+func a10GroupPayload(name, protocol string, memberList []a10SGMember) string {
+	var members []string
+	for _, m := range memberList {
+		members = append(members, a10MemberPayload(m))
+	}
+	format := `{"service_group": {"name": "%s", "protocol": %s, "member_list": [%s]}}`
+	return fmt.Sprintf(format, name, protocol, strings.Join(members, ", "))
+}
 
-		buf, errRead := ioutil.ReadAll(body)
-		if errRead != nil {
-			return fmt.Errorf("read error: %v", errRead)
+// findA10Groups returns groups from sgList named in be.ServiceGroups
+func findA10Groups(sgList []a10ServiceGroup, be backend) []a10ServiceGroup {
+	found := []a10ServiceGroup{}
+	for _, bsg := range be.ServiceGroups {
+		for _, sg := range sgList {
+			if sg.Name == bsg.Name {
+				found = append(found, sg)
+				break
+			}
 		}
+	}
+	return found
+}
 
-		errYaml := yaml.Unmarshal(buf, be)
-		if errYaml != nil {
-			log.Printf(me+": decoding YAML request body - error: %v buf=[%s]", errYaml, string(buf))
-			return fmt.Errorf("yaml error: %v", errYaml)
-		}
+// BackendUnlink moves every group straight from old member list to new member list in a single update,
+// so the group is never left empty while other members remain.
+// Should the device reject the update (or keep the backend members), falls back to per-member delete.
+// A rejected update is reported as superseded when the fallback removes every backend member from the group.
+func (a *a10v2) BackendUnlink(be backend) (int, error) {
 
-		return nil
-	}
+	me := "a10v2.BackendUnlink"
 
-	// defaults to JSON
-	log.Printf(me + ": decoding JSON request body")
-	dec := json.NewDecoder(body)
-	errJson := dec.Decode(be)
-	if errJson != nil {
-		return fmt.Errorf("json error: %v", errJson)
+	sgList, errList := a.serviceGroups()
+	if errList != nil {
+		return 0, errList
 	}
 
-	return nil
-}
-
-func decodeRequestBody(debug bool, w http.ResponseWriter, r *http.Request, be *backend) error {
+	sgUnlinkList := findA10Groups(sgList, be) // groups linked to backend server
 
-	me := "decodeRequestBody"
+	log.Printf(me+": backend=[%s] linked groups=%v", be.BackendName, sgUnlinkList)
 
-	_, bodyYAML := clientOptions(debug, r)
+	var errCount int
 
-	errDecode := decodeBackend(debug, r.Body, bodyYAML, be)
-	if errDecode != nil {
-		sendBadRequest(me, errDecode.Error(), w, r)
-		return errDecode
-	}
+	failedUpdate := map[string]int{} // group => index of failed update in operations
 
-	return nil
-}
+	// scan groups unlinking the backend server
 
-func nodeA10v2BackendDelete(debug, dry bool, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
-	me := "nodeA10v2BackendDelete"
+	for _, sg := range sgUnlinkList {
 
-	var be backend
+		memberList := rebuildMemberList(sg.Name, sg.Members, be.BackendName, nil)
 
-	if errDecode := decodeRequestBody(debug, w, r, &be); errDecode != nil {
-		return
+		// replace member list in one step
+		errUpdate := a.groupUpdate(sg, memberList)
+		if errUpdate != nil {
+			log.Printf(me+": unlink group=%s update: %v - falling back to member delete", sg.Name, errUpdate)
+			failedUpdate[sg.Name] = len(a.ops) - 1
+		}
 	}
 
-	if be.BackendName == "" {
-		sendBadRequest(me, "missing backend name", w, r)
-		return
+	if a.plan || a.dry {
+		return errCount + len(failedUpdate), nil // nothing changed on device - skip verification
 	}
 
-	host := fields[0]
-	c := a10go.New(host, a10go.Options{Debug: debug, Dry: dry})
+	// verify backend members are gone, otherwise delete them one by one
 
-	errLogin := c.Login(username, password)
-	if errLogin != nil {
-		log.Printf(me+": method=%s url=%s from=%s auth: %v", r.Method, r.URL.Path, r.RemoteAddr, errLogin)
-		http.Error(w, host+" bad gateway - auth", http.StatusBadGateway) // 502
-		return
+	sgAfter, errAfter := a.serviceGroups()
+	if errAfter != nil {
+		return errCount, errAfter
 	}
 
-	defer func() {
-		if errClose := c.Logout(); errClose != nil {
-			log.Printf(me+": method=%s url=%s from=%s close error: %v", r.Method, r.URL.Path, r.RemoteAddr, errClose)
-			// log warning only
+LOOP:
+	for _, sg := range sgUnlinkList {
+		for _, after := range sgAfter {
+			if after.Name != sg.Name {
+				continue
+			}
+			var deleteErrors int
+			for _, m := range after.Members {
+				if m.Name != be.BackendName {
+					continue
+				}
+				if errDelete := a.memberDelete(sg.Name, m); errDelete != nil {
+					log.Printf(me+": unlink group=%s member delete %s,%s: %v", sg.Name, m.Name, m.Port, errDelete)
+					deleteErrors++
+				}
+			}
+			errCount += deleteErrors
+			if i, failed := failedUpdate[sg.Name]; failed {
+				if deleteErrors == 0 {
+					a.ops[i].Status = opSuperseded // fallback removed the members
+				} else {
+					errCount++ // neither update nor fallback unlinked the backend
+				}
+			}
+			continue LOOP
 		}
-	}()
-
-	if len(be.ServiceGroups) < 1 {
-		// service groups not provided - delete unlinked server
+		log.Printf(me+": unlink group=%s missing from group list - could not verify", sg.Name)
+		errCount++
+	}
 
-		errDelete := c.ServerDelete(be.BackendName)
-		if errDelete != nil {
-			log.Printf(me+": method=%s url=%s from=%s delete server: %v", r.Method, r.URL.Path, r.RemoteAddr, errDelete)
-			http.Error(w, host+" bad gateway - delete server", http.StatusBadGateway) // 502
-			return
-		}
-		writeStr(me, w, "server deleted\n")
-	} else {
-		// service groups provided - unlink server from groups
+	return errCount, nil
+}
 
-		backendUnlink(c, w, r, be, host)
-	}
+// memberDelete removes a single member from service group
+func (a *a10v2) memberDelete(sgName string, m a10SGMember) error {
+	op := deviceOp{Operation: "group member delete", Target: sgName, Detail: []string{m.Name + "," + m.Port}}
+	format := `{"name": "%s", "member": {"server": "%s", "port": %s}}`
+	payload := fmt.Sprintf(format, sgName, m.Name, m.Port)
+	return a.write(op, func() error { return a.post("slb.service_group.member.delete", payload) })
 }
 
-func backendUnlink(c *a10go.Client, w http.ResponseWriter, r *http.Request, be backend, host string) {
+// MemberUpdate sets status and priority of members listed in be.ServiceGroups,
+// then weight and connection limit of their server ports.
+func (a *a10v2) MemberUpdate(be backend) (int, error) {
 
-	me := "backendUnlink"
+	me := "a10v2.MemberUpdate"
 
-	sgList := c.ServiceGroupList() // all available groups
+	sgList, errList := a.serviceGroups()
+	if errList != nil {
+		return 0, errList
+	}
 
-	sgUnlinkList := []a10go.A10ServiceGroup{} // groups linked to backend server
+	var errCount int
+	var portChanges []backendSGMember
 
-	// find groups linked to backend server
-LOOP:
 	for _, bsg := range be.ServiceGroups {
+		var current []a10SGMember
 		for _, sg := range sgList {
 			if sg.Name == bsg.Name {
-				// found bsg
-				sgUnlinkList = append(sgUnlinkList, sg)
-				continue LOOP // next bsg
+				current = sg.Members
+			}
+		}
+		for _, m := range bsg.Members {
+			if m.Weight != 0 || m.ConnectionLimit != 0 {
+				portChanges = append(portChanges, m)
+			}
+			if m.State == "" && m.Priority == 0 {
+				continue // keep member
+			}
+			// member update replaces member, hence send current status and priority
+			member := a10SGMember{Name: m.Name, Port: m.Port, State: m.State, Priority: m.Priority}
+			for _, c := range current {
+				if c.Name == m.Name && c.Port == m.Port {
+					member = inheritA10Member(member, c)
+				}
+			}
+			op := deviceOp{Operation: "group member update", Target: bsg.Name, Detail: memberDetail(backendSGMember{Name: m.Name, Port: m.Port, State: m.State, Priority: m.Priority})}
+			payload := fmt.Sprintf(`{"name": "%s", "member": %s}`, bsg.Name, a10MemberPayload(member))
+			if errUpdate := a.write(op, func() error { return a.post("slb.service_group.member.update", payload) }); errUpdate != nil {
+				log.Printf(me+": group=%s member=%s,%s: %v", bsg.Name, m.Name, m.Port, errUpdate)
+				errCount++
 			}
 		}
-		// bsg not found
-		log.Printf(me+": method=%s url=%s from=%s unlink server: group=%s not found", r.Method, r.URL.Path, r.RemoteAddr, bsg.Name)
-		http.Error(w, host+" bad gateway - unlink server: group not found", http.StatusBadGateway) // 502
-		return
 	}
 
-	log.Printf(me+": backend=[%s] linked groups=%v", be.BackendName, sgUnlinkList)
-
-	var errCount int
-
-	// scan groups unlinking the backend server
+	if len(portChanges) == 0 {
+		return errCount, nil
+	}
 
-	for _, sg := range sgUnlinkList {
+	// weight and connection limit belong to server port
 
-		memberList := rebuildMemberList(sg.Name, sg.Members, be.BackendName, nil)
+	sList, errServers := a.servers()
+	if errServers != nil {
+		return errCount, errServers
+	}
 
-		// delete previous member list
-		errUpdate1 := c.ServiceGroupUpdate(sg.Name, sg.Protocol, nil)
-		if errUpdate1 != nil {
-			log.Printf(me+": method=%s url=%s from=%s unlink group=%s update-reset: %v", r.Method, r.URL.Path, r.RemoteAddr, sg.Name, errUpdate1)
+	var changed []string // server names in order
+	seen := map[string]bool{}
+	for _, m := range portChanges {
+		s := findA10Server(sList, m.Name)
+		if s == nil && a.plan {
+			// server created by plan - record planned change
+			op := deviceOp{Operation: "server update", Target: m.Name, Detail: memberDetail(backendSGMember{Name: m.Name, Port: m.Port, Weight: m.Weight, ConnectionLimit: m.ConnectionLimit})}
+			a.run(op, nil)
+			continue
+		}
+		if s == nil {
+			log.Printf(me+": member=%s,%s: server not found", m.Name, m.Port)
+			errCount++
+			continue
+		}
+		var found bool
+		for i, p := range s.Ports {
+			if p.Number != m.Port {
+				continue
+			}
+			found = true
+			if m.Weight != 0 {
+				s.Ports[i].Weight = m.Weight
+			}
+			if m.ConnectionLimit != 0 {
+				s.Ports[i].ConnLimit = m.ConnectionLimit
+			}
+		}
+		if !found {
+			log.Printf(me+": member=%s,%s: server port not found", m.Name, m.Port)
 			errCount++
+			continue
 		}
+		if !seen[s.Name] {
+			seen[s.Name] = true
+			changed = append(changed, s.Name)
+		}
+	}
 
-		// rebuild member list
-		errUpdate2 := c.ServiceGroupUpdate(sg.Name, sg.Protocol, memberList)
-		if errUpdate2 != nil {
-			log.Printf(me+": method=%s url=%s from=%s unlink group=%s update-rebuild: %v", r.Method, r.URL.Path, r.RemoteAddr, sg.Name, errUpdate2)
+	for _, name := range changed {
+		if errUpdate := a.serverUpdate(*findA10Server(sList, name)); errUpdate != nil {
+			log.Printf(me+": server=%s: %v", name, errUpdate)
 			errCount++
 		}
 	}
 
-	writeStr(me, w, fmt.Sprintf("server unlinked - errors:%d\n", errCount))
+	return errCount, nil
 }
 
-func nodeA10v2BackendPost(debug, dry bool, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
-	me := "nodeA10v2BackendPost"
-
-	var be backend
-
-	if errDecode := decodeRequestBody(debug, w, r, &be); errDecode != nil {
-		return
+// inheritA10Member fills status and priority missing from m with values from current member
+func inheritA10Member(m, current a10SGMember) a10SGMember {
+	if m.State == "" {
+		m.State = current.State
 	}
-
-	if be.BackendName == "" {
-		sendBadRequest(me, "missing backend name", w, r)
-		return
+	if m.Priority == 0 {
+		m.Priority = current.Priority
 	}
+	return m
+}
 
-	// A10 API for slb.server.update requires server address
-	if be.BackendAddress == "" {
-		sendBadRequest(me, "missing backend address", w, r)
-		return
-	}
+// a10v2Counters are status and traffic of server, server port or group member
+type a10v2Counters struct {
+	Status    a10Value `json:"status"` // 1=up
+	CurConns  int64    `json:"cur_conns"`
+	TotConns  int64    `json:"tot_conns"`
+	ReqBytes  int64    `json:"req_bytes"`
+	RespBytes int64    `json:"resp_bytes"`
+}
 
-	host := fields[0]
-	c := a10go.New(host, a10go.Options{Debug: debug, Dry: dry})
+func (c a10v2Counters) stats() backendStats {
+	return backendStats{Health: health(a10Int(c.Status) == 1), CurConns: c.CurConns, TotConns: c.TotConns, BytesIn: c.RespBytes, BytesOut: c.ReqBytes}
+}
 
-	errLogin := c.Login(username, password)
-	if errLogin != nil {
-		log.Printf(me+": method=%s url=%s from=%s auth: %v", r.Method, r.URL.Path, r.RemoteAddr, errLogin)
-		http.Error(w, host+" bad gateway - auth", http.StatusBadGateway) // 502
-		return
-	}
+// a10v2GroupStat is the response for slb.service_group.fetchStatistics
+type a10v2GroupStat struct {
+	ServiceGroupStat struct {
+		Name           string `json:"name"`
+		MemberStatList []struct {
+			Server string   `json:"server"`
+			Port   a10Value `json:"port"`
+			a10v2Counters
+		} `json:"member_stat_list"`
+	} `json:"service_group_stat"`
+}
 
-	defer func() {
-		if errClose := c.Logout(); errClose != nil {
-			log.Printf(me+": method=%s url=%s from=%s close error: %v", r.Method, r.URL.Path, r.RemoteAddr, errClose)
-			// log warning only
-		}
-	}()
+// a10v2ServerStat is the response for slb.server.fetchStatistics
+type a10v2ServerStat struct {
+	ServerStat struct {
+		Name string `json:"name"`
+		a10v2Counters
+		PortStatList []struct {
+			PortNum a10Value `json:"port_num"`
+			a10v2Counters
+		} `json:"port_stat_list"`
+	} `json:"server_stat"`
+}
 
-	// find groups linked to backend server
+func (a *a10v2) serverStat(name string) (a10v2ServerStat, error) {
+	var stat a10v2ServerStat
+	err := a.retry(func() error {
+		body, errPost := a.c.Post("slb.server.fetchStatistics", fmt.Sprintf(`{"name": "%s"}`, name))
+		if errPost != nil {
+			return errPost
+		}
+		if errJSON := json.Unmarshal(body, &stat); errJSON != nil || stat.ServerStat.Name == "" {
+			return a10v2Response(body)
+		}
+		return nil
+	})
+	return stat, err
+}
 
-	sgList := c.ServiceGroupList()        // all available groups
-	sgLinked := []a10go.A10ServiceGroup{} // groups to be linked to backend server
-LOOP:
-	for _, bsg := range be.ServiceGroups {
-		for _, sg := range sgList {
-			if sg.Name == bsg.Name {
-				// found bsg
-				sgLinked = append(sgLinked, sg)
-				continue LOOP // next bsg
-			}
+func (a *a10v2) groupStat(name string) (a10v2GroupStat, error) {
+	var stat a10v2GroupStat
+	err := a.retry(func() error {
+		body, errPost := a.c.Post("slb.service_group.fetchStatistics", fmt.Sprintf(`{"name": "%s"}`, name))
+		if errPost != nil {
+			return errPost
+		}
+		if errJSON := json.Unmarshal(body, &stat); errJSON != nil || stat.ServiceGroupStat.Name == "" {
+			return a10v2Response(body)
 		}
-		// bsg not found
-		log.Printf(me+": method=%s url=%s from=%s link server: group=%s not found", r.Method, r.URL.Path, r.RemoteAddr, bsg.Name)
-		http.Error(w, host+" bad gateway - link server: group not found", http.StatusBadGateway) // 502
-		return
+		return nil
+	})
+	return stat, err
+}
+
+func (a *a10v2) MemberConnections(be backend) ([]memberConn, error) {
+
+	sgList, errList := a.serviceGroups()
+	if errList != nil {
+		return nil, errList
 	}
 
-	// create or update server?
-	sList := c.ServerList()
-	var serverFound bool // defaults to create server
-	for _, s := range sList {
-		if s.Name == be.BackendName {
-			serverFound = true // update server
-			break
+	list := []memberConn{}
+
+	for _, sg := range findA10Groups(sgList, be) {
+		stat, errStat := a.groupStat(sg.Name)
+		if errStat != nil {
+			return nil, fmt.Errorf("group %s statistics: %v", sg.Name, errStat)
+		}
+		for _, m := range stat.ServiceGroupStat.MemberStatList {
+			if m.Server != be.BackendName {
+				continue
+			}
+			list = append(list, memberConn{Group: sg.Name, Member: m.Server, Port: string(m.Port), Connections: int(m.CurConns)})
 		}
 	}
 
-	var portList []string
-	for _, p := range be.BackendPorts {
-		portList = append(portList, p.Port+","+A10ProtocolNumber(p.Protocol))
-	}
+	return list, nil
+}
 
-	// create or update server
+func (a *a10v2) BackendStats(tab map[string]*backend) error {
 
-	if serverFound {
-		// server exists - update
-		errUpdate := c.ServerUpdate(be.BackendName, be.BackendAddress, portList)
-		if errUpdate != nil {
-			log.Printf(me+": method=%s url=%s from=%s update server: %v", r.Method, r.URL.Path, r.RemoteAddr, errUpdate)
-			http.Error(w, host+" bad gateway - update server", http.StatusBadGateway) // 502
-			return
+	groupStats := map[string]a10v2GroupStat{} // fetch every group once
+
+	for _, b := range tab {
+		stat, errStat := a.serverStat(b.BackendName)
+		if errStat != nil {
+			return fmt.Errorf("server %s statistics: %v", b.BackendName, errStat)
+		}
+		serverStats := stat.ServerStat.stats()
+		b.Stats = &serverStats
+		for _, p := range stat.ServerStat.PortStatList {
+			setPortStats(b, string(p.PortNum), p.stats())
 		}
-	} else {
-		// server does not exist - create
-		errCreate := c.ServerCreate(be.BackendName, be.BackendAddress, portList)
-		if errCreate != nil {
-			log.Printf(me+": method=%s url=%s from=%s create server: %v", r.Method, r.URL.Path, r.RemoteAddr, errCreate)
-			http.Error(w, host+" bad gateway - create server", http.StatusBadGateway) // 502
-			return
+
+		for _, sg := range b.ServiceGroups {
+			gs, found := groupStats[sg.Name]
+			if !found {
+				var errGroup error
+				gs, errGroup = a.groupStat(sg.Name)
+				if errGroup != nil {
+					return fmt.Errorf("group %s statistics: %v", sg.Name, errGroup)
+				}
+				groupStats[sg.Name] = gs
+			}
+			for _, m := range gs.ServiceGroupStat.MemberStatList {
+				if m.Server == b.BackendName {
+					setMemberStats(b, sg.Name, string(m.Port), m.stats())
+				}
+			}
 		}
 	}
 
-	if len(be.ServiceGroups) < 1 {
-		// service groups not provided - create/update server
-		if serverFound {
-			writeStr(me, w, "server updated\n")
-		} else {
-			writeStr(me, w, "server created\n")
+	return nil
+}
+
+// a10v2Response checks aXAPI v2 response status
+// {"response": {"status": "OK"}}
+// {"response": {"status": "fail", "err": {"code": 67174402, "msg": " No such Server"}}}
+func a10v2Response(body []byte) error {
+	var resp struct {
+		Response struct {
+			Status string `json:"status"`
+			Err    struct {
+				Code int    `json:"code"`
+				Msg  string `json:"msg"`
+			} `json:"err"`
+		} `json:"response"`
+	}
+	if errJSON := json.Unmarshal(body, &resp); errJSON != nil {
+		return fmt.Errorf("bad response: %v: [%s]", errJSON, string(body))
+	}
+	if resp.Response.Status != "OK" {
+		return fmt.Errorf("bad response: status=%s code=%d msg=%s", resp.Response.Status, resp.Response.Err.Code, resp.Response.Err.Msg)
+	}
+	return nil
+}
+
+// groupsNamed selects from groups only those ones with given name
+func groupsNamed(groups []backendServiceGroup, name string) []backendServiceGroup {
+	var list []backendServiceGroup
+	for _, bsg := range groups {
+		if bsg.Name == name {
+			list = append(list, bsg)
 		}
-	} else {
-		// service groups provided - link server from groups
-		backendLink(c, w, r, be, host, sgLinked)
 	}
+	return list
 }
 
-// rebuild service group member list excluding groups in oldMembers, adding groups in newGroups
-func rebuildMemberList(sgName string, oldMembers []a10go.A10SGMember, backendName string, newGroups []backendServiceGroup) []string {
+// rebuild service group member list excluding groups in oldMembers, adding groups in newGroups.
+// Members keep their status and priority: existing members are changed by MemberUpdate, new members take requested state.
+func rebuildMemberList(sgName string, oldMembers []a10SGMember, backendName string, newGroups []backendServiceGroup) []a10SGMember {
 
 	me := "rebuildMemberList"
 
-	var memberList []string
+	var memberList []a10SGMember
 
 	// build service group member list
 	for _, m := range oldMembers {
 		if m.Name == backendName {
 			continue // exclude previous backend server ports from list
 		}
-		memberList = append(memberList, m.Name+","+m.Port) // keep other existing members
+		memberList = append(memberList, m) // keep other existing members
 	}
 
 	// append new ports for current backend server
 	for _, bsg := range newGroups {
 		for _, bsgm := range bsg.Members {
-			memberList = append(memberList, bsgm.Name+","+bsgm.Port)
+			m := a10SGMember{Name: bsgm.Name, Port: bsgm.Port, State: bsgm.State}
+			for _, old := range oldMembers {
+				if old.Name == m.Name && old.Port == m.Port {
+					m = old
+				}
+			}
+			memberList = append(memberList, m)
 		}
 	}
 
@@ -419,24 +667,31 @@ func rebuildMemberList(sgName string, oldMembers []a10go.A10SGMember, backendNam
 	return memberList
 }
 
-func backendLink(c *a10go.Client, w http.ResponseWriter, r *http.Request, be backend, host string, sgLinked []a10go.A10ServiceGroup) {
+func (a *a10v2) BackendLink(be backend) (int, error) {
+
+	me := "a10v2.BackendLink"
+
+	sgList, errList := a.serviceGroups()
+	if errList != nil {
+		return 0, errList
+	}
 
-	me := "backendLink"
+	sgLinked := findA10Groups(sgList, be) // groups to be linked to backend server
 
 	var errCount int
 
 	for _, sg := range sgLinked {
 
-		memberList := rebuildMemberList(sg.Name, sg.Members, be.BackendName, be.ServiceGroups)
+		memberList := rebuildMemberList(sg.Name, sg.Members, be.BackendName, groupsNamed(be.ServiceGroups, sg.Name))
 
-		errUpdate := c.ServiceGroupUpdate(sg.Name, sg.Protocol, memberList)
+		errUpdate := a.groupUpdate(sg, memberList)
 		if errUpdate != nil {
-			log.Printf(me+": method=%s url=%s from=%s link group=%s: %v", r.Method, r.URL.Path, r.RemoteAddr, sg.Name, errUpdate)
+			log.Printf(me+": link group=%s: %v", sg.Name, errUpdate)
 			errCount++
 		}
 	}
 
-	writeStr(me, w, fmt.Sprintf("server linked - errors:%d\n", errCount))
+	return errCount, nil
 }
 
 /*
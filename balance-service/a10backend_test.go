@@ -1,8 +1,13 @@
 package main
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/udhos/a10-go-rest-client/a10go"
 )
 
 func TestDecodingYAML1(t *testing.T) {
@@ -82,3 +87,56 @@ const str2 = `
 backendname: s1
 backendaddress: 2.2.2.2
 `
+
+func TestA10v2Response(t *testing.T) {
+	if err := a10v2Response([]byte(`{"response": {"status": "OK"}}`)); err != nil {
+		t.Errorf("status OK: unexpected error: %v", err)
+	}
+	if err := a10v2Response([]byte(`{"response": {"status": "fail", "err": {"code": 67174402, "msg": " No such Server"}}}`)); err == nil {
+		t.Errorf("status fail: missing error")
+	}
+	if err := a10v2Response([]byte(`not json`)); err == nil {
+		t.Errorf("bad json: missing error")
+	}
+}
+
+func TestFetchBackendTableError(t *testing.T) {
+
+	// service group list fails, like an expired session
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("method") {
+		case "slb.server.getAll":
+			io.WriteString(w, `{"server_list": [{"name": "s1", "host": "1.1.1.1", "port_list": [{"port_num": 80, "protocol": 2}]}, {"name": "s2", "host": "2.2.2.2"}]}`)
+		case "slb.virtual_server.getAll":
+			io.WriteString(w, `{"virtual_server_list": []}`)
+		default:
+			io.WriteString(w, `{"response": {"status": "fail", "err": {"code": 1009, "msg": "Invalid session ID"}}}`)
+		}
+	}))
+	defer ts.Close()
+
+	c := a10go.New(strings.TrimPrefix(ts.URL, "https://"), a10go.Options{})
+
+	sList, errServers := a10ServerList(c)
+	if errServers != nil {
+		t.Errorf("server list: %v", errServers)
+	}
+	if len(sList) != 2 {
+		t.Errorf("server list: expected 2 servers, got %d", len(sList))
+	}
+	if len(sList) > 0 && (len(sList[0].Ports) != 1 || sList[0].Ports[0].Number != "80" || sList[0].Ports[0].Protocol != "2") {
+		t.Errorf("server list: bad ports: %v", sList[0].Ports)
+	}
+
+	tab, errFetch := fetchBackendTable(c)
+	if errFetch == nil {
+		t.Errorf("fetchBackendTable: missing error, got table: %v", tab)
+	}
+	le, isList := errFetch.(*listError)
+	if !isList {
+		t.Fatalf("fetchBackendTable: unexpected error type: %v", errFetch)
+	}
+	if le.collection != "service group" {
+		t.Errorf("fetchBackendTable: expected collection=service group, got=%s", le.collection)
+	}
+}
@@ -1,28 +1,224 @@
 package main
 
 import (
-	//"encoding/json"
-	//"fmt"
-	//"log"
-	//"net/http"
+	"encoding/json"
+	"fmt"
+	"strconv"
 
-	//"github.com/sanity-io/litter"
 	"github.com/udhos/a10-go-rest-client/a10go"
 )
 
-func fetchBackendTable(c *a10go.Client) map[string]*backend {
+func fetchBackendTable(c *a10go.Client) (map[string]*backend, error) {
 
 	// collect all information from A10
-	sList := c.ServerList()
-	vsList := c.VirtualServerList()
-	sgList := c.ServiceGroupList()
+	sList, errServers := a10ServerList(c)
+	if errServers != nil {
+		return nil, errServers
+	}
+	vsList, errVirtual := a10VirtualServerList(c)
+	if errVirtual != nil {
+		return nil, errVirtual
+	}
+	sgList, errGroups := a10ServiceGroupList(c)
+	if errGroups != nil {
+		return nil, errGroups
+	}
 
 	backendTab := buildBackendTab(sList)
-	groupTab := buildGroupTab(sgList, backendTab)
+	groupTab := buildGroupTab(sgList, a10PortTab(sList), backendTab)
 
 	buildVSTab(vsList, groupTab, backendTab)
 
-	return backendTab
+	return backendTab, nil
+}
+
+// a10go list functions drop device errors, returning partial (or empty) lists.
+// Lists are fetched here with c.Get() instead, in order to report failures.
+
+// a10Value decodes aXAPI v2 values sent either as number or string
+type a10Value string
+
+func (v *a10Value) UnmarshalJSON(data []byte) error {
+	var i interface{}
+	if err := json.Unmarshal(data, &i); err != nil {
+		return err
+	}
+	if i != nil {
+		*v = a10Value(fmt.Sprintf("%v", i))
+	}
+	return nil
+}
+
+// a10List fetches list from aXAPI v2 method into v.
+// Failures are reported as listError naming collection.
+func a10List(c *a10go.Client, collection, method string, v interface{}) error {
+	body, errGet := c.Get(method)
+	if errGet != nil {
+		return &listError{collection: collection, err: errGet}
+	}
+	var resp struct {
+		Response *struct {
+			Status string `json:"status"`
+		} `json:"response"`
+	}
+	if errJSON := json.Unmarshal(body, &resp); errJSON != nil {
+		return &listError{collection: collection, err: fmt.Errorf("json error: %v", errJSON)}
+	}
+	if resp.Response != nil {
+		// list methods send response status only on failure
+		if errResp := a10v2Response(body); errResp != nil {
+			return &listError{collection: collection, err: errResp}
+		}
+	}
+	if errJSON := json.Unmarshal(body, v); errJSON != nil {
+		return &listError{collection: collection, err: fmt.Errorf("json error: %v", errJSON)}
+	}
+	return nil
+}
+
+// a10Server is a10go.A10Server with admin state
+type a10Server struct {
+	Name  string
+	Host  string
+	State string // enabled, disabled
+	Ports []a10Port
+}
+
+type a10Port struct {
+	Number    string
+	Protocol  string
+	State     string
+	Weight    int // 0: device default
+	ConnLimit int // 0: device default
+}
+
+// a10ServiceGroup is a10go.A10ServiceGroup with member admin state
+type a10ServiceGroup struct {
+	Name     string
+	Protocol string
+	Members  []a10SGMember
+}
+
+type a10SGMember struct {
+	Name     string
+	Port     string
+	State    string
+	Priority int // 0: device default
+}
+
+// a10State maps aXAPI v2 status (1=enabled 0=disabled) to backend state.
+// Missing status means enabled.
+func a10State(status a10Value) string {
+	if status == "0" {
+		return stateDisabled
+	}
+	return stateEnabled
+}
+
+// a10Int decodes optional aXAPI v2 number, missing or bad values are zero
+func a10Int(v a10Value) int {
+	i, _ := strconv.Atoi(string(v))
+	return i
+}
+
+// a10Status maps backend state to aXAPI v2 status.
+// A10 has no forced offline, hence offline is disabled.
+func a10Status(state string) int {
+	if stateOf(state) == stateEnabled {
+		return 1
+	}
+	return 0
+}
+
+func a10ServerList(c *a10go.Client) ([]a10Server, error) {
+	var tab struct {
+		ServerList *[]struct {
+			Name     string   `json:"name"`
+			Host     string   `json:"host"`
+			Status   a10Value `json:"status"`
+			PortList []struct {
+				PortNum   a10Value `json:"port_num"`
+				Protocol  a10Value `json:"protocol"`
+				Status    a10Value `json:"status"`
+				Weight    a10Value `json:"weight"`
+				ConnLimit a10Value `json:"conn_limit"`
+			} `json:"port_list"`
+		} `json:"server_list"`
+	}
+	if err := a10List(c, "server", "slb.server.getAll", &tab); err != nil {
+		return nil, err
+	}
+	if tab.ServerList == nil {
+		return nil, &listError{collection: "server", err: fmt.Errorf("server_list not found")}
+	}
+	list := []a10Server{}
+	for _, s := range *tab.ServerList {
+		server := a10Server{Name: s.Name, Host: s.Host, State: a10State(s.Status)}
+		for _, p := range s.PortList {
+			server.Ports = append(server.Ports, a10Port{Number: string(p.PortNum), Protocol: string(p.Protocol), State: a10State(p.Status), Weight: a10Int(p.Weight), ConnLimit: a10Int(p.ConnLimit)})
+		}
+		list = append(list, server)
+	}
+	return list, nil
+}
+
+func a10ServiceGroupList(c *a10go.Client) ([]a10ServiceGroup, error) {
+	var tab struct {
+		ServiceGroupList *[]struct {
+			Name       string   `json:"name"`
+			Protocol   a10Value `json:"protocol"`
+			MemberList []struct {
+				Server   string   `json:"server"`
+				Port     a10Value `json:"port"`
+				Status   a10Value `json:"status"`
+				Priority a10Value `json:"priority"`
+			} `json:"member_list"`
+		} `json:"service_group_list"`
+	}
+	if err := a10List(c, "service group", "slb.service_group.getAll", &tab); err != nil {
+		return nil, err
+	}
+	if tab.ServiceGroupList == nil {
+		return nil, &listError{collection: "service group", err: fmt.Errorf("service_group_list not found")}
+	}
+	list := []a10ServiceGroup{}
+	for _, sg := range *tab.ServiceGroupList {
+		group := a10ServiceGroup{Name: sg.Name, Protocol: string(sg.Protocol)}
+		for _, m := range sg.MemberList {
+			group.Members = append(group.Members, a10SGMember{Name: m.Server, Port: string(m.Port), State: a10State(m.Status), Priority: a10Int(m.Priority)})
+		}
+		list = append(list, group)
+	}
+	return list, nil
+}
+
+func a10VirtualServerList(c *a10go.Client) ([]a10go.A10VServer, error) {
+	var tab struct {
+		VirtualServerList *[]struct {
+			Name      string `json:"name"`
+			Address   string `json:"address"`
+			VportList []struct {
+				ServiceGroup string   `json:"service_group"`
+				Port         a10Value `json:"port"`
+				Protocol     a10Value `json:"protocol"`
+			} `json:"vport_list"`
+		} `json:"virtual_server_list"`
+	}
+	if err := a10List(c, "virtual server", "slb.virtual_server.getAll", &tab); err != nil {
+		return nil, err
+	}
+	if tab.VirtualServerList == nil {
+		return nil, &listError{collection: "virtual server", err: fmt.Errorf("virtual_server_list not found")}
+	}
+	list := []a10go.A10VServer{}
+	for _, vs := range *tab.VirtualServerList {
+		vServer := a10go.A10VServer{Name: vs.Name, Address: vs.Address}
+		for _, vp := range vs.VportList {
+			vServer.VirtualPorts = append(vServer.VirtualPorts, a10go.A10VirtualPort{ServiceGroup: vp.ServiceGroup, Port: string(vp.Port), Protocol: string(vp.Protocol)})
+		}
+		list = append(list, vServer)
+	}
+	return list, nil
 }
 
 func addVirtualPort(bvs backendVirtualServer, vpPort, vpProtocol, vpServiceGroup string) backendVirtualServer {
@@ -57,7 +253,7 @@ func addVS(b *backend, vsName, vsAddress, vpPort, vpProtocol, vpServiceGroup str
 	b.VirtualServers = append(b.VirtualServers, bvs)
 }
 
-func buildVSTab(vsList []a10go.A10VServer, groupTab map[string]a10go.A10ServiceGroup, backendTab map[string]*backend) {
+func buildVSTab(vsList []a10go.A10VServer, groupTab map[string]a10ServiceGroup, backendTab map[string]*backend) {
 
 	for _, vs := range vsList {
 		for _, vp := range vs.VirtualPorts {
@@ -77,7 +273,7 @@ func buildVSTab(vsList []a10go.A10VServer, groupTab map[string]a10go.A10ServiceG
 
 }
 
-func buildBackendTab(sList []a10go.A10Server) map[string]*backend {
+func buildBackendTab(sList []a10Server) map[string]*backend {
 	backendTab := map[string]*backend{} // backendName => backend
 
 	// build backend table
@@ -85,9 +281,10 @@ func buildBackendTab(sList []a10go.A10Server) map[string]*backend {
 		b := backend{
 			BackendName:    s.Name,
 			BackendAddress: s.Host,
+			State:          s.State,
 		}
 		for _, p := range s.Ports {
-			b.BackendPorts = append(b.BackendPorts, backendPort{Port: p.Number, Protocol: A10ProtocolName(p.Protocol)})
+			b.BackendPorts = append(b.BackendPorts, backendPort{Port: p.Number, Protocol: A10ProtocolName(p.Protocol), State: p.State})
 		}
 		backendTab[b.BackendName] = &b
 	}
@@ -95,38 +292,50 @@ func buildBackendTab(sList []a10go.A10Server) map[string]*backend {
 	return backendTab
 }
 
-func addMember(bsg backendServiceGroup, memberName, memberPort string) backendServiceGroup {
+func addMember(bsg backendServiceGroup, bsgm backendSGMember) backendServiceGroup {
 	for _, sgm := range bsg.Members {
-		if sgm.Name == memberName && sgm.Port == memberPort {
+		if sgm.Name == bsgm.Name && sgm.Port == bsgm.Port {
 			// member found - nothing to do
 			return bsg
 		}
 	}
 	// member not found - append
-	bsgm := backendSGMember{Name: memberName, Port: memberPort}
 	bsg.Members = append(bsg.Members, bsgm)
 	return bsg
 }
 
-func addGroupMember(b *backend, groupName, groupProtocol, memberName, memberPort string) {
+func addGroupMember(b *backend, groupName, groupProtocol string, bsgm backendSGMember) {
 
 	for i, bsg := range b.ServiceGroups {
 		if bsg.Name == groupName {
 			// group found - replace
-			b.ServiceGroups[i] = addMember(b.ServiceGroups[i], memberName, memberPort)
+			b.ServiceGroups[i] = addMember(b.ServiceGroups[i], bsgm)
 			return
 		}
 	}
 
 	// group not found - append new
 	bsg := backendServiceGroup{Name: groupName, Protocol: groupProtocol}
-	bsgm := backendSGMember{Name: memberName, Port: memberPort}
 	bsg.Members = append(bsg.Members, bsgm)
 	b.ServiceGroups = append(b.ServiceGroups, bsg)
 }
 
-func buildGroupTab(sgList []a10go.A10ServiceGroup, backendTab map[string]*backend) map[string]a10go.A10ServiceGroup {
-	groupTab := map[string]a10go.A10ServiceGroup{} // groupName => group
+// a10PortTab indexes server ports by server name and port number, in order to find member weight and connection limit
+func a10PortTab(sList []a10Server) map[string]a10Port {
+	tab := map[string]a10Port{} // name,port => port
+	for _, s := range sList {
+		for _, p := range s.Ports {
+			key := s.Name + "," + p.Number
+			if _, found := tab[key]; !found {
+				tab[key] = p // first protocol wins
+			}
+		}
+	}
+	return tab
+}
+
+func buildGroupTab(sgList []a10ServiceGroup, portTab map[string]a10Port, backendTab map[string]*backend) map[string]a10ServiceGroup {
+	groupTab := map[string]a10ServiceGroup{} // groupName => group
 
 	// scan service group table
 	// this loop IS able to find all service groups (including those ones detached from virtual servers)
@@ -137,7 +346,9 @@ func buildGroupTab(sgList []a10go.A10ServiceGroup, backendTab map[string]*backen
 				continue // backend not found - skip
 			}
 
-			addGroupMember(b, sg.Name, A10ProtocolName(sg.Protocol), sgm.Name, sgm.Port)
+			p := portTab[sgm.Name+","+sgm.Port]
+			bsgm := backendSGMember{Name: sgm.Name, Port: sgm.Port, State: sgm.State, Weight: p.Weight, Priority: sgm.Priority, ConnectionLimit: p.ConnLimit}
+			addGroupMember(b, sg.Name, A10ProtocolName(sg.Protocol), bsgm)
 
 			groupTab[sg.Name] = sg // table records only groups with members
 		}
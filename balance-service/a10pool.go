@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/udhos/a10-go-rest-client/a10go"
+)
+
+// ACOS caps concurrent admin sessions, hence aXAPI v2 sessions are pooled:
+// - sessions are reused per device and credential
+// - open sessions (idle or busy) are limited per device
+// - idle sessions expire after idle timeout, and are closed on shutdown,
+//   after waiting for busy sessions (see shutdown)
+
+var a10Pool = newA10SessionPool(4, 5*time.Minute, 30*time.Second)
+
+// a10Session is an authenticated aXAPI v2 client
+type a10Session struct {
+	c        *a10go.Client
+	host     string
+	key      string // host + credential + options
+	lastUsed time.Time
+}
+
+// a10Device holds sessions for one device
+type a10Device struct {
+	tokens chan struct{} // one token per open session
+	idle   []*a10Session
+}
+
+type a10SessionPool struct {
+	mutex       sync.Mutex
+	max         int           // max open sessions per device
+	idleTimeout time.Duration // idle sessions older than this are closed
+	wait        time.Duration // max wait for free session slot
+	devices     map[string]*a10Device
+}
+
+func newA10SessionPool(max int, idleTimeout, wait time.Duration) *a10SessionPool {
+	if max < 1 {
+		max = 1
+	}
+	return &a10SessionPool{
+		max:         max,
+		idleTimeout: idleTimeout,
+		wait:        wait,
+		devices:     map[string]*a10Device{},
+	}
+}
+
+func a10SessionKey(host, username, password string, opt a10go.Options) string {
+	sum := sha256.Sum256([]byte(password))
+	return fmt.Sprintf("%s|%s|%s|debug=%v|dry=%v", host, username, hex.EncodeToString(sum[:]), opt.Debug, opt.Dry)
+}
+
+// device returns device for host - pool must be locked
+func (p *a10SessionPool) device(host string) *a10Device {
+	d, found := p.devices[host]
+	if !found {
+		d = &a10Device{tokens: make(chan struct{}, p.max)}
+		p.devices[host] = d
+	}
+	return d
+}
+
+// get returns a session for device host, reusing idle session for the same credential if possible
+func (p *a10SessionPool) get(host, username, password string, opt a10go.Options) (*a10Session, error) {
+
+	me := "a10SessionPool.get"
+
+	key := a10SessionKey(host, username, password, opt)
+
+	p.mutex.Lock()
+	d := p.device(host)
+	p.expire(d)
+	for i := len(d.idle) - 1; i >= 0; i-- {
+		s := d.idle[i]
+		if s.key != key {
+			continue
+		}
+		d.idle = append(d.idle[:i], d.idle[i+1:]...)
+		p.mutex.Unlock()
+		log.Printf(me+": host=%s reusing session", host)
+		return s, nil
+	}
+	p.mutex.Unlock()
+
+	if errSlot := p.acquire(host, d); errSlot != nil {
+		return nil, errSlot
+	}
+
+	c := a10go.New(deviceHost(host), opt)
+	if errLogin := c.Login(username, password); errLogin != nil {
+		<-d.tokens // release slot
+		return nil, errLogin
+	}
+
+	log.Printf(me+": host=%s new session: open=%d max=%d", host, len(d.tokens), p.max)
+
+	return &a10Session{c: c, host: host, key: key}, nil
+}
+
+// acquire takes a session slot for device.
+// When device is full, idle sessions of other credentials are closed to make room.
+func (p *a10SessionPool) acquire(host string, d *a10Device) error {
+
+	for {
+		select {
+		case d.tokens <- struct{}{}:
+			return nil
+		default:
+		}
+
+		// device full - evict least recently used idle session
+		p.mutex.Lock()
+		var evict *a10Session
+		if len(d.idle) > 0 {
+			evict = d.idle[0]
+			d.idle = d.idle[1:]
+		}
+		p.mutex.Unlock()
+
+		if evict == nil {
+			break // no idle session - must wait
+		}
+
+		p.closeSession(evict, d)
+	}
+
+	select {
+	case d.tokens <- struct{}{}:
+		return nil
+	case <-time.After(p.wait):
+	}
+
+	return fmt.Errorf("host=%s session limit reached: max=%d wait=%v", host, p.max, p.wait)
+}
+
+// put returns session to pool. Broken sessions are closed.
+func (p *a10SessionPool) put(s *a10Session, healthy bool) {
+
+	p.mutex.Lock()
+	d := p.device(s.host)
+	if !healthy {
+		p.mutex.Unlock()
+		p.closeSession(s, d)
+		return
+	}
+	s.lastUsed = time.Now()
+	d.idle = append(d.idle, s)
+	p.mutex.Unlock()
+}
+
+// expire drops idle sessions past idle timeout - pool must be locked
+func (p *a10SessionPool) expire(d *a10Device) {
+	var keep []*a10Session
+	for _, s := range d.idle {
+		if time.Since(s.lastUsed) < p.idleTimeout {
+			keep = append(keep, s)
+			continue
+		}
+		go p.closeSession(s, d) // do not hold pool lock during logout
+	}
+	d.idle = keep
+}
+
+// sweep closes expired idle sessions for all devices
+func (p *a10SessionPool) sweep() {
+	p.mutex.Lock()
+	for _, d := range p.devices {
+		p.expire(d)
+	}
+	p.mutex.Unlock()
+}
+
+// close closes all idle sessions
+func (p *a10SessionPool) close() {
+	p.mutex.Lock()
+	idle := map[*a10Device][]*a10Session{}
+	for _, d := range p.devices {
+		idle[d] = d.idle
+		d.idle = nil
+	}
+	p.mutex.Unlock()
+
+	for d, list := range idle {
+		for _, s := range list {
+			p.closeSession(s, d)
+		}
+	}
+}
+
+// openSessions counts open sessions (busy and idle) per device
+func (p *a10SessionPool) openSessions() map[string]int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	open := map[string]int{}
+	for host, d := range p.devices {
+		open[host] = len(d.tokens)
+	}
+	return open
+}
+
+// busy counts sessions in use (open, not idle)
+func (p *a10SessionPool) busy() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var busy int
+	for _, d := range p.devices {
+		busy += len(d.tokens) - len(d.idle)
+	}
+	return busy
+}
+
+// waitIdle waits up to timeout for busy sessions to be returned, reporting sessions still busy
+func (p *a10SessionPool) waitIdle(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		busy := p.busy()
+		if busy == 0 || !time.Now().Before(deadline) {
+			return busy
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (p *a10SessionPool) closeSession(s *a10Session, d *a10Device) {
+	if errClose := s.c.Logout(); errClose != nil {
+		log.Printf("a10SessionPool.closeSession: host=%s close error: %v", s.host, errClose)
+		// log warning only
+	}
+	<-d.tokens // release slot
+}
+
+// a10SessionExpired detects device response for expired session:
+// {"response": {"status": "fail", "err": {"code": 1009, "msg": "Invalid session ID"}}}
+func a10SessionExpired(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Invalid session") || strings.Contains(msg, "code=1009")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/udhos/a10-go-rest-client/a10go"
+)
+
+// fakeSessions counts aXAPI v2 session calls
+type fakeSessions struct {
+	mutex  sync.Mutex
+	logins int
+	closes int
+	valid  map[string]bool
+}
+
+func (f *fakeSessions) handler(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	query := r.URL.Query()
+	switch query.Get("method") {
+	case "authenticate":
+		f.logins++
+		id := strings.Repeat("x", f.logins)
+		f.valid[id] = true
+		io.WriteString(w, `{"session_id": "`+id+`"}`)
+	case "session.close":
+		f.closes++
+		delete(f.valid, query.Get("session_id"))
+		io.WriteString(w, `{"response": {"status": "OK"}}`)
+	default:
+		if !f.valid[query.Get("session_id")] {
+			io.WriteString(w, `{"response": {"status": "fail", "err": {"code": 1009, "msg": "Invalid session ID"}}}`)
+			return
+		}
+		io.WriteString(w, `{"service_group_list": []}`)
+	}
+}
+
+func TestA10SessionPool(t *testing.T) {
+
+	fake := &fakeSessions{valid: map[string]bool{}}
+	ts := httptest.NewTLSServer(http.HandlerFunc(fake.handler))
+	defer ts.Close()
+
+	host := strings.TrimPrefix(ts.URL, "https://")
+
+	pool := newA10SessionPool(1, time.Minute, 100*time.Millisecond)
+
+	s1, errGet := pool.get(host, "admin", "a10", a10go.Options{})
+	if errGet != nil {
+		t.Fatalf("get: %v", errGet)
+	}
+
+	// device full - second session must wait, then fail
+	if _, errFull := pool.get(host, "admin", "a10", a10go.Options{}); errFull == nil {
+		t.Errorf("get: expected session limit error")
+	}
+
+	pool.put(s1, true)
+
+	// idle session reused
+	s2, errReuse := pool.get(host, "admin", "a10", a10go.Options{})
+	if errReuse != nil {
+		t.Fatalf("get reuse: %v", errReuse)
+	}
+	if s2 != s1 || fake.logins != 1 {
+		t.Errorf("get reuse: expected single login, got logins=%d", fake.logins)
+	}
+	pool.put(s2, true)
+
+	// other credential evicts idle session
+	s3, errOther := pool.get(host, "other", "pwd", a10go.Options{})
+	if errOther != nil {
+		t.Fatalf("get other: %v", errOther)
+	}
+	if fake.logins != 2 || fake.closes != 1 {
+		t.Errorf("get other: expected eviction, got logins=%d closes=%d", fake.logins, fake.closes)
+	}
+
+	// shutdown waits for busy session
+	if busy := pool.waitIdle(50 * time.Millisecond); busy != 1 {
+		t.Errorf("wait idle: expected busy=1, got %d", busy)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pool.put(s3, true)
+	}()
+	if busy := pool.waitIdle(time.Second); busy != 0 {
+		t.Errorf("wait idle: expected busy=0, got %d", busy)
+	}
+
+	pool.close()
+	if fake.closes != 2 {
+		t.Errorf("close: expected closes=2, got %d", fake.closes)
+	}
+}
+
+func TestA10v2SessionRenew(t *testing.T) {
+
+	fake := &fakeSessions{valid: map[string]bool{}}
+	ts := httptest.NewTLSServer(http.HandlerFunc(fake.handler))
+	defer ts.Close()
+
+	host := strings.TrimPrefix(ts.URL, "https://")
+
+	save := a10Pool
+	a10Pool = newA10SessionPool(1, time.Minute, 100*time.Millisecond)
+	defer func() { a10Pool = save }()
+
+	a := newA10v2(host, lbOptions{})
+	if errLogin := a.Login("admin", "a10"); errLogin != nil {
+		t.Fatalf("login: %v", errLogin)
+	}
+
+	fake.mutex.Lock()
+	fake.valid = map[string]bool{} // device drops sessions
+	fake.mutex.Unlock()
+
+	if _, errList := a.ServiceGroupList(); errList != nil {
+		t.Errorf("group list after session expiry: %v", errList)
+	}
+	if fake.logins != 2 {
+		t.Errorf("expected login again, got logins=%d", fake.logins)
+	}
+
+	a.Logout()
+}
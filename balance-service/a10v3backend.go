@@ -0,0 +1,791 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// aXAPI v3:
+//
+// https://github.com/a10networks/tps-scripts/blob/master/axapi_curl_example.txt
+//
+// POST   /axapi/v3/auth                                  -> {"authresponse": {"signature": "..."}}
+// header Authorization: A10 <signature>
+// GET    /axapi/v3/slb/server                            -> {"server-list": [...]}
+// POST   /axapi/v3/slb/server                            create server
+// PUT    /axapi/v3/slb/server/<name>                     replace server
+// DELETE /axapi/v3/slb/server/<name>                     delete server
+// GET    /axapi/v3/slb/server/<name>/stats               -> {"server": {"stats": {...}, "port-list": [{"stats": {...}}]}}
+// GET    /axapi/v3/slb/server/<name>/oper                -> {"server": {"oper": {"state": "Up"}, "port-list": [{"oper": {...}}]}}
+// GET    /axapi/v3/slb/service-group                     -> {"service-group-list": [...]}
+// POST   /axapi/v3/slb/service-group/<sg>/member         create member
+// PUT    /axapi/v3/slb/service-group/<sg>/member/<s>+<p> replace member (member-state: enable, disable)
+// DELETE /axapi/v3/slb/service-group/<sg>/member/<s>+<p> delete member
+// GET    /axapi/v3/slb/service-group/<sg>/stats          -> {"service-group": {"member-list": [{"stats": {...}}]}}
+// GET    /axapi/v3/slb/service-group/<sg>/oper           -> {"service-group": {"member-list": [{"oper": {...}}]}}
+// GET    /axapi/v3/slb/virtual-server                    -> {"virtual-server-list": [...]}
+// POST   /axapi/v3/logoff                                close session
+//
+// Admin state is server and port action (enable, disable), and member member-state (enable, disable).
+// Member weight and connection limit are server port weight and conn-limit, member priority is member-priority.
+
+type a10v3Server struct {
+	Name     string      `json:"name"`
+	Host     string      `json:"host,omitempty"`
+	Action   string      `json:"action,omitempty"` // enable, disable
+	PortList []a10v3Port `json:"port-list,omitempty"`
+}
+
+type a10v3Port struct {
+	PortNumber int    `json:"port-number"`
+	Protocol   string `json:"protocol"`
+	Action     string `json:"action,omitempty"`
+	Weight     int    `json:"weight,omitempty"`
+	ConnLimit  int    `json:"conn-limit,omitempty"`
+}
+
+type a10v3ServiceGroup struct {
+	Name       string        `json:"name"`
+	Protocol   string        `json:"protocol,omitempty"`
+	MemberList []a10v3Member `json:"member-list,omitempty"`
+}
+
+type a10v3Member struct {
+	Name           string `json:"name"`
+	Port           int    `json:"port"`
+	MemberState    string `json:"member-state,omitempty"` // enable, disable, disable-with-health-check
+	MemberPriority int    `json:"member-priority,omitempty"`
+}
+
+// key identifies member regardless of state and priority
+func (m a10v3Member) key() a10v3Member {
+	return a10v3Member{Name: m.Name, Port: m.Port}
+}
+
+// a10v3State maps aXAPI v3 action or member-state to backend state.
+// Missing action means enabled.
+func a10v3State(action string) string {
+	if action == "" || action == "enable" {
+		return stateEnabled
+	}
+	return stateDisabled
+}
+
+// a10v3Action maps backend state to aXAPI v3 action.
+// A10 has no forced offline, hence offline is disabled.
+func a10v3Action(state string) string {
+	if stateOf(state) == stateEnabled {
+		return "enable"
+	}
+	return "disable"
+}
+
+type a10v3VirtualServer struct {
+	Name      string             `json:"name"`
+	IPAddress string             `json:"ip-address,omitempty"`
+	PortList  []a10v3VirtualPort `json:"port-list,omitempty"`
+}
+
+type a10v3VirtualPort struct {
+	PortNumber   int    `json:"port-number"`
+	Protocol     string `json:"protocol"`
+	ServiceGroup string `json:"service-group,omitempty"`
+}
+
+// a10v3 is the load balancer driver for A10 aXAPI v3
+type a10v3 struct {
+	opRecorder
+	host      string
+	opt       lbOptions
+	client    *http.Client
+	signature string // session token
+}
+
+func newA10v3(host string, opt lbOptions) loadBalancer {
+	client := httpClient()
+	if opt.TLSVerify {
+		client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = false
+	}
+	return &a10v3{opRecorder: opRecorder{plan: opt.Plan}, host: host, opt: opt, client: client}
+}
+
+func (a *a10v3) url(path string) string {
+	return "https://" + deviceHost(a.host) + "/axapi/v3/" + path
+}
+
+// call sends request to aXAPI v3, using the session signature when available
+func (a *a10v3) call(method, path string, payload interface{}) ([]byte, error) {
+
+	var body bytes.Buffer
+	if payload != nil {
+		if errEnc := json.NewEncoder(&body).Encode(payload); errEnc != nil {
+			return nil, errEnc
+		}
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if a.signature != "" {
+		header.Set("Authorization", "A10 "+a.signature)
+	}
+
+	if a.opt.Debug {
+		log.Printf("a10v3: host=%s method=%s path=%s", a.host, method, path)
+	}
+
+	return clientDo(a.client, method, a.url(path), header, &body)
+}
+
+// change performs a write call, unless in dry mode
+func (a *a10v3) change(op deviceOp, method, path string, payload interface{}) error {
+	return a.run(op, func() error {
+		if a.opt.Dry {
+			log.Printf("a10v3: DRY host=%s method=%s path=%s", a.host, method, path)
+			return nil
+		}
+		_, err := a.call(method, path, payload)
+		return err
+	})
+}
+
+func (a *a10v3) Login(username, password string) error {
+
+	payload := map[string]interface{}{
+		"credentials": map[string]string{"username": username, "password": password},
+	}
+
+	body, errAuth := a.call(http.MethodPost, "auth", payload)
+	if errAuth != nil {
+		return errAuth
+	}
+
+	var resp struct {
+		AuthResponse struct {
+			Signature string `json:"signature"`
+		} `json:"authresponse"`
+	}
+	if errJSON := json.Unmarshal(body, &resp); errJSON != nil {
+		return fmt.Errorf("auth response: %v", errJSON)
+	}
+	if resp.AuthResponse.Signature == "" {
+		return fmt.Errorf("auth response missing signature")
+	}
+
+	a.signature = resp.AuthResponse.Signature
+
+	return nil
+}
+
+func (a *a10v3) Logout() error {
+	if a.signature == "" {
+		return nil // no session
+	}
+	_, errLogoff := a.call(http.MethodPost, "logoff", nil)
+	a.signature = ""
+	return errLogoff
+}
+
+func (a *a10v3) serverList() ([]a10v3Server, error) {
+	body, errGet := a.call(http.MethodGet, "slb/server", nil)
+	if errGet != nil {
+		return nil, &listError{collection: "server", err: errGet}
+	}
+	var resp struct {
+		List []a10v3Server `json:"server-list"`
+	}
+	if errJSON := json.Unmarshal(body, &resp); errJSON != nil {
+		return nil, &listError{collection: "server", err: errJSON}
+	}
+	return resp.List, nil
+}
+
+func (a *a10v3) groupList() ([]a10v3ServiceGroup, error) {
+	body, errGet := a.call(http.MethodGet, "slb/service-group", nil)
+	if errGet != nil {
+		return nil, &listError{collection: "service group", err: errGet}
+	}
+	var resp struct {
+		List []a10v3ServiceGroup `json:"service-group-list"`
+	}
+	if errJSON := json.Unmarshal(body, &resp); errJSON != nil {
+		return nil, &listError{collection: "service group", err: errJSON}
+	}
+	return resp.List, nil
+}
+
+func (a *a10v3) virtualServerList() ([]a10v3VirtualServer, error) {
+	body, errGet := a.call(http.MethodGet, "slb/virtual-server", nil)
+	if errGet != nil {
+		return nil, &listError{collection: "virtual server", err: errGet}
+	}
+	var resp struct {
+		List []a10v3VirtualServer `json:"virtual-server-list"`
+	}
+	if errJSON := json.Unmarshal(body, &resp); errJSON != nil {
+		return nil, &listError{collection: "virtual server", err: errJSON}
+	}
+	return resp.List, nil
+}
+
+func (a *a10v3) BackendList() (map[string]*backend, error) {
+
+	sList, errServers := a.serverList()
+	if errServers != nil {
+		return nil, errServers
+	}
+	vsList, errVirt := a.virtualServerList()
+	if errVirt != nil {
+		return nil, errVirt
+	}
+	sgList, errGroups := a.groupList()
+	if errGroups != nil {
+		return nil, errGroups
+	}
+
+	backendTab := map[string]*backend{} // backendName => backend
+	portTab := map[string]a10v3Port{}   // name,port => port, for member weight and connection limit
+
+	for _, s := range sList {
+		b := backend{BackendName: s.Name, BackendAddress: s.Host, State: a10v3State(s.Action)}
+		for _, p := range s.PortList {
+			port := strconv.Itoa(p.PortNumber)
+			b.BackendPorts = append(b.BackendPorts, backendPort{Port: port, Protocol: p.Protocol, State: a10v3State(p.Action)})
+			if _, found := portTab[s.Name+","+port]; !found {
+				portTab[s.Name+","+port] = p
+			}
+		}
+		backendTab[b.BackendName] = &b
+	}
+
+	groupTab := map[string]a10v3ServiceGroup{} // groupName => group
+
+	for _, sg := range sgList {
+		for _, m := range sg.MemberList {
+			b, found := backendTab[m.Name]
+			if !found {
+				continue // backend not found - skip
+			}
+			port := strconv.Itoa(m.Port)
+			p := portTab[m.Name+","+port]
+			bsgm := backendSGMember{Name: m.Name, Port: port, State: a10v3State(m.MemberState), Weight: p.Weight, Priority: m.MemberPriority, ConnectionLimit: p.ConnLimit}
+			addGroupMember(b, sg.Name, sg.Protocol, bsgm)
+			groupTab[sg.Name] = sg // table records only groups with members
+		}
+	}
+
+	for _, vs := range vsList {
+		for _, vp := range vs.PortList {
+			sg, groupFound := groupTab[vp.ServiceGroup]
+			if !groupFound {
+				continue // group not found - skip
+			}
+			for _, m := range sg.MemberList {
+				b, beFound := backendTab[m.Name]
+				if !beFound {
+					continue // backend not found - skip
+				}
+				addVS(b, vs.Name, vs.IPAddress, strconv.Itoa(vp.PortNumber), vp.Protocol, sg.Name)
+			}
+		}
+	}
+
+	return backendTab, nil
+}
+
+func (a *a10v3) ServiceGroupList() ([]backendServiceGroup, error) {
+
+	sgList, errGroups := a.groupList()
+	if errGroups != nil {
+		return nil, errGroups
+	}
+
+	var list []backendServiceGroup
+	for _, sg := range sgList {
+		bsg := backendServiceGroup{Name: sg.Name, Protocol: sg.Protocol}
+		for _, m := range sg.MemberList {
+			bsg.Members = append(bsg.Members, backendSGMember{Name: m.Name, Port: strconv.Itoa(m.Port), State: a10v3State(m.MemberState), Priority: m.MemberPriority})
+		}
+		list = append(list, bsg)
+	}
+
+	return list, nil
+}
+
+// a10v3ServerFrom builds server from backend.
+// Backend ports carry no weight nor connection limit, hence these are kept from current server (nil if missing).
+func a10v3ServerFrom(be backend, current *a10v3Server) (a10v3Server, error) {
+	s := a10v3Server{Name: be.BackendName, Host: be.BackendAddress, Action: a10v3Action(be.State)}
+	for _, p := range be.BackendPorts {
+		number, errPort := strconv.Atoi(p.Port)
+		if errPort != nil {
+			return s, fmt.Errorf("server=%s bad port=[%s]: %v", be.BackendName, p.Port, errPort)
+		}
+		port := a10v3Port{PortNumber: number, Protocol: p.Protocol, Action: a10v3Action(p.State)}
+		if current != nil {
+			for _, c := range current.PortList {
+				if c.PortNumber == number && c.Protocol == p.Protocol {
+					port.Weight, port.ConnLimit = c.Weight, c.ConnLimit
+				}
+			}
+		}
+		s.PortList = append(s.PortList, port)
+	}
+	return s, nil
+}
+
+// findV3Server finds server by name in sList
+func findV3Server(sList []a10v3Server, name string) *a10v3Server {
+	for i := range sList {
+		if sList[i].Name == name {
+			return &sList[i]
+		}
+	}
+	return nil
+}
+
+// a10v3PortDetail describes server for operation detail
+func a10v3PortDetail(s a10v3Server) []string {
+	detail := []string{withState(s.Host, a10v3State(s.Action))}
+	for _, p := range s.PortList {
+		port := withState(strconv.Itoa(p.PortNumber)+","+p.Protocol, a10v3State(p.Action))
+		if p.Weight != 0 {
+			port += fmt.Sprintf(",weight=%d", p.Weight)
+		}
+		if p.ConnLimit != 0 {
+			port += fmt.Sprintf(",conn-limit=%d", p.ConnLimit)
+		}
+		detail = append(detail, port)
+	}
+	return detail
+}
+
+func (a *a10v3) BackendCreate(be backend) error {
+	s, errServer := a10v3ServerFrom(be, nil)
+	if errServer != nil {
+		return errServer
+	}
+	op := deviceOp{Operation: "server create", Target: be.BackendName, Detail: a10v3PortDetail(s)}
+	return a.change(op, http.MethodPost, "slb/server", map[string]interface{}{"server": s})
+}
+
+func (a *a10v3) BackendUpdate(be backend) error {
+	sList, errList := a.serverList()
+	if errList != nil {
+		return errList
+	}
+	s, errServer := a10v3ServerFrom(be, findV3Server(sList, be.BackendName))
+	if errServer != nil {
+		return errServer
+	}
+	return a.serverUpdate(s)
+}
+
+// serverUpdate replaces server
+func (a *a10v3) serverUpdate(s a10v3Server) error {
+	op := deviceOp{Operation: "server update", Target: s.Name, Detail: a10v3PortDetail(s)}
+	return a.change(op, http.MethodPut, "slb/server/"+url.PathEscape(s.Name), map[string]interface{}{"server": s})
+}
+
+func (a *a10v3) BackendDelete(name string) error {
+	op := deviceOp{Operation: "server delete", Target: name}
+	return a.change(op, http.MethodDelete, "slb/server/"+url.PathEscape(name), nil)
+}
+
+// findV3Groups returns groups named in be.ServiceGroups
+func (a *a10v3) findV3Groups(be backend) ([]a10v3ServiceGroup, error) {
+	sgList, errGroups := a.groupList()
+	if errGroups != nil {
+		return nil, errGroups
+	}
+	found := []a10v3ServiceGroup{}
+	for _, bsg := range be.ServiceGroups {
+		for _, sg := range sgList {
+			if sg.Name == bsg.Name {
+				found = append(found, sg)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+func a10v3MemberPath(group string) string {
+	return "slb/service-group/" + url.PathEscape(group) + "/member"
+}
+
+// memberDelete removes group members for backend, except those in keep
+func (a *a10v3) memberDelete(sg a10v3ServiceGroup, backendName string, keep map[a10v3Member]string) int {
+
+	me := "a10v3.memberDelete"
+
+	var errCount int
+
+	for _, m := range sg.MemberList {
+		if m.Name != backendName {
+			continue // keep other members
+		}
+		if _, found := keep[m.key()]; found {
+			continue // keep wanted member
+		}
+		path := a10v3MemberPath(sg.Name) + "/" + url.PathEscape(m.Name) + "+" + strconv.Itoa(m.Port)
+		op := deviceOp{Operation: "group member delete", Target: sg.Name, Detail: []string{m.Name + "," + strconv.Itoa(m.Port)}}
+		if errDelete := a.change(op, http.MethodDelete, path, nil); errDelete != nil {
+			log.Printf(me+": group=%s member=%s port=%d: %v", sg.Name, m.Name, m.Port, errDelete)
+			errCount++
+		}
+	}
+
+	return errCount
+}
+
+func (a *a10v3) BackendLink(be backend) (int, error) {
+
+	me := "a10v3.BackendLink"
+
+	groups, errFind := a.findV3Groups(be)
+	if errFind != nil {
+		return 0, errFind
+	}
+
+	var errCount int
+
+	for _, sg := range groups {
+
+		wanted := map[a10v3Member]string{} // wanted members for group => state
+		for _, bsg := range be.ServiceGroups {
+			if bsg.Name != sg.Name {
+				continue
+			}
+			for _, bsgm := range bsg.Members {
+				port, errPort := strconv.Atoi(bsgm.Port)
+				if errPort != nil {
+					log.Printf(me+": group=%s member=%s bad port=[%s]: %v", sg.Name, bsgm.Name, bsgm.Port, errPort)
+					errCount++
+					continue
+				}
+				wanted[a10v3Member{Name: bsgm.Name, Port: port}] = bsgm.State
+			}
+		}
+
+		existing := map[a10v3Member]struct{}{}
+		for _, m := range sg.MemberList {
+			existing[m.key()] = struct{}{}
+		}
+
+		// sort members for stable operation order
+		var members []a10v3Member
+		for m := range wanted {
+			members = append(members, m)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if members[i].Name != members[j].Name {
+				return members[i].Name < members[j].Name
+			}
+			return members[i].Port < members[j].Port
+		})
+
+		// add missing members - existing members keep state and priority, see MemberUpdate
+		for _, m := range members {
+			if _, found := existing[m]; found {
+				continue
+			}
+			state := wanted[m]
+			m.MemberState = a10v3Action(state)
+			op := deviceOp{Operation: "group member create", Target: sg.Name, Detail: []string{withState(m.Name+","+strconv.Itoa(m.Port), state)}}
+			if errCreate := a.change(op, http.MethodPost, a10v3MemberPath(sg.Name), map[string]interface{}{"member": m}); errCreate != nil {
+				log.Printf(me+": group=%s member=%s port=%d: %v", sg.Name, m.Name, m.Port, errCreate)
+				errCount++
+			}
+		}
+
+		// remove previous members not wanted anymore - only after new ones are in, so the group never runs empty
+		errCount += a.memberDelete(sg, be.BackendName, wanted)
+	}
+
+	return errCount, nil
+}
+
+func (a *a10v3) BackendUnlink(be backend) (int, error) {
+
+	groups, errFind := a.findV3Groups(be)
+	if errFind != nil {
+		return 0, errFind
+	}
+
+	var errCount int
+
+	for _, sg := range groups {
+		errCount += a.memberDelete(sg, be.BackendName, nil)
+	}
+
+	return errCount, nil
+}
+
+// MemberUpdate sets member-state and member-priority of members listed in be.ServiceGroups,
+// then weight and conn-limit of their server ports.
+func (a *a10v3) MemberUpdate(be backend) (int, error) {
+
+	me := "a10v3.MemberUpdate"
+
+	groups, errFind := a.findV3Groups(be)
+	if errFind != nil {
+		return 0, errFind
+	}
+
+	var errCount int
+	var portChanges []backendSGMember
+
+	for _, bsg := range be.ServiceGroups {
+		var current []a10v3Member
+		for _, sg := range groups {
+			if sg.Name == bsg.Name {
+				current = sg.MemberList
+			}
+		}
+		for _, m := range bsg.Members {
+			if m.Weight != 0 || m.ConnectionLimit != 0 {
+				portChanges = append(portChanges, m)
+			}
+			if m.State == "" && m.Priority == 0 {
+				continue // keep member
+			}
+			port, errPort := strconv.Atoi(m.Port)
+			if errPort != nil {
+				log.Printf(me+": group=%s member=%s bad port=[%s]: %v", bsg.Name, m.Name, m.Port, errPort)
+				errCount++
+				continue
+			}
+			// PUT replaces member, hence send current state and priority
+			member := a10v3Member{Name: m.Name, Port: port, MemberPriority: m.Priority}
+			if m.State != "" {
+				member.MemberState = a10v3Action(m.State)
+			}
+			for _, c := range current {
+				if c.key() != member.key() {
+					continue
+				}
+				if member.MemberState == "" {
+					member.MemberState = c.MemberState
+				}
+				if member.MemberPriority == 0 {
+					member.MemberPriority = c.MemberPriority
+				}
+			}
+			path := a10v3MemberPath(bsg.Name) + "/" + url.PathEscape(m.Name) + "+" + m.Port
+			op := deviceOp{Operation: "group member update", Target: bsg.Name, Detail: memberDetail(backendSGMember{Name: m.Name, Port: m.Port, State: m.State, Priority: m.Priority})}
+			if errUpdate := a.change(op, http.MethodPut, path, map[string]interface{}{"member": member}); errUpdate != nil {
+				log.Printf(me+": group=%s member=%s port=%d: %v", bsg.Name, m.Name, port, errUpdate)
+				errCount++
+			}
+		}
+	}
+
+	if len(portChanges) == 0 {
+		return errCount, nil
+	}
+
+	// weight and conn-limit belong to server port
+
+	sList, errServers := a.serverList()
+	if errServers != nil {
+		return errCount, errServers
+	}
+
+	var changed []string // server names in order
+	seen := map[string]bool{}
+	for _, m := range portChanges {
+		s := findV3Server(sList, m.Name)
+		if s == nil && a.plan {
+			// server created by plan - record planned change
+			op := deviceOp{Operation: "server update", Target: m.Name, Detail: memberDetail(backendSGMember{Name: m.Name, Port: m.Port, Weight: m.Weight, ConnectionLimit: m.ConnectionLimit})}
+			a.run(op, nil)
+			continue
+		}
+		if s == nil {
+			log.Printf(me+": member=%s,%s: server not found", m.Name, m.Port)
+			errCount++
+			continue
+		}
+		var found bool
+		for i, p := range s.PortList {
+			if strconv.Itoa(p.PortNumber) != m.Port {
+				continue
+			}
+			found = true
+			if m.Weight != 0 {
+				s.PortList[i].Weight = m.Weight
+			}
+			if m.ConnectionLimit != 0 {
+				s.PortList[i].ConnLimit = m.ConnectionLimit
+			}
+		}
+		if !found {
+			log.Printf(me+": member=%s,%s: server port not found", m.Name, m.Port)
+			errCount++
+			continue
+		}
+		if !seen[s.Name] {
+			seen[s.Name] = true
+			changed = append(changed, s.Name)
+		}
+	}
+
+	for _, name := range changed {
+		if errUpdate := a.serverUpdate(*findV3Server(sList, name)); errUpdate != nil {
+			log.Printf(me+": server=%s: %v", name, errUpdate)
+			errCount++
+		}
+	}
+
+	return errCount, nil
+}
+
+func (a *a10v3) MemberConnections(be backend) ([]memberConn, error) {
+
+	groups, errFind := a.findV3Groups(be)
+	if errFind != nil {
+		return nil, errFind
+	}
+
+	list := []memberConn{}
+
+	for _, sg := range groups {
+		body, errGet := a.call(http.MethodGet, "slb/service-group/"+url.PathEscape(sg.Name)+"/stats", nil)
+		if errGet != nil {
+			return nil, fmt.Errorf("group %s statistics: %v", sg.Name, errGet)
+		}
+		var resp struct {
+			ServiceGroup struct {
+				MemberList []struct {
+					Name  string `json:"name"`
+					Port  int    `json:"port"`
+					Stats struct {
+						CurrConn int `json:"curr_conn"`
+					} `json:"stats"`
+				} `json:"member-list"`
+			} `json:"service-group"`
+		}
+		if errJSON := json.Unmarshal(body, &resp); errJSON != nil {
+			return nil, fmt.Errorf("group %s statistics: %v", sg.Name, errJSON)
+		}
+		for _, m := range resp.ServiceGroup.MemberList {
+			if m.Name != be.BackendName {
+				continue
+			}
+			list = append(list, memberConn{Group: sg.Name, Member: m.Name, Port: strconv.Itoa(m.Port), Connections: m.Stats.CurrConn})
+		}
+	}
+
+	return list, nil
+}
+
+// a10v3Counters are traffic counters of server, server port or group member
+type a10v3Counters struct {
+	CurrConn      int64 `json:"curr_conn"`
+	TotalConn     int64 `json:"total_conn"`
+	TotalFwdBytes int64 `json:"total_fwd_bytes"`
+	TotalRevBytes int64 `json:"total_rev_bytes"`
+}
+
+func (c a10v3Counters) stats(state string) backendStats {
+	return backendStats{Health: health(strings.EqualFold(state, "up")), CurConns: c.CurrConn, TotConns: c.TotalConn, BytesIn: c.TotalRevBytes, BytesOut: c.TotalFwdBytes}
+}
+
+// a10v3Oper is operational state (Up, Down, Disabled, ...)
+type a10v3Oper struct {
+	State string `json:"state"`
+}
+
+func (a *a10v3) get(path string, v interface{}) error {
+	body, errGet := a.call(http.MethodGet, path, nil)
+	if errGet != nil {
+		return errGet
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (a *a10v3) BackendStats(tab map[string]*backend) error {
+
+	type portStats struct {
+		PortNumber int           `json:"port-number"`
+		Stats      a10v3Counters `json:"stats"`
+		Oper       a10v3Oper     `json:"oper"`
+	}
+	type memberStats struct {
+		Name  string        `json:"name"`
+		Port  int           `json:"port"`
+		Stats a10v3Counters `json:"stats"`
+		Oper  a10v3Oper     `json:"oper"`
+	}
+
+	groups := map[string][]memberStats{} // fetch every group once
+
+	for _, b := range tab {
+		serverPath := "slb/server/" + url.PathEscape(b.BackendName)
+		var stats, oper struct {
+			Server struct {
+				Stats    a10v3Counters `json:"stats"`
+				Oper     a10v3Oper     `json:"oper"`
+				PortList []portStats   `json:"port-list"`
+			} `json:"server"`
+		}
+		if errStats := a.get(serverPath+"/stats", &stats); errStats != nil {
+			return fmt.Errorf("server %s statistics: %v", b.BackendName, errStats)
+		}
+		if errOper := a.get(serverPath+"/oper", &oper); errOper != nil {
+			return fmt.Errorf("server %s state: %v", b.BackendName, errOper)
+		}
+		serverStats := stats.Server.Stats.stats(oper.Server.Oper.State)
+		b.Stats = &serverStats
+		for _, p := range stats.Server.PortList {
+			var state string
+			for _, o := range oper.Server.PortList {
+				if o.PortNumber == p.PortNumber {
+					state = o.Oper.State
+				}
+			}
+			setPortStats(b, strconv.Itoa(p.PortNumber), p.Stats.stats(state))
+		}
+
+		for _, sg := range b.ServiceGroups {
+			members, found := groups[sg.Name]
+			if !found {
+				groupPath := "slb/service-group/" + url.PathEscape(sg.Name)
+				var stats, oper struct {
+					ServiceGroup struct {
+						MemberList []memberStats `json:"member-list"`
+					} `json:"service-group"`
+				}
+				if errStats := a.get(groupPath+"/stats", &stats); errStats != nil {
+					return fmt.Errorf("group %s statistics: %v", sg.Name, errStats)
+				}
+				if errOper := a.get(groupPath+"/oper", &oper); errOper != nil {
+					return fmt.Errorf("group %s state: %v", sg.Name, errOper)
+				}
+				for _, m := range stats.ServiceGroup.MemberList {
+					for _, o := range oper.ServiceGroup.MemberList {
+						if o.Name == m.Name && o.Port == m.Port {
+							m.Oper = o.Oper
+						}
+					}
+					members = append(members, m)
+				}
+				groups[sg.Name] = members
+			}
+			for _, m := range members {
+				if m.Name == b.BackendName {
+					setMemberStats(b, sg.Name, strconv.Itoa(m.Port), m.Stats.stats(m.Oper.State))
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit log (env var AUDIT_LOG): append-only JSON lines, one entry per change.
+// Every entry carries the HMAC-SHA256 of the previous entry, hence editing or
+// removing any entry breaks the chain (see verifyAuditChain). The HMAC key
+// (env var AUDIT_KEY) is never written to the log, so the chain cannot be
+// recomputed from the log alone. Truncation at the end of the log keeps the
+// chain valid: compare Head and Entries from /v1/audit/verify with values
+// recorded earlier.
+
+// auditEntry records one change request
+type auditEntry struct {
+	ID   string // sequence number
+	Time time.Time
+
+	User           string // service user, or device username with basic auth
+	From           string // remote address
+	ForwardedBy    string `json:",omitempty"`
+	ForwardedFor   string `json:",omitempty"`
+	ForwardedHost  string `json:",omitempty"`
+	ForwardedProto string `json:",omitempty"`
+
+	Method string
+	URL    string
+	Vendor string
+	Device string // address
+	Name   string `json:",omitempty"` // inventory device name
+
+	Backend       string                `json:",omitempty"`
+	Before        *backend              `json:",omitempty"` // nil: backend missing
+	After         *backend              `json:",omitempty"`
+	GroupsBefore  []backendServiceGroup `json:",omitempty"` // full member lists of groups the change touched
+	GroupsAfter   []backendServiceGroup `json:",omitempty"`
+	VirtualBefore []virtual             `json:",omitempty"`
+	VirtualAfter  []virtual             `json:",omitempty"`
+	Operations    []deviceOp            `json:",omitempty"`
+
+	Status int
+	Result string
+	Errors int
+
+	PrevHash string
+	Hash     string
+}
+
+type auditLog struct {
+	mutex    sync.Mutex
+	path     string
+	key      []byte // HMAC key
+	file     *os.File
+	seq      int64
+	lastHash string
+}
+
+// audit, when set, records every change
+var audit *auditLog
+
+// auditHash is the HMAC-SHA256 of entry, excluding the hash field itself
+func auditHash(key []byte, e auditEntry) string {
+	e.Hash = ""
+	buf, _ := json.Marshal(e)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readAuditLog loads all entries from file
+func readAuditLog(path string) ([]auditEntry, error) {
+	f, errOpen := os.Open(path)
+	if os.IsNotExist(errOpen) {
+		return nil, nil
+	}
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e auditEntry
+		if errJSON := json.Unmarshal(scanner.Bytes(), &e); errJSON != nil {
+			return entries, fmt.Errorf("audit log: %s: line %d: %v", path, line, errJSON)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// verifyAuditChain checks hash chain, reporting first broken entry
+func verifyAuditChain(key []byte, entries []auditEntry) error {
+	var prev string
+	for i, e := range entries {
+		if e.PrevHash != prev {
+			return fmt.Errorf("audit log: entry %d (id=%s): chain broken: previous hash mismatch", i+1, e.ID)
+		}
+		if !hmac.Equal([]byte(auditHash(key, e)), []byte(e.Hash)) {
+			return fmt.Errorf("audit log: entry %d (id=%s): entry modified: hash mismatch", i+1, e.ID)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+func openAuditLog(path string, key []byte) (*auditLog, error) {
+	entries, errRead := readAuditLog(path)
+	if errRead != nil {
+		return nil, errRead
+	}
+	if errChain := verifyAuditChain(key, entries); errChain != nil {
+		return nil, errChain
+	}
+
+	f, errOpen := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+
+	a := &auditLog{path: path, key: key, file: f}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		a.lastHash = last.Hash
+		a.seq, _ = strconv.ParseInt(last.ID, 10, 64)
+	}
+
+	return a, nil
+}
+
+// append chains entry to log, returning the recorded entry
+func (a *auditLog) append(e auditEntry) (auditEntry, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	e.ID = strconv.FormatInt(a.seq+1, 10)
+	e.PrevHash = a.lastHash
+	e.Hash = auditHash(a.key, e)
+
+	buf, errJSON := json.Marshal(e)
+	if errJSON != nil {
+		return e, errJSON
+	}
+	if _, errWrite := a.file.Write(append(buf, '\n')); errWrite != nil {
+		return e, errWrite
+	}
+	if errSync := a.file.Sync(); errSync != nil {
+		return e, errSync
+	}
+
+	a.seq++
+	a.lastHash = e.Hash
+
+	return e, nil
+}
+
+func (a *auditLog) entries() ([]auditEntry, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return readAuditLog(a.path)
+}
+
+// auditVerify is the result of /v1/audit/verify
+type auditVerify struct {
+	Entries int    // entries appended, as counted by the service
+	Head    string // hash of last entry appended
+	Valid   bool
+	Error   string `json:",omitempty" yaml:",omitempty"`
+}
+
+// verify checks hash chain of log file, and that file still ends at the last entry appended
+func (a *auditLog) verify() (auditVerify, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	report := auditVerify{Entries: int(a.seq), Head: a.lastHash, Valid: true}
+
+	entries, errRead := readAuditLog(a.path)
+	if errRead != nil {
+		return report, errRead
+	}
+
+	if errChain := verifyAuditChain(a.key, entries); errChain != nil {
+		report.Valid = false
+		report.Error = errChain.Error()
+		return report, nil
+	}
+
+	var head string
+	if len(entries) > 0 {
+		head = entries[len(entries)-1].Hash
+	}
+	if head != a.lastHash {
+		report.Valid = false
+		report.Error = fmt.Sprintf("audit log: truncated: %d entries in file, last hash differs from head", len(entries))
+	}
+
+	return report, nil
+}
+
+// auditRecord is the audit data collected along a write request
+type auditRecord struct {
+	vendor  string
+	host    string
+	backend string
+	before  *backend
+	groups  []backendServiceGroup // all groups before change
+}
+
+type auditKey struct{}
+
+// auditStart attaches backend state before change to request.
+// Group member lists are read from device, since a change may touch other members of the backend groups.
+func auditStart(r *http.Request, lb loadBalancer, vendor, host, backendName string, before *backend) *http.Request {
+	if audit == nil {
+		return r
+	}
+	groups, errGroups := lb.ServiceGroupList()
+	if errGroups != nil {
+		log.Printf("auditStart: host=%s backend=%s: groups before change: %v", host, backendName, errGroups)
+	}
+	rec := &auditRecord{vendor: vendor, host: host, backend: backendName, before: before, groups: groups}
+	return r.WithContext(context.WithValue(r.Context(), auditKey{}, rec))
+}
+
+// auditStartList reads backend state before change from device, then calls auditStart.
+// Plans change nothing, hence are not audited.
+func auditStartList(r *http.Request, lb loadBalancer, plan bool, vendor, host, backendName string) *http.Request {
+	if audit == nil || plan {
+		return r
+	}
+	backendTab, errList := lb.BackendList()
+	if errList != nil {
+		log.Printf("auditStartList: host=%s backend=%s: state before change: %v", host, backendName, errList)
+	}
+	return auditStart(r, lb, vendor, host, backendName, backendTab[backendName])
+}
+
+// auditVirtual records replacement of virtual server layout
+func auditVirtual(r *http.Request, host string, before, after []virtual, status int, result string, errCount int) {
+	if audit == nil {
+		return
+	}
+	e := newAuditEntry(r, "a10v2", host)
+	e.VirtualBefore = before
+	e.VirtualAfter = after
+	e.Status = status
+	e.Result = result
+	e.Errors = errCount
+	auditAppend(e)
+}
+
+// newAuditEntry fills request data for entry
+func newAuditEntry(r *http.Request, vendor, host string) auditEntry {
+	fBy, fFor, fHost, fProto := forwarded("audit", r)
+	e := auditEntry{
+		Time:           time.Now().UTC(),
+		User:           requestCaller(r),
+		From:           r.RemoteAddr,
+		ForwardedBy:    fBy,
+		ForwardedFor:   fFor,
+		ForwardedHost:  fHost,
+		ForwardedProto: fProto,
+		Method:         r.Method,
+		URL:            r.URL.String(),
+		Vendor:         vendor,
+		Device:         host,
+	}
+	if inventory != nil {
+		if d, found := inventory.byAddress[host]; found {
+			e.Name = d.Name
+		}
+	}
+	return e
+}
+
+// auditWrite records outcome of backend write request started with auditStart.
+// Backend state after change is read from device.
+func auditWrite(r *http.Request, lb loadBalancer, status int, result string, errCount int) {
+	if audit == nil {
+		return
+	}
+	rec, found := r.Context().Value(auditKey{}).(*auditRecord)
+	if !found {
+		return
+	}
+
+	e := newAuditEntry(r, rec.vendor, rec.host)
+	e.Backend = rec.backend
+	e.Before = rec.before
+	e.Operations = lb.Operations()
+	e.Status = status
+	e.Result = result
+	e.Errors = errCount
+
+	backendTab, errList := lb.BackendList()
+	if errList != nil {
+		log.Printf("auditWrite: host=%s backend=%s: state after change: %v", rec.host, rec.backend, errList)
+		e.Result += " (state after change unavailable: " + errList.Error() + ")"
+	} else {
+		e.After = backendTab[rec.backend]
+	}
+
+	touched := map[string]bool{}
+	for _, b := range []*backend{e.Before, e.After} {
+		if b != nil {
+			for _, g := range b.ServiceGroups {
+				touched[g.Name] = true
+			}
+		}
+	}
+	if len(touched) > 0 {
+		e.GroupsBefore = touchedGroups(rec.groups, touched)
+		groups, errGroups := lb.ServiceGroupList()
+		if errGroups != nil {
+			log.Printf("auditWrite: host=%s backend=%s: groups after change: %v", rec.host, rec.backend, errGroups)
+		}
+		e.GroupsAfter = touchedGroups(groups, touched)
+	}
+
+	auditAppend(e)
+}
+
+// touchedGroups picks groups by name
+func touchedGroups(groups []backendServiceGroup, touched map[string]bool) []backendServiceGroup {
+	var list []backendServiceGroup
+	for _, g := range groups {
+		if touched[g.Name] {
+			list = append(list, g)
+		}
+	}
+	return list
+}
+
+func auditAppend(e auditEntry) {
+	recorded, errAppend := audit.append(e)
+	if errAppend != nil {
+		log.Printf("AUDIT LOG FAILURE: %s: %v", audit.path, errAppend)
+		return
+	}
+	log.Printf("audit: id=%s user=%s device=%s backend=%s status=%d result=[%s]", recorded.ID, recorded.User, recorded.Device, recorded.Backend, recorded.Status, recorded.Result)
+}
+
+// Callers see only entries for devices they may read, see auditReader.
+//
+// /v1/audit/                          - query entries (filters: ?device=&backend=&user=)
+// /v1/audit/verify                    - check hash chain, report head hash and entry count
+// /v1/audit/<id>                      - single entry
+// ^^^^^^^^^^
+// prefix
+func handlerAudit(debug bool, w http.ResponseWriter, r *http.Request, path string) {
+
+	me := "handlerAudit"
+
+	if !strings.HasPrefix(r.URL.Path, path) {
+		sendNotFound(me, w, r)
+		return
+	}
+
+	if audit == nil {
+		http.Error(w, "audit log not configured", http.StatusNotFound) // 404
+		return
+	}
+
+	if !callerAuth(me, w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		sendNotSupported(me, w, r)
+		return
+	}
+
+	entries, errRead := audit.entries()
+	if errRead != nil {
+		log.Printf(me+": method=%s url=%s from=%s audit log: %v", r.Method, r.URL.Path, r.RemoteAddr, errRead)
+		http.Error(w, "audit log read error", http.StatusInternalServerError) // 500
+		return
+	}
+
+	reader := newAuditReader(debug, r)
+
+	acceptYAML, _ := clientOptions(debug, r)
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, path), "/")
+
+	switch id {
+	case "":
+		list := []auditEntry{}
+		for _, e := range filterAudit(entries, r.URL.Query()) {
+			if reader.may(e) {
+				list = append(list, e)
+			}
+		}
+		sendList(me, w, r, list, acceptYAML)
+	case "verify":
+		// head and count describe the whole log, hence require access to every audited device
+		for _, e := range entries {
+			if !reader.may(e) {
+				log.Printf(me+": method=%s url=%s from=%s user=%s forbidden: no read access to device %s", r.Method, r.URL.Path, r.RemoteAddr, reader.user, e.Device)
+				http.Error(w, "forbidden - audit verify requires read access to every audited device", http.StatusForbidden) // 403
+				return
+			}
+		}
+		report, errVerify := audit.verify()
+		if errVerify != nil {
+			log.Printf(me+": method=%s url=%s from=%s audit log: %v", r.Method, r.URL.Path, r.RemoteAddr, errVerify)
+			http.Error(w, "audit log read error", http.StatusInternalServerError) // 500
+			return
+		}
+		sendList(me, w, r, report, acceptYAML)
+	default:
+		for _, e := range entries {
+			if e.ID == id && reader.may(e) {
+				sendList(me, w, r, e, acceptYAML)
+				return
+			}
+		}
+		http.Error(w, "audit entry not found: "+id, http.StatusNotFound) // 404
+	}
+}
+
+// auditReader decides which audited devices the caller may read entries for:
+// policy must allow read on the device and, without service authentication,
+// the caller basic auth credentials must log into the device.
+type auditReader struct {
+	debug   bool
+	r       *http.Request
+	user    string
+	allowed map[string]bool // device address => may read
+}
+
+func newAuditReader(debug bool, r *http.Request) *auditReader {
+	a := &auditReader{debug: debug, r: r, allowed: map[string]bool{}}
+	if svcAuth != nil {
+		if u := svcAuth.user(r); u != nil {
+			a.user = u.Name
+		}
+	} else {
+		a.user, _, _ = r.BasicAuth()
+	}
+	return a
+}
+
+func (a *auditReader) may(e auditEntry) bool {
+	ok, found := a.allowed[e.Device]
+	if !found {
+		ok = a.check(e.Vendor, e.Device)
+		a.allowed[e.Device] = ok
+	}
+	return ok
+}
+
+func (a *auditReader) check(vendor, host string) bool {
+
+	me := "auditReader"
+
+	if inventory != nil {
+		if _, found := inventory.byAddress[host]; !found {
+			return false
+		}
+	}
+	if errDeny := policyCheck(a.user, host, policyRead, ""); errDeny != nil {
+		log.Printf(me+": host=%s: %v", host, errDeny)
+		return false
+	}
+	if svcAuth != nil {
+		return true
+	}
+
+	username, password, _ := a.r.BasicAuth()
+	lb, errNew := newLoadBalancer(vendor, host, inventoryOptions(host, lbOptions{Debug: a.debug}))
+	if errNew != nil {
+		log.Printf(me+": host=%s vendor=%s: %v", host, vendor, errNew)
+		return false
+	}
+	if errLogin := lb.Login(username, password); errLogin != nil {
+		log.Printf(me+": host=%s user=%s: device login: %v", host, username, errLogin)
+		return false
+	}
+	if errClose := lb.Logout(); errClose != nil {
+		log.Printf(me+": host=%s close error: %v", host, errClose)
+	}
+	return true
+}
+
+// filterAudit selects entries by device (address or name), backend and user
+func filterAudit(entries []auditEntry, query map[string][]string) []auditEntry {
+	match := func(key string, values ...string) bool {
+		wanted, found := query[key]
+		if !found {
+			return true
+		}
+		return inventoryMatch(wanted, values)
+	}
+	list := []auditEntry{}
+	for _, e := range entries {
+		if match("device", e.Device, e.Name) && match("backend", e.Backend) && match("user", e.User) {
+			list = append(list, e)
+		}
+	}
+	return list
+}
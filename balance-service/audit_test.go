@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/udhos/balance-api-service/credstore"
+)
+
+var testAuditKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newAudit(t *testing.T) (string, func()) {
+	dir, errDir := ioutil.TempDir("", "audit")
+	if errDir != nil {
+		t.Fatalf("tempdir: %v", errDir)
+	}
+	file := filepath.Join(dir, "audit.log")
+	a, errOpen := openAuditLog(file, testAuditKey)
+	if errOpen != nil {
+		t.Fatalf("open: %v", errOpen)
+	}
+	audit = a
+	return file, func() {
+		audit = nil
+		a.file.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// auditRequest queries audit log with device credentials as basic auth
+func auditRequest(url, username, password string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	if username != "" {
+		r.SetBasicAuth(username, password)
+	}
+	w := httptest.NewRecorder()
+	handlerAudit(false, w, r, "/v1/audit/")
+	return w
+}
+
+func queryAudit(t *testing.T, url string) []auditEntry {
+	return decodeAuditList(t, auditRequest(url, "admin", "a10"))
+}
+
+func verifyAudit(t *testing.T) auditVerify {
+	w := auditRequest("/v1/audit/verify", "admin", "a10")
+	expectStatus(t, "verify", w, http.StatusOK)
+	var report auditVerify
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &report); errJSON != nil {
+		t.Fatalf("verify: %v: [%s]", errJSON, w.Body.String())
+	}
+	return report
+}
+
+func TestE2EAudit(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	file, closeAudit := newAudit(t)
+	defer closeAudit()
+
+	expectStatus(t, "create", e.sample(http.MethodPost, "backend", "server_create.yaml", map[string]string{"X-Forwarded-For": "192.168.1.1"}), http.StatusOK)
+	expectStatus(t, "plan", e.sample(http.MethodPost, "backend", "server_link.yaml", map[string]string{"Prefer": "dry-run"}), http.StatusOK)
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	expectStatus(t, "read", e.request(http.MethodGet, "backend", nil, nil), http.StatusOK)
+
+	list := queryAudit(t, "/v1/audit/?backend=s1&user=admin")
+	if len(list) != 2 {
+		t.Fatalf("expected 2 entries (create, link), got %d: %v", len(list), list)
+	}
+
+	created := list[0]
+	if created.Before != nil || created.After == nil || created.After.BackendAddress != "2.2.2.2" || created.ForwardedFor != "192.168.1.1" || created.Device != e.host || len(created.Operations) < 1 {
+		t.Errorf("create: unexpected entry: %+v", created)
+	}
+	linked := list[1]
+	if linked.Before == nil || len(linked.Before.ServiceGroups) != 0 || linked.After == nil || len(linked.After.ServiceGroups) != 1 || linked.PrevHash != created.Hash {
+		t.Errorf("link: unexpected entry: %+v", linked)
+	}
+
+	if got := queryAudit(t, "/v1/audit/?device=10.9.9.9"); len(got) != 0 {
+		t.Errorf("device filter: unexpected entries: %v", got)
+	}
+
+	// reopen resumes chain
+	audit.file.Close()
+	a, errReopen := openAuditLog(file, testAuditKey)
+	if errReopen != nil {
+		t.Fatalf("reopen: %v", errReopen)
+	}
+	audit = a
+	expectStatus(t, "delete", e.sample(http.MethodDelete, "backend", "server_delete.yaml", nil), http.StatusOK)
+	entries, _ := audit.entries()
+	if len(entries) != 3 || entries[2].ID != "3" || entries[2].After != nil {
+		t.Fatalf("delete: unexpected entries: %v", entries)
+	}
+
+	report := verifyAudit(t)
+	if !report.Valid || report.Entries != 3 || report.Head != entries[2].Hash {
+		t.Errorf("verify: unexpected report: %+v", report)
+	}
+
+	if _, errOpen := openAuditLog(file, []byte("another key")); errOpen == nil {
+		t.Errorf("open: wrong key not detected")
+	}
+
+	// drop last entry
+	buf, _ := ioutil.ReadFile(file)
+	lines := bytes.SplitAfter(bytes.TrimSuffix(buf, []byte("\n")), []byte("\n"))
+	ioutil.WriteFile(file, bytes.Join(lines[:2], nil), 0600)
+	if report := verifyAudit(t); report.Valid || !strings.Contains(report.Error, "truncated") || report.Entries != 3 {
+		t.Errorf("verify: truncation not detected: %+v", report)
+	}
+	ioutil.WriteFile(file, buf, 0600)
+
+	// tamper with first entry
+	ioutil.WriteFile(file, bytes.Replace(buf, []byte("2.2.2.2"), []byte("6.6.6.6"), 1), 0600)
+
+	if report := verifyAudit(t); report.Valid || !strings.Contains(report.Error, "entry 1 (id=1)") {
+		t.Errorf("verify: tampering not detected: %+v", report)
+	}
+	if _, errOpen := openAuditLog(file, testAuditKey); errOpen == nil {
+		t.Errorf("open: tampering not detected")
+	}
+}
+
+func TestE2EAuditAccess(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	_, closeAudit := newAudit(t)
+	defer closeAudit()
+
+	expectStatus(t, "create", e.sample(http.MethodPost, "backend", "server_create.yaml", nil), http.StatusOK)
+
+	expectStatus(t, "anonymous", auditRequest("/v1/audit/", "", ""), http.StatusUnauthorized)
+	expectStatus(t, "anonymous verify", auditRequest("/v1/audit/verify", "", ""), http.StatusUnauthorized)
+
+	// device rejects credentials
+	w := auditRequest("/v1/audit/", "admin", "wrong")
+	expectStatus(t, "wrong password", w, http.StatusOK)
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("wrong password: entries leaked: %s", w.Body.String())
+	}
+	expectStatus(t, "wrong password entry", auditRequest("/v1/audit/1", "admin", "wrong"), http.StatusNotFound)
+	expectStatus(t, "wrong password verify", auditRequest("/v1/audit/verify", "admin", "wrong"), http.StatusForbidden)
+
+	// policy limits service user to another device
+	defer newServiceAuth(t, e.host, credstore.Credential{Username: "admin", Password: "a10"})()
+	p, errPolicy := parsePolicy([]byte("rules:\n- name: other-device\n  users: [team-payments]\n  devices: [lb9]\n  operations: [read]\n"))
+	if errPolicy != nil {
+		t.Fatalf("policy: %v", errPolicy)
+	}
+	policy = p
+	defer func() { policy = nil }()
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/audit/", nil)
+	r.Header.Set("Authorization", "Bearer pay-token")
+	w = httptest.NewRecorder()
+	handlerAudit(false, w, r, "/v1/audit/")
+	expectStatus(t, "other device", w, http.StatusOK)
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("other device: entries leaked: %s", w.Body.String())
+	}
+
+	policy = nil
+	w = httptest.NewRecorder()
+	handlerAudit(false, w, r, "/v1/audit/")
+	if list := decodeAuditList(t, w); len(list) != 1 {
+		t.Errorf("service user: unexpected entries: %v", list)
+	}
+}
+
+func decodeAuditList(t *testing.T, w *httptest.ResponseRecorder) []auditEntry {
+	expectStatus(t, "audit", w, http.StatusOK)
+	var list []auditEntry
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &list); errJSON != nil {
+		t.Fatalf("audit: %v: [%s]", errJSON, w.Body.String())
+	}
+	return list
+}
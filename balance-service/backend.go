@@ -0,0 +1,647 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/sanity-io/litter"
+	"gopkg.in/yaml.v2"
+)
+
+// backend is the main type for the /backend/ route
+// A10 full backend path is:
+// virtual server -> virtual port list -> service group -> list of {backend_name, backend_port} -> server (has own list of ports)
+
+type backend struct {
+	VirtualServers []backendVirtualServer
+	ServiceGroups  []backendServiceGroup
+	BackendName    string
+	BackendAddress string
+	BackendPorts   []backendPort
+	State          string        `json:",omitempty" yaml:",omitempty"` // enabled, disabled, offline - see backendstate.go
+	Stats          *backendStats `json:",omitempty" yaml:",omitempty"` // GET ?stats=true - see stats.go
+}
+
+type backendVirtualServer struct {
+	Name         string
+	Address      string
+	VirtualPorts []backendVirtualPort
+}
+
+type backendVirtualPort struct {
+	Port         string
+	Protocol     string
+	ServiceGroup string
+}
+
+type backendServiceGroup struct {
+	Name     string
+	Protocol string
+	Members  []backendSGMember // list of members
+}
+
+type backendSGMember struct {
+	Name            string
+	Port            string
+	State           string        `json:",omitempty" yaml:",omitempty"`
+	Weight          int           `json:",omitempty" yaml:",omitempty"` // share of traffic, see backendstate.go
+	Priority        int           `json:",omitempty" yaml:",omitempty"`
+	ConnectionLimit int           `json:",omitempty" yaml:",omitempty"`
+	Stats           *backendStats `json:",omitempty" yaml:",omitempty"` // GET ?stats=true - see stats.go
+}
+
+type backendPort struct {
+	Port     string
+	Protocol string
+	State    string        `json:",omitempty" yaml:",omitempty"`
+	Stats    *backendStats `json:",omitempty" yaml:",omitempty"`
+}
+
+// /v1/lb/<vendor>/node/<host>/backend/
+// /v1/at2/node/<host>/backend/
+
+func nodeBackend(debug, dry bool, vendor string, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+
+	me := "nodeBackend"
+
+	switch r.Method {
+	case http.MethodGet:
+		nodeBackendGet(debug, vendor, w, r, username, password, fields)
+	case http.MethodDelete:
+		nodeBackendDelete(debug, dry, vendor, w, r, username, password, fields)
+	case http.MethodPost:
+		nodeBackendPost(debug, dry, vendor, w, r, username, password, fields)
+	case http.MethodPut:
+		nodeBackendPut(debug, dry, vendor, w, r, username, password, fields)
+	case http.MethodPatch:
+		nodeBackendPatch(debug, dry, vendor, w, r, username, password, fields)
+	default:
+		sendNotSupported(me, w, r)
+	}
+}
+
+// lbLogin opens a driver session, reporting failures as http error
+func lbLogin(label, vendor, host string, opt lbOptions, username, password string, w http.ResponseWriter, r *http.Request) loadBalancer {
+
+	lb, errNew := newLoadBalancer(vendor, host, opt)
+	if errNew != nil {
+		sendBadRequest(label, errNew.Error(), w, r)
+		return nil
+	}
+
+	errLogin := lb.Login(username, password)
+	if errLogin != nil {
+		sendDriverError(label, host, "auth", errLogin, w, r)
+		return nil
+	}
+
+	return lb
+}
+
+func lbLogout(label string, lb loadBalancer, r *http.Request) {
+	if errClose := lb.Logout(); errClose != nil {
+		log.Printf(label+": method=%s url=%s from=%s close error: %v", r.Method, r.URL.Path, r.RemoteAddr, errClose)
+		// log warning only
+	}
+}
+
+// GET /backend/       - list backends, see backendFilters for query filters
+// GET /backend/<name> - single backend
+func nodeBackendGet(debug bool, vendor string, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+	me := "nodeBackendGet"
+
+	host := fields[0]
+
+	if !authorize(me, host, policyRead, nil, w, r) {
+		return
+	}
+
+	var name string
+	if len(fields) > 2 {
+		name = fields[2]
+	}
+
+	lb := lbLogin(me, vendor, host, lbOptions{Debug: debug}, username, password, w, r)
+	if lb == nil {
+		return
+	}
+
+	defer lbLogout(me, lb, r)
+
+	backendTab, errList := lb.BackendList()
+	if errList != nil {
+		sendDriverError(me, host, "backend list", errList, w, r)
+		return
+	}
+
+	acceptYAML, _ := clientOptions(debug, r)
+
+	stats := r.URL.Query().Get("stats") == "true"
+
+	if name == "" {
+		list := filterBackends(backendTab, r.URL.Query())
+		if stats {
+			tab := map[string]*backend{}
+			for _, b := range list {
+				tab[b.BackendName] = b
+			}
+			if errStats := lb.BackendStats(tab); errStats != nil {
+				sendDriverError(me, host, "backend stats", errStats, w, r)
+				return
+			}
+		}
+		sendList(me, w, r, list, acceptYAML)
+		return
+	}
+
+	b, found := backendTab[name]
+	if !found {
+		log.Printf(me+": method=%s url=%s from=%s backend=%s not found", r.Method, r.URL.Path, r.RemoteAddr, name)
+		http.Error(w, "backend not found: "+name, http.StatusNotFound) // 404
+		return
+	}
+
+	w.Header().Set("ETag", backendETag(b)) // for If-Match on write requests - before stats
+
+	if stats {
+		if errStats := lb.BackendStats(map[string]*backend{name: b}); errStats != nil {
+			sendDriverError(me, host, "backend stats", errStats, w, r)
+			return
+		}
+	}
+
+	sendList(me, w, r, b, acceptYAML)
+}
+
+// sendList encodes list as JSON, YAML (if accepted by client) or litter (debug)
+func sendList(me string, w http.ResponseWriter, r *http.Request, list interface{}, acceptYAML bool) {
+	sendReport(me, w, r, list, acceptYAML, http.StatusOK)
+}
+
+// sendReport is sendList with custom http status
+func sendReport(me string, w http.ResponseWriter, r *http.Request, list interface{}, acceptYAML bool, status int) {
+
+	// force litter
+	query := r.URL.Query()
+	if _, found := query["debug"]; found {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		writeStr(me, w, litter.Sdump(list))
+		writeLine(me, w)
+		return
+	}
+
+	// force YAML if supported
+	if acceptYAML {
+		buf, errMarshal := yaml.Marshal(list)
+		if errMarshal != nil {
+			log.Printf(me+": method=%s url=%s from=%s yaml error: %v", r.Method, r.URL.Path, r.RemoteAddr, errMarshal)
+			sendInternalError(me, w, r) // http 500
+			return
+		}
+		w.Header().Set("Content-Type", "text/x-yaml")
+		w.WriteHeader(status)
+		writeBuf(me, w, buf)
+		writeLine(me, w)
+		return
+	}
+
+	// default to JSON
+	buf, errMarshal := json.MarshalIndent(list, "", " ")
+	if errMarshal != nil {
+		log.Printf(me+": method=%s url=%s from=%s json error: %v", r.Method, r.URL.Path, r.RemoteAddr, errMarshal)
+		sendInternalError(me, w, r) // http 500
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeBuf(me, w, buf)
+	writeLine(me, w)
+}
+
+func decodeBackend(debug bool, body io.Reader, bodyYAML bool, be *backend) error {
+	return decodeBody(debug, body, bodyYAML, be)
+}
+
+// decodeBody decodes request body as YAML or JSON into v
+func decodeBody(debug bool, body io.Reader, bodyYAML bool, v interface{}) error {
+	me := "decodeBody"
+
+	// force YAML if supported
+	if bodyYAML {
+		log.Print(me + ": decoding YAML request body")
+
+		buf, errRead := ioutil.ReadAll(body)
+		if errRead != nil {
+			return fmt.Errorf("read error: %v", errRead)
+		}
+
+		errYaml := yaml.Unmarshal(buf, v)
+		if errYaml != nil {
+			log.Printf(me+": decoding YAML request body - error: %v buf=[%s]", errYaml, string(buf))
+			return fmt.Errorf("yaml error: %v", errYaml)
+		}
+
+		return nil
+	}
+
+	// defaults to JSON
+	log.Print(me + ": decoding JSON request body")
+	dec := json.NewDecoder(body)
+	errJson := dec.Decode(v)
+	if errJson != nil {
+		return fmt.Errorf("json error: %v", errJson)
+	}
+
+	return nil
+}
+
+func decodeRequestBody(debug bool, w http.ResponseWriter, r *http.Request, be *backend) error {
+	return decodeRequest(debug, w, r, be)
+}
+
+// decodeRequest decodes request body into v, reporting failure as bad request
+func decodeRequest(debug bool, w http.ResponseWriter, r *http.Request, v interface{}) error {
+
+	me := "decodeRequest"
+
+	_, bodyYAML := clientOptions(debug, r)
+
+	errDecode := decodeBody(debug, r.Body, bodyYAML, v)
+	if errDecode != nil {
+		sendBadRequest(me, errDecode.Error(), w, r)
+		return errDecode
+	}
+
+	return nil
+}
+
+// clientPlan reports whether request asks for execution plan only:
+// ?plan=true or header Prefer: dry-run
+func clientPlan(r *http.Request) bool {
+	if values, found := r.URL.Query()["plan"]; found {
+		v := strings.Join(values, "")
+		return v == "" || v == "true" || v == "1"
+	}
+	for _, prefer := range r.Header["Prefer"] {
+		for _, p := range strings.Split(prefer, ",") {
+			if strings.TrimSpace(p) == "dry-run" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// opReport is the response for write requests
+type opReport struct {
+	Plan       bool
+	Result     string
+	Errors     int
+	Operations []deviceOp
+}
+
+// opStatus picks http status for write outcome:
+// 200 when everything succeeded, 207 on partial failure, 502 when every operation failed
+func opStatus(ops []deviceOp, errCount int) int {
+	var ok, failed int
+	for _, op := range ops {
+		if op.Status == opFailed {
+			failed++
+			continue
+		}
+		ok++
+	}
+	switch {
+	case failed > 0 && ok == 0:
+		return http.StatusBadGateway // 502
+	case failed > 0 || errCount > 0:
+		return http.StatusMultiStatus // 207
+	}
+	return http.StatusOK // 200
+}
+
+// sendWriteResult reports outcome of write request as list of device operations.
+// Plan mode sends the operations that would run.
+func sendWriteResult(me string, debug, plan bool, w http.ResponseWriter, r *http.Request, lb loadBalancer, result string, errCount int) {
+
+	report := opReport{Plan: plan, Result: result, Errors: errCount, Operations: lb.Operations()}
+	if report.Operations == nil {
+		report.Operations = []deviceOp{} // nothing to do
+	}
+
+	status := http.StatusOK
+	if plan {
+		w.Header().Set("Preference-Applied", "dry-run")
+	} else {
+		status = opStatus(report.Operations, errCount)
+	}
+
+	log.Printf(me+": method=%s url=%s from=%s result=[%s] errors=%d operations=%d status=%d", r.Method, r.URL.Path, r.RemoteAddr, result, errCount, len(report.Operations), status)
+
+	if !plan {
+		auditWrite(r, lb, status, result, errCount)
+	}
+
+	acceptYAML, _ := clientOptions(debug, r)
+
+	sendReport(me, w, r, report, acceptYAML, status)
+}
+
+// sendWriteError reports a driver failure during write request.
+// Device operations already issued are reported along with the failure.
+func sendWriteError(me string, debug bool, host, reason string, err error, w http.ResponseWriter, r *http.Request, lb loadBalancer) {
+
+	ops := lb.Operations()
+	if len(ops) < 1 {
+		sendDriverError(me, host, reason, err, w, r)
+		return
+	}
+
+	log.Printf(me+": method=%s url=%s from=%s %s: %v", r.Method, r.URL.Path, r.RemoteAddr, reason, err)
+
+	report := opReport{Result: host + " bad gateway - " + reason, Errors: 1, Operations: ops}
+
+	auditWrite(r, lb, http.StatusBadGateway, fmt.Sprintf("%s: %v", report.Result, err), 1)
+
+	acceptYAML, _ := clientOptions(debug, r)
+
+	sendReport(me, w, r, report, acceptYAML, http.StatusBadGateway) // 502
+}
+
+// findGroups returns name of first group in wanted missing from available list
+func findGroups(available, wanted []backendServiceGroup) (string, bool) {
+LOOP:
+	for _, bsg := range wanted {
+		for _, sg := range available {
+			if sg.Name == bsg.Name {
+				continue LOOP // found bsg - next
+			}
+		}
+		return bsg.Name, false // bsg not found
+	}
+	return "", true
+}
+
+func nodeBackendDelete(debug, dry bool, vendor string, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+	me := "nodeBackendDelete"
+
+	var be backend
+
+	if errDecode := decodeRequestBody(debug, w, r, &be); errDecode != nil {
+		return
+	}
+
+	if !backendPathName(me, fields, &be, w, r) {
+		return
+	}
+
+	if be.BackendName == "" {
+		sendBadRequest(me, "missing backend name", w, r)
+		return
+	}
+
+	host := fields[0]
+
+	if len(be.ServiceGroups) < 1 {
+		if !authorize(me, host, policyDelete, nil, w, r) {
+			return
+		}
+	} else if !authorize(me, host, policyUnlink, groupNames(be.ServiceGroups), w, r) {
+		return
+	}
+
+	drain := r.URL.Query().Get("drain") == "true"
+	if drain && len(be.ServiceGroups) < 1 {
+		sendBadRequest(me, "drain requires service groups", w, r)
+		return
+	}
+	// drain also changes member states before unlinking
+	if drain && !authorize(me, host, policyUpdate, groupNames(be.ServiceGroups), w, r) {
+		return
+	}
+	timeout, errTimeout := drainTimeoutParam(r)
+	if errTimeout != nil {
+		sendBadRequest(me, errTimeout.Error(), w, r)
+		return
+	}
+
+	plan := clientPlan(r)
+
+	defer writeLock(host, plan)()
+
+	lb := lbLogin(me, vendor, host, lbOptions{Debug: debug, Dry: dry, Plan: plan}, username, password, w, r)
+	if lb == nil {
+		return
+	}
+
+	defer lbLogout(me, lb, r)
+
+	if !checkIfMatch(me, host, be.BackendName, w, r, lb) {
+		return
+	}
+
+	if len(be.ServiceGroups) < 1 {
+		// deleting server touches every group it is still member of
+		backendTab, errList := lb.BackendList()
+		if errList != nil {
+			sendDriverError(me, host, "backend list", errList, w, r)
+			return
+		}
+		if !authorize(me, host, policyDelete, backendGroups(backendTab[be.BackendName]), w, r) {
+			return
+		}
+	}
+
+	if !drain {
+		r = auditStartList(r, lb, plan, vendor, host, be.BackendName)
+	}
+
+	if len(be.ServiceGroups) < 1 {
+		// service groups not provided - delete unlinked server
+
+		errDelete := lb.BackendDelete(be.BackendName)
+		if errDelete != nil {
+			sendWriteError(me, debug, host, "delete server", errDelete, w, r, lb)
+			return
+		}
+		sendWriteResult(me, debug, plan, w, r, lb, "server deleted", 0)
+		return
+	}
+
+	// service groups provided - unlink server from groups
+
+	sgList, errList := lb.ServiceGroupList() // all available groups
+	if errList != nil {
+		sendDriverError(me, host, "unlink server: group list", errList, w, r)
+		return
+	}
+
+	if name, found := findGroups(sgList, be.ServiceGroups); !found {
+		log.Printf(me+": method=%s url=%s from=%s unlink server: group=%s not found", r.Method, r.URL.Path, r.RemoteAddr, name)
+		http.Error(w, host+" bad gateway - unlink server: group not found", http.StatusBadGateway) // 502
+		return
+	}
+
+	if drain {
+		if !plan {
+			startDrain(debug, dry, vendor, host, be, timeout, w, r, username, password)
+			return
+		}
+		// plan: member disable, then unlink
+		if _, _, errDisable := drainDisable(lb, be); errDisable != nil {
+			sendDriverError(me, host, "drain: disable members", errDisable, w, r)
+			return
+		}
+	}
+
+	errCount, errUnlink := lb.BackendUnlink(be)
+	if errUnlink != nil {
+		sendWriteError(me, debug, host, "unlink server", errUnlink, w, r, lb)
+		return
+	}
+
+	sendWriteResult(me, debug, plan, w, r, lb, "server unlinked", errCount)
+}
+
+func nodeBackendPost(debug, dry bool, vendor string, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+	me := "nodeBackendPost"
+
+	var be backend
+
+	if errDecode := decodeRequestBody(debug, w, r, &be); errDecode != nil {
+		return
+	}
+
+	if !backendPathName(me, fields, &be, w, r) {
+		return
+	}
+
+	if be.BackendName == "" {
+		sendBadRequest(me, "missing backend name", w, r)
+		return
+	}
+
+	// A10 API for slb.server.update requires server address
+	if be.BackendAddress == "" {
+		sendBadRequest(me, "missing backend address", w, r)
+		return
+	}
+
+	if errState := checkSettings(be); errState != nil {
+		sendBadRequest(me, errState.Error(), w, r)
+		return
+	}
+
+	host := fields[0]
+
+	if len(be.ServiceGroups) > 0 && !authorize(me, host, policyLink, groupNames(be.ServiceGroups), w, r) {
+		return
+	}
+
+	plan := clientPlan(r)
+
+	defer writeLock(host, plan)()
+
+	lb := lbLogin(me, vendor, host, lbOptions{Debug: debug, Dry: dry, Plan: plan}, username, password, w, r)
+	if lb == nil {
+		return
+	}
+
+	defer lbLogout(me, lb, r)
+
+	if !checkIfMatch(me, host, be.BackendName, w, r, lb) {
+		return
+	}
+
+	// find groups linked to backend server
+
+	if len(be.ServiceGroups) > 0 {
+		sgList, errList := lb.ServiceGroupList() // all available groups
+		if errList != nil {
+			sendDriverError(me, host, "link server: group list", errList, w, r)
+			return
+		}
+
+		if name, found := findGroups(sgList, be.ServiceGroups); !found {
+			log.Printf(me+": method=%s url=%s from=%s link server: group=%s not found", r.Method, r.URL.Path, r.RemoteAddr, name)
+			http.Error(w, host+" bad gateway - link server: group not found", http.StatusBadGateway) // 502
+			return
+		}
+	}
+
+	// create or update server?
+	backendTab, errList := lb.BackendList()
+	if errList != nil {
+		sendDriverError(me, host, "backend list", errList, w, r)
+		return
+	}
+	current, serverFound := backendTab[be.BackendName]
+
+	inheritSettings(&be, current) // states and member settings not given keep current values
+
+	serverOp := policyCreate
+	if serverFound {
+		serverOp = policyUpdate
+	}
+	if !authorize(me, host, serverOp, backendGroups(current, &be), w, r) {
+		return
+	}
+
+	if !plan {
+		r = auditStart(r, lb, vendor, host, be.BackendName, current)
+	}
+
+	// create or update server
+
+	if serverFound {
+		// server exists - update
+		errUpdate := lb.BackendUpdate(be)
+		if errUpdate != nil {
+			sendWriteError(me, debug, host, "update server", errUpdate, w, r, lb)
+			return
+		}
+	} else {
+		// server does not exist - create
+		errCreate := lb.BackendCreate(be)
+		if errCreate != nil {
+			sendWriteError(me, debug, host, "create server", errCreate, w, r, lb)
+			return
+		}
+	}
+
+	if len(be.ServiceGroups) < 1 {
+		// service groups not provided - create/update server
+		if serverFound {
+			sendWriteResult(me, debug, plan, w, r, lb, "server updated", 0)
+		} else {
+			sendWriteResult(me, debug, plan, w, r, lb, "server created", 0)
+		}
+		return
+	}
+
+	// service groups provided - link server to groups
+
+	errCount, errLink := lb.BackendLink(be)
+	if errLink != nil {
+		sendWriteError(me, debug, host, "link server", errLink, w, r, lb)
+		return
+	}
+
+	// members already linked keep their state on link, new members get settings after link
+	if changes := memberChanges(current, be); len(changes) > 0 {
+		count, errMembers := lb.MemberUpdate(backend{BackendName: be.BackendName, ServiceGroups: changes})
+		if errMembers != nil {
+			sendWriteError(me, debug, host, "member update", errMembers, w, r, lb)
+			return
+		}
+		errCount += count
+	}
+
+	sendWriteResult(me, debug, plan, w, r, lb, "server linked", errCount)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+)
+
+// GET /backend/ query filters:
+// ?address=1.1.1.1 ?group=sg1 ?vserver=vs1 ?port=80
+// Repeated values of one filter match any of them, distinct filters must all match.
+
+var backendFilters = map[string]func(b *backend, value string) bool{
+	"address": func(b *backend, value string) bool { return b.BackendAddress == value },
+	"group": func(b *backend, value string) bool {
+		for _, sg := range b.ServiceGroups {
+			if sg.Name == value {
+				return true
+			}
+		}
+		return false
+	},
+	"vserver": func(b *backend, value string) bool {
+		for _, vs := range b.VirtualServers {
+			if vs.Name == value {
+				return true
+			}
+		}
+		return false
+	},
+	"port": func(b *backend, value string) bool {
+		for _, p := range b.BackendPorts {
+			if p.Port == value {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// backendMatch reports whether backend satisfies query filters
+func backendMatch(b *backend, query url.Values) bool {
+FILTER:
+	for name, match := range backendFilters {
+		values, found := query[name]
+		if !found {
+			continue
+		}
+		for _, v := range values {
+			if match(b, v) {
+				continue FILTER
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// filterBackends returns backends matching query filters, sorted by name
+func filterBackends(tab map[string]*backend, query url.Values) []*backend {
+	list := []*backend{}
+	for _, b := range tab {
+		if backendMatch(b, query) {
+			sortBackend(b)
+			list = append(list, b)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].BackendName < list[j].BackendName })
+	return list
+}
+
+// sortBackend sorts backend lists, since devices (and driver maps) do not keep stable order
+func sortBackend(b *backend) {
+	for _, vs := range b.VirtualServers {
+		vp := vs.VirtualPorts
+		sort.Slice(vp, func(i, j int) bool {
+			if vp[i].Port != vp[j].Port {
+				return vp[i].Port < vp[j].Port
+			}
+			if vp[i].Protocol != vp[j].Protocol {
+				return vp[i].Protocol < vp[j].Protocol
+			}
+			return vp[i].ServiceGroup < vp[j].ServiceGroup
+		})
+	}
+	sort.Slice(b.VirtualServers, func(i, j int) bool { return b.VirtualServers[i].Name < b.VirtualServers[j].Name })
+
+	for _, sg := range b.ServiceGroups {
+		m := sg.Members
+		sort.Slice(m, func(i, j int) bool {
+			if m[i].Name != m[j].Name {
+				return m[i].Name < m[j].Name
+			}
+			return m[i].Port < m[j].Port
+		})
+	}
+	sort.Slice(b.ServiceGroups, func(i, j int) bool { return b.ServiceGroups[i].Name < b.ServiceGroups[j].Name })
+
+	p := b.BackendPorts
+	sort.Slice(p, func(i, j int) bool {
+		if p[i].Port != p[j].Port {
+			return p[i].Port < p[j].Port
+		}
+		return p[i].Protocol < p[j].Protocol
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestFilterBackends(t *testing.T) {
+	tab := map[string]*backend{
+		"s2": {BackendName: "s2", BackendAddress: "2.2.2.2", BackendPorts: []backendPort{{Port: "443", Protocol: "tcp"}, {Port: "80", Protocol: "tcp"}},
+			ServiceGroups: []backendServiceGroup{{Name: "sg2"}, {Name: "sg1"}}},
+		"s1": {BackendName: "s1", BackendAddress: "1.1.1.1", BackendPorts: []backendPort{{Port: "80", Protocol: "tcp"}},
+			ServiceGroups: []backendServiceGroup{{Name: "sg1"}}},
+		"s3": {BackendName: "s3", BackendAddress: "3.3.3.3"},
+	}
+
+	table := []struct {
+		query string
+		names []string
+	}{
+		{"", []string{"s1", "s2", "s3"}},
+		{"address=2.2.2.2", []string{"s2"}},
+		{"group=sg1", []string{"s1", "s2"}},
+		{"group=sg1&port=443", []string{"s2"}},
+		{"address=1.1.1.1&address=3.3.3.3", []string{"s1", "s3"}},
+		{"vserver=vs1", []string{}},
+	}
+
+	for _, e := range table {
+		query, _ := url.ParseQuery(e.query)
+		list := filterBackends(tab, query)
+		var names []string
+		for _, b := range list {
+			names = append(names, b.BackendName)
+		}
+		if len(names) != len(e.names) {
+			t.Errorf("query=[%s]: expected=%v got=%v", e.query, e.names, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != e.names[i] {
+				t.Errorf("query=[%s]: expected=%v got=%v", e.query, e.names, names)
+				break
+			}
+		}
+	}
+
+	s2 := tab["s2"]
+	if s2.ServiceGroups[0].Name != "sg1" || s2.BackendPorts[0].Port != "443" {
+		t.Errorf("s2 not sorted: groups=%v ports=%v", s2.ServiceGroups, s2.BackendPorts)
+	}
+}
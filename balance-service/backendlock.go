@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Writes to the same device are serialized in-process, since link/unlink
+// rebuild whole service group member lists (read-modify-write).
+
+var deviceLocks = struct {
+	mutex sync.Mutex
+	tab   map[string]*sync.Mutex // host => lock
+}{tab: map[string]*sync.Mutex{}}
+
+// lockDevice waits for exclusive write access to device host, returning unlock func
+func lockDevice(host string) func() {
+	deviceLocks.mutex.Lock()
+	m, found := deviceLocks.tab[host]
+	if !found {
+		m = &sync.Mutex{}
+		deviceLocks.tab[host] = m
+	}
+	deviceLocks.mutex.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
+
+// writeLock serializes write request to device host. Plan mode only reads device, hence is not serialized.
+func writeLock(host string, plan bool) func() {
+	if plan {
+		return func() {}
+	}
+	return lockDevice(host)
+}
+
+// backendETag is the entity tag for backend state, empty for missing backend
+func backendETag(b *backend) string {
+	if b == nil {
+		return ""
+	}
+	sortBackend(b)
+	buf, errMarshal := json.Marshal(b)
+	if errMarshal != nil {
+		log.Printf("backendETag: backend=%s json error: %v", b.BackendName, errMarshal)
+		return ""
+	}
+	sum := sha256.Sum256(buf)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatch checks If-Match header value against current etag (empty for missing resource)
+func etagMatch(ifMatch, etag string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" && etag != "" {
+			return true
+		}
+		if strings.TrimPrefix(tag, "W/") == etag && etag != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// backendPathName takes backend name from /backend/<name>, checking it against body backend name
+func backendPathName(me string, fields []string, be *backend, w http.ResponseWriter, r *http.Request) bool {
+	if len(fields) < 3 {
+		return true // plain /backend/
+	}
+	name := fields[2]
+	if be.BackendName == "" {
+		be.BackendName = name
+		return true
+	}
+	if be.BackendName != name {
+		sendBadRequest(me, "backend name mismatch: path=["+name+"] body=["+be.BackendName+"]", w, r)
+		return false
+	}
+	return true
+}
+
+// checkIfMatch enforces If-Match header against current backend state.
+// Sends 412 (precondition failed) when client holds stale state.
+func checkIfMatch(me, host, name string, w http.ResponseWriter, r *http.Request, lb loadBalancer) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true // unconditional request
+	}
+
+	backendTab, errList := lb.BackendList()
+	if errList != nil {
+		sendDriverError(me, host, "backend list", errList, w, r)
+		return false
+	}
+
+	etag := backendETag(backendTab[name])
+	if !etagMatch(ifMatch, etag) {
+		log.Printf(me+": method=%s url=%s from=%s backend=%s If-Match=[%s] ETag=[%s] precondition failed", r.Method, r.URL.Path, r.RemoteAddr, name, ifMatch, etag)
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.Error(w, "precondition failed - backend changed: "+name, http.StatusPreconditionFailed) // 412
+		return false
+	}
+
+	return true
+}
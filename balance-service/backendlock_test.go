@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBackendETag(t *testing.T) {
+	b1 := &backend{BackendName: "s1", BackendAddress: "1.1.1.1", ServiceGroups: []backendServiceGroup{{Name: "sg2"}, {Name: "sg1"}}}
+	b2 := &backend{BackendName: "s1", BackendAddress: "1.1.1.1", ServiceGroups: []backendServiceGroup{{Name: "sg1"}, {Name: "sg2"}}}
+	b3 := &backend{BackendName: "s1", BackendAddress: "2.2.2.2"}
+
+	etag1 := backendETag(b1)
+	if etag1 == "" {
+		t.Fatalf("empty etag")
+	}
+	if etag1 != backendETag(b2) {
+		t.Errorf("etag depends on list order")
+	}
+	if etag1 == backendETag(b3) {
+		t.Errorf("etag ignores address change")
+	}
+	if backendETag(nil) != "" {
+		t.Errorf("missing backend must have empty etag")
+	}
+
+	table := []struct {
+		ifMatch string
+		etag    string
+		match   bool
+	}{
+		{etag1, etag1, true},
+		{`"other", ` + etag1, etag1, true},
+		{"W/" + etag1, etag1, true},
+		{`"other"`, etag1, false},
+		{"*", etag1, true},
+		{"*", "", false},
+		{etag1, "", false},
+	}
+
+	for i, e := range table {
+		if m := etagMatch(e.ifMatch, e.etag); m != e.match {
+			t.Errorf("case %d: If-Match=[%s] ETag=[%s] expected=%v got=%v", i, e.ifMatch, e.etag, e.match, m)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// PUT /backend/ body is the complete desired state of one backend:
+// address, ports, group memberships and states (empty state keeps current state).
+// Virtual servers are derived from groups, hence ignored.
+
+// backendDiff holds the changes required to reach desired backend state
+type backendDiff struct {
+	Create  bool                  // backend missing - create
+	Update  bool                  // address, ports or server state changed - update
+	Link    []backendServiceGroup // groups to link (new groups or changed members)
+	Unlink  []backendServiceGroup // groups to unlink
+	Prune   []backendServiceGroup // linked groups with members on removed ports - current members on kept ports
+	Members []backendServiceGroup // members with changed state or settings (new members: settings only)
+}
+
+func portKeys(ports []backendPort) []string {
+	var keys []string
+	for _, p := range ports {
+		keys = append(keys, p.Port+","+p.Protocol)
+	}
+	return keys
+}
+
+func memberKeys(members []backendSGMember) []string {
+	var keys []string
+	for _, m := range members {
+		keys = append(keys, m.Name+","+m.Port)
+	}
+	return keys
+}
+
+func groupNames(groups []backendServiceGroup) []string {
+	var names []string
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+func findGroup(groups []backendServiceGroup, name string) backendServiceGroup {
+	for _, g := range groups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return backendServiceGroup{}
+}
+
+// diffBackend compares current backend state (nil if missing) against wanted state
+func diffBackend(current *backend, wanted backend) backendDiff {
+
+	var diff backendDiff
+
+	var currentGroups []backendServiceGroup
+
+	var portsDel []string
+
+	if current == nil {
+		diff.Create = true
+	} else {
+		currentGroups = current.ServiceGroups
+		var portsAdd []string
+		portsDel, portsAdd, _ = compareSets(portKeys(current.BackendPorts), portKeys(wanted.BackendPorts))
+		diff.Update = current.BackendAddress != wanted.BackendAddress || len(portsDel) > 0 || len(portsAdd) > 0 || serverStateChanged(current, wanted)
+	}
+
+	groupsUnlink, groupsLink, groupsBoth := compareSets(groupNames(currentGroups), groupNames(wanted.ServiceGroups))
+
+	sort.Strings(groupsUnlink)
+	sort.Strings(groupsLink)
+	sort.Strings(groupsBoth)
+
+	for _, name := range groupsUnlink {
+		diff.Unlink = append(diff.Unlink, findGroup(currentGroups, name))
+	}
+
+	for _, name := range groupsLink {
+		diff.Link = append(diff.Link, findGroup(wanted.ServiceGroups, name))
+	}
+
+	// groups in both sets are relinked only when members changed
+	for _, name := range groupsBoth {
+		g := findGroup(wanted.ServiceGroups, name)
+		membersDel, membersAdd, _ := compareSets(memberKeys(findGroup(currentGroups, name).Members), memberKeys(g.Members))
+		if len(membersDel) == 0 && len(membersAdd) == 0 {
+			continue
+		}
+		diff.Link = append(diff.Link, g)
+		if prune, found := pruneMembers(findGroup(currentGroups, name), wanted.BackendPorts); len(portsDel) > 0 && found {
+			diff.Prune = append(diff.Prune, prune)
+		}
+	}
+
+	diff.Members = memberChanges(current, wanted)
+
+	return diff
+}
+
+// pruneMembers drops members on ports missing from ports, since the device refuses to remove ports still in use
+func pruneMembers(g backendServiceGroup, ports []backendPort) (backendServiceGroup, bool) {
+	prune := backendServiceGroup{Name: g.Name, Protocol: g.Protocol}
+	for _, m := range g.Members {
+		for _, p := range ports {
+			if p.Port == m.Port {
+				prune.Members = append(prune.Members, m)
+				break
+			}
+		}
+	}
+	return prune, len(prune.Members) < len(g.Members)
+}
+
+func nodeBackendPut(debug, dry bool, vendor string, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+	me := "nodeBackendPut"
+
+	var be backend
+
+	if errDecode := decodeRequestBody(debug, w, r, &be); errDecode != nil {
+		return
+	}
+
+	if !backendPathName(me, fields, &be, w, r) {
+		return
+	}
+
+	if be.BackendName == "" {
+		sendBadRequest(me, "missing backend name", w, r)
+		return
+	}
+
+	// A10 API for slb.server.update requires server address
+	if be.BackendAddress == "" {
+		sendBadRequest(me, "missing backend address", w, r)
+		return
+	}
+
+	if errState := checkSettings(be); errState != nil {
+		sendBadRequest(me, errState.Error(), w, r)
+		return
+	}
+
+	host := fields[0]
+
+	plan := clientPlan(r)
+
+	defer writeLock(host, plan)()
+
+	lb := lbLogin(me, vendor, host, lbOptions{Debug: debug, Dry: dry, Plan: plan}, username, password, w, r)
+	if lb == nil {
+		return
+	}
+
+	defer lbLogout(me, lb, r)
+
+	if !checkIfMatch(me, host, be.BackendName, w, r, lb) {
+		return
+	}
+
+	backendTab, errList := lb.BackendList()
+	if errList != nil {
+		sendDriverError(me, host, "backend list", errList, w, r)
+		return
+	}
+
+	inheritSettings(&be, backendTab[be.BackendName])
+
+	diff := diffBackend(backendTab[be.BackendName], be)
+
+	log.Printf(me+": backend=%s create=%v update=%v link=%v unlink=%v members=%v", be.BackendName, diff.Create, diff.Update, groupNames(diff.Link), groupNames(diff.Unlink), groupNames(diff.Members))
+
+	if !authorizeDiff(me, host, backendTab[be.BackendName], be, diff, w, r) {
+		return
+	}
+
+	if !plan {
+		r = auditStart(r, lb, vendor, host, be.BackendName, backendTab[be.BackendName])
+	}
+
+	errCount, applied := applyBackendDiff(me, debug, host, be, diff, w, r, lb)
+	if !applied {
+		return
+	}
+
+	sendWriteResult(me, debug, plan, w, r, lb, fmt.Sprintf("server reconciled - create:%v update:%v link:%d unlink:%d members:%d", diff.Create, diff.Update, len(diff.Link), len(diff.Unlink), len(diff.Members)), errCount)
+}
+
+// applyBackendDiff performs changes in diff to reach wanted backend state.
+// Failures are reported to client, returning false.
+func applyBackendDiff(me string, debug bool, host string, be backend, diff backendDiff, w http.ResponseWriter, r *http.Request, lb loadBalancer) (int, bool) {
+	if len(diff.Link) > 0 {
+		sgList, errGroups := lb.ServiceGroupList() // all available groups
+		if errGroups != nil {
+			sendDriverError(me, host, "link server: group list", errGroups, w, r)
+			return 0, false
+		}
+
+		if name, found := findGroups(sgList, diff.Link); !found {
+			log.Printf(me+": method=%s url=%s from=%s link server: group=%s not found", r.Method, r.URL.Path, r.RemoteAddr, name)
+			http.Error(w, host+" bad gateway - link server: group not found", http.StatusBadGateway) // 502
+			return 0, false
+		}
+	}
+
+	// order matters: groups must drop members before server drops their ports,
+	// and server must have new ports before groups link them
+
+	if diff.Create {
+		if errCreate := lb.BackendCreate(be); errCreate != nil {
+			sendWriteError(me, debug, host, "create server", errCreate, w, r, lb)
+			return 0, false
+		}
+	}
+
+	var errCount int
+
+	if len(diff.Unlink) > 0 {
+		unlink := backend{BackendName: be.BackendName, ServiceGroups: diff.Unlink}
+		count, errUnlink := lb.BackendUnlink(unlink)
+		if errUnlink != nil {
+			sendWriteError(me, debug, host, "unlink server", errUnlink, w, r, lb)
+			return 0, false
+		}
+		errCount += count
+	}
+
+	for _, g := range diff.Prune {
+		prune := backend{BackendName: be.BackendName, ServiceGroups: []backendServiceGroup{g}}
+		var count int
+		var errPrune error
+		if len(g.Members) == 0 {
+			count, errPrune = lb.BackendUnlink(prune)
+		} else {
+			count, errPrune = lb.BackendLink(prune)
+		}
+		if errPrune != nil {
+			sendWriteError(me, debug, host, "unlink removed ports", errPrune, w, r, lb)
+			return 0, false
+		}
+		errCount += count
+	}
+
+	if diff.Update {
+		if errUpdate := lb.BackendUpdate(be); errUpdate != nil {
+			sendWriteError(me, debug, host, "update server", errUpdate, w, r, lb)
+			return 0, false
+		}
+	}
+
+	if len(diff.Link) > 0 {
+		link := backend{BackendName: be.BackendName, ServiceGroups: diff.Link}
+		count, errLink := lb.BackendLink(link)
+		if errLink != nil {
+			sendWriteError(me, debug, host, "link server", errLink, w, r, lb)
+			return 0, false
+		}
+		errCount += count
+	}
+
+	if len(diff.Members) > 0 {
+		members := backend{BackendName: be.BackendName, ServiceGroups: diff.Members}
+		count, errMembers := lb.MemberUpdate(members)
+		if errMembers != nil {
+			sendWriteError(me, debug, host, "member update", errMembers, w, r, lb)
+			return 0, false
+		}
+		errCount += count
+	}
+
+	return errCount, true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDiffBackendCreate(t *testing.T) {
+	wanted := backend{BackendName: "s1", BackendAddress: "2.2.2.2",
+		ServiceGroups: []backendServiceGroup{{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80"}}}}}
+	diff := diffBackend(nil, wanted)
+	if !diff.Create {
+		t.Errorf("missing create")
+	}
+	if diff.Update {
+		t.Errorf("unexpected update")
+	}
+	if len(diff.Link) != 1 || diff.Link[0].Name != "g1" {
+		t.Errorf("wrong link: %v", diff.Link)
+	}
+	if len(diff.Unlink) != 0 {
+		t.Errorf("unexpected unlink: %v", diff.Unlink)
+	}
+}
+
+func TestDiffBackendReconcile(t *testing.T) {
+	current := &backend{BackendName: "s1", BackendAddress: "2.2.2.2",
+		BackendPorts: []backendPort{{Port: "80", Protocol: "tcp"}},
+		ServiceGroups: []backendServiceGroup{
+			{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80"}}},
+			{Name: "g2", Members: []backendSGMember{{Name: "s1", Port: "80"}}},
+			{Name: "g3", Members: []backendSGMember{{Name: "s1", Port: "80"}}},
+		}}
+	wanted := backend{BackendName: "s1", BackendAddress: "2.2.2.2",
+		BackendPorts: []backendPort{{Port: "80", Protocol: "tcp"}},
+		ServiceGroups: []backendServiceGroup{
+			{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80"}}},   // unchanged
+			{Name: "g2", Members: []backendSGMember{{Name: "s1", Port: "8080"}}}, // changed
+			{Name: "g4", Members: []backendSGMember{{Name: "s1", Port: "80"}}},   // new
+		}}
+	diff := diffBackend(current, wanted)
+	if diff.Create || diff.Update {
+		t.Errorf("unexpected create=%v update=%v", diff.Create, diff.Update)
+	}
+	if names := groupNames(diff.Link); len(names) != 2 || names[0] != "g4" || names[1] != "g2" {
+		t.Errorf("wrong link: %v", names)
+	}
+	if names := groupNames(diff.Unlink); len(names) != 1 || names[0] != "g3" {
+		t.Errorf("wrong unlink: %v", names)
+	}
+}
+
+func TestDiffBackendUpdatePorts(t *testing.T) {
+	current := &backend{BackendName: "s1", BackendAddress: "2.2.2.2", BackendPorts: []backendPort{{Port: "80", Protocol: "tcp"}}}
+	wanted := backend{BackendName: "s1", BackendAddress: "2.2.2.2", BackendPorts: []backendPort{{Port: "443", Protocol: "tcp"}}}
+	if diff := diffBackend(current, wanted); !diff.Update {
+		t.Errorf("missing update")
+	}
+}
+
+func TestDiffBackendPrune(t *testing.T) {
+	current := &backend{BackendName: "s1", BackendAddress: "2.2.2.2",
+		BackendPorts: []backendPort{{Port: "80", Protocol: "tcp"}, {Port: "443", Protocol: "tcp"}},
+		ServiceGroups: []backendServiceGroup{
+			{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80"}, {Name: "s1", Port: "443"}}},
+			{Name: "g2", Members: []backendSGMember{{Name: "s1", Port: "443"}}},
+		}}
+	wanted := backend{BackendName: "s1", BackendAddress: "2.2.2.2",
+		BackendPorts: []backendPort{{Port: "80", Protocol: "tcp"}, {Port: "8080", Protocol: "tcp"}},
+		ServiceGroups: []backendServiceGroup{
+			{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80"}}},
+			{Name: "g2", Members: []backendSGMember{{Name: "s1", Port: "8080"}}},
+		}}
+	diff := diffBackend(current, wanted)
+	if !diff.Update {
+		t.Errorf("missing update")
+	}
+	if len(diff.Prune) != 2 || len(diff.Prune[0].Members) != 1 || diff.Prune[0].Members[0].Port != "80" || len(diff.Prune[1].Members) != 0 {
+		t.Errorf("wrong prune: %+v", diff.Prune)
+	}
+}
+
+func TestOpStatus(t *testing.T) {
+	ok := deviceOp{Operation: "group update", Target: "sg1", Status: opOK}
+	failed := deviceOp{Operation: "group update", Target: "sg2", Status: opFailed, Error: "timeout"}
+
+	table := []struct {
+		ops      []deviceOp
+		errCount int
+		status   int
+	}{
+		{nil, 0, http.StatusOK},
+		{[]deviceOp{ok}, 0, http.StatusOK},
+		{[]deviceOp{ok}, 1, http.StatusMultiStatus},
+		{[]deviceOp{ok, failed}, 1, http.StatusMultiStatus},
+		{[]deviceOp{failed}, 1, http.StatusBadGateway},
+	}
+
+	for i, e := range table {
+		if status := opStatus(e.ops, e.errCount); status != e.status {
+			t.Errorf("case %d: expected status=%d got=%d", i, e.status, status)
+		}
+	}
+}
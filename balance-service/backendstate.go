@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Admin state of backend, backend ports and group members.
+// Maintenance takes a server out of rotation without removing its configuration.
+//
+// State    | A10                | F5 node, pool member
+// ---------+--------------------+---------------------------------------
+// enabled  | status 1 (enable)  | session user-enabled, state user-up
+// disabled | status 0 (disable) | session user-disabled, state user-up
+// offline  | status 0 (disable) | session user-disabled, state user-down
+//
+// Disabled objects get no new connections, but keep current (and persistent) ones.
+// Offline (forced offline) also refuses persistent connections. A10 has no forced offline, hence offline is disabled there.
+// F5 ports have no state, since backend ports are derived from pool members.
+//
+// Group members also carry weight, priority and connection limit:
+//
+// Member          | A10                                | F5 pool member
+// ----------------+------------------------------------+----------------
+// Weight          | server port weight (1-100)         | ratio
+// Priority        | member priority (1-16)             | priorityGroup
+// ConnectionLimit | server port conn_limit             | connectionLimit
+//
+// A10 keeps weight and connection limit in the server port, hence they are shared by every group the port is member of.
+//
+// Empty state and zero settings in requests keep current values (device defaults for new objects).
+const (
+	stateEnabled  = "enabled"
+	stateDisabled = "disabled"
+	stateOffline  = "offline"
+)
+
+// stateOf maps empty state to enabled
+func stateOf(state string) string {
+	if state == "" {
+		return stateEnabled
+	}
+	return state
+}
+
+func checkState(label, state string) error {
+	switch state {
+	case "", stateEnabled, stateDisabled, stateOffline:
+		return nil
+	}
+	return fmt.Errorf("%s: bad state=[%s] - expecting %s, %s or %s", label, state, stateEnabled, stateDisabled, stateOffline)
+}
+
+// checkSettings validates every state and member setting in backend request
+func checkSettings(be backend) error {
+	if err := checkState("backend "+be.BackendName, be.State); err != nil {
+		return err
+	}
+	for _, p := range be.BackendPorts {
+		if err := checkState("port "+p.Port+","+p.Protocol, p.State); err != nil {
+			return err
+		}
+	}
+	for _, g := range be.ServiceGroups {
+		for _, m := range g.Members {
+			label := "group " + g.Name + " member " + m.Name + "," + m.Port
+			if err := checkState(label, m.State); err != nil {
+				return err
+			}
+			if m.Weight < 0 || m.Priority < 0 || m.ConnectionLimit < 0 {
+				return fmt.Errorf("%s: negative weight=%d priority=%d connection limit=%d", label, m.Weight, m.Priority, m.ConnectionLimit)
+			}
+		}
+	}
+	return nil
+}
+
+// findMember finds group member by name and port
+func findMember(members []backendSGMember, name, port string) (backendSGMember, bool) {
+	for _, m := range members {
+		if m.Name == name && m.Port == port {
+			return m, true
+		}
+	}
+	return backendSGMember{}, false
+}
+
+// inheritSettings fills states and member settings missing from be with values from current backend (nil if missing)
+func inheritSettings(be *backend, current *backend) {
+	if current == nil {
+		return
+	}
+
+	if be.State == "" {
+		be.State = current.State
+	}
+
+	ports := make([]backendPort, len(be.BackendPorts))
+	for i, p := range be.BackendPorts {
+		for _, c := range current.BackendPorts {
+			if p.State == "" && p.Port == c.Port && p.Protocol == c.Protocol {
+				p.State = c.State
+			}
+		}
+		ports[i] = p
+	}
+	be.BackendPorts = ports
+
+	groups := make([]backendServiceGroup, len(be.ServiceGroups))
+	for i, g := range be.ServiceGroups {
+		cg := findGroup(current.ServiceGroups, g.Name)
+		members := make([]backendSGMember, len(g.Members))
+		for j, m := range g.Members {
+			if c, found := findMember(cg.Members, m.Name, m.Port); found {
+				m = inheritMember(m, c)
+			}
+			members[j] = m
+		}
+		g.Members = members
+		groups[i] = g
+	}
+	be.ServiceGroups = groups
+}
+
+// inheritMember fills state and settings missing from m with values from current member
+func inheritMember(m, current backendSGMember) backendSGMember {
+	if m.State == "" {
+		m.State = current.State
+	}
+	if m.Weight == 0 {
+		m.Weight = current.Weight
+	}
+	if m.Priority == 0 {
+		m.Priority = current.Priority
+	}
+	if m.ConnectionLimit == 0 {
+		m.ConnectionLimit = current.ConnectionLimit
+	}
+	return m
+}
+
+// memberDetail describes member state and settings for operation detail
+func memberDetail(m backendSGMember) []string {
+	detail := []string{m.Name + "," + m.Port}
+	if m.State != "" {
+		detail = append(detail, m.State)
+	}
+	if m.Weight != 0 {
+		detail = append(detail, fmt.Sprintf("weight=%d", m.Weight))
+	}
+	if m.Priority != 0 {
+		detail = append(detail, fmt.Sprintf("priority=%d", m.Priority))
+	}
+	if m.ConnectionLimit != 0 {
+		detail = append(detail, fmt.Sprintf("connection_limit=%d", m.ConnectionLimit))
+	}
+	return detail
+}
+
+// memberChange returns wanted member carrying only state and settings changed from current member
+func memberChange(current, wanted backendSGMember) (backendSGMember, bool) {
+	change := backendSGMember{Name: wanted.Name, Port: wanted.Port}
+	if stateOf(current.State) != stateOf(wanted.State) {
+		change.State = stateOf(wanted.State)
+	}
+	if wanted.Weight != 0 && wanted.Weight != current.Weight {
+		change.Weight = wanted.Weight
+	}
+	if wanted.Priority != 0 && wanted.Priority != current.Priority {
+		change.Priority = wanted.Priority
+	}
+	if wanted.ConnectionLimit != 0 && wanted.ConnectionLimit != current.ConnectionLimit {
+		change.ConnectionLimit = wanted.ConnectionLimit
+	}
+	changed := change.State != "" || change.Weight != 0 || change.Priority != 0 || change.ConnectionLimit != 0
+	return change, changed
+}
+
+// memberChanges returns groups listing members of wanted with state or settings changed from current backend (nil if missing).
+// Members missing from current backend get their state on link, hence only their settings are listed.
+func memberChanges(current *backend, wanted backend) []backendServiceGroup {
+	var changes []backendServiceGroup
+	for _, g := range wanted.ServiceGroups {
+		var cg backendServiceGroup
+		if current != nil {
+			cg = findGroup(current.ServiceGroups, g.Name)
+		}
+		change := backendServiceGroup{Name: g.Name, Protocol: g.Protocol}
+		for _, m := range g.Members {
+			c, found := findMember(cg.Members, m.Name, m.Port)
+			if !found {
+				c = backendSGMember{Name: m.Name, Port: m.Port, State: m.State}
+			}
+			if mc, changed := memberChange(c, m); changed {
+				change.Members = append(change.Members, mc)
+			}
+		}
+		if len(change.Members) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// serverStateChanged reports changed state for backend or any backend port present in both current and wanted
+func serverStateChanged(current *backend, wanted backend) bool {
+	if stateOf(current.State) != stateOf(wanted.State) {
+		return true
+	}
+	for _, p := range wanted.BackendPorts {
+		for _, c := range current.BackendPorts {
+			if p.Port == c.Port && p.Protocol == c.Protocol && stateOf(p.State) != stateOf(c.State) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyStates returns copy of current backend with states and member settings given in patch.
+// Ports and members in patch must exist in current backend.
+func applyStates(current backend, patch backend) (backend, error) {
+	wanted := current
+	if patch.State != "" {
+		wanted.State = patch.State
+	}
+
+	wanted.BackendPorts = append([]backendPort{}, current.BackendPorts...)
+	for _, p := range patch.BackendPorts {
+		found := false
+		for i, c := range wanted.BackendPorts {
+			if p.Port == c.Port && p.Protocol == c.Protocol {
+				if p.State != "" {
+					wanted.BackendPorts[i].State = p.State
+				}
+				found = true
+			}
+		}
+		if !found {
+			return wanted, fmt.Errorf("port not found: %s,%s", p.Port, p.Protocol)
+		}
+	}
+
+	wanted.ServiceGroups = nil
+	for _, g := range current.ServiceGroups {
+		g.Members = append([]backendSGMember{}, g.Members...)
+		wanted.ServiceGroups = append(wanted.ServiceGroups, g)
+	}
+	for _, pg := range patch.ServiceGroups {
+		found := false
+		for _, g := range wanted.ServiceGroups {
+			if g.Name != pg.Name {
+				continue
+			}
+			found = true
+			for _, pm := range pg.Members {
+				if _, memberFound := findMember(g.Members, pm.Name, pm.Port); !memberFound {
+					return wanted, fmt.Errorf("group %s: member not found: %s,%s", g.Name, pm.Name, pm.Port)
+				}
+				for i, m := range g.Members {
+					if m.Name == pm.Name && m.Port == pm.Port {
+						g.Members[i] = inheritMember(pm, m)
+					}
+				}
+			}
+		}
+		if !found {
+			return wanted, fmt.Errorf("group not found: %s", pg.Name)
+		}
+	}
+
+	return wanted, nil
+}
+
+// PATCH /backend/<name> changes only the state of backend and its ports, and the state and settings of group members.
+// Ports and members are matched by port,protocol and name,port, hence must exist.
+// See samples/server_state.yaml.
+func nodeBackendPatch(debug, dry bool, vendor string, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+	me := "nodeBackendPatch"
+
+	var patch backend
+
+	if errDecode := decodeRequestBody(debug, w, r, &patch); errDecode != nil {
+		return
+	}
+
+	if !backendPathName(me, fields, &patch, w, r) {
+		return
+	}
+
+	if patch.BackendName == "" {
+		sendBadRequest(me, "missing backend name", w, r)
+		return
+	}
+
+	if errState := checkSettings(patch); errState != nil {
+		sendBadRequest(me, errState.Error(), w, r)
+		return
+	}
+
+	host := fields[0]
+
+	plan := clientPlan(r)
+
+	defer writeLock(host, plan)()
+
+	lb := lbLogin(me, vendor, host, lbOptions{Debug: debug, Dry: dry, Plan: plan}, username, password, w, r)
+	if lb == nil {
+		return
+	}
+
+	defer lbLogout(me, lb, r)
+
+	if !checkIfMatch(me, host, patch.BackendName, w, r, lb) {
+		return
+	}
+
+	backendTab, errList := lb.BackendList()
+	if errList != nil {
+		sendDriverError(me, host, "backend list", errList, w, r)
+		return
+	}
+
+	current, found := backendTab[patch.BackendName]
+	if !found {
+		log.Printf(me+": method=%s url=%s from=%s backend=%s not found", r.Method, r.URL.Path, r.RemoteAddr, patch.BackendName)
+		http.Error(w, "backend not found: "+patch.BackendName, http.StatusNotFound) // 404
+		return
+	}
+
+	wanted, errApply := applyStates(*current, patch)
+	if errApply != nil {
+		sendBadRequest(me, errApply.Error(), w, r)
+		return
+	}
+
+	diff := diffBackend(current, wanted)
+
+	log.Printf(me+": backend=%s update=%v members=%v", wanted.BackendName, diff.Update, groupNames(diff.Members))
+
+	if !authorizeDiff(me, host, current, wanted, diff, w, r) {
+		return
+	}
+
+	if !plan {
+		r = auditStart(r, lb, vendor, host, wanted.BackendName, current)
+	}
+
+	errCount, applied := applyBackendDiff(me, debug, host, wanted, diff, w, r, lb)
+	if !applied {
+		return
+	}
+
+	sendWriteResult(me, debug, plan, w, r, lb, fmt.Sprintf("server state updated - update:%v groups:%d", diff.Update, len(diff.Members)), errCount)
+}
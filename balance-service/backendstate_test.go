@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestApplyStates(t *testing.T) {
+	current := backend{
+		BackendName:  "s1",
+		BackendPorts: []backendPort{{Port: "80", Protocol: "tcp", State: stateEnabled}},
+		ServiceGroups: []backendServiceGroup{
+			{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80", State: stateEnabled}}},
+		},
+	}
+
+	patch := backend{
+		State:         stateDisabled,
+		ServiceGroups: []backendServiceGroup{{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80", State: stateOffline}}}},
+	}
+
+	wanted, errApply := applyStates(current, patch)
+	if errApply != nil {
+		t.Fatalf("apply: %v", errApply)
+	}
+	if current.ServiceGroups[0].Members[0].State != stateEnabled {
+		t.Errorf("apply: current backend changed: %v", current)
+	}
+
+	diff := diffBackend(&current, wanted)
+	if !diff.Update || len(diff.Link) > 0 || len(diff.Unlink) > 0 || len(diff.Members) != 1 || diff.Members[0].Members[0].State != stateOffline {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+
+	if _, errMissing := applyStates(current, backend{BackendPorts: []backendPort{{Port: "443", Protocol: "tcp"}}}); errMissing == nil {
+		t.Errorf("missing port: expected error")
+	}
+	if _, errMissing := applyStates(current, backend{ServiceGroups: []backendServiceGroup{{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "8080"}}}}}); errMissing == nil {
+		t.Errorf("missing member: expected error")
+	}
+
+	// states omitted from desired state are kept
+	put := backend{BackendName: "s1", BackendPorts: []backendPort{{Port: "80", Protocol: "tcp"}}, ServiceGroups: []backendServiceGroup{{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80"}}}}}
+	inheritSettings(&put, &wanted)
+	if put.State != stateDisabled || put.ServiceGroups[0].Members[0].State != stateOffline {
+		t.Errorf("inherit: unexpected states: %+v", put)
+	}
+	if diff := diffBackend(&wanted, put); diff.Update || len(diff.Members) > 0 {
+		t.Errorf("inherit: unexpected diff: %+v", diff)
+	}
+}
+
+func TestE2EState(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_put.yaml", nil), http.StatusOK)
+
+	expectStatus(t, "bad state", e.request(http.MethodPatch, "backend/s1", []byte(`{"State": "down"}`), nil), http.StatusBadRequest)
+	expectStatus(t, "missing member", e.request(http.MethodPatch, "backend/s1", []byte(`{"ServiceGroups": [{"Name": "group1", "Members": [{"Name": "s1", "Port": "9999", "State": "disabled"}]}]}`), nil), http.StatusBadRequest)
+	expectStatus(t, "missing backend", e.request(http.MethodPatch, "backend/s9", []byte(`{"State": "disabled"}`), nil), http.StatusNotFound)
+
+	expectStatus(t, "patch", e.sample(http.MethodPatch, "backend", "server_state.yaml", nil), http.StatusOK)
+
+	state := e.device.State()
+	for _, s := range state.ServerList {
+		if (s.Status == 0) != (s.Name == "s1") {
+			t.Errorf("patch: unexpected server status: %v", s)
+		}
+	}
+	for _, m := range state.ServiceGroupList[0].MemberList {
+		if m.Disabled != (m.Server == "s1" && m.Port == 5555) {
+			t.Errorf("patch: unexpected member status: %v", m)
+		}
+	}
+
+	w := e.request(http.MethodGet, "backend/s1", nil, nil)
+	expectStatus(t, "get", w, http.StatusOK)
+	var b backend
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &b); errJSON != nil {
+		t.Fatalf("get: %v: [%s]", errJSON, w.Body.String())
+	}
+	if b.State != stateDisabled || len(b.BackendPorts) != 2 || b.BackendPorts[0].State != stateEnabled {
+		t.Errorf("get: unexpected states: %+v", b)
+	}
+	// A10 has no forced offline
+	if m, _ := findMember(findGroup(b.ServiceGroups, "group1").Members, "s1", "5555"); m.State != stateDisabled {
+		t.Errorf("get: unexpected member state: %+v", b.ServiceGroups)
+	}
+
+	// reconcile without states keeps states, unlink keeps status of other members
+	expectStatus(t, "put", e.sample(http.MethodPut, "backend", "server_put.yaml", nil), http.StatusOK)
+	expectStatus(t, "disable s0", e.request(http.MethodPatch, "backend/s0", []byte(`{"ServiceGroups": [{"Name": "group1", "Members": [{"Name": "s0", "Port": "8080", "State": "disabled"}]}]}`), nil), http.StatusOK)
+	expectStatus(t, "unlink", e.request(http.MethodDelete, "backend/s1", []byte(`{"ServiceGroups": [{"Name": "group1"}]}`), nil), http.StatusOK)
+	expectStatus(t, "relink", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+
+	state = e.device.State()
+	if state.ServerList[1].Name != "s1" || state.ServerList[1].Status != 0 {
+		t.Errorf("relink: unexpected server: %v", state.ServerList)
+	}
+	for _, m := range state.ServiceGroupList[0].MemberList {
+		if m.Disabled != (m.Server == "s0") {
+			t.Errorf("relink: unexpected member status: %v", m)
+		}
+	}
+
+	// enable server, disable another member
+	expectStatus(t, "enable", e.request(http.MethodPatch, "backend/s1", []byte(`{"State": "enabled", "ServiceGroups": [{"Name": "group1", "Members": [{"Name": "s1", "Port": "3333", "State": "disabled"}]}]}`), nil), http.StatusOK)
+	state = e.device.State()
+	if state.ServerList[1].Status != 1 {
+		t.Errorf("enable: unexpected server: %v", state.ServerList[1])
+	}
+	for _, m := range state.ServiceGroupList[0].MemberList {
+		if m.Disabled != (m.Server == "s0" || m.Port == 3333) {
+			t.Errorf("enable: unexpected member status: %v", m)
+		}
+	}
+}
+
+func TestE2EF5State(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	expectStatus(t, "patch", e.sample(http.MethodPatch, "backend", "server_state.yaml", nil), http.StatusOK)
+
+	state := e.device.State()
+	for _, n := range state.Nodes {
+		if (n.Session == "user-disabled") != (n.Name == "s1") || n.State == "user-down" {
+			t.Errorf("patch: unexpected node: %+v", n)
+		}
+	}
+	for _, m := range state.Pools[0].Members {
+		offline := m.Session == "user-disabled" && m.State == "user-down"
+		if offline != (m.Name == "s1:5555") {
+			t.Errorf("patch: unexpected member: %+v", m)
+		}
+	}
+
+	w := e.request(http.MethodGet, "backend/s1", nil, nil)
+	expectStatus(t, "get", w, http.StatusOK)
+	var b backend
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &b); errJSON != nil {
+		t.Fatalf("get: %v: [%s]", errJSON, w.Body.String())
+	}
+	if m, _ := findMember(findGroup(b.ServiceGroups, "group1").Members, "s1", "5555"); b.State != stateDisabled || m.State != stateOffline {
+		t.Errorf("get: unexpected states: %+v", b)
+	}
+
+	expectStatus(t, "enable", e.request(http.MethodPatch, "backend/s1", []byte(`{"State": "enabled", "ServiceGroups": [{"Name": "group1", "Members": [{"Name": "s1", "Port": "5555", "State": "enabled"}]}]}`), nil), http.StatusOK)
+	for _, n := range e.device.State().Nodes {
+		if n.Session != "monitor-enabled" {
+			t.Errorf("enable: unexpected node: %+v", n)
+		}
+	}
+	for _, m := range e.device.State().Pools[0].Members {
+		if m.Session != "monitor-enabled" || m.State == "user-down" {
+			t.Errorf("enable: unexpected member: %+v", m)
+		}
+	}
+}
+
+func TestMemberChanges(t *testing.T) {
+	current := backend{
+		BackendName: "s1",
+		ServiceGroups: []backendServiceGroup{
+			{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80", State: stateEnabled, Weight: 10, Priority: 1}}},
+		},
+	}
+
+	// settings omitted from desired state are kept
+	wanted := backend{BackendName: "s1", ServiceGroups: []backendServiceGroup{{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80", ConnectionLimit: 500}}}}}
+	inheritSettings(&wanted, &current)
+	if m := wanted.ServiceGroups[0].Members[0]; m.Weight != 10 || m.Priority != 1 || m.ConnectionLimit != 500 {
+		t.Errorf("inherit: unexpected member: %+v", m)
+	}
+
+	changes := memberChanges(&current, wanted)
+	if len(changes) != 1 || len(changes[0].Members) != 1 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	if m := changes[0].Members[0]; m != (backendSGMember{Name: "s1", Port: "80", ConnectionLimit: 500}) {
+		t.Errorf("changes should carry only changed settings: %+v", m)
+	}
+
+	// new members carry settings, but not state (given on link)
+	wanted.ServiceGroups[0].Members = append(wanted.ServiceGroups[0].Members, backendSGMember{Name: "s1", Port: "81", State: stateDisabled, Weight: 5})
+	changes = memberChanges(&current, wanted)
+	if len(changes[0].Members) != 2 || changes[0].Members[1] != (backendSGMember{Name: "s1", Port: "81", Weight: 5}) {
+		t.Errorf("new member: unexpected changes: %+v", changes)
+	}
+
+	if errCheck := checkSettings(backend{ServiceGroups: []backendServiceGroup{{Name: "g1", Members: []backendSGMember{{Name: "s1", Port: "80", Weight: -1}}}}}); errCheck == nil {
+		t.Errorf("negative weight: expected error")
+	}
+}
+
+func TestE2EMemberSettings(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	// A10 member weight needs server port
+	expectStatus(t, "link", e.sample(http.MethodPut, "backend", "server_put.yaml", nil), http.StatusOK)
+	expectStatus(t, "patch", e.request(http.MethodPatch, "backend/s1", []byte(`{"ServiceGroups": [{"Name": "group1", "Members": [{"Name": "s1", "Port": "5555", "Weight": 10, "Priority": 2, "ConnectionLimit": 1000}]}]}`), nil), http.StatusOK)
+
+	state := e.device.State()
+	for _, p := range state.ServerList[1].PortList {
+		if (p.Weight == 10 && p.ConnLimit == 1000) != (p.PortNum == 5555) {
+			t.Errorf("patch: unexpected port: %+v", p)
+		}
+	}
+	for _, m := range state.ServiceGroupList[0].MemberList {
+		if (m.Priority == 2) != (m.Server == "s1" && m.Port == 5555) || m.Disabled {
+			t.Errorf("patch: unexpected member: %+v", m)
+		}
+	}
+
+	// reconcile without settings keeps settings
+	expectStatus(t, "put", e.sample(http.MethodPut, "backend", "server_put.yaml", nil), http.StatusOK)
+
+	w := e.request(http.MethodGet, "backend/s1", nil, nil)
+	expectStatus(t, "get", w, http.StatusOK)
+	var b backend
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &b); errJSON != nil {
+		t.Fatalf("get: %v: [%s]", errJSON, w.Body.String())
+	}
+	if m, _ := findMember(findGroup(b.ServiceGroups, "group1").Members, "s1", "5555"); m.Weight != 10 || m.Priority != 2 || m.ConnectionLimit != 1000 {
+		t.Errorf("get: unexpected member: %+v", b.ServiceGroups)
+	}
+}
+
+func TestE2EF5MemberSettings(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	expectStatus(t, "patch", e.request(http.MethodPatch, "backend/s1", []byte(`{"ServiceGroups": [{"Name": "group1", "Members": [{"Name": "s1", "Port": "5555", "Weight": 10, "Priority": 2, "ConnectionLimit": 1000}]}]}`), nil), http.StatusOK)
+
+	for _, m := range e.device.State().Pools[0].Members {
+		set := m.Ratio == 10 && m.PriorityGroup == 2 && m.ConnectionLimit == 1000
+		if set != (m.Name == "s1:5555") || m.Session != "monitor-enabled" {
+			t.Errorf("patch: unexpected member: %+v", m)
+		}
+	}
+
+	w := e.request(http.MethodGet, "backend/s1", nil, nil)
+	expectStatus(t, "get", w, http.StatusOK)
+	var b backend
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &b); errJSON != nil {
+		t.Fatalf("get: %v: [%s]", errJSON, w.Body.String())
+	}
+	if m, _ := findMember(findGroup(b.ServiceGroups, "group1").Members, "s1", "5555"); m.Weight != 10 || m.Priority != 2 || m.ConnectionLimit != 1000 {
+		t.Errorf("get: unexpected member: %+v", b.ServiceGroups)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A cassette records device traffic into a file (env var CASSETTE_RECORD),
+// or replays it instead of contacting devices (env var CASSETTE_REPLAY).
+// Tests replay cassettes through the same code, see cassette_test.go.
+//
+// Vendor clients (a10go, f5-rest-client) build their own http clients, hence
+// traffic is captured by pointing them to a local HTTPS endpoint per device
+// (see deviceHost), which forwards calls to the device (record) or answers
+// from the file (replay).
+
+// cassetteRedacted replaces secrets in recorded calls
+const cassetteRedacted = "REDACTED"
+
+// cassetteSecrets are query parameters and JSON fields never written to cassettes.
+// Session ids are also normalized, so replayed calls match recorded ones.
+var cassetteSecrets = map[string]bool{
+	"password":   true,
+	"session_id": true,
+	"signature":  true,
+	"token":      true,
+}
+
+// cassetteCall is one recorded device call
+type cassetteCall struct {
+	Host         string `json:"host"`
+	Method       string `json:"method"`
+	URL          string `json:"url"` // path?query
+	RequestBody  string `json:"request_body,omitempty"`
+	Status       int    `json:"status"`
+	ContentType  string `json:"content_type,omitempty"`
+	ResponseBody string `json:"response_body"`
+}
+
+type cassetteTape struct {
+	Calls []cassetteCall `json:"calls"`
+}
+
+type cassette struct {
+	mutex     sync.Mutex
+	file      string
+	tape      cassetteTape
+	answer    func(call cassetteCall, body []byte, w http.ResponseWriter, r *http.Request) // forward and record, or replay
+	endpoints map[string]*cassetteEndpoint                                                 // device host => local endpoint
+}
+
+// cassetteEndpoint is a local HTTPS listener standing for one device
+type cassetteEndpoint struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// deviceCassette, when set, records or replays all device traffic
+var deviceCassette *cassette
+
+// deviceHost returns the address vendor clients should use to reach device host
+func deviceHost(host string) string {
+	if deviceCassette == nil {
+		return host
+	}
+	return deviceCassette.endpoint(host)
+}
+
+// newCassetteRecorder records device calls into file
+func newCassetteRecorder(file string) *cassette {
+	c := &cassette{file: file, endpoints: map[string]*cassetteEndpoint{}}
+	c.answer = c.forward
+	return c
+}
+
+// cassettePlayer replays device calls recorded in a cassette
+type cassettePlayer struct {
+	mutex sync.Mutex
+	tape  cassetteTape
+	used  []bool // calls already served
+}
+
+// newCassettePlayer replays device calls from file instead of contacting devices
+func newCassettePlayer(file string) (*cassette, error) {
+	buf, errRead := ioutil.ReadFile(file)
+	if errRead != nil {
+		return nil, errRead
+	}
+	p := &cassettePlayer{}
+	if errJSON := json.Unmarshal(buf, &p.tape); errJSON != nil {
+		return nil, fmt.Errorf("cassette: %s: %v", file, errJSON)
+	}
+	p.used = make([]bool, len(p.tape.Calls))
+	return &cassette{file: file, answer: p.replay, endpoints: map[string]*cassetteEndpoint{}}, nil
+}
+
+func (p *cassettePlayer) replay(call cassetteCall, body []byte, w http.ResponseWriter, r *http.Request) {
+	me := "cassettePlayer"
+	recorded, found := p.find(call)
+	if !found {
+		log.Printf(me+": host=%s method=%s url=%s: no recorded call", call.Host, call.Method, call.URL)
+		http.Error(w, me+": no recorded call: "+call.Method+" "+call.URL, http.StatusBadGateway)
+		return
+	}
+	if recorded.ContentType != "" {
+		w.Header().Set("Content-Type", recorded.ContentType)
+	}
+	w.WriteHeader(recorded.Status)
+	writeStr(me, w, recorded.ResponseBody)
+}
+
+// find returns the first unused recorded call matching request.
+// Once all matches are used, the last one is served again, hence repeated reads keep working.
+func (p *cassettePlayer) find(call cassetteCall) (cassetteCall, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	last := -1
+	for i, recorded := range p.tape.Calls {
+		if recorded.Host != call.Host || recorded.Method != call.Method || recorded.URL != call.URL || recorded.RequestBody != call.RequestBody {
+			continue
+		}
+		if !p.used[i] {
+			p.used[i] = true
+			return recorded, true
+		}
+		last = i
+	}
+	if last < 0 {
+		return cassetteCall{}, false
+	}
+	return p.tape.Calls[last], true
+}
+
+// endpoint returns local address for device host, starting its listener on first use.
+// Without a listener, calls go straight to the device and are not recorded.
+func (c *cassette) endpoint(host string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, found := c.endpoints[host]
+	if !found {
+		var errListen error
+		e, errListen = c.listen(host)
+		if errListen != nil {
+			log.Printf("cassette: file=%s host=%s: %v - calling device directly", c.file, host, errListen)
+			return host
+		}
+		c.endpoints[host] = e
+		log.Printf("cassette: file=%s host=%s endpoint=%s", c.file, host, e.listener.Addr())
+	}
+	return e.listener.Addr().String()
+}
+
+func (c *cassette) listen(host string) (*cassetteEndpoint, error) {
+	cert, errCert := cassetteCert()
+	if errCert != nil {
+		return nil, errCert
+	}
+	listener, errListen := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if errListen != nil {
+		return nil, errListen
+	}
+	e := &cassetteEndpoint{
+		server:   &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { c.serve(host, w, r) })},
+		listener: listener,
+	}
+	go e.server.Serve(listener)
+	return e, nil
+}
+
+// cassetteCert is a self-signed certificate for local endpoints (vendor clients skip verification)
+func cassetteCert() (tls.Certificate, error) {
+	key, errKey := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		return tls.Certificate{}, errKey
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: "balance-service cassette"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, errCreate := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if errCreate != nil {
+		return tls.Certificate{}, errCreate
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func (c *cassette) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, e := range c.endpoints {
+		e.server.Close()
+	}
+	c.endpoints = map[string]*cassetteEndpoint{}
+}
+
+func (c *cassette) serve(host string, w http.ResponseWriter, r *http.Request) {
+
+	me := "cassette"
+
+	body, errRead := ioutil.ReadAll(r.Body)
+	if errRead != nil {
+		http.Error(w, me+": read: "+errRead.Error(), http.StatusBadGateway)
+		return
+	}
+
+	call := cassetteCall{
+		Host:        host,
+		Method:      r.Method,
+		URL:         redactURL(r.URL),
+		RequestBody: redactBody(body),
+	}
+
+	c.answer(call, body, w, r)
+}
+
+// forward relays call to device, recording it
+func (c *cassette) forward(call cassetteCall, body []byte, w http.ResponseWriter, r *http.Request) {
+
+	me := "cassette"
+
+	host := call.Host
+
+	req, errNew := http.NewRequest(r.Method, "https://"+host+r.URL.RequestURI(), bytes.NewReader(body))
+	if errNew != nil {
+		http.Error(w, me+": "+errNew.Error(), http.StatusBadGateway)
+		return
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	req.Header.Del("Accept-Encoding") // record plain body
+
+	resp, errDo := httpClient().Do(req)
+	if errDo != nil {
+		log.Printf(me+": host=%s method=%s url=%s: %v", host, call.Method, call.URL, errDo)
+		http.Error(w, me+": "+errDo.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, errBody := ioutil.ReadAll(resp.Body)
+	if errBody != nil {
+		http.Error(w, me+": "+errBody.Error(), http.StatusBadGateway)
+		return
+	}
+
+	call.Status = resp.StatusCode
+	call.ContentType = resp.Header.Get("Content-Type")
+	call.ResponseBody = redactBody(respBody)
+
+	if errSave := c.record(call); errSave != nil {
+		log.Printf(me+": file=%s: %v", c.file, errSave)
+	}
+
+	if call.ContentType != "" {
+		w.Header().Set("Content-Type", call.ContentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	writeBuf(me, w, respBody)
+}
+
+// record appends call and rewrites the cassette file
+func (c *cassette) record(call cassetteCall) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tape.Calls = append(c.tape.Calls, call)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // keep & readable in urls
+	enc.SetIndent("", "  ")
+	if errJSON := enc.Encode(c.tape); errJSON != nil {
+		return errJSON
+	}
+	return ioutil.WriteFile(c.file, buf.Bytes(), 0600)
+}
+
+// redactURL returns path?query with secret parameters redacted.
+// Query parameters are sorted, giving a stable key for replay.
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	if len(query) == 0 {
+		return u.Path
+	}
+	for k := range query {
+		if cassetteSecrets[k] {
+			query.Set(k, cassetteRedacted)
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+// redactBody removes secret fields from JSON body. Non-JSON bodies are kept as is.
+func redactBody(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber() // keep numbers verbatim
+	var v interface{}
+	if errJSON := dec.Decode(&v); errJSON != nil {
+		return string(body)
+	}
+	buf, errMarshal := json.Marshal(redactJSON(v))
+	if errMarshal != nil {
+		return string(body)
+	}
+	return string(buf)
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, value := range t {
+			if cassetteSecrets[k] {
+				t[k] = cassetteRedacted
+				continue
+			}
+			t[k] = redactJSON(value)
+		}
+	case []interface{}:
+		for i, value := range t {
+			t[i] = redactJSON(value)
+		}
+	}
+	return v
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Drain mode for DELETE /backend with service groups (?drain=true):
+//
+// 1. disable backend members (device sends no new connections to them)
+// 2. poll current connections to members until zero, or timeout (?timeout=5m)
+// 3. unlink backend from groups
+//
+// Drain runs in background as a job, polled with GET /v1/jobs/<id>.
+// A job canceled while disabling or draining re-enables the members it disabled.
+
+const (
+	drainDisabling = "disabling"
+	drainDraining  = "draining"
+	drainUnlinking = "unlinking"
+)
+
+var (
+	drainTimeout = 5 * time.Minute // default drain timeout
+	drainPoll    = 2 * time.Second // interval between connection polls
+)
+
+// drainTimeoutParam reads ?timeout=, defaulting to drainTimeout
+func drainTimeoutParam(r *http.Request) (time.Duration, error) {
+	str := r.URL.Query().Get("timeout")
+	if str == "" {
+		return drainTimeout, nil
+	}
+	timeout, errParse := time.ParseDuration(str)
+	if errParse != nil || timeout < 0 {
+		return 0, fmt.Errorf("bad drain timeout: %s", str)
+	}
+	return timeout, nil
+}
+
+// startDrain starts drain job for backend, answering 202 (accepted) with job location
+func startDrain(debug, dry bool, vendor, host string, be backend, timeout time.Duration, w http.ResponseWriter, r *http.Request, username, password string) {
+
+	me := "startDrain"
+
+	j := newJob(vendor, jobStatus{
+		Kind:    jobDrain,
+		Device:  host,
+		Backend: be.BackendName,
+		Groups:  groupNames(be.ServiceGroups),
+		State:   drainDisabling,
+		Timeout: timeout.String(),
+	})
+
+	log.Printf(me+": method=%s url=%s from=%s job=%s backend=%s groups=%v timeout=%v", r.Method, r.URL.Path, r.RemoteAddr, j.status.ID, be.BackendName, groupNames(be.ServiceGroups), timeout)
+
+	jr := jobRequest(r)
+	j.start(func() { drainRun(j, debug, dry, vendor, host, be, timeout, jr, username, password) })
+
+	sendJob(me, debug, j, w, r)
+}
+
+// drainDisable disables enabled backend members in be.ServiceGroups, so device sends no new connections to them.
+// Returns members it tried to disable.
+func drainDisable(lb loadBalancer, be backend) (backend, int, error) {
+	backendTab, errList := lb.BackendList()
+	if errList != nil {
+		return backend{}, 0, errList
+	}
+	current, found := backendTab[be.BackendName]
+	if !found {
+		return backend{}, 0, fmt.Errorf("backend not found: %s", be.BackendName)
+	}
+	disable := backend{BackendName: be.BackendName}
+	for _, name := range groupNames(be.ServiceGroups) {
+		g := findGroup(current.ServiceGroups, name)
+		sg := backendServiceGroup{Name: name, Protocol: g.Protocol}
+		for _, m := range g.Members {
+			if stateOf(m.State) != stateEnabled {
+				continue // already disabled or offline
+			}
+			sg.Members = append(sg.Members, backendSGMember{Name: m.Name, Port: m.Port, State: stateDisabled})
+		}
+		if len(sg.Members) > 0 {
+			disable.ServiceGroups = append(disable.ServiceGroups, sg)
+		}
+	}
+	errCount, err := lb.MemberUpdate(disable)
+	return disable, errCount, err
+}
+
+// drainFail fails drain job, listing members disabled by drain so they can be re-enabled
+func drainFail(j *job, disabled backend, err error) {
+	var list []string
+	for _, sg := range disabled.ServiceGroups {
+		for _, m := range sg.Members {
+			list = append(list, sg.Name+":"+m.Name+","+m.Port)
+		}
+	}
+	if len(list) > 0 {
+		err = fmt.Errorf("%v - members left disabled: %s", err, strings.Join(list, " "))
+	}
+	j.fail(err)
+}
+
+// drainCancel re-enables members disabled by drain job
+func drainCancel(j *job, debug, dry bool, vendor, host string, disabled backend, r *http.Request, username, password string) {
+	id := j.get().ID
+
+	log.Printf("drainCancel: job=%s backend=%s: canceled - re-enabling members", id, disabled.BackendName)
+
+	enable := backend{BackendName: disabled.BackendName}
+	for _, sg := range disabled.ServiceGroups {
+		g := backendServiceGroup{Name: sg.Name, Protocol: sg.Protocol}
+		for _, m := range sg.Members {
+			g.Members = append(g.Members, backendSGMember{Name: m.Name, Port: m.Port, State: stateEnabled})
+		}
+		enable.ServiceGroups = append(enable.ServiceGroups, g)
+	}
+
+	result := "drain canceled - members re-enabled"
+
+	defer lockDevice(host)()
+	errEnable := j.session(debug, dry, vendor, host, username, password, func(lb loadBalancer) error {
+		if len(enable.ServiceGroups) == 0 {
+			return nil // nothing was disabled
+		}
+		ra := auditStartList(r, lb, false, vendor, host, disabled.BackendName)
+		errCount, err := lb.MemberUpdate(enable)
+		if err != nil {
+			auditWrite(ra, lb, http.StatusBadGateway, "drain job "+id+": canceled: re-enable members: "+err.Error(), 1)
+			return err
+		}
+		auditWrite(ra, lb, opStatus(lb.Operations(), errCount), "drain job "+id+": "+result, errCount)
+		j.update(func(s *jobStatus) { s.Errors += errCount })
+		return nil
+	})
+	if errEnable != nil {
+		drainFail(j, disabled, fmt.Errorf("canceled: re-enable members: %v", errEnable))
+		return
+	}
+
+	j.update(func(s *jobStatus) {
+		s.State = jobCanceled
+		s.Result = result
+	})
+}
+
+func drainRun(j *job, debug, dry bool, vendor, host string, be backend, timeout time.Duration, r *http.Request, username, password string) {
+
+	me := "drainRun"
+
+	id := j.get().ID
+
+	// 1. disable members
+
+	var disabled backend
+	unlock := lockDevice(host)
+	errDisable := j.session(debug, dry, vendor, host, username, password, func(lb loadBalancer) error {
+		ra := auditStartList(r, lb, false, vendor, host, be.BackendName)
+		var errCount int
+		var err error
+		disabled, errCount, err = drainDisable(lb, be)
+		if err != nil {
+			auditWrite(ra, lb, http.StatusBadGateway, "drain job "+id+": disable members: "+err.Error(), 1)
+			return err
+		}
+		auditWrite(ra, lb, opStatus(lb.Operations(), errCount), "drain job "+id+": members disabled", errCount)
+		j.update(func(s *jobStatus) { s.Errors += errCount })
+		return nil
+	})
+	unlock()
+	if errDisable != nil {
+		drainFail(j, disabled, fmt.Errorf("disable members: %v", errDisable))
+		return
+	}
+	if j.canceled() {
+		drainCancel(j, debug, dry, vendor, host, disabled, r, username, password)
+		return
+	}
+
+	// 2. wait for connections to finish
+
+	j.update(func(s *jobStatus) { s.State = drainDraining })
+
+	deadline := time.Now().Add(timeout)
+	var remaining int
+
+	for {
+		errPoll := j.session(debug, dry, vendor, host, username, password, func(lb loadBalancer) error {
+			conns, err := lb.MemberConnections(be)
+			if err != nil {
+				return err
+			}
+			remaining = 0
+			for _, c := range conns {
+				remaining += c.Connections
+			}
+			j.update(func(s *jobStatus) { s.Connections = conns; s.Error = "" })
+			return nil
+		})
+		if errPoll != nil {
+			// keep polling - device may recover before timeout
+			log.Printf(me+": job=%s connections: %v", id, errPoll)
+			j.update(func(s *jobStatus) { s.Error = "connections: " + errPoll.Error() })
+		} else {
+			log.Printf(me+": job=%s backend=%s connections=%d", id, be.BackendName, remaining)
+			if remaining == 0 {
+				break
+			}
+		}
+		if !time.Now().Before(deadline) {
+			log.Printf(me+": job=%s backend=%s drain timeout=%v - unlinking anyway", id, be.BackendName, timeout)
+			j.update(func(s *jobStatus) { s.TimedOut = true })
+			break
+		}
+		if !j.sleep(drainPoll) {
+			drainCancel(j, debug, dry, vendor, host, disabled, r, username, password)
+			return
+		}
+	}
+
+	// 3. unlink
+
+	j.update(func(s *jobStatus) { s.State = drainUnlinking })
+
+	result := "server unlinked after drain"
+	if j.get().TimedOut {
+		result = fmt.Sprintf("server unlinked after drain timeout (%s) - connections remaining: %d", timeout, remaining)
+	}
+
+	unlock = lockDevice(host)
+	errUnlink := j.session(debug, dry, vendor, host, username, password, func(lb loadBalancer) error {
+		ra := auditStartList(r, lb, false, vendor, host, be.BackendName)
+		errCount, err := lb.BackendUnlink(be)
+		if err != nil {
+			auditWrite(ra, lb, http.StatusBadGateway, "drain job "+id+": unlink server: "+err.Error(), 1)
+			return err
+		}
+		auditWrite(ra, lb, opStatus(lb.Operations(), errCount), "drain job "+id+": "+result, errCount)
+		j.update(func(s *jobStatus) { s.Errors += errCount })
+		return nil
+	})
+	unlock()
+	if errUnlink != nil {
+		drainFail(j, disabled, fmt.Errorf("unlink server: %v", errUnlink))
+		return
+	}
+
+	j.update(func(s *jobStatus) {
+		s.State = jobDone
+		s.Result = result
+	})
+}
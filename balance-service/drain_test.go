@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/udhos/balance-api-service/a10sim"
+	"github.com/udhos/balance-api-service/f5sim"
+)
+
+// waitJob polls /v1/jobs/<id> until cond holds
+func waitJob(t *testing.T, id string, cond func(s jobStatus) bool) jobStatus {
+	var s jobStatus
+	for i := 0; i < 500; i++ {
+		w := httptest.NewRecorder()
+		handlerJobs(false, w, httptest.NewRequest(http.MethodGet, "/v1/jobs/"+id, nil), "/v1/jobs/")
+		expectStatus(t, "job", w, http.StatusOK)
+		if errJSON := json.Unmarshal(w.Body.Bytes(), &s); errJSON != nil {
+			t.Fatalf("job: %v: [%s]", errJSON, w.Body.String())
+		}
+		if cond(s) {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s: condition not reached: %+v", id, s)
+	return s
+}
+
+// cancelJob sends DELETE /v1/jobs/<id>, with basic auth unless user is empty
+func cancelJob(id, user, pass string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodDelete, "/v1/jobs/"+id, nil)
+	if user != "" {
+		r.SetBasicAuth(user, pass)
+	}
+	w := httptest.NewRecorder()
+	handlerJobs(false, w, r, "/v1/jobs/")
+	return w
+}
+
+func startJob(t *testing.T, w *httptest.ResponseRecorder) string {
+	expectStatus(t, "job", w, http.StatusAccepted)
+	var s jobStatus
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &s); errJSON != nil {
+		t.Fatalf("job: %v: [%s]", errJSON, w.Body.String())
+	}
+	if loc := w.Header().Get("Location"); loc != "/v1/jobs/"+s.ID {
+		t.Errorf("job: unexpected location: %s", loc)
+	}
+	return s.ID
+}
+
+func TestE2EDrain(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	savedPoll := drainPoll
+	drainPoll = 10 * time.Millisecond
+	defer func() { drainPoll = savedPoll }()
+
+	_, closeAudit := newAudit(t)
+	defer closeAudit()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	e.device.SetStat("group1", "s1", 5555, a10sim.MemberStat{CurConns: 3})
+
+	expectStatus(t, "drain without groups", e.sample(http.MethodDelete, "backend?drain=true", "server_delete.yaml", nil), http.StatusBadRequest)
+
+	w := e.sample(http.MethodDelete, "backend?drain=true&plan=true", "server_unlink.yaml", nil)
+	expectStatus(t, "drain plan", w, http.StatusOK)
+	if report := decodeReport(t, "drain plan", w); len(report.Operations) < 3 || report.Operations[0].Operation != "group member update" {
+		t.Errorf("drain plan: unexpected operations: %v", report.Operations)
+	}
+
+	id := startJob(t, e.sample(http.MethodDelete, "backend?drain=true&timeout=1m", "server_unlink.yaml", nil))
+
+	s := waitJob(t, id, func(s jobStatus) bool { return s.State == drainDraining && len(s.Connections) == 2 })
+	for _, sg := range e.device.State().ServiceGroupList {
+		for _, m := range sg.MemberList {
+			if m.Disabled != (m.Server == "s1") {
+				t.Errorf("draining: unexpected member status: %v", m)
+			}
+		}
+	}
+	if m := e.members("group1"); !m["s1,5555"] {
+		t.Errorf("draining: member unlinked too early: %v", m)
+	}
+
+	e.device.SetStat("group1", "s1", 5555, a10sim.MemberStat{})
+
+	s = waitJob(t, id, func(s jobStatus) bool { return s.State == jobDone || s.State == jobFailed })
+	if s.State != jobDone || s.TimedOut {
+		t.Errorf("drain: unexpected job: %+v", s)
+	}
+	if m := e.members("group1"); len(m) != 1 || !m["s0,8080"] {
+		t.Errorf("drain: unexpected members: %v", m)
+	}
+
+	list := queryAudit(t, "/v1/audit/?backend=s1")
+	if len(list) != 3 {
+		t.Fatalf("expected 3 entries (link, disable, unlink), got %d: %v", len(list), list)
+	}
+	if disabled := list[1]; disabled.Result != "drain job "+id+": members disabled" || len(disabled.Operations) != 2 || disabled.Operations[0].Operation != "group member update" {
+		t.Errorf("disable: unexpected entry: %+v", disabled)
+	}
+	if unlinked := list[2]; unlinked.Result != "drain job "+id+": server unlinked after drain" {
+		t.Errorf("unlink: unexpected entry: %+v", unlinked)
+	}
+}
+
+func TestE2EDrainShutdown(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	savedPoll := drainPoll
+	drainPoll = 10 * time.Millisecond
+	defer func() { drainPoll = savedPoll }()
+
+	_, closeAudit := newAudit(t)
+	defer closeAudit()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	e.device.SetStat("group1", "s1", 5555, a10sim.MemberStat{CurConns: 3})
+
+	id := startJob(t, e.sample(http.MethodDelete, "backend?drain=true&timeout=1m", "server_unlink.yaml", nil))
+	waitJob(t, id, func(s jobStatus) bool { return s.State == drainDraining && len(s.Connections) == 2 })
+
+	jobsCancel() // as shutdown does
+	if !jobsWait(5 * time.Second) {
+		t.Fatalf("shutdown: jobs still running")
+	}
+
+	s := waitJob(t, id, func(s jobStatus) bool { return true })
+	if s.State != jobCanceled || s.Result != "drain canceled - members re-enabled" {
+		t.Errorf("shutdown: unexpected job: %+v", s)
+	}
+	for _, sg := range e.device.State().ServiceGroupList {
+		for _, m := range sg.MemberList {
+			if m.Disabled {
+				t.Errorf("shutdown: member left disabled: %v", m)
+			}
+		}
+	}
+	if m := e.members("group1"); len(m) != 3 {
+		t.Errorf("shutdown: unexpected members: %v", m)
+	}
+
+	list := queryAudit(t, "/v1/audit/?backend=s1")
+	if len(list) != 3 {
+		t.Fatalf("expected 3 entries (link, disable, re-enable), got %d: %v", len(list), list)
+	}
+	if enabled := list[2]; enabled.Result != "drain job "+id+": drain canceled - members re-enabled" || enabled.User != "admin" || !strings.Contains(enabled.URL, "drain=true") {
+		t.Errorf("re-enable: unexpected entry: %+v", enabled)
+	}
+}
+
+func TestE2EDrainCancel(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	savedPoll := drainPoll
+	drainPoll = 10 * time.Millisecond
+	defer func() { drainPoll = savedPoll }()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	e.device.SetStat("group1", "s1", 5555, a10sim.MemberStat{CurConns: 3})
+
+	id := startJob(t, e.sample(http.MethodDelete, "backend?drain=true&timeout=1m", "server_unlink.yaml", nil))
+	waitJob(t, id, func(s jobStatus) bool { return s.State == drainDraining && len(s.Connections) == 2 })
+
+	expectStatus(t, "cancel missing job", cancelJob("999", "admin", "a10"), http.StatusNotFound)
+	expectStatus(t, "cancel without auth", cancelJob(id, "", ""), http.StatusUnauthorized)
+	expectStatus(t, "cancel with bad password", cancelJob(id, "admin", "bad"), http.StatusBadGateway)
+	expectStatus(t, "cancel", cancelJob(id, "admin", "a10"), http.StatusAccepted)
+
+	s := waitJob(t, id, func(s jobStatus) bool { return jobFinished(s.State) })
+	if s.State != jobCanceled {
+		t.Errorf("cancel: unexpected job: %+v", s)
+	}
+	for _, sg := range e.device.State().ServiceGroupList {
+		for _, m := range sg.MemberList {
+			if m.Disabled {
+				t.Errorf("cancel: member left disabled: %v", m)
+			}
+		}
+	}
+
+	expectStatus(t, "cancel finished job", cancelJob(id, "admin", "a10"), http.StatusConflict)
+}
+
+func TestE2EDrainUnlinkFailure(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	savedPoll := drainPoll
+	drainPoll = 10 * time.Millisecond
+	defer func() { drainPoll = savedPoll }()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	e.device.SetStat("group1", "s1", 5555, a10sim.MemberStat{CurConns: 3})
+
+	id := startJob(t, e.sample(http.MethodDelete, "backend?drain=true&timeout=1s", "server_unlink.yaml", nil))
+
+	waitJob(t, id, func(s jobStatus) bool { return s.State == drainDraining && len(s.Connections) == 2 })
+	e.device.Fail("slb.service_group.getAll", "device busy")
+
+	s := waitJob(t, id, func(s jobStatus) bool { return s.State == jobDone || s.State == jobFailed })
+	if s.State != jobFailed || !strings.HasSuffix(s.Error, "members left disabled: group1:s1,5555 group1:s1,3333") {
+		t.Errorf("drain: unexpected job: %+v", s)
+	}
+}
+
+func TestE2EF5DrainTimeout(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	savedPoll := drainPoll
+	drainPoll = 10 * time.Millisecond
+	defer func() { drainPoll = savedPoll }()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	e.device.SetStat("group1", "s1:3333", f5sim.MemberStat{CurConns: 7})
+
+	id := startJob(t, e.sample(http.MethodDelete, "backend?drain=true&timeout=50ms", "server_unlink.yaml", nil))
+
+	s := waitJob(t, id, func(s jobStatus) bool { return s.State == jobDone || s.State == jobFailed })
+	if s.State != jobDone || !s.TimedOut {
+		t.Errorf("drain: unexpected job: %+v", s)
+	}
+	var remaining int
+	for _, c := range s.Connections {
+		remaining += c.Connections
+	}
+	if remaining != 7 {
+		t.Errorf("drain: unexpected connections: %v", s.Connections)
+	}
+	if m := e.members("group1"); len(m) != 1 || !m["s0:8080"] {
+		t.Errorf("drain: unexpected members: %v", m)
+	}
+}
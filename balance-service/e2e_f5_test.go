@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/udhos/balance-api-service/f5sim"
+)
+
+// end-to-end tests: /v1/ff/ handlers against simulated F5 device
+
+// f5Seed is pool group1 bound to virtual vs1, with member s0:8080
+var f5Seed = f5sim.State{
+	Nodes: []f5sim.Node{{Name: "s0", Address: "1.1.1.1"}},
+	Pools: []f5sim.Pool{
+		{Name: "group1", Members: []f5sim.Member{{Name: "s0:8080", Address: "1.1.1.1"}}},
+	},
+	Virtuals: []f5sim.Virtual{
+		{Name: "vs1", Destination: "/Common/10.10.10.10:80", IPProtocol: "tcp", Pool: "/Common/group1"},
+	},
+}
+
+type f5E2E struct {
+	t      *testing.T
+	device *f5sim.Device
+	server *httptest.Server
+	host   string
+}
+
+func newF5E2E(t *testing.T) *f5E2E {
+	if _, found := lbDriverTab["f5"]; !found {
+		registerDriver("f5", newF5) // main() is not run by tests
+	}
+	d := f5sim.New()
+	d.Load(f5Seed)
+	server := f5sim.NewTLSServer(d)
+	return &f5E2E{t: t, device: d, server: server, host: f5sim.Host(server)}
+}
+
+func (e *f5E2E) close() {
+	e.server.Close()
+}
+
+// request sends request to /v1/ff/node/<host>/<resource>
+func (e *f5E2E) request(method, resource string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/v1/ff/node/"+e.host+"/"+resource, bytes.NewReader(body))
+	r.SetBasicAuth("admin", "admin")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handlerNodeF5(false, false, w, r, "/v1/ff/node/")
+	return w
+}
+
+func (e *f5E2E) sample(method, resource, file string, header map[string]string) *httptest.ResponseRecorder {
+	body, yamlHeader := readSample(e.t, file, header)
+	return e.request(method, resource, body, yamlHeader)
+}
+
+func (e *f5E2E) members(pool string) map[string]bool {
+	tab := map[string]bool{}
+	for _, p := range e.device.State().Pools {
+		if p.Name != pool {
+			continue
+		}
+		for _, m := range p.Members {
+			tab[m.Name] = true
+		}
+	}
+	return tab
+}
+
+func TestE2EF5LinkUnlink(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	expectStatus(t, "create", e.sample(http.MethodPost, "backend", "server_create.yaml", nil), http.StatusOK)
+	w := e.sample(http.MethodPost, "backend", "server_link.yaml", nil)
+	expectStatus(t, "link", w, http.StatusOK)
+	var created []string
+	for _, op := range decodeReport(t, "link", w).Operations {
+		if op.Operation == "group member create" {
+			created = append(created, op.Detail[0])
+		}
+	}
+	if len(created) != 2 || created[0] != "s1:3333" || created[1] != "s1:5555" {
+		t.Errorf("link: unexpected member create order: %v", created)
+	}
+
+	m := e.members("group1")
+	if len(m) != 3 || !m["s0:8080"] || !m["s1:5555"] || !m["s1:3333"] {
+		t.Errorf("link: unexpected members: %v", m)
+	}
+
+	w = e.request(http.MethodGet, "backend/s1", nil, nil)
+	expectStatus(t, "get", w, http.StatusOK)
+	if !bytes.Contains(w.Body.Bytes(), []byte("vs1")) || !bytes.Contains(w.Body.Bytes(), []byte("2.2.2.2")) {
+		t.Errorf("get: unexpected backend: [%s]", w.Body.String())
+	}
+
+	expectStatus(t, "unlink", e.sample(http.MethodDelete, "backend", "server_unlink.yaml", nil), http.StatusOK)
+
+	m = e.members("group1")
+	if len(m) != 1 || !m["s0:8080"] {
+		t.Errorf("unlink: unexpected members: %v", m)
+	}
+
+	expectStatus(t, "delete", e.sample(http.MethodDelete, "backend", "server_delete.yaml", nil), http.StatusOK)
+	expectStatus(t, "get deleted", e.request(http.MethodGet, "backend/s1", nil, nil), http.StatusNotFound)
+}
+
+func TestE2EF5RelinkCreatesFirst(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	body := []byte(`{"BackendName": "s0", "BackendAddress": "1.1.1.1", "ServiceGroups": [{"Name": "group1", "Members": [{"Name": "s0", "Port": "9090"}]}]}`)
+	w := e.request(http.MethodPost, "backend", body, nil)
+	expectStatus(t, "relink", w, http.StatusOK)
+
+	var ops []string
+	for _, op := range decodeReport(t, "relink", w).Operations {
+		if op.Operation == "group member create" || op.Operation == "group member delete" {
+			ops = append(ops, op.Operation+" "+op.Detail[0])
+		}
+	}
+	if len(ops) != 2 || ops[0] != "group member create s0:9090" || ops[1] != "group member delete s0:8080" {
+		t.Errorf("relink: pool must get new member before losing old one: %v", ops)
+	}
+
+	if m := e.members("group1"); len(m) != 1 || !m["s0:9090"] {
+		t.Errorf("relink: unexpected members: %v", m)
+	}
+}
+
+func TestE2EF5Partition(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	inv, errParse := parseInventory([]byte("devices:\n- name: bigip1\n  address: " + e.host + "\n  vendor: f5\n  partition: Tenant\n"))
+	if errParse != nil {
+		t.Fatalf("inventory: %v", errParse)
+	}
+	inventory = inv
+	defer func() { inventory = nil }()
+
+	expectStatus(t, "create", e.sample(http.MethodPost, "backend", "server_create.yaml", nil), http.StatusOK)
+	expectStatus(t, "disable", e.request(http.MethodPatch, "backend/s1", []byte(`{"State": "disabled"}`), nil), http.StatusOK)
+
+	nodes := e.device.State().Nodes
+	if len(nodes) != 2 || nodes[1].Partition != "Tenant" || nodes[1].Session != "user-disabled" {
+		t.Errorf("disable: unexpected nodes: %+v", nodes)
+	}
+
+	expectStatus(t, "delete", e.sample(http.MethodDelete, "backend", "server_delete.yaml", nil), http.StatusOK)
+	if nodes := e.device.State().Nodes; len(nodes) != 1 || nodes[0].Name != "s0" {
+		t.Errorf("delete: unexpected nodes: %+v", nodes)
+	}
+}
+
+func TestE2EF5PartialFailure(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	expectStatus(t, "create", e.sample(http.MethodPost, "backend", "server_create.yaml", nil), http.StatusOK)
+
+	e.device.Fail("POST /mgmt/tm/ltm/pool/~Common~group1/members", "simulated failure")
+
+	w := e.sample(http.MethodPost, "backend", "server_link.yaml", nil)
+	expectStatus(t, "link", w, http.StatusBadGateway) // every member create failed
+
+	report := decodeReport(t, "link", w)
+	if report.Errors != 2 {
+		t.Errorf("link: unexpected report: %v", report)
+	}
+}
+
+func TestE2EF5ListError(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	e.device.Fail("GET /mgmt/tm/ltm/node", "simulated timeout")
+
+	w := e.request(http.MethodGet, "backend", nil, nil)
+	expectStatus(t, "list", w, http.StatusBadGateway)
+	if !bytes.Contains(w.Body.Bytes(), []byte("node list")) {
+		t.Errorf("list: error should name failed collection: [%s]", w.Body.String())
+	}
+}
+
+func TestE2EF5RuleGet(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	w := e.request(http.MethodGet, "rule", nil, nil)
+	expectStatus(t, "rule get", w, http.StatusOK)
+	if !bytes.Contains(w.Body.Bytes(), []byte("vs1")) {
+		t.Errorf("rule get: missing virtual: [%s]", w.Body.String())
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/udhos/balance-api-service/a10sim"
+)
+
+// end-to-end tests: /v1/at2/ handlers against simulated A10 device
+
+// e2eSeed is group1 bound to vs1, with member s0
+var e2eSeed = a10sim.State{
+	ServerList: []a10sim.Server{
+		{Name: "s0", Host: "1.1.1.1", Status: 1, PortList: []a10sim.Port{{PortNum: 8080, Protocol: 2}}},
+	},
+	ServiceGroupList: []a10sim.ServiceGroup{
+		{Name: "group1", Protocol: 2, MemberList: []a10sim.Member{{Server: "s0", Port: 8080}}},
+	},
+	VirtualServerList: []a10sim.VirtualServer{
+		{Name: "vs1", Address: "10.10.10.10", Status: 1, VportList: []a10sim.VirtualPort{{Port: 80, Protocol: 2, ServiceGroup: "group1"}}},
+	},
+}
+
+type e2eDevice struct {
+	t      *testing.T
+	device *a10sim.Device
+	server *httptest.Server
+	host   string
+}
+
+func newE2E(t *testing.T) *e2eDevice {
+	if _, found := lbDriverTab["a10v2"]; !found {
+		registerDriver("a10v2", newA10v2) // main() is not run by tests
+	}
+	d := a10sim.New()
+	d.Load(e2eSeed)
+	server := a10sim.NewTLSServer(d)
+	return &e2eDevice{t: t, device: d, server: server, host: a10sim.Host(server)}
+}
+
+func (e *e2eDevice) close() {
+	e.server.Close()
+}
+
+// request sends request to /v1/at2/node/<host>/<resource>
+func (e *e2eDevice) request(method, resource string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/v1/at2/node/"+e.host+"/"+resource, bytes.NewReader(body))
+	r.SetBasicAuth("admin", "a10")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handlerNodeA10v2(false, false, w, r, "/v1/at2/node/")
+	return w
+}
+
+// sample sends samples/<file> as YAML body
+func (e *e2eDevice) sample(method, resource, file string, header map[string]string) *httptest.ResponseRecorder {
+	body, yamlHeader := readSample(e.t, file, header)
+	return e.request(method, resource, body, yamlHeader)
+}
+
+// readSample loads samples/<file>, adding YAML content type to header
+func readSample(t *testing.T, file string, header map[string]string) ([]byte, map[string]string) {
+	body, errRead := ioutil.ReadFile("../samples/" + file)
+	if errRead != nil {
+		t.Fatalf("sample: %v", errRead)
+	}
+	if header == nil {
+		header = map[string]string{}
+	}
+	header["Content-Type"] = "text/x-yaml"
+	return body, header
+}
+
+func (e *e2eDevice) members(group string) map[string]bool {
+	tab := map[string]bool{}
+	for _, sg := range e.device.State().ServiceGroupList {
+		if sg.Name != group {
+			continue
+		}
+		for _, m := range sg.MemberList {
+			tab[m.Server+","+strconv.Itoa(int(m.Port))] = true
+		}
+	}
+	return tab
+}
+
+func expectStatus(t *testing.T, label string, w *httptest.ResponseRecorder, status int) {
+	if w.Code != status {
+		t.Errorf("%s: expected status=%d got=%d body=[%s]", label, status, w.Code, w.Body.String())
+	}
+}
+
+func decodeReport(t *testing.T, label string, w *httptest.ResponseRecorder) opReport {
+	var report opReport
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &report); errJSON != nil {
+		t.Fatalf("%s: bad report: %v: [%s]", label, errJSON, w.Body.String())
+	}
+	return report
+}
+
+func TestE2ELinkUnlink(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "create", e.sample(http.MethodPost, "backend", "server_create.yaml", nil), http.StatusOK)
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+
+	m := e.members("group1")
+	if !m["s0,8080"] || !m["s1,5555"] || !m["s1,3333"] {
+		t.Errorf("link: unexpected members: %v", m)
+	}
+
+	w := e.request(http.MethodGet, "backend/s1", nil, nil)
+	expectStatus(t, "get", w, http.StatusOK)
+	var b backend
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &b); errJSON != nil {
+		t.Fatalf("get: %v", errJSON)
+	}
+	if b.BackendAddress != "2.2.2.2" || len(b.VirtualServers) != 1 || b.VirtualServers[0].Name != "vs1" {
+		t.Errorf("get: unexpected backend: %v", b)
+	}
+
+	expectStatus(t, "unlink", e.sample(http.MethodDelete, "backend", "server_unlink.yaml", nil), http.StatusOK)
+
+	m = e.members("group1")
+	if len(m) != 1 || !m["s0,8080"] {
+		t.Errorf("unlink: unexpected members: %v", m)
+	}
+
+	expectStatus(t, "delete", e.sample(http.MethodDelete, "backend", "server_delete.yaml", nil), http.StatusOK)
+	expectStatus(t, "get deleted", e.request(http.MethodGet, "backend/s1", nil, nil), http.StatusNotFound)
+}
+
+func TestE2EUnlinkMergingDevice(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPut, "backend", "server_put.yaml", nil), http.StatusOK)
+
+	// device ignores removals on group update - unlink falls back to member delete
+	e.device.MergeGroupUpdate(true)
+
+	w := e.sample(http.MethodDelete, "backend", "server_unlink.yaml", nil)
+	expectStatus(t, "unlink", w, http.StatusOK)
+
+	m := e.members("group1")
+	if len(m) != 1 || !m["s0,8080"] {
+		t.Errorf("unlink: unexpected members: %v", m)
+	}
+
+	var deletes int
+	for _, op := range decodeReport(t, "unlink", w).Operations {
+		if op.Operation == "group member delete" {
+			deletes++
+		}
+	}
+	if deletes != 2 {
+		t.Errorf("unlink: expected 2 member deletes, got %d", deletes)
+	}
+}
+
+func TestE2EPartialFailure(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	e.device.Fail("slb.service_group.update", "simulated failure")
+
+	w := e.sample(http.MethodPost, "backend", "server_link.yaml", nil)
+	expectStatus(t, "link", w, http.StatusMultiStatus)
+
+	report := decodeReport(t, "link", w)
+	if report.Errors != 1 || len(report.Operations) != 2 {
+		t.Fatalf("link: unexpected report: %v", report)
+	}
+	if op := report.Operations[1]; op.Status != opFailed || op.Error == "" {
+		t.Errorf("link: expected failed group update: %v", op)
+	}
+}
+
+func TestE2EUnlinkFallback(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+
+	e.device.Fail("slb.service_group.update", "simulated failure")
+
+	w := e.sample(http.MethodDelete, "backend", "server_unlink.yaml", nil)
+	expectStatus(t, "unlink", w, http.StatusOK)
+
+	report := decodeReport(t, "unlink", w)
+	if report.Errors != 0 || len(report.Operations) != 3 {
+		t.Fatalf("unlink: unexpected report: %v", report)
+	}
+	if op := report.Operations[0]; op.Operation != "group update" || op.Status != opSuperseded || op.Error == "" {
+		t.Errorf("unlink: expected superseded group update: %v", op)
+	}
+	for _, op := range report.Operations[1:] {
+		if op.Operation != "group member delete" || op.Status != opOK {
+			t.Errorf("unlink: expected member delete: %v", op)
+		}
+	}
+	if m := e.members("group1"); len(m) != 1 || !m["s0,8080"] {
+		t.Errorf("unlink: unexpected members: %v", m)
+	}
+
+	// fallback fails too
+	e.device.Heal("slb.service_group.update")
+	expectStatus(t, "relink", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	e.device.Fail("slb.service_group.update", "simulated failure")
+	e.device.Fail("slb.service_group.member.delete", "simulated failure")
+
+	w = e.sample(http.MethodDelete, "backend", "server_unlink.yaml", nil)
+	expectStatus(t, "unlink", w, http.StatusBadGateway)
+	report = decodeReport(t, "unlink", w)
+	if report.Errors != 3 || report.Operations[0].Status != opFailed {
+		t.Errorf("unlink: unexpected report: %v", report)
+	}
+}
+
+func TestE2EPlan(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	before := e.device.State()
+
+	w := e.sample(http.MethodPut, "backend", "server_put.yaml", map[string]string{"Prefer": "dry-run"})
+	expectStatus(t, "plan", w, http.StatusOK)
+
+	report := decodeReport(t, "plan", w)
+	if !report.Plan || len(report.Operations) != 2 {
+		t.Errorf("plan: unexpected report: %v", report)
+	}
+
+	after := e.device.State()
+	if len(after.ServerList) != len(before.ServerList) {
+		t.Errorf("plan: device changed: %v", after)
+	}
+}
+
+func TestE2EIfMatch(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "put", e.sample(http.MethodPut, "backend/s1", "server_put.yaml", nil), http.StatusOK)
+
+	w := e.request(http.MethodGet, "backend/s1", nil, nil)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("get: missing etag")
+	}
+
+	// someone else changes s1
+	expectStatus(t, "unlink", e.sample(http.MethodDelete, "backend", "server_unlink.yaml", nil), http.StatusOK)
+
+	w = e.sample(http.MethodPut, "backend/s1", "server_put.yaml", map[string]string{"If-Match": etag})
+	expectStatus(t, "stale put", w, http.StatusPreconditionFailed)
+
+	w = e.sample(http.MethodPut, "backend/s1", "server_put.yaml", map[string]string{"If-Match": w.Header().Get("ETag")})
+	expectStatus(t, "fresh put", w, http.StatusOK)
+}
+
+func TestE2EPutRemovePort(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "put", e.sample(http.MethodPut, "backend/s1", "server_put.yaml", nil), http.StatusOK)
+
+	body := []byte(`{"BackendAddress": "2.2.2.2", "BackendPorts": [{"Port": "5555", "Protocol": "tcp"}], "ServiceGroups": [{"Name": "group1", "Protocol": "tcp", "Members": [{"Name": "s1", "Port": "5555"}]}]}`)
+	expectStatus(t, "remove port", e.request(http.MethodPut, "backend/s1", body, nil), http.StatusOK)
+
+	if m := e.members("group1"); len(m) != 2 || !m["s0,8080"] || !m["s1,5555"] {
+		t.Errorf("remove port: unexpected members: %v", m)
+	}
+	for _, s := range e.device.State().ServerList {
+		if s.Name == "s1" && len(s.PortList) != 1 {
+			t.Errorf("remove port: unexpected ports: %v", s.PortList)
+		}
+	}
+}
+
+func TestE2EListError(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	e.device.Fail("slb.virtual_server.getAll", "simulated timeout")
+
+	w := e.request(http.MethodGet, "backend", nil, nil)
+	expectStatus(t, "list", w, http.StatusBadGateway)
+	if !bytes.Contains(w.Body.Bytes(), []byte("virtual server list")) {
+		t.Errorf("list: error should name failed collection: [%s]", w.Body.String())
+	}
+}
+
+func TestE2EVirtualPut(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	w := e.sample(http.MethodPut, "virtual", "virtual_put.yaml", nil)
+	expectStatus(t, "virtual put", w, http.StatusOK)
+
+	state := e.device.State()
+	if len(state.ServerList) != 1 || state.ServerList[0].Name != "s1" {
+		t.Errorf("virtual put: unexpected servers: %v", state.ServerList)
+	}
+	if m := e.members("group1"); len(m) != 1 || !m["s1,8080"] {
+		t.Errorf("virtual put: unexpected members: %v", m)
+	}
+}
+
+func TestE2EVirtualPutKeepsState(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	w := e.request(http.MethodGet, "virtual", nil, nil)
+	expectStatus(t, "virtual get", w, http.StatusOK)
+	layout := w.Body.Bytes()
+
+	expectStatus(t, "patch", e.request(http.MethodPatch, "backend/s0", []byte(`{"State": "disabled", "ServiceGroups": [{"Name": "group1", "Members": [{"Name": "s0", "Port": "8080", "State": "disabled", "Priority": 3}]}]}`), nil), http.StatusOK)
+
+	expectStatus(t, "virtual put", e.request(http.MethodPut, "virtual", layout, map[string]string{"Content-Type": "application/json"}), http.StatusOK)
+
+	state := e.device.State()
+	if len(state.ServerList) != 1 || state.ServerList[0].Status != 0 {
+		t.Errorf("virtual put: server re-enabled: %+v", state.ServerList)
+	}
+	for _, sg := range state.ServiceGroupList {
+		for _, m := range sg.MemberList {
+			if !m.Disabled || m.Priority != 3 {
+				t.Errorf("virtual put: member state lost: %+v", m)
+			}
+		}
+	}
+}
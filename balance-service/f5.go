@@ -11,9 +11,10 @@ import (
 )
 
 // /v1/ff/node/<host>/rule/<rule>
+// /v1/ff/node/<host>/backend/
 // ^^^^^^^^^^^^
 // prefix
-func handlerNodeF5(w http.ResponseWriter, r *http.Request, path string) {
+func handlerNodeF5(debug, dry bool, w http.ResponseWriter, r *http.Request, path string) {
 
 	me := "handlerNodeF5"
 
@@ -36,28 +37,37 @@ func handlerNodeF5(w http.ResponseWriter, r *http.Request, path string) {
 	}
 
 	node := fields[0]
-	realm := "node-" + node
-	log.Printf(me+": method=%s url=%s from=%s suffix=[%s] auth realm=[%s]", r.Method, r.URL.Path, r.RemoteAddr, suffix, realm)
-	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
-	username, password, authOK := r.BasicAuth()
+	if !checkInventory(me, "f5", node, w, r) {
+		return
+	}
+	r, username, password, authOK := deviceAuth(me, node, suffix, w, r)
 	if !authOK {
-		http.Error(w, "not authorized", http.StatusUnauthorized) // 401
 		return
 	}
-	log.Printf(me+": method=%s url=%s from=%s suffix=[%s] auth realm=[%s] auth=[%s:%s]", r.Method, r.URL.Path, r.RemoteAddr, suffix, realm, username, hidePassword(password))
+
+	w.Header().Set("Access-Control-Allow-Origin", "*") // FIXME??
 
 	ruleField := fields[1]
-	if ruleField != "rule" {
-		reason := fmt.Sprintf("missing fule field: [%s]", ruleField)
+	switch ruleField {
+	case "rule":
+		// handled below
+	case "backend":
+		nodeBackend(debug, dry, "f5", w, r, username, password, fields)
+		return
+	case "shift":
+		nodeShift(debug, dry, "f5", w, r, username, password, fields)
+		return
+	default:
+		reason := fmt.Sprintf("missing rule field: [%s]", ruleField)
 		sendBadRequest(me, reason, w, r)
 		return
 	}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*") // FIXME??
-
 	switch r.Method {
 	case http.MethodGet:
-		nodeF5RuleGet(w, r, username, password, fields)
+		if authorize(me, node, policyRead, nil, w, r) {
+			nodeF5RuleGet(w, r, username, password, fields)
+		}
 	case http.MethodPost:
 		nodeF5RulePost(w, r, username, password, fields)
 	case http.MethodDelete:
@@ -75,7 +85,7 @@ func nodeF5RuleGet(w http.ResponseWriter, r *http.Request, username, password st
 
 	host := fields[0]
 
-	f5Host := "https://" + host
+	f5Host := "https://" + deviceHost(host)
 
 	log.Printf(me+": method=%s url=%s from=%s f5.NewBasicClient opening: %s", r.Method, r.URL.Path, r.RemoteAddr, f5Host)
 
@@ -87,7 +97,9 @@ func nodeF5RuleGet(w http.ResponseWriter, r *http.Request, username, password st
 		return
 	}
 
-	f5Client.DisableCertCheck()
+	if !inventoryOptions(host, lbOptions{}).TLSVerify {
+		f5Client.DisableCertCheck()
+	}
 
 	ltmClient := ltm.New(f5Client)
 
@@ -108,8 +120,8 @@ func nodeF5RuleGet(w http.ResponseWriter, r *http.Request, username, password st
 		}
 	*/
 
-	poolClient := ltmClient.Pool()
-	poolList, errPoolList := poolClient.ListAll()
+	var poolList f5PoolList // ltm.Pool can't decode partition
+	errPoolList := f5Client.ReadQuery(ltm.BasePath+ltm.PoolEndpoint, &poolList)
 	if errPoolList != nil {
 		log.Printf(me+": method=%s url=%s from=%s pool list: %v", r.Method, r.URL.Path, r.RemoteAddr, errPoolList)
 		http.Error(w, host+" bad gateway - pool list", http.StatusBadGateway) // 502
@@ -135,7 +147,7 @@ func nodeF5RuleGet(w http.ResponseWriter, r *http.Request, username, password st
 	*/
 
 	for _, p := range poolList.Items {
-		log.Printf("pool: user=%s name=%s members=%s", username, p.Name, p.Members)
+		log.Printf("pool: user=%s name=%s partition=%s", username, p.Name, p.Partition)
 	}
 
 	/*
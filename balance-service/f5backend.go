@@ -0,0 +1,633 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+	"github.com/e-XpertSolutions/f5-rest-client/f5/ltm"
+)
+
+// F5 full backend path is:
+// virtual -> pool -> list of pool members {node:port} -> node
+//
+// F5 object  | backend model
+// -----------+---------------------------------
+// node       | BackendName, BackendAddress
+// pool       | ServiceGroups
+// virtual    | VirtualServers
+//
+// Node and pool member session and state map to State, see backendstate.go.
+
+// f5lb is the load balancer driver for F5 iControl REST
+type f5lb struct {
+	opRecorder
+	host   string
+	opt    lbOptions
+	client *f5.Client
+	ltm    ltm.LTM
+}
+
+func newF5(host string, opt lbOptions) loadBalancer {
+	return &f5lb{opRecorder: opRecorder{plan: opt.Plan}, host: host, opt: opt}
+}
+
+func (f *f5lb) Login(username, password string) error {
+	f5Client, errOpen := f5.NewBasicClient("https://"+deviceHost(f.host), username, password)
+	if errOpen != nil {
+		return errOpen
+	}
+	if !f.opt.TLSVerify {
+		f5Client.DisableCertCheck()
+	}
+	f.client = f5Client
+	f.ltm = ltm.New(f5Client)
+	return f5Client.CheckAuth()
+}
+
+func (f *f5lb) Logout() error {
+	return nil // basic auth is stateless
+}
+
+// change performs a write call, unless in dry mode
+func (f *f5lb) change(op deviceOp, call func() error) error {
+	return f.run(op, func() error {
+		if f.opt.Dry {
+			log.Printf("f5lb: DRY host=%s %s %s %v", f.host, op.Operation, op.Target, op.Detail)
+			return nil
+		}
+		if f.opt.Debug {
+			log.Printf("f5lb: host=%s %s %s %v", f.host, op.Operation, op.Target, op.Detail)
+		}
+		return call()
+	})
+}
+
+// f5State maps node or pool member session and state to backend state
+func f5State(session, state string) string {
+	switch {
+	case state == "user-down":
+		return stateOffline
+	case session == "user-disabled":
+		return stateDisabled
+	}
+	return stateEnabled
+}
+
+// f5Session maps backend state to node or pool member session and state
+func f5Session(state string) (string, string) {
+	switch stateOf(state) {
+	case stateOffline:
+		return "user-disabled", "user-down"
+	case stateDisabled:
+		return "user-disabled", "user-up"
+	}
+	return "user-enabled", "user-up"
+}
+
+// patchState changes session and state of node or pool member at path
+func (f *f5lb) patchState(op deviceOp, path, state string) error {
+	session, upDown := f5Session(state)
+	return f.patch(op, path, map[string]interface{}{"session": session, "state": upDown})
+}
+
+// patch changes fields of object at path
+func (f *f5lb) patch(op deviceOp, path string, fields map[string]interface{}) error {
+	return f.change(op, func() error {
+		return f.client.ModQuery("PATCH", path, fields)
+	})
+}
+
+// f5MemberFields maps member state and settings to pool member fields, zero values are left out
+func f5MemberFields(m backendSGMember) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if m.State != "" {
+		fields["session"], fields["state"] = f5Session(m.State)
+	}
+	if m.Weight != 0 {
+		fields["ratio"] = m.Weight
+	}
+	if m.Priority != 0 {
+		fields["priorityGroup"] = m.Priority
+	}
+	if m.ConnectionLimit != 0 {
+		fields["connectionLimit"] = m.ConnectionLimit
+	}
+	return fields
+}
+
+// f5Pool is a pool as listed by /mgmt/tm/ltm/pool
+// ltm.Pool declares Partition as int64, breaking decoding of "partition":"Common" from actual devices.
+type f5Pool struct {
+	Name      string `json:"name,omitempty"`
+	Partition string `json:"partition,omitempty"`
+	FullPath  string `json:"fullPath,omitempty"`
+}
+
+type f5PoolList struct {
+	Items []f5Pool `json:"items,omitempty"`
+}
+
+// f5Group is a pool with its members
+type f5Group struct {
+	pool     f5Pool
+	protocol string
+	members  []ltm.PoolMembers
+}
+
+// f5ID converts full path /Common/name into REST id ~Common~name
+func f5ID(fullPath, name string) string {
+	if fullPath == "" {
+		return name
+	}
+	return strings.Replace(fullPath, "/", "~", -1)
+}
+
+// f5Name strips partition from /Common/name
+func f5Name(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// f5SplitMember splits pool member name node:port
+func f5SplitMember(name string) (string, string) {
+	i := strings.LastIndex(name, ":")
+	if i < 0 {
+		return name, ""
+	}
+	return name[:i], name[i+1:]
+}
+
+// f5SplitDestination splits virtual destination /Common/1.1.1.1:80 into address and port
+// IPv6 destinations use dot as port separator: /Common/2001::1.80
+func f5SplitDestination(dest string) (string, string) {
+	d := f5Name(dest)
+	if strings.Count(d, ":") > 1 {
+		i := strings.LastIndex(d, ".")
+		if i < 0 {
+			return d, ""
+		}
+		return d[:i], d[i+1:]
+	}
+	return f5SplitMember(d)
+}
+
+func (f *f5lb) groupList(vsList []ltm.VirtualServer) ([]f5Group, error) {
+
+	var pools f5PoolList
+	if errList := f.client.ReadQuery(ltm.BasePath+ltm.PoolEndpoint, &pools); errList != nil {
+		return nil, &listError{collection: "pool", err: errList}
+	}
+
+	var groups []f5Group
+
+	for _, p := range pools.Items {
+		id := f5ID(p.FullPath, p.Name)
+		members, errMembers := f.ltm.PoolMembers().ListAll(id)
+		if errMembers != nil {
+			return nil, &listError{collection: "pool member", err: fmt.Errorf("pool=%s: %v", p.Name, errMembers)}
+		}
+		g := f5Group{pool: p, protocol: "tcp", members: members.Items}
+		for _, vs := range vsList {
+			if f5Name(vs.Pool) == p.Name && vs.IPProtocol != "" {
+				g.protocol = vs.IPProtocol
+				break
+			}
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+func addBackendPort(b *backend, port, protocol string) {
+	for _, bp := range b.BackendPorts {
+		if bp.Port == port && bp.Protocol == protocol {
+			return // port found - nothing to do
+		}
+	}
+	b.BackendPorts = append(b.BackendPorts, backendPort{Port: port, Protocol: protocol})
+}
+
+func (f *f5lb) BackendList() (map[string]*backend, error) {
+
+	nodes, errNodes := f.ltm.Node().ListAll()
+	if errNodes != nil {
+		return nil, &listError{collection: "node", err: errNodes}
+	}
+
+	vsList, errVirt := f.ltm.Virtual().ListAll()
+	if errVirt != nil {
+		return nil, &listError{collection: "virtual", err: errVirt}
+	}
+
+	groups, errGroups := f.groupList(vsList.Items)
+	if errGroups != nil {
+		return nil, errGroups
+	}
+
+	backendTab := map[string]*backend{} // backendName => backend
+
+	for _, n := range nodes.Items {
+		backendTab[n.Name] = &backend{BackendName: n.Name, BackendAddress: n.Address, State: f5State(n.Session, n.State)}
+	}
+
+	groupTab := map[string]f5Group{} // poolName => pool
+
+	for _, g := range groups {
+		for _, m := range g.members {
+			nodeName, port := f5SplitMember(m.Name)
+			b, found := backendTab[nodeName]
+			if !found {
+				continue // node not found - skip
+			}
+			addGroupMember(b, g.pool.Name, g.protocol, f5Member(m))
+			addBackendPort(b, port, g.protocol)
+			groupTab[g.pool.Name] = g // table records only pools with members
+		}
+	}
+
+	for _, vs := range vsList.Items {
+		g, groupFound := groupTab[f5Name(vs.Pool)]
+		if !groupFound {
+			continue // pool not found - skip
+		}
+		address, port := f5SplitDestination(vs.Destination)
+		for _, m := range g.members {
+			nodeName, _ := f5SplitMember(m.Name)
+			b, beFound := backendTab[nodeName]
+			if !beFound {
+				continue // node not found - skip
+			}
+			addVS(b, vs.Name, address, port, vs.IPProtocol, g.pool.Name)
+		}
+	}
+
+	return backendTab, nil
+}
+
+// f5Member maps pool member to group member
+func f5Member(m ltm.PoolMembers) backendSGMember {
+	nodeName, port := f5SplitMember(m.Name)
+	return backendSGMember{
+		Name:            nodeName,
+		Port:            port,
+		State:           f5State(m.Session, m.State),
+		Weight:          int(m.Ratio),
+		Priority:        int(m.PriorityGroup),
+		ConnectionLimit: int(m.ConnectionLimit),
+	}
+}
+
+func (f *f5lb) ServiceGroupList() ([]backendServiceGroup, error) {
+
+	groups, errGroups := f.groupList(nil)
+	if errGroups != nil {
+		return nil, errGroups
+	}
+
+	var list []backendServiceGroup
+	for _, g := range groups {
+		bsg := backendServiceGroup{Name: g.pool.Name, Protocol: g.protocol}
+		for _, m := range g.members {
+			bsg.Members = append(bsg.Members, f5Member(m))
+		}
+		list = append(list, bsg)
+	}
+
+	return list, nil
+}
+
+func (f *f5lb) BackendCreate(be backend) error {
+	session, upDown := f5Session(be.State)
+	node := ltm.Node{Name: be.BackendName, Address: be.BackendAddress, Partition: f.opt.Partition, Session: session, State: upDown}
+	op := deviceOp{Operation: "server create", Target: be.BackendName, Detail: []string{withState(be.BackendAddress, be.State)}}
+	return f.change(op, func() error { return f.ltm.Node().Create(node) })
+}
+
+// BackendUpdate checks the node address, since F5 does not support changing it, then updates node state.
+// Backend ports are defined by pool members, hence port state is ignored.
+func (f *f5lb) BackendUpdate(be backend) error {
+	node, errGet := f.ltm.Node().Get(f.nodeID(be.BackendName))
+	if errGet != nil {
+		return errGet
+	}
+	if node.Address != be.BackendAddress {
+		return fmt.Errorf("node=%s address=%s can not be changed to %s", be.BackendName, node.Address, be.BackendAddress)
+	}
+	if f5State(node.Session, node.State) == stateOf(be.State) {
+		return nil
+	}
+	op := deviceOp{Operation: "server state", Target: be.BackendName, Detail: []string{stateOf(be.State)}}
+	return f.patchState(op, ltm.BasePath+ltm.NodeEndpoint+"/"+f5ID(node.FullPath, node.Name), be.State)
+}
+
+func (f *f5lb) BackendDelete(name string) error {
+	op := deviceOp{Operation: "server delete", Target: name}
+	return f.change(op, func() error { return f.ltm.Node().Delete(f.nodeID(name)) })
+}
+
+// nodeID addresses node in driver partition, since a bare name resolves to /Common
+func (f *f5lb) nodeID(name string) string {
+	if f.opt.Partition == "" {
+		return name
+	}
+	return f5ID("/"+f.opt.Partition+"/"+name, name)
+}
+
+// findF5Groups returns groups named in be.ServiceGroups
+func (f *f5lb) findF5Groups(be backend) ([]f5Group, error) {
+	groups, errGroups := f.groupList(nil)
+	if errGroups != nil {
+		return nil, errGroups
+	}
+	found := []f5Group{}
+	for _, bsg := range be.ServiceGroups {
+		for _, g := range groups {
+			if g.pool.Name == bsg.Name {
+				found = append(found, g)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// memberDelete removes pool members for backend, except those in keep
+func (f *f5lb) memberDelete(g f5Group, backendName string, keep map[string]string) int {
+
+	me := "f5lb.memberDelete"
+
+	var errCount int
+
+	poolID := f5ID(g.pool.FullPath, g.pool.Name)
+
+	for _, m := range g.members {
+		nodeName, _ := f5SplitMember(m.Name)
+		if nodeName != backendName {
+			continue // keep other members
+		}
+		if _, found := keep[m.Name]; found {
+			continue // keep wanted member
+		}
+		memberID := f5ID(m.FullPath, m.Name)
+		op := deviceOp{Operation: "group member delete", Target: g.pool.Name, Detail: []string{m.Name}}
+		errDelete := f.change(op, func() error { return f.ltm.PoolMembers().Delete(poolID, memberID) })
+		if errDelete != nil {
+			log.Printf(me+": pool=%s member=%s: %v", g.pool.Name, m.Name, errDelete)
+			errCount++
+		}
+	}
+
+	return errCount
+}
+
+func (f *f5lb) BackendLink(be backend) (int, error) {
+
+	me := "f5lb.BackendLink"
+
+	groups, errFind := f.findF5Groups(be)
+	if errFind != nil {
+		return 0, errFind
+	}
+
+	var errCount int
+
+	for _, g := range groups {
+
+		wanted := map[string]string{} // wanted members for pool => state
+		for _, bsg := range be.ServiceGroups {
+			if bsg.Name != g.pool.Name {
+				continue
+			}
+			for _, bsgm := range bsg.Members {
+				wanted[bsgm.Name+":"+bsgm.Port] = bsgm.State
+			}
+		}
+
+		existing := map[string]struct{}{}
+		for _, m := range g.members {
+			existing[m.Name] = struct{}{}
+		}
+
+		// sort members for stable operation order
+		var names []string
+		for name := range wanted {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// add missing members - existing members keep state and settings, see MemberUpdate
+		poolID := f5ID(g.pool.FullPath, g.pool.Name)
+		for _, name := range names {
+			if _, found := existing[name]; found {
+				continue
+			}
+			state := wanted[name]
+			session, upDown := f5Session(state)
+			member := ltm.PoolMembers{Name: name, Partition: f.opt.Partition, Session: session, State: upDown}
+			op := deviceOp{Operation: "group member create", Target: g.pool.Name, Detail: []string{withState(name, state)}}
+			errCreate := f.change(op, func() error { return f.ltm.PoolMembers().Create(poolID, member) })
+			if errCreate != nil {
+				log.Printf(me+": pool=%s member=%s: %v", g.pool.Name, name, errCreate)
+				errCount++
+			}
+		}
+
+		// remove previous members not wanted anymore - only after new ones are in, so the pool never runs empty
+		errCount += f.memberDelete(g, be.BackendName, wanted)
+	}
+
+	return errCount, nil
+}
+
+func (f *f5lb) BackendUnlink(be backend) (int, error) {
+
+	groups, errFind := f.findF5Groups(be)
+	if errFind != nil {
+		return 0, errFind
+	}
+
+	var errCount int
+
+	for _, g := range groups {
+		errCount += f.memberDelete(g, be.BackendName, nil)
+	}
+
+	return errCount, nil
+}
+
+// MemberUpdate sets session, state, ratio, priorityGroup and connectionLimit of pool members listed in be.ServiceGroups.
+// Disabled members keep current connections (and persistent ones), getting no new connections.
+func (f *f5lb) MemberUpdate(be backend) (int, error) {
+
+	me := "f5lb.MemberUpdate"
+
+	groups, errFind := f.findF5Groups(be)
+	if errFind != nil {
+		return 0, errFind
+	}
+
+	var errCount int
+
+	for _, g := range groups {
+		poolID := f5ID(g.pool.FullPath, g.pool.Name)
+		for _, bsgm := range findGroup(be.ServiceGroups, g.pool.Name).Members {
+			fields := f5MemberFields(bsgm)
+			if len(fields) == 0 {
+				continue // keep member
+			}
+			name := bsgm.Name + ":" + bsgm.Port
+			detail := memberDetail(bsgm)
+			detail[0] = name
+			op := deviceOp{Operation: "group member update", Target: g.pool.Name, Detail: detail}
+			memberID := ""
+			for _, m := range g.members {
+				if m.Name == name {
+					memberID = f5ID(m.FullPath, m.Name)
+				}
+			}
+			if memberID == "" && f.plan {
+				memberID = name // member created by plan
+			}
+			if memberID == "" {
+				log.Printf(me+": pool=%s member=%s not found", g.pool.Name, name)
+				errCount++
+				continue
+			}
+			path := ltm.BasePath + ltm.PoolEndpoint + "/" + poolID + "/members/" + memberID
+			if errPatch := f.patch(op, path, fields); errPatch != nil {
+				log.Printf(me+": pool=%s member=%s: %v", g.pool.Name, name, errPatch)
+				errCount++
+			}
+		}
+	}
+
+	return errCount, nil
+}
+
+// f5Stats is the generic stats response from /stats endpoints
+type f5Stats struct {
+	Entries map[string]struct {
+		NestedStats struct {
+			Entries map[string]f5StatValue `json:"entries"`
+		} `json:"nestedStats"`
+	} `json:"entries"`
+}
+
+type f5StatValue struct {
+	Value       int64  `json:"value"`
+	Description string `json:"description"`
+}
+
+// f5StatsFrom converts serverside counters, availability offline is down (unknown: no monitor, takes traffic)
+func f5StatsFrom(s map[string]f5StatValue) backendStats {
+	return backendStats{
+		Health:   health(s["status.availabilityState"].Description != "offline"),
+		CurConns: s["serverside.curConns"].Value,
+		TotConns: s["serverside.totConns"].Value,
+		BytesIn:  s["serverside.bitsIn"].Value / 8,
+		BytesOut: s["serverside.bitsOut"].Value / 8,
+	}
+}
+
+func (f *f5lb) MemberConnections(be backend) ([]memberConn, error) {
+
+	groups, errFind := f.findF5Groups(be)
+	if errFind != nil {
+		return nil, errFind
+	}
+
+	list := []memberConn{}
+
+	for _, g := range groups {
+		var stats f5Stats
+		path := ltm.BasePath + ltm.PoolEndpoint + "/" + f5ID(g.pool.FullPath, g.pool.Name) + "/members/stats"
+		if errStats := f.client.ReadQuery(path, &stats); errStats != nil {
+			return nil, fmt.Errorf("pool %s statistics: %v", g.pool.Name, errStats)
+		}
+		for _, e := range stats.Entries {
+			s := e.NestedStats.Entries
+			if f5Name(s["nodeName"].Description) != be.BackendName {
+				continue
+			}
+			port := fmt.Sprintf("%d", s["port"].Value)
+			list = append(list, memberConn{Group: g.pool.Name, Member: be.BackendName, Port: port, Connections: int(s["serverside.curConns"].Value)})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Group != list[j].Group {
+			return list[i].Group < list[j].Group
+		}
+		return list[i].Port < list[j].Port
+	})
+
+	return list, nil
+}
+
+// BackendStats reads node stats into backends, pool member stats into members.
+// F5 has no port object, hence port stats are the sum of member stats for the port.
+func (f *f5lb) BackendStats(tab map[string]*backend) error {
+
+	var nodeStats f5Stats
+	if errStats := f.client.ReadQuery(ltm.BasePath+ltm.NodeEndpoint+"/stats", &nodeStats); errStats != nil {
+		return fmt.Errorf("node statistics: %v", errStats)
+	}
+	for _, e := range nodeStats.Entries {
+		s := e.NestedStats.Entries
+		if b, found := tab[f5Name(s["tmName"].Description)]; found {
+			stats := f5StatsFrom(s)
+			b.Stats = &stats
+		}
+	}
+
+	groups, errGroups := f.groupList(nil)
+	if errGroups != nil {
+		return errGroups
+	}
+
+	for _, g := range groups {
+		var stats f5Stats
+		var read bool // read pool stats only when some backend is member
+		for _, b := range tab {
+			if findGroup(b.ServiceGroups, g.pool.Name).Name == "" {
+				continue
+			}
+			if !read {
+				path := ltm.BasePath + ltm.PoolEndpoint + "/" + f5ID(g.pool.FullPath, g.pool.Name) + "/members/stats"
+				if errStats := f.client.ReadQuery(path, &stats); errStats != nil {
+					return fmt.Errorf("pool %s statistics: %v", g.pool.Name, errStats)
+				}
+				read = true
+			}
+			for _, e := range stats.Entries {
+				s := e.NestedStats.Entries
+				if f5Name(s["nodeName"].Description) != b.BackendName {
+					continue
+				}
+				port := fmt.Sprintf("%d", s["port"].Value)
+				setMemberStats(b, g.pool.Name, port, f5StatsFrom(s))
+			}
+		}
+	}
+
+	// sum member stats per port
+	for _, b := range tab {
+		for i, p := range b.BackendPorts {
+			var sum *backendStats
+			for _, sg := range b.ServiceGroups {
+				if m, found := findMember(sg.Members, b.BackendName, p.Port); found && m.Stats != nil {
+					if sum == nil {
+						sum = &backendStats{}
+					}
+					sum.add(*m.Stats)
+				}
+			}
+			b.BackendPorts[i].Stats = sum
+		}
+	}
+
+	return nil
+}
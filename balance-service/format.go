@@ -4,7 +4,6 @@ import (
 	"log"
 )
 
-/*
 type virtual struct {
 	Name    string
 	Address string // listen addr
@@ -28,7 +27,6 @@ type serverPort struct {
 	Port     string // backend server port
 	Protocol string // backend server proto
 }
-*/
 
 func A10ProtocolName(number string) string {
 	protoName := "unknown"
@@ -58,7 +56,6 @@ func A10ProtocolNumber(name string) string {
 	return number
 }
 
-/*
 // listNames extracts all names from virtual list
 func listNames(vsList []virtual) ([]string, []string, []string) {
 
@@ -122,4 +119,3 @@ func findVirtual(vsList []virtual, name string) virtual {
 
 	return virtual{}
 }
-*/
@@ -92,6 +92,36 @@ func clientGet(c *http.Client, url string) ([]byte, error) {
 	return info, errRead
 }
 
+// clientDo sends request with arbitrary method and headers
+func clientDo(c *http.Client, method, url string, header http.Header, r io.Reader) ([]byte, error) {
+
+	req, errNew := http.NewRequest(method, url, r)
+	if errNew != nil {
+		return nil, fmt.Errorf("httpDo: method=%s url=%v: %v", method, url, errNew)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, errDo := c.Do(req)
+	if errDo != nil {
+		return nil, fmt.Errorf("httpDo: method=%s url=%v: %v", method, url, errDo)
+	}
+
+	defer resp.Body.Close()
+
+	body, errRead := ioutil.ReadAll(resp.Body)
+	if errRead != nil {
+		return nil, fmt.Errorf("httpDo: read all: method=%s url=%v: %v", method, url, errRead)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return body, fmt.Errorf("httpDo: method=%s bad status: %d body=[%s]", method, resp.StatusCode, string(body))
+	}
+
+	return body, nil
+}
+
 func writeLine(caller string, w http.ResponseWriter) {
 	_, err := io.WriteString(w, "\n")
 	if err != nil {
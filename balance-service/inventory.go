@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Device inventory: named devices loaded from a config file (env var INVENTORY).
+// Once an inventory is loaded, the service refuses to talk to hosts not listed there,
+// hence it can't be abused as a proxy to arbitrary hosts.
+//
+// Example inventory file:
+//
+// devices:
+// - name: lb1
+//   address: 10.0.0.1
+//   vendor: a10
+//   api_version: v2
+//   site: dc1
+//   tags: [prod]
+// - name: bigip1
+//   address: 10.0.0.2:8443
+//   vendor: f5
+//   partition: Common
+//   tls:
+//     verify: true
+
+// inventoryDevice is a load balancer known to the service
+type inventoryDevice struct {
+	Name       string       `json:"name" yaml:"name"`
+	Address    string       `json:"address" yaml:"address"`                             // host or host:port
+	Vendor     string       `json:"vendor" yaml:"vendor"`                               // a10, f5
+	APIVersion string       `json:"api_version,omitempty" yaml:"api_version,omitempty"` // a10: v2 (default), v3
+	Partition  string       `json:"partition,omitempty" yaml:"partition,omitempty"`     // f5: partition for created objects
+	TLS        inventoryTLS `json:"tls" yaml:"tls"`
+	Site       string       `json:"site,omitempty" yaml:"site,omitempty"`
+	Tags       []string     `json:"tags,omitempty" yaml:"tags,omitempty"`
+}
+
+type inventoryTLS struct {
+	Verify bool `json:"verify" yaml:"verify"` // verify device certificate against system CAs
+}
+
+// driver returns the driver name for device
+func (d *inventoryDevice) driver() string {
+	switch d.Vendor {
+	case "a10":
+		if d.APIVersion == "" {
+			return "a10v2"
+		}
+		return "a10" + d.APIVersion
+	}
+	return d.Vendor
+}
+
+type deviceInventory struct {
+	byName    map[string]*inventoryDevice
+	byAddress map[string]*inventoryDevice
+}
+
+// inventory, when set, restricts the service to known devices
+var inventory *deviceInventory
+
+func loadInventory(file string) (*deviceInventory, error) {
+	buf, errRead := ioutil.ReadFile(file)
+	if errRead != nil {
+		return nil, errRead
+	}
+	return parseInventory(buf)
+}
+
+func parseInventory(buf []byte) (*deviceInventory, error) {
+	var config struct {
+		Devices []inventoryDevice `yaml:"devices"`
+	}
+	if errYaml := yaml.UnmarshalStrict(buf, &config); errYaml != nil {
+		return nil, errYaml
+	}
+
+	inv := &deviceInventory{byName: map[string]*inventoryDevice{}, byAddress: map[string]*inventoryDevice{}}
+
+	for i := range config.Devices {
+		d := &config.Devices[i]
+		if d.Name == "" || d.Address == "" {
+			return nil, fmt.Errorf("device %d: missing name or address", i)
+		}
+		if strings.ContainsAny(d.Name, "/?#") {
+			return nil, fmt.Errorf("device %s: bad name", d.Name)
+		}
+		if _, found := lbDriverTab[d.driver()]; !found {
+			return nil, fmt.Errorf("device %s: unknown vendor=[%s] api_version=[%s]", d.Name, d.Vendor, d.APIVersion)
+		}
+		if _, found := inv.byName[d.Name]; found {
+			return nil, fmt.Errorf("device %s: duplicate name", d.Name)
+		}
+		if dup, found := inv.byAddress[d.Address]; found {
+			return nil, fmt.Errorf("device %s: address %s already used by device %s", d.Name, d.Address, dup.Name)
+		}
+		inv.byName[d.Name] = d
+		inv.byAddress[d.Address] = d
+	}
+
+	return inv, nil
+}
+
+// checkInventory sends 403 (forbidden) for hosts not in inventory,
+// or reached through a vendor driver other than the inventory one.
+// Any host is allowed when no inventory is loaded.
+func checkInventory(label, vendor, host string, w http.ResponseWriter, r *http.Request) bool {
+	if inventory == nil {
+		return true
+	}
+	d, found := inventory.byAddress[host]
+	if !found {
+		log.Printf("%s: method=%s url=%s from=%s host=%s - refused: not in device inventory", label, r.Method, r.URL.Path, r.RemoteAddr, host)
+		http.Error(w, "device not in inventory: "+host, http.StatusForbidden) // 403
+		return false
+	}
+	if driver := d.driver(); driver != vendor {
+		log.Printf("%s: method=%s url=%s from=%s host=%s vendor=%s - refused: inventory device %s uses %s", label, r.Method, r.URL.Path, r.RemoteAddr, host, vendor, d.Name, driver)
+		http.Error(w, fmt.Sprintf("device %s uses vendor driver %s, not %s", d.Name, driver, vendor), http.StatusForbidden) // 403
+		return false
+	}
+	return true
+}
+
+// inventoryOptions adds device settings from inventory to driver options
+func inventoryOptions(host string, opt lbOptions) lbOptions {
+	if inventory == nil {
+		return opt
+	}
+	if d, found := inventory.byAddress[host]; found {
+		opt.Partition = d.Partition
+		opt.TLSVerify = d.TLS.Verify
+	}
+	return opt
+}
+
+// /v1/devices/                  - list devices (filters: ?site=dc1&tag=prod)
+// /v1/devices/<name>            - device details
+// /v1/devices/<name>/backend/   - same as /v1/lb/<vendor>/node/<address>/backend/
+// /v1/devices/<name>/virtual/   - same as /v1/lb/<vendor>/node/<address>/virtual/
+// ^^^^^^^^^^^^
+// prefix
+func handlerDevices(debug, dry bool, w http.ResponseWriter, r *http.Request, path string) {
+
+	me := "handlerDevices"
+
+	if !strings.HasPrefix(r.URL.Path, path) {
+		sendNotFound(me, w, r)
+		return
+	}
+
+	if inventory == nil {
+		http.Error(w, "device inventory not configured", http.StatusNotFound) // 404
+		return
+	}
+
+	suffix := strings.TrimPrefix(r.URL.Path, path)
+
+	fields := strings.FieldsFunc(suffix, func(r rune) bool { return r == '/' })
+
+	if len(fields) < 2 {
+		if svcAuth != nil && svcAuth.user(r) == nil {
+			http.Error(w, "not authorized - missing or unknown API token", http.StatusUnauthorized) // 401
+			return
+		}
+		if r.Method != http.MethodGet {
+			sendNotSupported(me, w, r)
+			return
+		}
+		acceptYAML, _ := clientOptions(debug, r)
+		if len(fields) == 0 {
+			sendList(me, w, r, inventory.list(r.URL.Query()["site"], r.URL.Query()["tag"]), acceptYAML)
+			return
+		}
+		d, found := inventory.byName[fields[0]]
+		if !found {
+			http.Error(w, "device not found: "+fields[0], http.StatusNotFound) // 404
+			return
+		}
+		sendList(me, w, r, d, acceptYAML)
+		return
+	}
+
+	d, found := inventory.byName[fields[0]]
+	if !found {
+		http.Error(w, "device not found: "+fields[0], http.StatusNotFound) // 404
+		return
+	}
+
+	// replace device name with address: <address>/backend/...
+	nodeFields := append([]string{d.Address}, fields[1:]...)
+
+	serveNode(debug, dry, d.driver(), w, r, suffix, nodeFields)
+}
+
+// list returns devices sorted by name, matching any of sites (if given) and any of tags (if given)
+func (inv *deviceInventory) list(sites, tags []string) []*inventoryDevice {
+	list := []*inventoryDevice{}
+	for _, d := range inv.byName {
+		if len(sites) > 0 && !inventoryMatch(sites, []string{d.Site}) {
+			continue
+		}
+		if len(tags) > 0 && !inventoryMatch(tags, d.Tags) {
+			continue
+		}
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func inventoryMatch(wanted, values []string) bool {
+	for _, w := range wanted {
+		for _, v := range values {
+			if w == v {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseInventory(t *testing.T) {
+	if _, found := lbDriverTab["a10v2"]; !found {
+		registerDriver("a10v2", newA10v2) // main() is not run by tests
+	}
+
+	bad := []string{
+		"devices:\n- name: lb1\n",                                                                                // missing address
+		"devices:\n- name: lb1\n  address: 1.1.1.1\n  vendor: acme\n",                                            // unknown vendor
+		"devices:\n- name: lb1\n  address: 1.1.1.1\n  vendor: a10\n  color: red\n",                               // unknown field
+		"devices:\n- {name: lb1, address: 1.1.1.1, vendor: a10}\n- {name: lb1, address: 2.2.2.2, vendor: a10}\n", // duplicate name
+		"devices:\n- {name: lb1, address: 1.1.1.1, vendor: a10}\n- {name: lb2, address: 1.1.1.1, vendor: a10}\n", // duplicate address
+	}
+	for _, b := range bad {
+		if _, errParse := parseInventory([]byte(b)); errParse == nil {
+			t.Errorf("missing error for inventory: [%s]", b)
+		}
+	}
+
+	inv, errParse := parseInventory([]byte("devices:\n- {name: lb1, address: 1.1.1.1, vendor: a10, site: dc1}\n- {name: lb2, address: 2.2.2.2, vendor: a10, api_version: v2, tags: [prod]}\n"))
+	if errParse != nil {
+		t.Fatalf("inventory: %v", errParse)
+	}
+	if d := inv.byName["lb2"]; d == nil || d.driver() != "a10v2" {
+		t.Errorf("unexpected device: %v", d)
+	}
+	if list := inv.list(nil, []string{"prod"}); len(list) != 1 || list[0].Name != "lb2" {
+		t.Errorf("unexpected tag filter result: %v", list)
+	}
+	if list := inv.list([]string{"dc1", "dc2"}, nil); len(list) != 1 || list[0].Name != "lb1" {
+		t.Errorf("unexpected site filter result: %v", list)
+	}
+}
+
+func TestE2EInventory(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	inv, errParse := parseInventory([]byte("devices:\n- name: lb1\n  address: " + e.host + "\n  vendor: a10\n"))
+	if errParse != nil {
+		t.Fatalf("inventory: %v", errParse)
+	}
+	inventory = inv
+	defer func() { inventory = nil }()
+
+	devices := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.SetBasicAuth("admin", "a10")
+		w := httptest.NewRecorder()
+		handlerDevices(false, false, w, r, "/v1/devices/")
+		return w
+	}
+
+	w := devices("/v1/devices/")
+	expectStatus(t, "list", w, http.StatusOK)
+	var list []inventoryDevice
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &list); errJSON != nil || len(list) != 1 || list[0].Name != "lb1" {
+		t.Errorf("list: unexpected devices: %v [%s]", errJSON, w.Body.String())
+	}
+
+	w = devices("/v1/devices/lb1/backend/s0")
+	expectStatus(t, "get", w, http.StatusOK)
+	if !bytes.Contains(w.Body.Bytes(), []byte("1.1.1.1")) {
+		t.Errorf("get: unexpected backend: [%s]", w.Body.String())
+	}
+
+	expectStatus(t, "unknown device", devices("/v1/devices/lb9/backend"), http.StatusNotFound)
+
+	// raw address routes are restricted to inventory
+	expectStatus(t, "raw known host", e.request(http.MethodGet, "backend/s0", nil, nil), http.StatusOK)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/at2/node/169.254.169.254/backend", nil)
+	r.SetBasicAuth("admin", "a10")
+	w = httptest.NewRecorder()
+	handlerNodeA10v2(false, false, w, r, "/v1/at2/node/")
+	expectStatus(t, "raw unknown host", w, http.StatusForbidden)
+
+	// inventory device is reached only through its vendor driver
+	r = httptest.NewRequest(http.MethodGet, "/v1/at3/node/"+e.host+"/backend", nil)
+	r.SetBasicAuth("admin", "a10")
+	w = httptest.NewRecorder()
+	handlerNodeA10v3(false, false, w, r, "/v1/at3/node/")
+	expectStatus(t, "raw host wrong vendor", w, http.StatusForbidden)
+	if !strings.Contains(w.Body.String(), "device lb1 uses vendor driver a10v2, not a10v3") {
+		t.Errorf("wrong vendor: unexpected body: [%s]", w.Body.String())
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Background jobs (drain, shift) are polled with GET /v1/jobs/<id>, and canceled with DELETE /v1/jobs/<id>.
+// Jobs live in memory only: their state is lost on restart. Shutdown cancels running jobs
+// and waits for them to wind down (drain re-enables members) up to SHUTDOWN_TIMEOUT.
+
+const (
+	jobDrain = "drain"
+	jobShift = "shift"
+
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+var jobKeep = time.Hour // finished jobs are forgotten after this
+
+// jobStatus is the progress of background job, as reported to clients
+type jobStatus struct {
+	ID      string
+	Kind    string // drain, shift
+	Device  string
+	Backend string `json:",omitempty" yaml:",omitempty"`
+	Groups  []string
+	State   string // drain: disabling, draining, unlinking - shift: shifting - done, failed
+	Started time.Time
+	Updated time.Time
+
+	// drain
+	Timeout     string       `json:",omitempty" yaml:",omitempty"`
+	TimedOut    bool         `json:",omitempty" yaml:",omitempty"`
+	Connections []memberConn `json:",omitempty" yaml:",omitempty"` // last poll
+
+	// shift
+	Interval string `json:",omitempty" yaml:",omitempty"`
+	Steps    []int  `json:",omitempty" yaml:",omitempty"` // percent of weight on new members, per step
+	Step     int    `json:",omitempty" yaml:",omitempty"` // steps completed
+
+	Operations []deviceOp
+	Errors     int
+	Result     string `json:",omitempty" yaml:",omitempty"`
+	Error      string `json:",omitempty" yaml:",omitempty"`
+}
+
+type job struct {
+	mutex  sync.Mutex
+	status jobStatus
+	vendor string          // device driver, for cancel authorization
+	ctx    context.Context // canceled to stop job
+	cancel context.CancelFunc
+}
+
+func (j *job) get() jobStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	s := j.status
+	s.Connections = append([]memberConn{}, s.Connections...)
+	s.Operations = append([]deviceOp{}, s.Operations...)
+	return s
+}
+
+func (j *job) update(change func(s *jobStatus)) {
+	j.mutex.Lock()
+	change(&j.status)
+	j.status.Updated = time.Now().UTC()
+	j.mutex.Unlock()
+}
+
+var jobs = struct {
+	mutex sync.Mutex
+	next  int
+	tab   map[string]*job
+}{tab: map[string]*job{}}
+
+// newJob registers job with initial status, forgetting old finished jobs
+func newJob(vendor string, status jobStatus) *job {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	for id, j := range jobs.tab {
+		s := j.get()
+		if jobFinished(s.State) && time.Since(s.Updated) > jobKeep {
+			delete(jobs.tab, id)
+		}
+	}
+
+	jobs.next++
+	now := time.Now().UTC()
+	status.ID = strconv.Itoa(jobs.next)
+	status.Started = now
+	status.Updated = now
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{status: status, vendor: vendor, ctx: ctx, cancel: cancel}
+	jobs.tab[status.ID] = j
+	return j
+}
+
+func jobFinished(state string) bool {
+	return state == jobDone || state == jobFailed || state == jobCanceled
+}
+
+// jobsRunning tracks running jobs, so shutdown can wait for them
+var jobsRunning sync.WaitGroup
+
+// start runs job in background
+func (j *job) start(run func()) {
+	jobsRunning.Add(1)
+	go func() {
+		defer jobsRunning.Done()
+		defer j.cancel() // release context
+		run()
+	}()
+}
+
+// sleep waits for d, returning false when job is canceled first
+func (j *job) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-j.ctx.Done():
+		return false
+	}
+}
+
+func (j *job) canceled() bool {
+	return j.ctx.Err() != nil
+}
+
+// jobsCancel cancels all jobs - finished jobs ignore it
+func jobsCancel() {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	for _, j := range jobs.tab {
+		j.cancel()
+	}
+}
+
+// jobsWait waits for running jobs up to timeout, returning false on timeout
+func jobsWait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		jobsRunning.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// jobRequest copies request fields recorded by audit, since job outlives its handler
+func jobRequest(r *http.Request) *http.Request {
+	d := r.Clone(context.WithValue(context.Background(), callerKey{}, requestCaller(r)))
+	d.Body = http.NoBody
+	d.Header.Del("Authorization")
+	return d
+}
+
+// session runs call within a new device session
+func (j *job) session(debug, dry bool, vendor, host, username, password string, call func(lb loadBalancer) error) error {
+	lb, errNew := newLoadBalancer(vendor, host, lbOptions{Debug: debug, Dry: dry})
+	if errNew != nil {
+		return errNew
+	}
+	if errLogin := lb.Login(username, password); errLogin != nil {
+		return fmt.Errorf("auth: %v", errLogin)
+	}
+	defer func() {
+		if errClose := lb.Logout(); errClose != nil {
+			log.Printf("job.session: job=%s close error: %v", j.status.ID, errClose)
+		}
+	}()
+	errCall := call(lb)
+	j.update(func(s *jobStatus) { s.Operations = append(s.Operations, lb.Operations()...) })
+	return errCall
+}
+
+func (j *job) fail(err error) {
+	log.Printf("job: job=%s failed: %v", j.status.ID, err)
+	j.update(func(s *jobStatus) {
+		s.State = jobFailed
+		s.Error = err.Error()
+	})
+}
+
+// sendJob answers 202 (accepted) with job location
+func sendJob(me string, debug bool, j *job, w http.ResponseWriter, r *http.Request) {
+	acceptYAML, _ := clientOptions(debug, r)
+
+	w.Header().Set("Location", "/v1/jobs/"+j.status.ID)
+
+	sendReport(me, w, r, j.get(), acceptYAML, http.StatusAccepted) // 202
+}
+
+// /v1/jobs/            - list jobs
+// /v1/jobs/<id>        - single job
+// DELETE /v1/jobs/<id> - cancel job
+// ^^^^^^^^^
+// prefix
+func handlerJobs(debug bool, w http.ResponseWriter, r *http.Request, path string) {
+
+	me := "handlerJobs"
+
+	if !strings.HasPrefix(r.URL.Path, path) {
+		sendNotFound(me, w, r)
+		return
+	}
+
+	if svcAuth != nil && svcAuth.user(r) == nil {
+		http.Error(w, "not authorized - missing or unknown API token", http.StatusUnauthorized) // 401
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, path), "/")
+
+	if r.Method == http.MethodDelete && id != "" {
+		jobCancel(debug, id, w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		sendNotSupported(me, w, r)
+		return
+	}
+
+	acceptYAML, _ := clientOptions(debug, r)
+
+	jobs.mutex.Lock()
+	var found []*job
+	for jobID, j := range jobs.tab {
+		if id == "" || id == jobID {
+			found = append(found, j)
+		}
+	}
+	jobs.mutex.Unlock()
+
+	if id != "" {
+		if len(found) < 1 {
+			http.Error(w, "job not found: "+id, http.StatusNotFound) // 404
+			return
+		}
+		sendList(me, w, r, found[0].get(), acceptYAML)
+		return
+	}
+
+	list := []jobStatus{}
+	for _, j := range found {
+		list = append(list, j.get())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := strconv.Atoi(list[i].ID)
+		b, _ := strconv.Atoi(list[j].ID)
+		return a < b
+	})
+
+	sendList(me, w, r, list, acceptYAML)
+}
+
+// jobCancel stops running job, with the same credentials and policy required to change the job groups.
+// Answers 202 (accepted): the job winds down in background, until state canceled.
+func jobCancel(debug bool, id string, w http.ResponseWriter, r *http.Request) {
+
+	me := "jobCancel"
+
+	if !callerAuth(me, w, r) {
+		return
+	}
+
+	jobs.mutex.Lock()
+	j, found := jobs.tab[id]
+	jobs.mutex.Unlock()
+
+	if !found {
+		http.Error(w, "job not found: "+id, http.StatusNotFound) // 404
+		return
+	}
+
+	s := j.get()
+
+	if !checkInventory(me, j.vendor, s.Device, w, r) {
+		return
+	}
+
+	r, username, password, authOK := deviceAuth(me, s.Device, id, w, r)
+	if !authOK {
+		return
+	}
+
+	if !authorize(me, s.Device, policyUpdate, s.Groups, w, r) {
+		return
+	}
+
+	if svcAuth == nil {
+		// basic auth: credentials must log into the device
+		lb := lbLogin(me, j.vendor, s.Device, inventoryOptions(s.Device, lbOptions{Debug: debug}), username, password, w, r)
+		if lb == nil {
+			return
+		}
+		lbLogout(me, lb, r)
+	}
+
+	if jobFinished(s.State) {
+		http.Error(w, "job already finished: "+id+" state="+s.State, http.StatusConflict) // 409
+		return
+	}
+
+	log.Printf(me+": method=%s url=%s from=%s user=%s job=%s kind=%s canceling", r.Method, r.URL.Path, r.RemoteAddr, requestCaller(r), id, s.Kind)
+
+	j.cancel()
+
+	acceptYAML, _ := clientOptions(debug, r)
+
+	sendReport(me, w, r, j.get(), acceptYAML, http.StatusAccepted) // 202
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// loadBalancer is the vendor-neutral driver interface for the /backend/ route
+// Every driver speaks the same backend model, regardless of device brand.
+type loadBalancer interface {
+	Login(username, password string) error
+	Logout() error
+
+	BackendList() (map[string]*backend, error) // backendName => backend
+	BackendCreate(be backend) error
+	BackendUpdate(be backend) error
+	BackendDelete(name string) error
+
+	ServiceGroupList() ([]backendServiceGroup, error) // all groups available on device
+	BackendLink(be backend) (int, error)              // link backend to be.ServiceGroups - returns error count
+	BackendUnlink(be backend) (int, error)            // unlink backend from be.ServiceGroups - returns error count
+
+	MemberUpdate(be backend) (int, error)               // set state and settings of members listed in be.ServiceGroups - returns error count
+	MemberConnections(be backend) ([]memberConn, error) // current connections to backend members in be.ServiceGroups
+	BackendStats(tab map[string]*backend) error         // fill Stats of backends in tab, their ports and members
+
+	Operations() []deviceOp // device write operations issued (or planned) so far
+}
+
+// lbOptions specify parameters for a load balancer driver
+type lbOptions struct {
+	Debug bool // enable debugging
+	Dry   bool // do not change anything
+	Plan  bool // only record write operations, do not send them to device
+
+	Partition string // f5 partition for created objects (from device inventory)
+	TLSVerify bool   // verify device certificate (from device inventory)
+}
+
+// deviceOp is a write operation sent (or planned) to a device
+type deviceOp struct {
+	Operation string   // server create, group update, ...
+	Target    string   // object name
+	Detail    []string `json:",omitempty" yaml:",omitempty"` // address, ports, members
+	Status    string   // planned, ok, failed, superseded
+	Error     string   `json:",omitempty" yaml:",omitempty"` // device error text
+}
+
+// memberConn is the current connection count for a group member
+type memberConn struct {
+	Group       string
+	Member      string
+	Port        string
+	Connections int
+}
+
+const (
+	opPlanned    = "planned"
+	opOK         = "ok"
+	opFailed     = "failed"
+	opSuperseded = "superseded" // failed, but a fallback achieved the same result
+)
+
+// opRecorder records device write operations, skipping them in plan mode
+// Drivers embed opRecorder and send every write call through run().
+type opRecorder struct {
+	plan bool
+	ops  []deviceOp
+}
+
+func (o *opRecorder) run(op deviceOp, call func() error) error {
+	if o.plan {
+		log.Printf("PLAN %s %s %v", op.Operation, op.Target, op.Detail)
+		op.Status = opPlanned
+		o.ops = append(o.ops, op)
+		return nil
+	}
+	err := call()
+	if err == nil {
+		op.Status = opOK
+	} else {
+		op.Status = opFailed
+		op.Error = err.Error()
+	}
+	o.ops = append(o.ops, op)
+	return err
+}
+
+func (o *opRecorder) Operations() []deviceOp {
+	return o.ops
+}
+
+// lbDriver creates a load balancer driver for a device host
+type lbDriver func(host string, opt lbOptions) loadBalancer
+
+var (
+	lbDriverTab = map[string]lbDriver{} // vendor => driver
+
+	errNotImplemented = errors.New("not implemented")
+)
+
+func registerDriver(vendor string, driver lbDriver) {
+	log.Printf("registering driver: [%s]", vendor)
+	lbDriverTab[vendor] = driver
+}
+
+func newLoadBalancer(vendor, host string, opt lbOptions) (loadBalancer, error) {
+	driver, found := lbDriverTab[vendor]
+	if !found {
+		return nil, fmt.Errorf("unknown vendor: [%s]", vendor)
+	}
+	return &meteredLB{lb: driver(host, inventoryOptions(host, opt)), device: host, vendor: vendor}, nil
+}
+
+// /v1/lb/<vendor>/node/<host>/backend/
+// ^^^^^^^
+// prefix
+func handlerLB(debug, dry bool, w http.ResponseWriter, r *http.Request, path string) {
+
+	me := "handlerLB"
+
+	if !strings.HasPrefix(r.URL.Path, path) {
+		sendNotFound(me, w, r)
+		return
+	}
+
+	suffix := strings.TrimPrefix(r.URL.Path, path)
+
+	fields := strings.FieldsFunc(suffix, func(r rune) bool { return r == '/' })
+
+	if len(fields) < 2 {
+		reason := fmt.Sprintf("missing path fields: %d < %d", len(fields), 2)
+		sendBadRequest(me, reason, w, r)
+		return
+	}
+
+	vendor := fields[0]
+	if _, found := lbDriverTab[vendor]; !found {
+		reason := fmt.Sprintf("unknown vendor: [%s]", vendor)
+		sendBadRequest(me, reason, w, r)
+		return
+	}
+
+	nodeField := fields[1]
+	if nodeField != "node" {
+		reason := fmt.Sprintf("missing node field: [%s]", nodeField)
+		sendBadRequest(me, reason, w, r)
+		return
+	}
+
+	serveNode(debug, dry, vendor, w, r, suffix, fields[2:])
+}
+
+// /v1/at2/node/<host>/rule/
+// /v1/at2/node/<host>/backend/
+// ^^^^^^^^^^^^^
+// prefix
+func handlerNode(debug, dry bool, vendor string, w http.ResponseWriter, r *http.Request, path string) {
+
+	me := "handlerNode"
+
+	if !strings.HasPrefix(r.URL.Path, path) {
+		sendNotFound(me, w, r)
+		return
+	}
+
+	suffix := strings.TrimPrefix(r.URL.Path, path)
+
+	fields := strings.FieldsFunc(suffix, func(r rune) bool { return r == '/' })
+
+	serveNode(debug, dry, vendor, w, r, suffix, fields)
+}
+
+// fields: <host>/backend/
+// fields: <host>/virtual/
+// fields: <host>/shift
+func serveNode(debug, dry bool, vendor string, w http.ResponseWriter, r *http.Request, suffix string, fields []string) {
+
+	me := "serveNode"
+
+	log.Printf(me+": vendor=%s TLS=%v method=%s url=%s from=%s suffix=[%s]", vendor, r.TLS != nil, r.Method, r.URL.Path, r.RemoteAddr, suffix)
+	forwarded(me, r)
+
+	if len(fields) < 2 {
+		reason := fmt.Sprintf("missing path fields: %d < %d", len(fields), 2)
+		sendBadRequest(me, reason, w, r)
+		return
+	}
+
+	node := fields[0]
+	if !checkInventory(me, vendor, node, w, r) {
+		return
+	}
+	r, username, password, authOK := deviceAuth(me, node, suffix, w, r)
+	if !authOK {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*") // FIXME?
+
+	optionField := fields[1]
+	switch optionField {
+	case "backend":
+		nodeBackend(debug, dry, vendor, w, r, username, password, fields)
+	case "virtual":
+		nodeVirtual(debug, dry, vendor, w, r, username, password, fields)
+	case "shift":
+		nodeShift(debug, dry, vendor, w, r, username, password, fields)
+	case "healthcheck":
+		writeStr(me, w, "node health ok\n")
+	default:
+		reason := fmt.Sprintf("unexpected option field: [%s]", optionField)
+		sendBadRequest(me, reason, w, r)
+	}
+}
+
+// listError reports failure to read a collection (server, service group, ...) from device
+type listError struct {
+	collection string
+	err        error
+}
+
+func (e *listError) Error() string {
+	return e.collection + " list: " + e.err.Error()
+}
+
+// sendDriverError reports a driver failure as http error
+func sendDriverError(label, host, reason string, err error, w http.ResponseWriter, r *http.Request) {
+	log.Printf(label+": method=%s url=%s from=%s %s: %v", r.Method, r.URL.Path, r.RemoteAddr, reason, err)
+
+	if le, isList := err.(*listError); isList {
+		reason += ": " + le.collection + " list" // name failed collection
+	}
+
+	if err == errNotImplemented {
+		sendNotImplemented(label+": "+reason, w, r) // 501
+		return
+	}
+
+	http.Error(w, host+" bad gateway - "+reason, http.StatusBadGateway) // 502
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/udhos/balance-api-service/credstore"
 )
 
 const (
@@ -65,26 +72,206 @@ func main() {
 		tls = false
 	}
 
+	a10Pool = newA10SessionPool(envInt("A10_MAX_SESSIONS", 4), envDuration("A10_SESSION_IDLE", 5*time.Minute), envDuration("A10_SESSION_WAIT", 30*time.Second))
+	log.Printf("a10 sessions per device: max=%d idle=%v wait=%v -- change with env vars: A10_MAX_SESSIONS=[%s] A10_SESSION_IDLE=[%s] A10_SESSION_WAIT=[%s]",
+		a10Pool.max, a10Pool.idleTimeout, a10Pool.wait, os.Getenv("A10_MAX_SESSIONS"), os.Getenv("A10_SESSION_IDLE"), os.Getenv("A10_SESSION_WAIT"))
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			a10Pool.sweep() // close expired idle sessions
+		}
+	}()
+
+	record := os.Getenv("CASSETTE_RECORD")
+	replay := os.Getenv("CASSETTE_REPLAY")
+	switch {
+	case record != "" && replay != "":
+		log.Fatalf("device cassette: CASSETTE_RECORD and CASSETTE_REPLAY are mutually exclusive")
+	case record != "":
+		deviceCassette = newCassetteRecorder(record)
+	case replay != "":
+		player, errLoad := newCassettePlayer(replay)
+		if errLoad != nil {
+			log.Fatalf("device cassette: %v", errLoad)
+		}
+		deviceCassette = player
+	}
+	log.Printf("device cassette: CASSETTE_RECORD=[%s] CASSETTE_REPLAY=[%s]", record, replay)
+
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	log.Printf("shutdown timeout=%v -- change with env var: SHUTDOWN_TIMEOUT=[%s]", shutdownTimeout, os.Getenv("SHUTDOWN_TIMEOUT"))
+
+	registerDriver("a10v2", newA10v2)
+	registerDriver("a10v3", newA10v3)
+	registerDriver("f5", newF5)
+
+	if usersFile := os.Getenv("USERS"); usersFile != "" {
+		credFile := os.Getenv("CREDENTIALS")
+		if credFile == "" {
+			credFile = "credentials.enc"
+		}
+		credKey, errKey := credstore.ParseKey(os.Getenv("CREDENTIALS_KEY"))
+		if errKey != nil {
+			log.Fatalf("service auth: env var CREDENTIALS_KEY: %v", errKey)
+		}
+		store, errStore := credstore.Open(credFile, credKey)
+		if errStore != nil {
+			log.Fatalf("service auth: credential store: %v", errStore)
+		}
+		auth, errAuth := loadServiceAuth(usersFile, store)
+		if errAuth != nil {
+			log.Fatalf("service auth: users: %s: %v", usersFile, errAuth)
+		}
+		svcAuth = auth
+		log.Printf("service auth: USERS=%s users=%d CREDENTIALS=%s devices=%d - callers must send API token", usersFile, len(auth.users), credFile, len(store.Devices()))
+	} else {
+		log.Printf("service auth: USERS=[] - callers must send device credentials as basic auth")
+	}
+
+	if file := os.Getenv("INVENTORY"); file != "" {
+		inv, errInv := loadInventory(file)
+		if errInv != nil {
+			log.Fatalf("device inventory: %s: %v", file, errInv)
+		}
+		inventory = inv
+		log.Printf("device inventory: file=%s devices=%d - refusing hosts not in inventory", file, len(inv.byName))
+	} else {
+		log.Printf("device inventory: INVENTORY=[] - accepting any device host")
+	}
+
+	if file := os.Getenv("POLICY"); file != "" {
+		p, errPolicy := loadPolicy(file)
+		if errPolicy != nil {
+			log.Fatalf("authorization policy: %s: %v", file, errPolicy)
+		}
+		policy = p
+		log.Printf("authorization policy: file=%s rules=%d", file, len(p.Rules))
+	} else {
+		log.Printf("authorization policy: POLICY=[] - every caller may perform any operation")
+	}
+
+	if file := os.Getenv("AUDIT_LOG"); file != "" {
+		key, errKey := credstore.ParseKey(os.Getenv("AUDIT_KEY"))
+		if errKey != nil {
+			log.Fatalf("audit log: env var AUDIT_KEY: %v", errKey)
+		}
+		a, errAudit := openAuditLog(file, key)
+		if errAudit != nil {
+			log.Fatalf("audit log: %s: %v", file, errAudit)
+		}
+		audit = a
+		log.Printf("audit log: file=%s entries=%d", file, a.seq)
+	} else {
+		log.Printf("audit log: AUDIT_LOG=[] - changes are not audited")
+	}
+
+	if scrape := os.Getenv("METRICS_SCRAPE"); scrape != "" {
+		interval, errParse := time.ParseDuration(scrape)
+		if errParse != nil || interval <= 0 {
+			log.Fatalf("metrics scrape: bad METRICS_SCRAPE=[%s]", scrape)
+		}
+		if inventory == nil || svcAuth == nil {
+			log.Fatalf("metrics scrape: requires device inventory (INVENTORY) and stored device credentials (USERS)")
+		}
+		go scrapeMembers(debug, interval)
+		log.Printf("metrics scrape: member health of inventory devices every %v", interval)
+	} else {
+		log.Printf("metrics scrape: METRICS_SCRAPE=[] - member health is not scraped")
+	}
+
 	register("/", func(w http.ResponseWriter, r *http.Request) { handlerRoot(w, r, "/") })
+	register("/metrics", func(w http.ResponseWriter, r *http.Request) { handlerMetrics(w, r, "/metrics") })
 
-	register("/v1/ff/node/", func(w http.ResponseWriter, r *http.Request) { handlerNodeF5(w, r, "/v1/ff/node/") })
+	register("/v1/devices/", func(w http.ResponseWriter, r *http.Request) { handlerDevices(debug, dry, w, r, "/v1/devices/") })
+	register("/v1/audit/", func(w http.ResponseWriter, r *http.Request) { handlerAudit(debug, w, r, "/v1/audit/") })
+	register("/v1/jobs/", func(w http.ResponseWriter, r *http.Request) { handlerJobs(debug, w, r, "/v1/jobs/") })
+	register("/v1/changes/", func(w http.ResponseWriter, r *http.Request) { handlerChanges(debug, dry, w, r, "/v1/changes/") })
+
+	register("/v1/lb/", func(w http.ResponseWriter, r *http.Request) { handlerLB(debug, dry, w, r, "/v1/lb/") })
+
+	register("/v1/ff/node/", func(w http.ResponseWriter, r *http.Request) { handlerNodeF5(debug, dry, w, r, "/v1/ff/node/") })
 	register("/v1/at2/node/", func(w http.ResponseWriter, r *http.Request) { handlerNodeA10v2(debug, dry, w, r, "/v1/at2/node/") })
 	register("/v1/at2/healthcheck", func(w http.ResponseWriter, r *http.Request) { handlerNodeA10v2Health(w, r, "/v1/at2/healthcheck") })
 	register("/v1/at2/healthcheck/", func(w http.ResponseWriter, r *http.Request) { handlerNodeA10v2Health(w, r, "/v1/at2/healthcheck/") })
-	register("/v1/at3/node/", func(w http.ResponseWriter, r *http.Request) { handlerNodeA10v3(w, r, "/v1/at3/node/") })
+	register("/v1/at3/node/", func(w http.ResponseWriter, r *http.Request) { handlerNodeA10v3(debug, dry, w, r, "/v1/at3/node/") })
+
+	server := newServer(addr, nil, true)
+	done := make(chan struct{})
+	go shutdown(server, shutdownTimeout, done)
 
 	if tls {
 		log.Printf("serving HTTPS on TCP %s LISTEN=[%s] TLS=%v", addr, os.Getenv("LISTEN"), tls)
-		if err := listenAndServeTLS(addr, cert, key, nil, true); err != nil {
+		if err := server.ListenAndServeTLS(cert, key); err != http.ErrServerClosed {
 			log.Fatalf("listenAndServeTLS: %s: %v", addr, err)
 		}
-		return
+	} else {
+		log.Printf("serving HTTP on TCP %s LISTEN=[%s] TLS=%v", addr, os.Getenv("LISTEN"), tls)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("listenAndServe: %s: %v", addr, err)
+		}
+	}
+
+	<-done // wait for shutdown to finish
+}
+
+// shutdown on exit signal stops accepting requests, waits for requests in flight,
+// cancels background jobs and waits for them and for busy device sessions (up to timeout),
+// then closes idle device sessions
+func shutdown(server *http.Server, timeout time.Duration, done chan<- struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	s := <-sig
+	log.Printf("shutdown: signal=%v timeout=%v - waiting for requests in flight", s, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if errShutdown := server.Shutdown(ctx); errShutdown != nil {
+		log.Printf("shutdown: http server: %v", errShutdown)
+	}
+
+	deadline, _ := ctx.Deadline()
+
+	log.Printf("shutdown: canceling background jobs")
+	jobsCancel()
+	if !jobsWait(time.Until(deadline)) {
+		log.Printf("shutdown: background jobs still running - exiting anyway")
 	}
 
-	log.Printf("serving HTTP on TCP %s LISTEN=[%s] TLS=%v", addr, os.Getenv("LISTEN"), tls)
-	if err := listenAndServe(addr, nil, true); err != nil {
-		log.Fatalf("listenAndServe: %s: %v", addr, err)
+	if busy := a10Pool.waitIdle(time.Until(deadline)); busy > 0 {
+		log.Printf("shutdown: device sessions still busy: %d - closing anyway", busy)
 	}
+
+	log.Printf("shutdown: closing idle device sessions")
+	a10Pool.close()
+
+	close(done)
+}
+
+func envInt(name string, defaultValue int) int {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultValue
+	}
+	value, errConv := strconv.Atoi(str)
+	if errConv != nil {
+		log.Printf("bad env var %s=[%s]: %v - using default: %d", name, str, errConv, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultValue
+	}
+	value, errParse := time.ParseDuration(str)
+	if errParse != nil {
+		log.Printf("bad env var %s=[%s]: %v - using default: %v", name, str, errParse, defaultValue)
+		return defaultValue
+	}
+	return value
 }
 
 func fileExists(path string) bool {
@@ -92,23 +279,18 @@ func fileExists(path string) bool {
 	return err == nil
 }
 
-func listenAndServeTLS(addr, certFile, keyFile string, handler http.Handler, keepalive bool) error {
-	server := &http.Server{Addr: addr, Handler: handler}
-	server.SetKeepAlivesEnabled(keepalive)
-	return server.ListenAndServeTLS(certFile, keyFile)
-}
-
-func listenAndServe(addr string, handler http.Handler, keepalive bool) error {
+func newServer(addr string, handler http.Handler, keepalive bool) *http.Server {
 	server := &http.Server{Addr: addr, Handler: handler}
 	server.SetKeepAlivesEnabled(keepalive)
-	return server.ListenAndServe()
+	return server
 }
 
 type handlerFunc func(w http.ResponseWriter, r *http.Request)
 
+// register serves path with handler, counting requests into metrics
 func register(path string, handler handlerFunc) {
 	log.Printf("registering path: [%s]", path)
-	http.HandleFunc(path, handler)
+	http.HandleFunc(path, countRequests(path, handler))
 }
 
 func handlerRoot(w http.ResponseWriter, r *http.Request, path string) {
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Member scrape periodically reads member health of every inventory device,
+// logging in with stored device credentials (service authentication),
+// in order to alert when a service group loses capacity:
+//
+//   METRICS_SCRAPE=1m INVENTORY=inventory.yaml USERS=users.yaml balance-service
+
+// scrapeMembers scrapes every inventory device at interval, forever
+func scrapeMembers(debug bool, interval time.Duration) {
+	for {
+		for _, d := range inventory.list(nil, nil) {
+			scrapeDevice(debug, d)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// scrapeDevice replaces member metrics for device
+func scrapeDevice(debug bool, d *inventoryDevice) {
+
+	me := "scrapeDevice"
+
+	families := map[string]*metricFamily{
+		"balance_scrape_success":   {help: "Last member scrape of device succeeded.", kind: "gauge", values: map[string]float64{}},
+		"balance_member_up":        {help: "Service group member health, 1=up 0=down.", kind: "gauge", values: map[string]float64{}},
+		"balance_group_members":    {help: "Service group members.", kind: "gauge", values: map[string]float64{}},
+		"balance_group_members_up": {help: "Service group members up.", kind: "gauge", values: map[string]float64{}},
+	}
+	device := metricLabels("device", d.Name)
+
+	tab, errScrape := scrapeBackends(debug, d)
+	if errScrape != nil {
+		log.Printf(me+": device=%s: %v", d.Name, errScrape)
+		families["balance_scrape_success"].values[device] = 0
+		metrics.setScraped(d.Name, families)
+		return
+	}
+
+	for _, b := range tab {
+		for _, sg := range b.ServiceGroups {
+			group := metricLabels("device", d.Name, "group", sg.Name)
+			families["balance_group_members"].values[group] += 0 // report groups with no members up
+			families["balance_group_members_up"].values[group] += 0
+			for _, m := range sg.Members {
+				if m.Name != b.BackendName || m.Stats == nil {
+					continue
+				}
+				var up float64
+				if m.Stats.Health == healthUp {
+					up = 1
+				}
+				families["balance_member_up"].values[metricLabels("device", d.Name, "group", sg.Name, "member", m.Name, "port", m.Port)] = up
+				families["balance_group_members"].values[group]++
+				families["balance_group_members_up"].values[group] += up
+			}
+		}
+	}
+
+	families["balance_scrape_success"].values[device] = 1
+	metrics.setScraped(d.Name, families)
+}
+
+// scrapeBackends reads backends with stats from device
+func scrapeBackends(debug bool, d *inventoryDevice) (map[string]*backend, error) {
+
+	c, found := svcAuth.credential(d.Address)
+	if !found {
+		return nil, fmt.Errorf("no stored credential for device: %s", d.Name)
+	}
+
+	lb, errNew := newLoadBalancer(d.driver(), d.Address, lbOptions{Debug: debug})
+	if errNew != nil {
+		return nil, errNew
+	}
+	if errLogin := lb.Login(c.Username, c.Password); errLogin != nil {
+		return nil, errLogin
+	}
+	defer func() {
+		if errClose := lb.Logout(); errClose != nil {
+			log.Printf("scrapeBackends: device=%s close error: %v", d.Name, errClose)
+		}
+	}()
+
+	tab, errList := lb.BackendList()
+	if errList != nil {
+		return nil, errList
+	}
+
+	return tab, lb.BackendStats(tab)
+}
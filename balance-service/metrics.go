@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /metrics serves Prometheus metrics in text exposition format:
+//
+// balance_http_requests_total{route,method,status}                    counter
+// balance_device_call_duration_seconds{device,vendor,operation,result} histogram - driver calls, see meteredLB
+// balance_device_sessions{device,vendor}                              gauge - driver sessions logged in
+// balance_a10_open_sessions{device}                                   gauge - pooled aXAPI v2 sessions (busy and idle)
+//
+// Background member scrape (METRICS_SCRAPE), see memberscrape.go:
+//
+// balance_member_up{device,group,member,port}                         gauge - 1=up 0=down
+// balance_group_members{device,group}                                 gauge
+// balance_group_members_up{device,group}                              gauge
+// balance_scrape_success{device}                                      gauge
+
+var metricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30} // seconds
+
+// metricFamily holds values of one counter or gauge
+type metricFamily struct {
+	help   string
+	kind   string             // counter, gauge
+	values map[string]float64 // labels => value
+}
+
+type histogram struct {
+	buckets []int64 // per bucket, not cumulative
+	count   int64
+	sum     float64
+}
+
+type metricSet struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+	calls    map[string]*histogram               // labels => latency
+	scraped  map[string]map[string]*metricFamily // device => name => family, replaced by every scrape
+}
+
+var metrics = newMetricSet()
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		families: map[string]*metricFamily{
+			"balance_http_requests_total": {help: "HTTP requests served.", kind: "counter", values: map[string]float64{}},
+			"balance_device_sessions":     {help: "Device sessions logged in.", kind: "gauge", values: map[string]float64{}},
+		},
+		calls:   map[string]*histogram{},
+		scraped: map[string]map[string]*metricFamily{},
+	}
+}
+
+// metricLabels renders name/value pairs as name="value",...
+func metricLabels(pairs ...string) string {
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		labels = append(labels, pairs[i]+`="`+value+`"`)
+	}
+	return strings.Join(labels, ",")
+}
+
+func (m *metricSet) add(name, labels string, delta float64) {
+	m.mutex.Lock()
+	m.families[name].values[labels] += delta
+	m.mutex.Unlock()
+}
+
+// metricMethods keeps unknown methods from inflating label values
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+func (m *metricSet) request(route, method string, status int) {
+	if !metricMethods[method] {
+		method = "other"
+	}
+	m.add("balance_http_requests_total", metricLabels("route", route, "method", method, "status", strconv.Itoa(status)), 1)
+}
+
+func (m *metricSet) session(device, vendor string, delta float64) {
+	m.add("balance_device_sessions", metricLabels("device", device, "vendor", vendor), delta)
+}
+
+func (m *metricSet) call(device, vendor, operation, result string, elapsed time.Duration) {
+	labels := metricLabels("device", device, "vendor", vendor, "operation", operation, "result", result)
+	seconds := elapsed.Seconds()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	h, found := m.calls[labels]
+	if !found {
+		h = &histogram{buckets: make([]int64, len(metricBuckets))}
+		m.calls[labels] = h
+	}
+	for i, le := range metricBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// setScraped replaces metrics scraped from device
+func (m *metricSet) setScraped(device string, families map[string]*metricFamily) {
+	m.mutex.Lock()
+	m.scraped[device] = families
+	m.mutex.Unlock()
+}
+
+func sortedLabels(values map[string]float64) []string {
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sample(w io.Writer, name, labels string, value float64) {
+	if labels == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(value))
+}
+
+// write renders all metrics in text exposition format
+func (m *metricSet) write(w io.Writer) {
+	families := map[string]*metricFamily{
+		"balance_a10_open_sessions": {help: "Pooled aXAPI v2 sessions open to device.", kind: "gauge", values: map[string]float64{}},
+	}
+	for host, open := range a10Pool.openSessions() {
+		families["balance_a10_open_sessions"].values[metricLabels("device", host)] = float64(open)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	merge := func(name string, f *metricFamily) {
+		all, found := families[name]
+		if !found {
+			all = &metricFamily{help: f.help, kind: f.kind, values: map[string]float64{}}
+			families[name] = all
+		}
+		for labels, v := range f.values {
+			all.values[labels] = v
+		}
+	}
+	for name, f := range m.families {
+		merge(name, f)
+	}
+	for _, device := range m.scraped {
+		for name, f := range device {
+			merge(name, f)
+		}
+	}
+
+	var names []string
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+		for _, labels := range sortedLabels(f.values) {
+			sample(w, name, labels, f.values[labels])
+		}
+	}
+
+	const calls = "balance_device_call_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of device driver calls.\n", calls)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", calls)
+	var keys []string
+	for k := range m.calls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		h := m.calls[labels]
+		var cumulative int64
+		for i, le := range metricBuckets {
+			cumulative += h.buckets[i]
+			sample(w, calls+"_bucket", labels+`,le="`+formatFloat(le)+`"`, float64(cumulative))
+		}
+		sample(w, calls+"_bucket", labels+`,le="+Inf"`, float64(h.count))
+		sample(w, calls+"_sum", labels, h.sum)
+		sample(w, calls+"_count", labels, float64(h.count))
+	}
+}
+
+// /metrics
+func handlerMetrics(w http.ResponseWriter, r *http.Request, path string) {
+
+	me := "handlerMetrics"
+
+	if r.URL.Path != path {
+		sendNotFound(me, w, r)
+		return
+	}
+
+	if svcAuth != nil && svcAuth.user(r) == nil {
+		http.Error(w, "not authorized - missing or unknown API token", http.StatusUnauthorized) // 401
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		sendNotSupported(me, w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(w)
+}
+
+// statusWriter remembers response status for metrics
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// countRequests wraps handler for route, counting requests by method and status
+func countRequests(route string, handler handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+		metrics.request(route, r.Method, sw.status)
+	}
+}
+
+// meteredLB records driver calls and sessions into metrics
+type meteredLB struct {
+	lb       loadBalancer
+	device   string
+	vendor   string
+	loggedIn bool
+}
+
+func (m *meteredLB) observe(operation string, start time.Time, err error, errCount int) {
+	result := "ok"
+	switch {
+	case err != nil:
+		result = "error"
+	case errCount > 0:
+		result = "partial" // some device operations failed
+	}
+	metrics.call(m.device, m.vendor, operation, result, time.Since(start))
+}
+
+func (m *meteredLB) Login(username, password string) error {
+	start := time.Now()
+	err := m.lb.Login(username, password)
+	m.observe("login", start, err, 0)
+	if err == nil && !m.loggedIn {
+		m.loggedIn = true
+		metrics.session(m.device, m.vendor, 1)
+	}
+	return err
+}
+
+func (m *meteredLB) Logout() error {
+	start := time.Now()
+	err := m.lb.Logout()
+	m.observe("logout", start, err, 0)
+	if m.loggedIn {
+		m.loggedIn = false
+		metrics.session(m.device, m.vendor, -1)
+	}
+	return err
+}
+
+func (m *meteredLB) BackendList() (map[string]*backend, error) {
+	start := time.Now()
+	tab, err := m.lb.BackendList()
+	m.observe("backend_list", start, err, 0)
+	return tab, err
+}
+
+func (m *meteredLB) BackendCreate(be backend) error {
+	start := time.Now()
+	err := m.lb.BackendCreate(be)
+	m.observe("backend_create", start, err, 0)
+	return err
+}
+
+func (m *meteredLB) BackendUpdate(be backend) error {
+	start := time.Now()
+	err := m.lb.BackendUpdate(be)
+	m.observe("backend_update", start, err, 0)
+	return err
+}
+
+func (m *meteredLB) BackendDelete(name string) error {
+	start := time.Now()
+	err := m.lb.BackendDelete(name)
+	m.observe("backend_delete", start, err, 0)
+	return err
+}
+
+func (m *meteredLB) ServiceGroupList() ([]backendServiceGroup, error) {
+	start := time.Now()
+	list, err := m.lb.ServiceGroupList()
+	m.observe("group_list", start, err, 0)
+	return list, err
+}
+
+func (m *meteredLB) BackendLink(be backend) (int, error) {
+	start := time.Now()
+	count, err := m.lb.BackendLink(be)
+	m.observe("backend_link", start, err, count)
+	return count, err
+}
+
+func (m *meteredLB) BackendUnlink(be backend) (int, error) {
+	start := time.Now()
+	count, err := m.lb.BackendUnlink(be)
+	m.observe("backend_unlink", start, err, count)
+	return count, err
+}
+
+func (m *meteredLB) MemberUpdate(be backend) (int, error) {
+	start := time.Now()
+	count, err := m.lb.MemberUpdate(be)
+	m.observe("member_update", start, err, count)
+	return count, err
+}
+
+func (m *meteredLB) MemberConnections(be backend) ([]memberConn, error) {
+	start := time.Now()
+	list, err := m.lb.MemberConnections(be)
+	m.observe("member_connections", start, err, 0)
+	return list, err
+}
+
+func (m *meteredLB) BackendStats(tab map[string]*backend) error {
+	start := time.Now()
+	err := m.lb.BackendStats(tab)
+	m.observe("backend_stats", start, err, 0)
+	return err
+}
+
+func (m *meteredLB) Operations() []deviceOp {
+	return m.lb.Operations()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/udhos/balance-api-service/credstore"
+)
+
+func scrapeMetrics(t *testing.T, token string) string {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	handlerMetrics(w, r, "/metrics")
+	expectStatus(t, "metrics", w, http.StatusOK)
+	return w.Body.String()
+}
+
+func expectMetric(t *testing.T, body, line string) {
+	for _, l := range strings.Split(body, "\n") {
+		if l == line {
+			return
+		}
+	}
+	t.Errorf("missing metric: %s", line)
+}
+
+func TestMetricLabels(t *testing.T) {
+	if labels := metricLabels("a", `x"y\z`, "b", "1\n2"); labels != `a="x\"y\\z",b="1\n2"` {
+		t.Errorf("unexpected labels: %s", labels)
+	}
+}
+
+func TestE2EMetrics(t *testing.T) {
+	saved := metrics
+	metrics = newMetricSet()
+	defer func() { metrics = saved }()
+
+	e := newE2E(t)
+	defer e.close()
+
+	handler := countRequests("/v1/at2/node/", func(w http.ResponseWriter, r *http.Request) {
+		handlerNodeA10v2(false, true, w, r, "/v1/at2/node/")
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/v1/at2/node/"+e.host+"/backend/s0", nil)
+	r.SetBasicAuth("admin", "a10")
+	handler(w, r)
+	expectStatus(t, "get", w, http.StatusOK)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/v1/at2/node/"+e.host+"/backend/missing", nil)
+	r.SetBasicAuth("admin", "a10")
+	handler(w, r)
+	expectStatus(t, "get missing", w, http.StatusNotFound)
+
+	body := scrapeMetrics(t, "")
+	expectMetric(t, body, `balance_http_requests_total{route="/v1/at2/node/",method="GET",status="200"} 1`)
+	expectMetric(t, body, `balance_http_requests_total{route="/v1/at2/node/",method="GET",status="404"} 1`)
+	expectMetric(t, body, `balance_device_call_duration_seconds_count{device="`+e.host+`",vendor="a10v2",operation="backend_list",result="ok"} 2`)
+	expectMetric(t, body, `balance_device_call_duration_seconds_bucket{device="`+e.host+`",vendor="a10v2",operation="backend_list",result="ok",le="+Inf"} 2`)
+	expectMetric(t, body, `balance_device_sessions{device="`+e.host+`",vendor="a10v2"} 0`)
+	expectMetric(t, body, "# TYPE balance_device_call_duration_seconds histogram")
+}
+
+func TestE2EMetricsScrape(t *testing.T) {
+	saved := metrics
+	metrics = newMetricSet()
+	defer func() { metrics = saved }()
+
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+	e.device.SetDown("s1", 5555, true)
+
+	inv, errParse := parseInventory([]byte("devices:\n- name: lb1\n  address: " + e.host + "\n  vendor: a10\n"))
+	if errParse != nil {
+		t.Fatalf("inventory: %v", errParse)
+	}
+	inventory = inv
+	defer func() { inventory = nil }()
+
+	defer newServiceAuth(t, "lb1", credstore.Credential{Username: "admin", Password: "a10"})()
+
+	scrapeDevice(false, inv.byName["lb1"])
+
+	w := httptest.NewRecorder()
+	handlerMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil), "/metrics")
+	expectStatus(t, "metrics without token", w, http.StatusUnauthorized)
+
+	body := scrapeMetrics(t, "pay-token")
+	expectMetric(t, body, `balance_scrape_success{device="lb1"} 1`)
+	expectMetric(t, body, `balance_member_up{device="lb1",group="group1",member="s0",port="8080"} 1`)
+	expectMetric(t, body, `balance_member_up{device="lb1",group="group1",member="s1",port="5555"} 0`)
+	expectMetric(t, body, `balance_group_members{device="lb1",group="group1"} 3`)
+	expectMetric(t, body, `balance_group_members_up{device="lb1",group="group1"} 2`)
+	expectMetric(t, body, `balance_a10_open_sessions{device="`+e.host+`"} 1`)
+
+	e.device.Fail("slb.server.getAll", "device busy")
+	scrapeDevice(false, inv.byName["lb1"])
+	body = scrapeMetrics(t, "pay-token")
+	expectMetric(t, body, `balance_scrape_success{device="lb1"} 0`)
+	if strings.Contains(body, "balance_member_up{") {
+		t.Errorf("stale member metrics after failed scrape")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Authorization policy (env var POLICY): rules are evaluated in order,
+// the first rule matching caller, device, operation and service group decides.
+// Requests matched by no rule are denied. Without policy, everything is allowed.
+//
+// Example policy file:
+//
+// rules:
+// - name: payments-prod
+//   users: [team-payments]
+//   device_tags: [prod]
+//   groups: [pay-*]
+//   operations: [create, update, link, unlink]
+// - name: payments-read
+//   users: [team-payments]
+//   operations: [read]
+//
+// Operations: read, create, update, delete, link, unlink, virtual.
+// Group patterns restrict changes to backends: every group the backend is in,
+// before and after the change, must match. Backends in no group are not restricted by groups.
+
+const (
+	policyRead    = "read"
+	policyCreate  = "create"
+	policyUpdate  = "update"
+	policyDelete  = "delete"
+	policyLink    = "link"
+	policyUnlink  = "unlink"
+	policyVirtual = "virtual" // replace virtual server layout
+)
+
+var policyOperations = map[string]bool{
+	policyRead:    true,
+	policyCreate:  true,
+	policyUpdate:  true,
+	policyDelete:  true,
+	policyLink:    true,
+	policyUnlink:  true,
+	policyVirtual: true,
+}
+
+// policyRule grants (or denies) operations. Empty selector matches anything.
+// Users, devices and groups accept shell patterns (pay-*).
+type policyRule struct {
+	Name       string   `yaml:"name"`
+	Effect     string   `yaml:"effect,omitempty"` // allow (default), deny
+	Users      []string `yaml:"users,omitempty"`
+	Devices    []string `yaml:"devices,omitempty"` // inventory device name or address
+	DeviceTags []string `yaml:"device_tags,omitempty"`
+	Sites      []string `yaml:"sites,omitempty"`
+	Groups     []string `yaml:"groups,omitempty"`
+	Operations []string `yaml:"operations"`
+}
+
+type accessPolicy struct {
+	Rules []policyRule `yaml:"rules"`
+}
+
+// policy, when set, restricts callers to operations granted by rules
+var policy *accessPolicy
+
+func loadPolicy(file string) (*accessPolicy, error) {
+	buf, errRead := ioutil.ReadFile(file)
+	if errRead != nil {
+		return nil, errRead
+	}
+	return parsePolicy(buf)
+}
+
+func parsePolicy(buf []byte) (*accessPolicy, error) {
+	var p accessPolicy
+	if errYaml := yaml.UnmarshalStrict(buf, &p); errYaml != nil {
+		return nil, errYaml
+	}
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d: missing name", i)
+		}
+		if rule.Effect != "" && rule.Effect != "allow" && rule.Effect != "deny" {
+			return nil, fmt.Errorf("rule %s: bad effect: %s", rule.Name, rule.Effect)
+		}
+		if len(rule.Operations) < 1 {
+			return nil, fmt.Errorf("rule %s: missing operations", rule.Name)
+		}
+		for _, op := range rule.Operations {
+			if !policyOperations[op] && op != "*" {
+				return nil, fmt.Errorf("rule %s: bad operation: %s", rule.Name, op)
+			}
+		}
+		for _, list := range [][]string{rule.Users, rule.Devices, rule.DeviceTags, rule.Sites, rule.Groups} {
+			for _, pattern := range list {
+				if _, errPattern := path.Match(pattern, ""); errPattern != nil {
+					return nil, fmt.Errorf("rule %s: bad pattern: %s", rule.Name, pattern)
+				}
+			}
+		}
+	}
+	return &p, nil
+}
+
+// policyMatch checks if any pattern matches any value. Empty pattern list matches everything.
+func policyMatch(patterns []string, values ...string) bool {
+	if len(patterns) < 1 {
+		return true
+	}
+	for _, p := range patterns {
+		for _, v := range values {
+			if ok, _ := path.Match(p, v); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// policyRequest is an operation to authorize
+type policyRequest struct {
+	user      string
+	device    string // inventory name, or address
+	address   string
+	tags      []string
+	site      string
+	operation string
+	group     string // group touched by change
+}
+
+func (q policyRequest) String() string {
+	s := fmt.Sprintf("user=%s device=%s operation=%s", q.user, q.device, q.operation)
+	if q.group != "" {
+		s += " group=" + q.group
+	}
+	return s
+}
+
+func (rule *policyRule) matches(q policyRequest) bool {
+	if !policyMatch(rule.Operations, q.operation) {
+		return false
+	}
+	if !policyMatch(rule.Users, q.user) {
+		return false
+	}
+	if !policyMatch(rule.Devices, q.device, q.address) {
+		return false
+	}
+	if len(rule.DeviceTags) > 0 && !policyMatch(rule.DeviceTags, q.tags...) {
+		return false
+	}
+	if !policyMatch(rule.Sites, q.site) {
+		return false
+	}
+	if q.group != "" && !policyMatch(rule.Groups, q.group) {
+		return false
+	}
+	return true
+}
+
+// check returns nil if request is allowed, otherwise the reason for denial
+func (p *accessPolicy) check(q policyRequest) error {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(q) {
+			continue
+		}
+		if rule.Effect == "deny" {
+			return fmt.Errorf("denied by policy rule %s: %s", rule.Name, q)
+		}
+		return nil
+	}
+	return fmt.Errorf("no policy rule allows: %s", q)
+}
+
+// policyCheck returns nil if user may perform operation on device host and group.
+// Everything is allowed without policy.
+func policyCheck(user, host, operation, group string) error {
+	if policy == nil {
+		return nil
+	}
+	q := policyRequest{user: user, device: host, address: host, operation: operation, group: group}
+	if inventory != nil {
+		if d, found := inventory.byAddress[host]; found {
+			q.device = d.Name
+			q.tags = d.Tags
+			q.site = d.Site
+		}
+	}
+	return policy.check(q)
+}
+
+// authorize checks policy for operation on device host, once per service group touched by the change.
+// Sends 403 (forbidden) naming the rule that blocked the request.
+func authorize(label, host, operation string, groups []string, w http.ResponseWriter, r *http.Request) bool {
+	if policy == nil {
+		return true
+	}
+
+	if len(groups) < 1 {
+		groups = []string{""}
+	}
+
+	for _, g := range groups {
+		if errDeny := policyCheck(requestCaller(r), host, operation, g); errDeny != nil {
+			log.Printf("%s: method=%s url=%s from=%s forbidden: %v", label, r.Method, r.URL.Path, r.RemoteAddr, errDeny)
+			http.Error(w, "forbidden - "+errDeny.Error(), http.StatusForbidden) // 403
+			return false
+		}
+	}
+
+	return true
+}
+
+// backendGroups returns sorted names of groups of backends (nil skipped), without duplicates
+func backendGroups(backends ...*backend) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, b := range backends {
+		if b == nil {
+			continue
+		}
+		for _, g := range b.ServiceGroups {
+			if !seen[g.Name] {
+				seen[g.Name] = true
+				names = append(names, g.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// authorizeDiff checks policy for every change in PUT reconciliation, from current (nil if missing) to wanted
+func authorizeDiff(label, host string, current *backend, wanted backend, diff backendDiff, w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case diff.Create && !authorize(label, host, policyCreate, groupNames(wanted.ServiceGroups), w, r):
+		return false
+	case diff.Update && !authorize(label, host, policyUpdate, backendGroups(current, &wanted), w, r):
+		return false
+	case len(diff.Members) > 0 && !authorize(label, host, policyUpdate, groupNames(diff.Members), w, r):
+		return false
+	case len(diff.Unlink) > 0 && !authorize(label, host, policyUnlink, groupNames(diff.Unlink), w, r):
+		return false
+	case len(diff.Link) > 0 && !authorize(label, host, policyLink, groupNames(diff.Link), w, r):
+		return false
+	}
+	return true
+}
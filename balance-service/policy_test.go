@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/udhos/balance-api-service/a10sim"
+)
+
+const testPolicy = `
+rules:
+- name: no-delete
+  effect: deny
+  operations: [delete]
+- name: admin-prod-pay
+  users: [admin]
+  device_tags: [prod]
+  groups: [pay-*]
+  operations: [create, update, link, unlink]
+- name: admin-read
+  users: [admin]
+  operations: [read]
+`
+
+func TestParsePolicy(t *testing.T) {
+	bad := []string{
+		"rules:\n- operations: [read]\n",                              // missing name
+		"rules:\n- name: r1\n",                                        // missing operations
+		"rules:\n- name: r1\n  operations: [fly]\n",                   // bad operation
+		"rules:\n- name: r1\n  effect: maybe\n  operations: [read]\n", // bad effect
+		"rules:\n- name: r1\n  groups: ['[']\n  operations: [read]\n", // bad pattern
+	}
+	for _, b := range bad {
+		if _, errParse := parsePolicy([]byte(b)); errParse == nil {
+			t.Errorf("missing error for policy: [%s]", b)
+		}
+	}
+}
+
+func TestE2EPolicy(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	state := e.device.State()
+	state.ServiceGroupList = append(state.ServiceGroupList, a10sim.ServiceGroup{Name: "pay-1", Protocol: 2})
+	e.device.Load(state)
+
+	inv, errInv := parseInventory([]byte("devices:\n- name: lb1\n  address: " + e.host + "\n  vendor: a10\n  tags: [prod]\n"))
+	if errInv != nil {
+		t.Fatalf("inventory: %v", errInv)
+	}
+	p, errPolicy := parsePolicy([]byte(testPolicy))
+	if errPolicy != nil {
+		t.Fatalf("policy: %v", errPolicy)
+	}
+	inventory = inv
+	policy = p
+	defer func() { inventory = nil; policy = nil }()
+
+	expectStatus(t, "read", e.request(http.MethodGet, "backend", nil, nil), http.StatusOK)
+
+	w := e.sample(http.MethodPost, "backend", "server_link.yaml", nil)
+	expectStatus(t, "link group1", w, http.StatusForbidden)
+	if !bytes.Contains(w.Body.Bytes(), []byte("no policy rule allows: user=admin device=lb1 operation=link group=group1")) {
+		t.Errorf("link group1: unexpected reason: [%s]", w.Body.String())
+	}
+
+	link := []byte(`{"BackendName":"s1","BackendAddress":"2.2.2.2","ServiceGroups":[{"Name":"pay-1","Members":[{"Name":"s1","Port":"80"}]}]}`)
+	expectStatus(t, "link pay-1", e.request(http.MethodPost, "backend", link, nil), http.StatusOK)
+	expectStatus(t, "unlink pay-1", e.request(http.MethodDelete, "backend", link, nil), http.StatusOK)
+
+	w = e.sample(http.MethodDelete, "backend", "server_delete.yaml", nil)
+	expectStatus(t, "delete", w, http.StatusForbidden)
+	if !bytes.Contains(w.Body.Bytes(), []byte("denied by policy rule no-delete")) {
+		t.Errorf("delete: unexpected reason: [%s]", w.Body.String())
+	}
+
+	// group patterns restrict member and server changes, not only link and unlink
+	expectStatus(t, "relink pay-1", e.request(http.MethodPost, "backend", link, nil), http.StatusOK)
+	w = e.request(http.MethodPatch, "backend/s0", []byte(`{"ServiceGroups": [{"Name": "group1", "Members": [{"Name": "s0", "Port": "8080", "State": "disabled"}]}]}`), nil)
+	expectStatus(t, "member state group1", w, http.StatusForbidden)
+	if !bytes.Contains(w.Body.Bytes(), []byte("operation=update group=group1")) {
+		t.Errorf("member state group1: unexpected reason: [%s]", w.Body.String())
+	}
+	expectStatus(t, "server state group1", e.request(http.MethodPatch, "backend/s0", []byte(`{"State": "disabled"}`), nil), http.StatusForbidden)
+	expectStatus(t, "member state pay-1", e.request(http.MethodPatch, "backend/s1", []byte(`{"ServiceGroups": [{"Name": "pay-1", "Members": [{"Name": "s1", "Port": "80", "State": "disabled"}]}]}`), nil), http.StatusOK)
+	shift := []byte(`{"ServiceGroup": "group1", "From": [{"Name": "s0", "Port": "8080"}], "To": [{"Name": "s1", "Port": "80"}]}`)
+	expectStatus(t, "shift group1", e.request(http.MethodPost, "shift", shift, nil), http.StatusForbidden)
+	if m := e.device.State().ServiceGroupList[0].MemberList[0]; m.Disabled {
+		t.Errorf("member changed by forbidden request: %v", m)
+	}
+
+	// same caller, device without prod tag: read-only
+	inventory.byAddress[e.host].Tags = nil
+	expectStatus(t, "link pay-1 non-prod", e.request(http.MethodPost, "backend", link, nil), http.StatusForbidden)
+}
+
+func TestE2EPolicyDrain(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+
+	p, errPolicy := parsePolicy([]byte("rules:\n- name: unlink-only\n  users: [admin]\n  operations: [read, link, unlink]\n"))
+	if errPolicy != nil {
+		t.Fatalf("policy: %v", errPolicy)
+	}
+	policy = p
+	defer func() { policy = nil }()
+
+	// drain disables members before unlinking, hence requires update
+	for _, query := range []string{"?drain=true", "?drain=true&plan=true"} {
+		w := e.sample(http.MethodDelete, "backend"+query, "server_unlink.yaml", nil)
+		expectStatus(t, "drain "+query, w, http.StatusForbidden)
+		if !bytes.Contains(w.Body.Bytes(), []byte("operation=update group=group1")) {
+			t.Errorf("drain %s: unexpected reason: [%s]", query, w.Body.String())
+		}
+	}
+	for _, m := range e.device.State().ServiceGroupList[0].MemberList {
+		if m.Disabled {
+			t.Errorf("drain: member disabled: %+v", m)
+		}
+	}
+
+	expectStatus(t, "unlink", e.sample(http.MethodDelete, "backend", "server_unlink.yaml", nil), http.StatusOK)
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
-//"fmt"
-//"log"
+	"fmt"
+	"log"
+	"strings"
 
-//"github.com/udhos/a10-go-rest-client/a10go"
+	"github.com/udhos/a10-go-rest-client/a10go"
 )
 
-/*
-func put(c *a10go.Client, oldList, newList []virtual) {
+// put reconciles device virtual server layout from oldList into newList.
+// Every failed device call is reported in returned error list.
+func put(debug bool, c *a10go.Client, oldList, newList []virtual) []error {
 
 	me := "put"
 
@@ -40,70 +42,98 @@ func put(c *a10go.Client, oldList, newList []virtual) {
 	log.Printf(me+": vServers - create: %v", vServersCreate)
 	log.Printf(me+": vServers - update: %v", vServersUpdate)
 
-	debug := true
+	var errList []error
 
 	// 1. delete virtual servers
-	putVServersDelete(debug, c, vServersDelete)
+	errList = append(errList, putVServersDelete(debug, c, vServersDelete)...)
 	// 2. delete service groups
-	putGroupsDelete(debug, c, groupsDelete)
+	errList = append(errList, putGroupsDelete(debug, c, groupsDelete)...)
 	// 3. delete servers
-	putServersDelete(debug, c, serversDelete)
+	errList = append(errList, putServersDelete(debug, c, serversDelete)...)
 	// 4. update servers
-	putServersUpdate(debug, c, serversUpdate, newList)
+	errList = append(errList, putServersUpdate(debug, c, serversUpdate, newList)...)
 	// 5. create servers
-	putServersCreate(debug, c, serversCreate, newList)
+	errList = append(errList, putServersCreate(debug, c, serversCreate, newList)...)
 	// 6. update service groups  - after 5
-	putGroupsUpdate(debug, c, groupsUpdate, newList)
+	errList = append(errList, putGroupsUpdate(debug, c, groupsUpdate, newList)...)
 	// 7. create service groups  - after 5
-	putGroupsCreate(debug, c, groupsCreate, newList)
+	errList = append(errList, putGroupsCreate(debug, c, groupsCreate, newList)...)
 	// 8. update virtual servers - after 7
-	putVServersUpdate(debug, c, vServersUpdate, newList)
+	errList = append(errList, putVServersUpdate(debug, c, vServersUpdate, newList)...)
 	// 9. create virtual servers - after 7
-	putVServersCreate(debug, c, vServersCreate, newList)
+	errList = append(errList, putVServersCreate(debug, c, vServersCreate, newList)...)
+
+	log.Printf(me+": errors: %d", len(errList))
+
+	return errList
 }
 
-func putVServersDelete(debug bool, c *a10go.Client, names []string) {
+func putDelete(label string, call func(string) error, debug bool, names []string) []error {
+	var errList []error
 	for _, s := range names {
 		if debug {
-			log.Printf("putVServersDelete: %s", s)
+			log.Printf("%s: %s", label, s)
 		}
-		if err := c.VirtualServerDelete(s); err != nil {
-			log.Printf("putVServersDelete: %s: %v", s, err)
+		if err := call(s); err != nil {
+			log.Printf("%s: %s: %v", label, s, err)
+			errList = append(errList, fmt.Errorf("%s: %s: %v", label, s, err))
 		}
 	}
+	return errList
 }
 
-func putGroupsDelete(debug bool, c *a10go.Client, names []string) {
-	for _, s := range names {
-		if debug {
-			log.Printf("putGroupsDelete: %s", s)
-		}
-		if err := c.ServiceGroupDelete(s); err != nil {
-			log.Printf("putGroupsDelete: %s: %v", s, err)
-		}
-	}
+func putVServersDelete(debug bool, c *a10go.Client, names []string) []error {
+	return putDelete("putVServersDelete", c.VirtualServerDelete, debug, names)
 }
 
-func putServersDelete(debug bool, c *a10go.Client, names []string) {
-	for _, s := range names {
-		if debug {
-			log.Printf("putServersDelete: %s", s)
+func putGroupsDelete(debug bool, c *a10go.Client, names []string) []error {
+	return putDelete("putGroupsDelete", c.ServiceGroupDelete, debug, names)
+}
+
+func putServersDelete(debug bool, c *a10go.Client, names []string) []error {
+	return putDelete("putServersDelete", c.ServerDelete, debug, names)
+}
+
+// putServersUpdate replaces server address and ports.
+// a10go ServerUpdate always enables server and ports, hence payload is built here,
+// keeping current server and port status, weight and connection limit.
+func putServersUpdate(debug bool, c *a10go.Client, names []string, newList []virtual) []error {
+	if len(names) == 0 {
+		return nil
+	}
+	current, errList := a10ServerList(c)
+	if errList != nil {
+		return []error{fmt.Errorf("putServersUpdate: server list: %v", errList)}
+	}
+	update := func(name, address string, portList []string) error {
+		s := a10Server{Name: name, Host: address, State: stateEnabled}
+		old := findA10Server(current, name)
+		if old != nil {
+			s.State = old.State
 		}
-		if err := c.ServerDelete(s); err != nil {
-			log.Printf("putServersDelete: %s: %v", s, err)
+		for _, p := range portList {
+			f := strings.SplitN(p, ",", 2) // port,protocol
+			port := a10Port{Number: f[0], Protocol: f[1], State: stateEnabled}
+			if old != nil {
+				for _, op := range old.Ports {
+					if op.Number == port.Number && op.Protocol == port.Protocol {
+						port.State, port.Weight, port.ConnLimit = op.State, op.Weight, op.ConnLimit
+					}
+				}
+			}
+			s.Ports = append(s.Ports, port)
 		}
+		return a10PostRaw(c, "slb.server.update", a10ServerPayload(s))
 	}
+	return serversCreateUpdate("putServersUpdate", update, debug, names, newList)
 }
 
-func putServersUpdate(debug bool, c *a10go.Client, names []string, newList []virtual) {
-	serversCreateUpdate("putServersUpdate", c.ServerUpdate, debug, c, names, newList)
-}
-
-func putServersCreate(debug bool, c *a10go.Client, names []string, newList []virtual) {
-	serversCreateUpdate("putServersCreate", c.ServerCreate, debug, c, names, newList)
+func putServersCreate(debug bool, c *a10go.Client, names []string, newList []virtual) []error {
+	return serversCreateUpdate("putServersCreate", c.ServerCreate, debug, names, newList)
 }
 
-func serversCreateUpdate(label string, call func(string, string, []string) error, debug bool, c *a10go.Client, names []string, newList []virtual) {
+func serversCreateUpdate(label string, call func(string, string, []string) error, debug bool, names []string, newList []virtual) []error {
+	var errList []error
 	for _, s := range names {
 		if debug {
 			log.Printf("%s: %s", label, s)
@@ -111,6 +141,7 @@ func serversCreateUpdate(label string, call func(string, string, []string) error
 		host := findServer(newList, s)
 		if host.Name == "" {
 			log.Printf("%s: %s: not found", label, s)
+			errList = append(errList, fmt.Errorf("%s: %s: not found", label, s))
 			continue
 		}
 		var portList []string
@@ -119,19 +150,61 @@ func serversCreateUpdate(label string, call func(string, string, []string) error
 		}
 		if err := call(host.Name, host.Address, portList); err != nil {
 			log.Printf("%s: %s: %v", label, host.Name, err)
+			errList = append(errList, fmt.Errorf("%s: %s: %v", label, host.Name, err))
+		}
+	}
+	return errList
+}
+
+// putGroupsUpdate replaces service group member list.
+// a10go ServiceGroupUpdate drops member status and priority, hence payload is built here,
+// keeping status and priority of current members.
+func putGroupsUpdate(debug bool, c *a10go.Client, names []string, newList []virtual) []error {
+	if len(names) == 0 {
+		return nil
+	}
+	current, errList := a10ServiceGroupList(c)
+	if errList != nil {
+		return []error{fmt.Errorf("putGroupsUpdate: service group list: %v", errList)}
+	}
+	update := func(name, protocol string, portList []string) error {
+		var old []a10SGMember
+		for _, sg := range current {
+			if sg.Name == name {
+				old = sg.Members
+			}
+		}
+		var members []a10SGMember
+		for _, p := range portList {
+			f := strings.SplitN(p, ",", 2) // serverName,portNumber
+			m := a10SGMember{Name: f[0], Port: f[1], State: stateEnabled}
+			for _, om := range old {
+				if om.Name == m.Name && om.Port == m.Port {
+					m.State, m.Priority = om.State, om.Priority
+				}
+			}
+			members = append(members, m)
 		}
+		return a10PostRaw(c, "slb.service_group.update", a10GroupPayload(name, protocol, members))
 	}
+	return groupsCreateUpdate("putGroupsUpdate", update, debug, names, newList)
 }
 
-func putGroupsUpdate(debug bool, c *a10go.Client, names []string, newList []virtual) {
-	groupsCreateUpdate("putGroupsUpdate", c.ServiceGroupUpdate, debug, c, names, newList)
+// a10PostRaw calls aXAPI v2 method with JSON payload
+func a10PostRaw(c *a10go.Client, method, payload string) error {
+	body, errPost := c.Post(method, payload)
+	if errPost != nil {
+		return errPost
+	}
+	return a10v2Response(body)
 }
 
-func putGroupsCreate(debug bool, c *a10go.Client, names []string, newList []virtual) {
-	groupsCreateUpdate("putGroupsCreate", c.ServiceGroupCreate, debug, c, names, newList)
+func putGroupsCreate(debug bool, c *a10go.Client, names []string, newList []virtual) []error {
+	return groupsCreateUpdate("putGroupsCreate", c.ServiceGroupCreate, debug, names, newList)
 }
 
-func groupsCreateUpdate(label string, call func(string, string, []string) error, debug bool, c *a10go.Client, names []string, newList []virtual) {
+func groupsCreateUpdate(label string, call func(string, string, []string) error, debug bool, names []string, newList []virtual) []error {
+	var errList []error
 	for _, s := range names {
 		if debug {
 			log.Printf("%s: %s", label, s)
@@ -139,30 +212,36 @@ func groupsCreateUpdate(label string, call func(string, string, []string) error,
 		p := findPool(newList, s)
 		if p.Name == "" {
 			log.Printf("%s: %s: not found", label, s)
+			errList = append(errList, fmt.Errorf("%s: %s: not found", label, s))
 			continue
 		}
-		var portList []string // port = "serverName,portNumber,portProtocol"
+		var portList []string // port = "serverName,portNumber"
 		for _, member := range p.Members {
 			for _, mp := range member.Ports {
-				portList = append(portList, fmt.Sprintf("%s,%s,%s", member.Name, mp.Port, A10ProtocolNumber(mp.Protocol)))
+				portList = append(portList, fmt.Sprintf("%s,%s", member.Name, mp.Port))
 			}
 		}
-		log.Printf("debug %s: %s: pool=%v portList=%v", label, p.Name, p, portList)
-		if err := call(p.Name, p.Protocol, portList); err != nil {
+		if debug {
+			log.Printf("%s: %s: pool=%v portList=%v", label, p.Name, p, portList)
+		}
+		if err := call(p.Name, A10ProtocolNumber(p.Protocol), portList); err != nil {
 			log.Printf("%s: %s: %v", label, p.Name, err)
+			errList = append(errList, fmt.Errorf("%s: %s: %v", label, p.Name, err))
 		}
 	}
+	return errList
 }
 
-func putVServersUpdate(debug bool, c *a10go.Client, names []string, newList []virtual) {
-	vServersCreateUpdate("putVServersUpdate", c.VirtualServerUpdate, debug, c, names, newList)
+func putVServersUpdate(debug bool, c *a10go.Client, names []string, newList []virtual) []error {
+	return vServersCreateUpdate("putVServersUpdate", c.VirtualServerUpdate, debug, names, newList)
 }
 
-func putVServersCreate(debug bool, c *a10go.Client, names []string, newList []virtual) {
-	vServersCreateUpdate("putVServersCreate", c.VirtualServerCreate, debug, c, names, newList)
+func putVServersCreate(debug bool, c *a10go.Client, names []string, newList []virtual) []error {
+	return vServersCreateUpdate("putVServersCreate", c.VirtualServerCreate, debug, names, newList)
 }
 
-func vServersCreateUpdate(label string, call func(string, string, []string) error, debug bool, c *a10go.Client, names []string, newList []virtual) {
+func vServersCreateUpdate(label string, call func(string, string, []string) error, debug bool, names []string, newList []virtual) []error {
+	var errList []error
 	for _, s := range names {
 		if debug {
 			log.Printf("%s: %s", label, s)
@@ -170,6 +249,7 @@ func vServersCreateUpdate(label string, call func(string, string, []string) erro
 		vs := findVirtual(newList, s)
 		if vs.Name == "" {
 			log.Printf("%s: %s: not found", label, s)
+			errList = append(errList, fmt.Errorf("%s: %s: not found", label, s))
 			continue
 		}
 		var virtualPorts []string // virtualPort = "serviceGroup,port,protocol"
@@ -178,8 +258,8 @@ func vServersCreateUpdate(label string, call func(string, string, []string) erro
 		}
 		if err := call(vs.Name, vs.Address, virtualPorts); err != nil {
 			log.Printf("%s: %s: %v", label, vs.Name, err)
+			errList = append(errList, fmt.Errorf("%s: %s: %v", label, vs.Name, err))
 		}
 	}
+	return errList
 }
-
-*/
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Rollback restores a backend to the state recorded in the audit log before a change:
+// address, ports, group memberships and states. A change that created the backend is undone
+// by deleting the backend. Other members of the groups the change touched are restored
+// from the group snapshots in the audit entry (GroupsBefore).
+// A virtual layout replacement (PUT /virtual) is undone by putting back the previous layout.
+//
+// Rollback refuses (409) when the backend, its groups or the virtual layout changed again
+// after the audited change, unless ?force=true is given.
+// Plan mode (?plan=true) is supported for backend changes.
+
+// /v1/changes/<id>/rollback
+// ^^^^^^^^^^^^
+// prefix
+func handlerChanges(debug, dry bool, w http.ResponseWriter, r *http.Request, path string) {
+
+	me := "handlerChanges"
+
+	if !strings.HasPrefix(r.URL.Path, path) {
+		sendNotFound(me, w, r)
+		return
+	}
+
+	suffix := strings.TrimPrefix(r.URL.Path, path)
+
+	fields := strings.FieldsFunc(suffix, func(r rune) bool { return r == '/' })
+
+	if len(fields) != 2 || fields[1] != "rollback" {
+		sendNotFound(me, w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		sendNotSupported(me, w, r)
+		return
+	}
+
+	if audit == nil {
+		http.Error(w, "audit log not configured - changes are not recorded", http.StatusNotFound) // 404
+		return
+	}
+
+	if !callerAuth(me, w, r) {
+		return
+	}
+
+	entry, found := auditFind(fields[0])
+	if !found {
+		http.Error(w, "change not found: "+fields[0], http.StatusNotFound) // 404
+		return
+	}
+
+	if !checkInventory(me, entry.Vendor, entry.Device, w, r) {
+		return
+	}
+
+	r, username, password, authOK := deviceAuth(me, entry.Device, suffix, w, r)
+	if !authOK {
+		return
+	}
+
+	if entry.Backend == "" {
+		if entry.VirtualBefore != nil || entry.VirtualAfter != nil {
+			rollbackVirtual(debug, dry, entry, w, r, username, password)
+			return
+		}
+		sendBadRequest(me, "change "+entry.ID+" recorded no backend nor virtual layout - nothing to roll back", w, r)
+		return
+	}
+
+	rollbackChange(debug, dry, entry, w, r, username, password)
+}
+
+// auditFind finds audit entry by id
+func auditFind(id string) (auditEntry, bool) {
+	entries, errRead := audit.entries()
+	if errRead != nil {
+		log.Printf("auditFind: id=%s audit log: %v", id, errRead)
+	}
+	for _, e := range entries {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return auditEntry{}, false
+}
+
+func rollbackChange(debug, dry bool, entry auditEntry, w http.ResponseWriter, r *http.Request, username, password string) {
+
+	me := "rollbackChange"
+
+	host := entry.Device
+	name := entry.Backend
+
+	plan := clientPlan(r)
+
+	defer writeLock(host, plan)()
+
+	lb := lbLogin(me, entry.Vendor, host, lbOptions{Debug: debug, Dry: dry, Plan: plan}, username, password, w, r)
+	if lb == nil {
+		return
+	}
+
+	defer lbLogout(me, lb, r)
+
+	backendTab, errList := lb.BackendList()
+	if errList != nil {
+		sendDriverError(me, host, "backend list", errList, w, r)
+		return
+	}
+
+	current := backendTab[name]
+
+	groupsNow, errGroups := lb.ServiceGroupList()
+	if errGroups != nil {
+		sendDriverError(me, host, "service group list", errGroups, w, r)
+		return
+	}
+
+	if r.URL.Query().Get("force") != "true" {
+		if backendETag(current) != backendETag(entry.After) {
+			log.Printf(me+": method=%s url=%s from=%s change=%s backend=%s changed after audited change", r.Method, r.URL.Path, r.RemoteAddr, entry.ID, name)
+			http.Error(w, fmt.Sprintf("conflict - backend %s changed after change %s, use ?force=true to roll back anyway", name, entry.ID), http.StatusConflict) // 409
+			return
+		}
+		if g, changed := groupsChanged(entry.GroupsAfter, groupsNow); changed {
+			log.Printf(me+": method=%s url=%s from=%s change=%s group=%s changed after audited change", r.Method, r.URL.Path, r.RemoteAddr, entry.ID, g)
+			http.Error(w, fmt.Sprintf("conflict - group %s changed after change %s, use ?force=true to roll back anyway", g, entry.ID), http.StatusConflict) // 409
+			return
+		}
+	}
+
+	others := groupRestores(name, entry.GroupsBefore, groupsNow)
+
+	if !authorizeRestores(me, host, others, w, r) {
+		return
+	}
+
+	label := "change " + entry.ID + " rolled back"
+
+	if entry.Before == nil {
+		// change created backend - remove it
+
+		if current == nil {
+			sendWriteResult(me, debug, plan, w, r, lb, label+" - server already missing", 0)
+			return
+		}
+
+		if !authorize(me, host, policyDelete, groupNames(current.ServiceGroups), w, r) {
+			return
+		}
+		if len(current.ServiceGroups) > 0 && !authorize(me, host, policyUnlink, groupNames(current.ServiceGroups), w, r) {
+			return
+		}
+
+		if !plan {
+			r = auditStart(r, lb, entry.Vendor, host, name, current)
+		}
+
+		var errCount int
+		if len(current.ServiceGroups) > 0 {
+			count, errUnlink := lb.BackendUnlink(backend{BackendName: name, ServiceGroups: current.ServiceGroups})
+			if errUnlink != nil {
+				sendWriteError(me, debug, host, "unlink server", errUnlink, w, r, lb)
+				return
+			}
+			errCount += count
+		}
+
+		if errDelete := lb.BackendDelete(name); errDelete != nil {
+			sendWriteError(me, debug, host, "delete server", errDelete, w, r, lb)
+			return
+		}
+
+		count, errRestore := applyRestores(lb, others)
+		if errRestore != nil {
+			sendWriteError(me, debug, host, "restore group members", errRestore, w, r, lb)
+			return
+		}
+		errCount += count
+
+		sendWriteResult(me, debug, plan, w, r, lb, fmt.Sprintf("%s - server deleted - other members restored:%d", label, len(others)), errCount)
+		return
+	}
+
+	// restore previous backend state
+
+	wanted := *entry.Before
+
+	inheritSettings(&wanted, current) // entries recorded without states keep current states
+
+	diff := diffBackend(current, wanted)
+
+	log.Printf(me+": change=%s backend=%s create=%v update=%v link=%v unlink=%v", entry.ID, name, diff.Create, diff.Update, groupNames(diff.Link), groupNames(diff.Unlink))
+
+	if !authorizeDiff(me, host, current, wanted, diff, w, r) {
+		return
+	}
+
+	if !plan {
+		r = auditStart(r, lb, entry.Vendor, host, name, current)
+	}
+
+	errCount, applied := applyBackendDiff(me, debug, host, wanted, diff, w, r, lb)
+	if !applied {
+		return
+	}
+
+	count, errRestore := applyRestores(lb, others)
+	if errRestore != nil {
+		sendWriteError(me, debug, host, "restore group members", errRestore, w, r, lb)
+		return
+	}
+	errCount += count
+
+	sendWriteResult(me, debug, plan, w, r, lb, fmt.Sprintf("%s - create:%v update:%v link:%d unlink:%d - other members restored:%d", label, diff.Create, diff.Update, len(diff.Link), len(diff.Unlink), len(others)), errCount)
+}
+
+// groupsChanged reports first group whose members differ from snapshot
+func groupsChanged(snapshot, groupsNow []backendServiceGroup) (string, bool) {
+	for _, g := range snapshot {
+		now := findGroup(groupsNow, g.Name)
+		if groupSignature(g) != groupSignature(now) {
+			return g.Name, true
+		}
+	}
+	return "", false
+}
+
+// groupSignature lists group members in stable order
+func groupSignature(g backendServiceGroup) string {
+	var list []string
+	for _, m := range g.Members {
+		list = append(list, fmt.Sprintf("%s,%s,%s,%d", m.Name, m.Port, stateOf(m.State), m.Priority))
+	}
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
+
+// memberRestore puts back members of one server in one group
+type memberRestore struct {
+	group  backendServiceGroup // Members: server members before change (empty: server was not a member)
+	server string
+	link   bool              // member ports differ
+	update []backendSGMember // members to set state and priority
+}
+
+// groupRestores finds members of servers other than skip that differ from group snapshots
+func groupRestores(skip string, snapshot, groupsNow []backendServiceGroup) []memberRestore {
+	var list []memberRestore
+	for _, g := range snapshot {
+		now := findGroup(groupsNow, g.Name)
+		if now.Name == "" {
+			log.Printf("groupRestores: group=%s missing from device - not restored", g.Name)
+			continue
+		}
+		servers := map[string]bool{}
+		for _, m := range append(append([]backendSGMember{}, g.Members...), now.Members...) {
+			if m.Name != skip {
+				servers[m.Name] = true
+			}
+		}
+		var names []string
+		for s := range servers {
+			names = append(names, s)
+		}
+		sort.Strings(names)
+		for _, s := range names {
+			want := serverMembers(g, s)
+			have := serverMembers(now, s)
+			mr := memberRestore{group: backendServiceGroup{Name: g.Name, Protocol: g.Protocol, Members: want}, server: s}
+			for _, m := range want {
+				h, found := findMember(have, m.Name, m.Port)
+				if !found {
+					mr.link = true
+					if m.Priority != 0 {
+						mr.update = append(mr.update, m) // link sets state only
+					}
+					continue
+				}
+				if stateOf(h.State) != stateOf(m.State) || h.Priority != m.Priority {
+					mr.update = append(mr.update, m)
+				}
+			}
+			for _, h := range have {
+				if _, found := findMember(want, h.Name, h.Port); !found {
+					mr.link = true
+				}
+			}
+			if mr.link || len(mr.update) > 0 {
+				list = append(list, mr)
+			}
+		}
+	}
+	return list
+}
+
+// serverMembers picks group members of server
+func serverMembers(g backendServiceGroup, server string) []backendSGMember {
+	var list []backendSGMember
+	for _, m := range g.Members {
+		if m.Name == server {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+// authorizeRestores checks policy for restoring other members
+func authorizeRestores(label, host string, restores []memberRestore, w http.ResponseWriter, r *http.Request) bool {
+	var link, unlink, update []string
+	for _, mr := range restores {
+		switch {
+		case mr.link && len(mr.group.Members) == 0:
+			unlink = append(unlink, mr.group.Name)
+		case mr.link:
+			link = append(link, mr.group.Name)
+			unlink = append(unlink, mr.group.Name) // stale ports are dropped
+		}
+		if len(mr.update) > 0 {
+			update = append(update, mr.group.Name)
+		}
+	}
+	return (len(link) == 0 || authorize(label, host, policyLink, link, w, r)) &&
+		(len(unlink) == 0 || authorize(label, host, policyUnlink, unlink, w, r)) &&
+		(len(update) == 0 || authorize(label, host, policyUpdate, update, w, r))
+}
+
+// applyRestores puts back members of other servers - returns error count
+func applyRestores(lb loadBalancer, restores []memberRestore) (int, error) {
+	var errCount int
+	for _, mr := range restores {
+		if mr.link {
+			var count int
+			var err error
+			if len(mr.group.Members) == 0 {
+				count, err = lb.BackendUnlink(backend{BackendName: mr.server, ServiceGroups: []backendServiceGroup{{Name: mr.group.Name, Protocol: mr.group.Protocol}}})
+			} else {
+				count, err = lb.BackendLink(backend{BackendName: mr.server, ServiceGroups: []backendServiceGroup{mr.group}})
+			}
+			if err != nil {
+				return errCount, err
+			}
+			errCount += count
+		}
+		if len(mr.update) > 0 {
+			count, err := lb.MemberUpdate(backend{BackendName: mr.server, ServiceGroups: []backendServiceGroup{{Name: mr.group.Name, Protocol: mr.group.Protocol, Members: mr.update}}})
+			if err != nil {
+				return errCount, err
+			}
+			errCount += count
+		}
+	}
+	return errCount, nil
+}
+
+// rollbackVirtual puts back virtual layout replaced by change
+func rollbackVirtual(debug, dry bool, entry auditEntry, w http.ResponseWriter, r *http.Request, username, password string) {
+
+	me := "rollbackVirtual"
+
+	host := entry.Device
+
+	if clientPlan(r) {
+		sendBadRequest(me, "plan mode is not supported for virtual layout rollback: change "+entry.ID, w, r)
+		return
+	}
+
+	if !authorize(me, host, policyVirtual, nil, w, r) {
+		return
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+
+	check := func(oldList []virtual) bool {
+		if force || sameVirtualList(oldList, entry.VirtualAfter) {
+			return true
+		}
+		log.Printf(me+": method=%s url=%s from=%s change=%s virtual layout changed after audited change", r.Method, r.URL.Path, r.RemoteAddr, entry.ID)
+		http.Error(w, fmt.Sprintf("conflict - virtual layout changed after change %s, use ?force=true to roll back anyway", entry.ID), http.StatusConflict) // 409
+		return false
+	}
+
+	replaceVirtualList(me, debug, dry, host, username, password, entry.VirtualBefore, check, w, r)
+}
+
+// sameVirtualList compares layouts - the audit log omits empty layouts
+func sameVirtualList(a, b []virtual) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	bufA, errA := json.Marshal(a)
+	bufB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(bufA) == string(bufB)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func rollback(id, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/changes/"+id+"/rollback"+query, nil)
+	r.SetBasicAuth("admin", "a10")
+	w := httptest.NewRecorder()
+	handlerChanges(false, false, w, r, "/v1/changes/")
+	return w
+}
+
+func TestE2ERollback(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	_, closeAudit := newAudit(t)
+	defer closeAudit()
+
+	expectStatus(t, "create", e.sample(http.MethodPost, "backend", "server_create.yaml", nil), http.StatusOK) // change 1
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)     // change 2
+
+	expectStatus(t, "missing change", rollback("9", ""), http.StatusNotFound)
+
+	w := httptest.NewRecorder()
+	handlerChanges(false, false, w, httptest.NewRequest(http.MethodPost, "/v1/changes/9/rollback", nil), "/v1/changes/")
+	expectStatus(t, "missing change without auth", w, http.StatusUnauthorized)
+
+	expectStatus(t, "plan", rollback("2", "?plan=true"), http.StatusOK)
+	if m := e.members("group1"); !m["s1,5555"] {
+		t.Errorf("plan: members changed: %v", m)
+	}
+
+	expectStatus(t, "rollback link", rollback("2", ""), http.StatusOK) // change 3
+	if m := e.members("group1"); len(m) != 1 || !m["s0,8080"] {
+		t.Errorf("rollback link: unexpected members: %v", m)
+	}
+
+	expectStatus(t, "relink", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK) // change 4
+
+	w = rollback("1", "")
+	expectStatus(t, "rollback create after relink", w, http.StatusConflict)
+	if !strings.Contains(w.Body.String(), "backend s1 changed after change 1") {
+		t.Errorf("rollback conflict: unexpected body: %s", w.Body.String())
+	}
+
+	expectStatus(t, "force rollback create", rollback("1", "?force=true"), http.StatusOK) // change 5
+	expectStatus(t, "get rolled back", e.request(http.MethodGet, "backend/s1", nil, nil), http.StatusNotFound)
+	if m := e.members("group1"); len(m) != 1 || !m["s0,8080"] {
+		t.Errorf("rollback create: unexpected members: %v", m)
+	}
+
+	entries, _ := audit.entries()
+	if len(entries) != 5 || entries[4].Before == nil || entries[4].After != nil || entries[4].URL != "/v1/changes/1/rollback?force=true" {
+		t.Errorf("unexpected audit entries: %v", entries)
+	}
+}
+
+func TestE2ERollbackOtherMembers(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	_, closeAudit := newAudit(t)
+	defer closeAudit()
+
+	expectStatus(t, "create", e.sample(http.MethodPost, "backend", "server_create.yaml", nil), http.StatusOK) // change 1
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)     // change 2
+
+	entries, _ := audit.entries()
+	if len(entries) != 2 || len(entries[1].GroupsBefore) != 1 || len(entries[1].GroupsBefore[0].Members) != 1 || len(entries[1].GroupsAfter[0].Members) != 3 {
+		t.Fatalf("link: unexpected group snapshots: %+v", entries)
+	}
+
+	// another member goes away behind the service
+	state := e.device.State()
+	state.ServiceGroupList[0].MemberList = state.ServiceGroupList[0].MemberList[1:]
+	e.device.Load(state)
+	if m := e.members("group1"); len(m) != 2 || m["s0,8080"] {
+		t.Fatalf("unexpected members: %v", m)
+	}
+
+	w := rollback("2", "")
+	expectStatus(t, "rollback after group change", w, http.StatusConflict)
+	if !strings.Contains(w.Body.String(), "group group1 changed after change 2") {
+		t.Errorf("rollback conflict: unexpected body: %s", w.Body.String())
+	}
+
+	expectStatus(t, "force rollback", rollback("2", "?force=true"), http.StatusOK) // change 3
+	if m := e.members("group1"); len(m) != 1 || !m["s0,8080"] {
+		t.Errorf("rollback: other member not restored: %v", m)
+	}
+}
+
+func TestE2ERollbackVirtual(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	_, closeAudit := newAudit(t)
+	defer closeAudit()
+
+	expectStatus(t, "virtual put", e.request(http.MethodPut, "virtual", []byte(`[]`), map[string]string{"Content-Type": "application/json"}), http.StatusOK) // change 1
+	if state := e.device.State(); len(state.VirtualServerList) != 0 {
+		t.Fatalf("virtual put: unexpected layout: %+v", state)
+	}
+
+	expectStatus(t, "plan", rollback("1", "?plan=true"), http.StatusBadRequest)
+
+	expectStatus(t, "rollback", rollback("1", ""), http.StatusOK) // change 2
+	state := e.device.State()
+	if len(state.VirtualServerList) != 1 || state.VirtualServerList[0].Name != "vs1" {
+		t.Errorf("rollback: virtual server not restored: %+v", state.VirtualServerList)
+	}
+	if m := e.members("group1"); len(m) != 1 || !m["s0,8080"] {
+		t.Errorf("rollback: unexpected members: %v", m)
+	}
+
+	expectStatus(t, "rollback again", rollback("1", ""), http.StatusConflict)
+
+	entries, _ := audit.entries()
+	if len(entries) != 2 || len(entries[1].VirtualAfter) != 1 {
+		t.Errorf("unexpected audit entries: %+v", entries)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/udhos/balance-api-service/credstore"
+)
+
+// Service authentication: callers present their own API token, and the service
+// logs into devices with credentials from the encrypted credential store.
+// Without service authentication, device credentials are passed by callers as Basic auth.
+//
+// Example users file (token hashes from: balance-admin token <user>):
+//
+// users:
+// - name: team-payments
+//   token_sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+
+// serviceUser is a caller of the service
+type serviceUser struct {
+	Name        string `yaml:"name"`
+	TokenSHA256 string `yaml:"token_sha256"` // hex sha256 of API token
+}
+
+type serviceAuth struct {
+	users map[string]*serviceUser // token hash => user
+	store *credstore.Store
+}
+
+// svcAuth, when set, enables service authentication
+var svcAuth *serviceAuth
+
+func loadServiceAuth(usersFile string, store *credstore.Store) (*serviceAuth, error) {
+	buf, errRead := ioutil.ReadFile(usersFile)
+	if errRead != nil {
+		return nil, errRead
+	}
+	return parseServiceAuth(buf, store)
+}
+
+func parseServiceAuth(buf []byte, store *credstore.Store) (*serviceAuth, error) {
+	var config struct {
+		Users []serviceUser `yaml:"users"`
+	}
+	if errYaml := yaml.UnmarshalStrict(buf, &config); errYaml != nil {
+		return nil, errYaml
+	}
+
+	a := &serviceAuth{users: map[string]*serviceUser{}, store: store}
+
+	for i := range config.Users {
+		u := &config.Users[i]
+		u.TokenSHA256 = strings.ToLower(u.TokenSHA256)
+		if u.Name == "" {
+			return nil, fmt.Errorf("user %d: missing name", i)
+		}
+		if len(u.TokenSHA256) != 2*sha256.Size {
+			return nil, fmt.Errorf("user %s: bad token_sha256", u.Name)
+		}
+		if _, found := a.users[u.TokenSHA256]; found {
+			return nil, fmt.Errorf("user %s: duplicate token", u.Name)
+		}
+		a.users[u.TokenSHA256] = u
+	}
+
+	return a, nil
+}
+
+// requestToken extracts API token from Authorization: Bearer or X-API-Key header
+func requestToken(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	const bearer = "bearer "
+	if len(auth) > len(bearer) && strings.ToLower(auth[:len(bearer)]) == bearer {
+		return strings.TrimSpace(auth[len(bearer):])
+	}
+	return ""
+}
+
+func (a *serviceAuth) user(r *http.Request) *serviceUser {
+	token := requestToken(r)
+	if token == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(token))
+	return a.users[hex.EncodeToString(sum[:])]
+}
+
+// credential finds stored device credential, by inventory name then by address
+func (a *serviceAuth) credential(host string) (credstore.Credential, bool) {
+	if inventory != nil {
+		if d, found := inventory.byAddress[host]; found {
+			if c, found := a.store.Get(d.Name); found {
+				return c, true
+			}
+		}
+	}
+	return a.store.Get(host)
+}
+
+type callerKey struct{}
+
+// requestCaller returns the service user name (device username without service authentication)
+func requestCaller(r *http.Request) string {
+	caller, _ := r.Context().Value(callerKey{}).(string)
+	return caller
+}
+
+// callerAuth checks caller credentials before the device is known:
+// API token with service authentication, otherwise basic auth present
+// (device credentials are checked later by device login).
+func callerAuth(label string, w http.ResponseWriter, r *http.Request) bool {
+	if svcAuth == nil {
+		if _, _, authOK := r.BasicAuth(); !authOK {
+			log.Printf(label+": method=%s url=%s from=%s - missing basic auth", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="balance-service"`)
+			http.Error(w, "not authorized", http.StatusUnauthorized) // 401
+			return false
+		}
+		return true
+	}
+	if svcAuth.user(r) == nil {
+		log.Printf(label+": method=%s url=%s from=%s - missing or unknown API token", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="balance-service"`)
+		http.Error(w, "not authorized - missing or unknown API token", http.StatusUnauthorized) // 401
+		return false
+	}
+	return true
+}
+
+// deviceAuth finds device credentials for request.
+// With service authentication, the caller is identified by API token and device credentials come from the credential store.
+// Otherwise device credentials are taken from Basic auth.
+// The returned request carries the caller name (see requestCaller).
+func deviceAuth(label, node, suffix string, w http.ResponseWriter, r *http.Request) (*http.Request, string, string, bool) {
+
+	if svcAuth == nil {
+		realm := "node-" + node
+		log.Printf(label+": method=%s url=%s from=%s suffix=[%s] auth realm=[%s]", r.Method, r.URL.Path, r.RemoteAddr, suffix, realm)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
+		username, password, authOK := r.BasicAuth()
+		if !authOK {
+			http.Error(w, "not authorized", http.StatusUnauthorized) // 401
+			return r, "", "", false
+		}
+		log.Printf(label+": method=%s url=%s from=%s suffix=[%s] auth realm=[%s] auth=[%s:%s]", r.Method, r.URL.Path, r.RemoteAddr, suffix, realm, username, hidePassword(password))
+		return r.WithContext(context.WithValue(r.Context(), callerKey{}, username)), username, password, true
+	}
+
+	u := svcAuth.user(r)
+	if u == nil {
+		log.Printf(label+": method=%s url=%s from=%s suffix=[%s] - missing or unknown API token", r.Method, r.URL.Path, r.RemoteAddr, suffix)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="balance-service"`)
+		http.Error(w, "not authorized - missing or unknown API token", http.StatusUnauthorized) // 401
+		return r, "", "", false
+	}
+
+	c, found := svcAuth.credential(node)
+	if !found {
+		log.Printf(label+": method=%s url=%s from=%s suffix=[%s] user=%s - no stored credential for device: %s", r.Method, r.URL.Path, r.RemoteAddr, suffix, u.Name, node)
+		http.Error(w, "no stored credential for device: "+node, http.StatusForbidden) // 403
+		return r, "", "", false
+	}
+
+	log.Printf(label+": method=%s url=%s from=%s suffix=[%s] user=%s device auth=[%s:%s]", r.Method, r.URL.Path, r.RemoteAddr, suffix, u.Name, c.Username, hidePassword(c.Password))
+
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, u.Name)), c.Username, c.Password, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/udhos/balance-api-service/credstore"
+)
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newServiceAuth enables service authentication with user "team-payments" (token "pay-token")
+// and device credentials for host
+func newServiceAuth(t *testing.T, host string, c credstore.Credential) func() {
+	dir, errDir := ioutil.TempDir("", "serviceauth")
+	if errDir != nil {
+		t.Fatalf("tempdir: %v", errDir)
+	}
+	encoded, _ := credstore.GenerateKey()
+	key, _ := credstore.ParseKey(encoded)
+	store, errOpen := credstore.Open(filepath.Join(dir, "creds"), key)
+	if errOpen != nil {
+		t.Fatalf("store: %v", errOpen)
+	}
+	store.Set(host, c)
+
+	auth, errAuth := parseServiceAuth([]byte("users:\n- name: team-payments\n  token_sha256: "+tokenHash("pay-token")+"\n"), store)
+	if errAuth != nil {
+		t.Fatalf("users: %v", errAuth)
+	}
+	svcAuth = auth
+
+	return func() {
+		svcAuth = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestE2EServiceAuth(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	defer newServiceAuth(t, e.host, credstore.Credential{Username: "admin", Password: "a10"})()
+
+	get := func(host string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/at2/node/"+host+"/backend/s0", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handlerNodeA10v2(false, false, w, r, "/v1/at2/node/")
+		return w
+	}
+
+	expectStatus(t, "no token", get(e.host, nil), http.StatusUnauthorized)
+	expectStatus(t, "device password is not a token", e.request(http.MethodGet, "backend/s0", nil, nil), http.StatusUnauthorized)
+	expectStatus(t, "bad token", get(e.host, map[string]string{"Authorization": "Bearer bad"}), http.StatusUnauthorized)
+	expectStatus(t, "unknown device", get("10.9.9.9", map[string]string{"X-API-Key": "pay-token"}), http.StatusForbidden)
+
+	w := get(e.host, map[string]string{"Authorization": "Bearer pay-token"})
+	expectStatus(t, "bearer", w, http.StatusOK)
+	if !bytes.Contains(w.Body.Bytes(), []byte("1.1.1.1")) {
+		t.Errorf("bearer: unexpected backend: [%s]", w.Body.String())
+	}
+
+	expectStatus(t, "api key", get(e.host, map[string]string{"X-API-Key": "pay-token"}), http.StatusOK)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Traffic shift (POST /v1/at2/node/<host>/shift) moves traffic between members of a service group
+// by changing member weights over a schedule of steps (canary release):
+//
+// At every step, members in To get Steps[i] percent of Weight, members in From get the rest.
+// Members with weight zero are disabled, members with some weight are enabled.
+// Shift runs in background as a job, polled with GET /v1/jobs/<id>.
+// A canceled shift stops before its next step, leaving weights as set by the last step completed.
+// See samples/shift.yaml.
+
+const shiftShifting = "shifting"
+
+var (
+	shiftSteps    = []int{10, 25, 50, 75, 100} // default steps
+	shiftInterval = 5 * time.Minute            // default wait between steps
+	shiftWeight   = 100                        // default weight (A10 weight is 1-100)
+)
+
+// shiftRequest moves traffic from members in From to members in To
+type shiftRequest struct {
+	ServiceGroup string
+	From         []backendSGMember // members losing traffic
+	To           []backendSGMember // members taking traffic
+	Steps        []int             // percent of Weight on members in To, per step
+	Interval     string            // wait between steps
+	Weight       int               // per member weight, split between From and To
+}
+
+// checkShift validates request, filling defaults
+func checkShift(req *shiftRequest) (time.Duration, error) {
+	if req.ServiceGroup == "" {
+		return 0, fmt.Errorf("missing service group")
+	}
+	if len(req.From) < 1 || len(req.To) < 1 {
+		return 0, fmt.Errorf("missing members: from=%d to=%d", len(req.From), len(req.To))
+	}
+	seen := map[string]bool{}
+	for _, m := range append(append([]backendSGMember{}, req.From...), req.To...) {
+		if m.Name == "" || m.Port == "" {
+			return 0, fmt.Errorf("member missing name or port: %s,%s", m.Name, m.Port)
+		}
+		if seen[m.Name+","+m.Port] {
+			return 0, fmt.Errorf("duplicate member: %s,%s", m.Name, m.Port)
+		}
+		seen[m.Name+","+m.Port] = true
+	}
+	if len(req.Steps) < 1 {
+		req.Steps = shiftSteps
+	}
+	prev := 0
+	for _, step := range req.Steps {
+		if step < prev || step > 100 {
+			return 0, fmt.Errorf("bad steps %v - expecting increasing percents up to 100", req.Steps)
+		}
+		prev = step
+	}
+	if req.Weight == 0 {
+		req.Weight = shiftWeight
+	}
+	if req.Weight < 0 {
+		return 0, fmt.Errorf("bad weight: %d", req.Weight)
+	}
+	if req.Interval == "" {
+		return shiftInterval, nil
+	}
+	interval, errParse := time.ParseDuration(req.Interval)
+	if errParse != nil || interval < 0 {
+		return 0, fmt.Errorf("bad interval: %s", req.Interval)
+	}
+	return interval, nil
+}
+
+// shiftMembers returns state and weight of members at step percent
+func shiftMembers(req shiftRequest, percent int) []backendSGMember {
+	var members []backendSGMember
+	add := func(list []backendSGMember, share int) {
+		weight := req.Weight * share / 100
+		if weight < 1 && share > 0 {
+			weight = 1 // devices take no fractional weights
+		}
+		for _, m := range list {
+			member := backendSGMember{Name: m.Name, Port: m.Port, State: stateEnabled, Weight: weight}
+			if weight == 0 {
+				member = backendSGMember{Name: m.Name, Port: m.Port, State: stateDisabled} // device weight can not be zero
+			}
+			members = append(members, member)
+		}
+	}
+	add(req.From, 100-percent)
+	add(req.To, percent)
+	return members
+}
+
+// shiftChanges returns members carrying only state and weight changed from current backends
+func shiftChanges(backendTab map[string]*backend, group string, members []backendSGMember) []backendSGMember {
+	var changes []backendSGMember
+	for _, m := range members {
+		var c backendSGMember
+		if b, found := backendTab[m.Name]; found {
+			c, _ = findMember(findGroup(b.ServiceGroups, group).Members, m.Name, m.Port)
+		}
+		if change, changed := memberChange(c, m); changed {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// shiftBackends splits members by backend, keeping order
+func shiftBackends(members []backendSGMember) ([]string, map[string][]backendSGMember) {
+	var names []string
+	tab := map[string][]backendSGMember{}
+	for _, m := range members {
+		if _, found := tab[m.Name]; !found {
+			names = append(names, m.Name)
+		}
+		tab[m.Name] = append(tab[m.Name], m)
+	}
+	return names, tab
+}
+
+// fields: <host>/shift
+func nodeShift(debug, dry bool, vendor string, w http.ResponseWriter, r *http.Request, username, password string, fields []string) {
+
+	me := "nodeShift"
+
+	if r.Method != http.MethodPost {
+		sendNotSupported(me, w, r)
+		return
+	}
+
+	var req shiftRequest
+
+	if errDecode := decodeRequest(debug, w, r, &req); errDecode != nil {
+		return
+	}
+
+	interval, errCheck := checkShift(&req)
+	if errCheck != nil {
+		sendBadRequest(me, errCheck.Error(), w, r)
+		return
+	}
+
+	host := fields[0]
+
+	plan := clientPlan(r)
+
+	if !authorize(me, host, policyUpdate, []string{req.ServiceGroup}, w, r) {
+		return
+	}
+
+	lb := lbLogin(me, vendor, host, lbOptions{Debug: debug, Dry: dry, Plan: plan}, username, password, w, r)
+	if lb == nil {
+		return
+	}
+
+	defer lbLogout(me, lb, r)
+
+	sgList, errList := lb.ServiceGroupList()
+	if errList != nil {
+		sendDriverError(me, host, "group list", errList, w, r)
+		return
+	}
+
+	g := findGroup(sgList, req.ServiceGroup)
+	if g.Name == "" {
+		sendBadRequest(me, "group not found: "+req.ServiceGroup, w, r)
+		return
+	}
+	for _, m := range shiftMembers(req, 0) {
+		if _, found := findMember(g.Members, m.Name, m.Port); !found {
+			sendBadRequest(me, fmt.Sprintf("group %s: member not found: %s,%s", g.Name, m.Name, m.Port), w, r)
+			return
+		}
+	}
+
+	if plan {
+		// list operations for every step, as changes from current device state
+		backendTab, errList := lb.BackendList()
+		if errList != nil {
+			sendDriverError(me, host, "backend list", errList, w, r)
+			return
+		}
+		var errCount int
+		for _, percent := range req.Steps {
+			changes := shiftChanges(backendTab, g.Name, shiftMembers(req, percent))
+			if len(changes) == 0 {
+				continue
+			}
+			count, errUpdate := lb.MemberUpdate(backend{ServiceGroups: []backendServiceGroup{{Name: g.Name, Protocol: g.Protocol, Members: changes}}})
+			if errUpdate != nil {
+				sendDriverError(me, host, "member update", errUpdate, w, r)
+				return
+			}
+			errCount += count
+		}
+		sendWriteResult(me, debug, plan, w, r, lb, fmt.Sprintf("traffic shift - steps:%v", req.Steps), errCount)
+		return
+	}
+
+	j := newJob(vendor, jobStatus{
+		Kind:     jobShift,
+		Device:   host,
+		Groups:   []string{g.Name},
+		State:    shiftShifting,
+		Interval: interval.String(),
+		Steps:    req.Steps,
+	})
+
+	log.Printf(me+": method=%s url=%s from=%s job=%s group=%s steps=%v interval=%v", r.Method, r.URL.Path, r.RemoteAddr, j.status.ID, g.Name, req.Steps, interval)
+
+	jr := jobRequest(r)
+	j.start(func() { shiftRun(j, debug, dry, vendor, host, req, interval, jr, username, password) })
+
+	sendJob(me, debug, j, w, r)
+}
+
+func shiftRun(j *job, debug, dry bool, vendor, host string, req shiftRequest, interval time.Duration, r *http.Request, username, password string) {
+
+	me := "shiftRun"
+
+	id := j.get().ID
+
+	for i, percent := range req.Steps {
+		if i > 0 && !j.sleep(interval) {
+			log.Printf(me+": job=%s group=%s canceled after step=%d/%d", id, req.ServiceGroup, i, len(req.Steps))
+			j.update(func(s *jobStatus) {
+				s.State = jobCanceled
+				s.Result = fmt.Sprintf("shift canceled after step %d/%d (%d%%) - weights left as set by that step", i, len(req.Steps), req.Steps[i-1])
+			})
+			return
+		}
+
+		result := fmt.Sprintf("shift job %s: step %d/%d: %d%%", id, i+1, len(req.Steps), percent)
+		names, tab := shiftBackends(shiftMembers(req, percent))
+
+		// one session per backend, in order to audit every backend change
+		unlock := lockDevice(host)
+		for _, name := range names {
+			errStep := j.session(debug, dry, vendor, host, username, password, func(lb loadBalancer) error {
+				backendTab, errList := lb.BackendList()
+				if errList != nil {
+					return errList
+				}
+				changes := shiftChanges(backendTab, req.ServiceGroup, tab[name])
+				if len(changes) == 0 {
+					return nil // nothing to change
+				}
+				ra := auditStart(r, lb, vendor, host, name, backendTab[name])
+				be := backend{BackendName: name, ServiceGroups: []backendServiceGroup{{Name: req.ServiceGroup, Members: changes}}}
+				errCount, err := lb.MemberUpdate(be)
+				if err != nil {
+					auditWrite(ra, lb, http.StatusBadGateway, result+": "+err.Error(), 1)
+					return err
+				}
+				auditWrite(ra, lb, opStatus(lb.Operations(), errCount), result, errCount)
+				j.update(func(s *jobStatus) { s.Errors += errCount })
+				return nil
+			})
+			if errStep != nil {
+				unlock()
+				j.fail(fmt.Errorf("step %d (%d%%): backend %s: %v", i+1, percent, name, errStep))
+				return
+			}
+		}
+		unlock()
+
+		log.Printf(me+": job=%s group=%s step=%d/%d percent=%d", id, req.ServiceGroup, i+1, len(req.Steps), percent)
+
+		j.update(func(s *jobStatus) { s.Step = i + 1 })
+	}
+
+	j.update(func(s *jobStatus) {
+		s.State = jobDone
+		s.Result = fmt.Sprintf("traffic shifted in %d steps", len(req.Steps))
+	})
+}
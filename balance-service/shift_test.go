@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestShiftMembers(t *testing.T) {
+	req := shiftRequest{
+		ServiceGroup: "g1",
+		From:         []backendSGMember{{Name: "old", Port: "80"}},
+		To:           []backendSGMember{{Name: "new", Port: "80"}},
+		Weight:       10,
+	}
+	if _, errCheck := checkShift(&req); errCheck != nil {
+		t.Fatalf("check: %v", errCheck)
+	}
+	if len(req.Steps) != len(shiftSteps) {
+		t.Errorf("check: missing default steps: %v", req.Steps)
+	}
+
+	members := shiftMembers(req, 5)
+	if members[0].Weight != 9 || members[1].Weight != 1 || members[1].State != stateEnabled {
+		t.Errorf("5%%: unexpected members: %+v", members)
+	}
+	members = shiftMembers(req, 100)
+	if members[0].State != stateDisabled || members[0].Weight != 0 || members[1].Weight != 10 {
+		t.Errorf("100%%: unexpected members: %+v", members)
+	}
+
+	bad := []shiftRequest{
+		{From: req.From, To: req.To},
+		{ServiceGroup: "g1", From: req.From},
+		{ServiceGroup: "g1", From: req.From, To: req.From},
+		{ServiceGroup: "g1", From: req.From, To: req.To, Steps: []int{50, 10}},
+		{ServiceGroup: "g1", From: req.From, To: req.To, Steps: []int{50, 150}},
+		{ServiceGroup: "g1", From: req.From, To: req.To, Interval: "soon"},
+	}
+	for _, b := range bad {
+		if _, errCheck := checkShift(&b); errCheck == nil {
+			t.Errorf("expected error: %+v", b)
+		}
+	}
+}
+
+func TestE2EShift(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPut, "backend", "server_put.yaml", nil), http.StatusOK)
+
+	body := []byte(`{"ServiceGroup": "group1", "From": [{"Name": "s0", "Port": "8080"}], "To": [{"Name": "s1", "Port": "5555"}], "Steps": [50, 100], "Interval": "10ms"}`)
+
+	expectStatus(t, "missing member", e.request(http.MethodPost, "shift", []byte(`{"ServiceGroup": "group1", "From": [{"Name": "s0", "Port": "8080"}], "To": [{"Name": "s9", "Port": "1"}]}`), nil), http.StatusBadRequest)
+
+	w := e.request(http.MethodPost, "shift?plan=true", body, nil)
+	expectStatus(t, "plan", w, http.StatusOK)
+	if report := decodeReport(t, "plan", w); len(report.Operations) != 4 {
+		t.Errorf("plan: unexpected operations: %v", report.Operations)
+	}
+	if port := e.device.State().ServerList[0].PortList[0]; port.Weight != 0 {
+		t.Errorf("plan: device changed: %+v", port)
+	}
+
+	id := startJob(t, e.request(http.MethodPost, "shift", body, nil))
+
+	s := waitJob(t, id, func(s jobStatus) bool { return s.State == jobDone || s.State == jobFailed })
+	if s.State != jobDone || s.Step != 2 || s.Errors != 0 {
+		t.Errorf("shift: unexpected job: %+v", s)
+	}
+
+	state := e.device.State()
+	if port := state.ServerList[0].PortList[0]; port.Weight != 50 {
+		t.Errorf("shift: unexpected old port: %+v", port)
+	}
+	for _, p := range state.ServerList[1].PortList {
+		if (p.Weight == 100) != (p.PortNum == 5555) {
+			t.Errorf("shift: unexpected new port: %+v", p)
+		}
+	}
+	for _, m := range state.ServiceGroupList[0].MemberList {
+		if m.Disabled != (m.Server == "s0") {
+			t.Errorf("shift: unexpected member: %+v", m)
+		}
+	}
+}
+
+func TestE2EShiftCancel(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPut, "backend", "server_put.yaml", nil), http.StatusOK)
+
+	body := []byte(`{"ServiceGroup": "group1", "From": [{"Name": "s0", "Port": "8080"}], "To": [{"Name": "s1", "Port": "5555"}], "Steps": [50, 100], "Interval": "1m"}`)
+
+	id := startJob(t, e.request(http.MethodPost, "shift", body, nil))
+	waitJob(t, id, func(s jobStatus) bool { return s.Step == 1 })
+
+	expectStatus(t, "cancel", cancelJob(id, "admin", "a10"), http.StatusAccepted)
+
+	s := waitJob(t, id, func(s jobStatus) bool { return jobFinished(s.State) })
+	if s.State != jobCanceled || s.Step != 1 {
+		t.Errorf("cancel: unexpected job: %+v", s)
+	}
+	if port := e.device.State().ServerList[0].PortList[0]; port.Weight != 50 {
+		t.Errorf("cancel: old port should keep first step weight: %+v", port)
+	}
+}
+
+func TestE2EF5Shift(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	expectStatus(t, "link", e.sample(http.MethodPost, "backend", "server_link.yaml", nil), http.StatusOK)
+
+	body := []byte(`{"ServiceGroup": "group1", "From": [{"Name": "s0", "Port": "8080"}], "To": [{"Name": "s1", "Port": "5555"}], "Steps": [25, 100], "Interval": "10ms"}`)
+
+	id := startJob(t, e.request(http.MethodPost, "shift", body, nil))
+
+	s := waitJob(t, id, func(s jobStatus) bool { return s.State == jobDone || s.State == jobFailed })
+	if s.State != jobDone || s.Step != 2 || s.Kind != jobShift {
+		t.Errorf("shift: unexpected job: %+v", s)
+	}
+
+	for _, m := range e.device.State().Pools[0].Members {
+		switch m.Name {
+		case "s0:8080":
+			if m.Session != "user-disabled" || m.Ratio != 75 {
+				t.Errorf("shift: unexpected old member: %+v", m)
+			}
+		case "s1:5555":
+			if m.Session != "monitor-enabled" || m.Ratio != 100 {
+				t.Errorf("shift: unexpected new member: %+v", m)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+// GET /backend?stats=true adds live Stats to backends, backend ports and group members:
+// health monitor status and traffic counters, read from the device side facing the backend.
+//
+// BytesIn:  received from backend (A10 resp_bytes, total_rev_bytes - F5 serverside.bitsIn/8)
+// BytesOut: sent to backend (A10 req_bytes, total_fwd_bytes - F5 serverside.bitsOut/8)
+
+const (
+	healthUp   = "up"
+	healthDown = "down"
+)
+
+// backendStats is live status and traffic
+type backendStats struct {
+	Health   string // up, down
+	CurConns int64  // current connections
+	TotConns int64  // total connections
+	BytesIn  int64
+	BytesOut int64
+}
+
+func health(up bool) string {
+	if up {
+		return healthUp
+	}
+	return healthDown
+}
+
+// add sums traffic, health is up when any is up
+func (s *backendStats) add(other backendStats) {
+	if s.Health != healthUp {
+		s.Health = other.Health
+	}
+	s.CurConns += other.CurConns
+	s.TotConns += other.TotConns
+	s.BytesIn += other.BytesIn
+	s.BytesOut += other.BytesOut
+}
+
+// setPortStats attaches stats to backend port
+func setPortStats(b *backend, port string, stats backendStats) {
+	for i := range b.BackendPorts {
+		if b.BackendPorts[i].Port == port {
+			s := stats
+			b.BackendPorts[i].Stats = &s
+		}
+	}
+}
+
+// setMemberStats attaches stats to backend member port in group
+func setMemberStats(b *backend, group, port string, stats backendStats) {
+	for i, sg := range b.ServiceGroups {
+		if sg.Name != group {
+			continue
+		}
+		for j, m := range sg.Members {
+			if m.Name == b.BackendName && m.Port == port {
+				s := stats
+				b.ServiceGroups[i].Members[j].Stats = &s
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/udhos/balance-api-service/a10sim"
+	"github.com/udhos/balance-api-service/f5sim"
+)
+
+func getBackend(t *testing.T, w *httptest.ResponseRecorder) backend {
+	expectStatus(t, "get", w, http.StatusOK)
+	var b backend
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &b); errJSON != nil {
+		t.Fatalf("get: %v: [%s]", errJSON, w.Body.String())
+	}
+	return b
+}
+
+func TestE2EStats(t *testing.T) {
+	e := newE2E(t)
+	defer e.close()
+
+	e.device.SetStat("group1", "s0", 8080, a10sim.MemberStat{CurConns: 3, TotConns: 10, ReqBytes: 100, RespBytes: 2000})
+
+	w := e.request(http.MethodGet, "backend/s0", nil, nil)
+	if b := getBackend(t, w); b.Stats != nil || b.BackendPorts[0].Stats != nil {
+		t.Errorf("stats not requested: %+v", b)
+	}
+	etag := w.Header().Get("ETag")
+
+	w = e.request(http.MethodGet, "backend/s0?stats=true", nil, nil)
+	b := getBackend(t, w)
+	if w.Header().Get("ETag") != etag {
+		t.Errorf("stats changed etag")
+	}
+	want := backendStats{Health: healthUp, CurConns: 3, TotConns: 10, BytesIn: 2000, BytesOut: 100}
+	m, _ := findMember(findGroup(b.ServiceGroups, "group1").Members, "s0", "8080")
+	if b.Stats == nil || *b.Stats != want || b.BackendPorts[0].Stats == nil || *b.BackendPorts[0].Stats != want || m.Stats == nil || *m.Stats != want {
+		t.Errorf("unexpected stats: %+v", b)
+	}
+
+	e.device.SetDown("s0", 8080, true)
+
+	var list []backend
+	w = e.request(http.MethodGet, "backend?stats=true", nil, nil)
+	expectStatus(t, "list", w, http.StatusOK)
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &list); errJSON != nil || len(list) != 1 {
+		t.Fatalf("list: %v: [%s]", errJSON, w.Body.String())
+	}
+	b = list[0]
+	m, _ = findMember(findGroup(b.ServiceGroups, "group1").Members, "s0", "8080")
+	if b.Stats.Health != healthDown || b.BackendPorts[0].Stats.Health != healthDown || m.Stats.Health != healthDown {
+		t.Errorf("expecting health down: %+v", b)
+	}
+}
+
+func TestE2EF5Stats(t *testing.T) {
+	e := newF5E2E(t)
+	defer e.close()
+
+	e.device.SetStat("group1", "s0:8080", f5sim.MemberStat{CurConns: 2, TotConns: 5, BitsIn: 800, BitsOut: 80})
+
+	b := getBackend(t, e.request(http.MethodGet, "backend/s0?stats=true", nil, nil))
+	want := backendStats{Health: healthUp, CurConns: 2, TotConns: 5, BytesIn: 100, BytesOut: 10}
+	m, _ := findMember(findGroup(b.ServiceGroups, "group1").Members, "s0", "8080")
+	if b.Stats == nil || *b.Stats != want || len(b.BackendPorts) != 1 || b.BackendPorts[0].Stats == nil || *b.BackendPorts[0].Stats != want || m.Stats == nil || *m.Stats != want {
+		t.Errorf("unexpected stats: %+v", b)
+	}
+
+	e.device.SetStat("group1", "s0:8080", f5sim.MemberStat{Down: true})
+
+	b = getBackend(t, e.request(http.MethodGet, "backend/s0?stats=true", nil, nil))
+	m, _ = findMember(findGroup(b.ServiceGroups, "group1").Members, "s0", "8080")
+	if b.Stats.Health != healthDown || b.BackendPorts[0].Stats.Health != healthDown || m.Stats.Health != healthDown {
+		t.Errorf("expecting health down: %+v", b)
+	}
+}
@@ -0,0 +1,176 @@
+// Package credstore keeps device credentials in an encrypted local file.
+//
+// File format is nonce followed by AES-256-GCM sealed JSON:
+//
+//	{"devices":{"lb1":{"username":"admin","password":"a10"}}}
+package credstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeySize is the AES-256 key size in bytes
+const KeySize = 32
+
+// Credential is the login for a device
+type Credential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type content struct {
+	Devices map[string]Credential `json:"devices"`
+}
+
+// Store holds device credentials
+type Store struct {
+	mutex sync.Mutex
+	file  string
+	key   []byte
+	data  content
+}
+
+// GenerateKey returns a new random key, base64 encoded
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, errRand := io.ReadFull(rand.Reader, key); errRand != nil {
+		return "", errRand
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseKey decodes base64 key
+func ParseKey(s string) ([]byte, error) {
+	key, errDecode := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if errDecode != nil {
+		return nil, fmt.Errorf("credstore: bad key: %v", errDecode)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("credstore: bad key size: %d != %d", len(key), KeySize)
+	}
+	return key, nil
+}
+
+// Open loads store from file. Missing file gives empty store.
+func Open(file string, key []byte) (*Store, error) {
+	s := &Store{file: file, key: key, data: content{Devices: map[string]Credential{}}}
+
+	sealed, errRead := ioutil.ReadFile(file)
+	if os.IsNotExist(errRead) {
+		return s, nil
+	}
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	gcm, errGCM := newGCM(key)
+	if errGCM != nil {
+		return nil, errGCM
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("credstore: %s: file too short", file)
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	plain, errOpen := gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+	if errOpen != nil {
+		return nil, fmt.Errorf("credstore: %s: wrong key or corrupted file", file)
+	}
+
+	if errJSON := json.Unmarshal(plain, &s.data); errJSON != nil {
+		return nil, fmt.Errorf("credstore: %s: %v", file, errJSON)
+	}
+	if s.data.Devices == nil {
+		s.data.Devices = map[string]Credential{}
+	}
+
+	return s, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("credstore: bad key size: %d != %d", len(key), KeySize)
+	}
+	block, errCipher := aes.NewCipher(key)
+	if errCipher != nil {
+		return nil, errCipher
+	}
+	return cipher.NewGCM(block)
+}
+
+// Save writes store to file, readable only by owner
+func (s *Store) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	plain, errJSON := json.Marshal(s.data)
+	if errJSON != nil {
+		return errJSON
+	}
+
+	gcm, errGCM := newGCM(s.key)
+	if errGCM != nil {
+		return errGCM
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, errRand := io.ReadFull(rand.Reader, nonce); errRand != nil {
+		return errRand
+	}
+
+	tmp := s.file + ".tmp"
+	if errWrite := ioutil.WriteFile(tmp, gcm.Seal(nonce, nonce, plain, nil), 0600); errWrite != nil {
+		return errWrite
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// Get finds credential for device
+func (s *Store) Get(device string) (Credential, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c, found := s.data.Devices[device]
+	return c, found
+}
+
+// Set defines credential for device
+func (s *Store) Set(device string, c Credential) error {
+	if device == "" || c.Username == "" {
+		return errors.New("credstore: device and username are required")
+	}
+	s.mutex.Lock()
+	s.data.Devices[device] = c
+	s.mutex.Unlock()
+	return nil
+}
+
+// Delete removes credential for device
+func (s *Store) Delete(device string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, found := s.data.Devices[device]
+	delete(s.data.Devices, device)
+	return found
+}
+
+// Devices lists devices with credentials, sorted
+func (s *Store) Devices() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var list []string
+	for d := range s.data.Devices {
+		list = append(list, d)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,57 @@
+package credstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, errDir := ioutil.TempDir("", "credstore")
+	if errDir != nil {
+		t.Fatalf("tempdir: %v", errDir)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "creds")
+
+	encoded, errGen := GenerateKey()
+	if errGen != nil {
+		t.Fatalf("key: %v", errGen)
+	}
+	key, errKey := ParseKey(encoded)
+	if errKey != nil {
+		t.Fatalf("key: %v", errKey)
+	}
+
+	s, errOpen := Open(file, key)
+	if errOpen != nil {
+		t.Fatalf("open missing file: %v", errOpen)
+	}
+	if errSet := s.Set("lb1", Credential{Username: "admin", Password: "s3cret"}); errSet != nil {
+		t.Errorf("set: %v", errSet)
+	}
+	if errSave := s.Save(); errSave != nil {
+		t.Fatalf("save: %v", errSave)
+	}
+
+	buf, _ := ioutil.ReadFile(file)
+	if strings.Contains(string(buf), "s3cret") || strings.Contains(string(buf), "admin") {
+		t.Errorf("store file is not encrypted")
+	}
+
+	s2, errReopen := Open(file, key)
+	if errReopen != nil {
+		t.Fatalf("reopen: %v", errReopen)
+	}
+	if c, found := s2.Get("lb1"); !found || c.Password != "s3cret" {
+		t.Errorf("unexpected credential: %v", c)
+	}
+
+	otherKey, _ := GenerateKey()
+	other, _ := ParseKey(otherKey)
+	if _, errWrong := Open(file, other); errWrong == nil {
+		t.Errorf("open with wrong key: missing error")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/e-XpertSolutions/f5-rest-client/f5"
 	"github.com/e-XpertSolutions/f5-rest-client/f5/ltm"
@@ -20,7 +21,11 @@ func sexyPrint(label string, a interface{}) {
 
 func main() {
 
-	f5Host := "https://10.255.255.120"
+	host := os.Getenv("F5_HOST")
+	if host == "" {
+		host = "10.255.255.120"
+	}
+	f5Host := "https://" + host
 
 	// 1) Basic Authentication
 	f5Client, err := f5.NewBasicClient(f5Host, "admin", "admin")
@@ -0,0 +1,61 @@
+// f5-sim serves a simulated F5 BIG-IP iControl REST device.
+//
+// Env vars:
+//
+// LISTEN=:8443         listen address
+// AUTH=admin:admin     device credentials
+// STATE=state.yaml     initial device configuration
+// CERT=cert.pem        TLS certificate (self-signed if unset)
+// KEY=key.pem          TLS key (self-signed if unset)
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/udhos/balance-api-service/f5sim"
+)
+
+func main() {
+
+	addr := os.Getenv("LISTEN")
+	if addr == "" {
+		addr = ":8443"
+	}
+
+	d := f5sim.New()
+
+	if auth := os.Getenv("AUTH"); auth != "" {
+		i := strings.IndexByte(auth, ':')
+		if i < 0 {
+			log.Fatalf("bad env var AUTH=[%s] - expecting username:password", auth)
+		}
+		d.AddUser(auth[:i], auth[i+1:])
+	}
+
+	if stateFile := os.Getenv("STATE"); stateFile != "" {
+		buf, errRead := ioutil.ReadFile(stateFile)
+		if errRead != nil {
+			log.Fatalf("state: %v", errRead)
+		}
+		var s f5sim.State
+		if errYaml := yaml.Unmarshal(buf, &s); errYaml != nil {
+			log.Fatalf("state: %s: %v", stateFile, errYaml)
+		}
+		d.Load(s)
+		log.Printf("state=%s: nodes=%d pools=%d virtuals=%d selfs=%d", stateFile, len(s.Nodes), len(s.Pools), len(s.Virtuals), len(s.Selfs))
+	}
+
+	cert := os.Getenv("CERT")
+	key := os.Getenv("KEY")
+
+	log.Printf("serving simulated F5 iControl REST on HTTPS %s LISTEN=[%s] CERT=[%s] KEY=[%s]", addr, os.Getenv("LISTEN"), cert, key)
+
+	if err := f5sim.ListenAndServeTLS(d, addr, cert, key); err != nil {
+		log.Fatalf("ListenAndServeTLS: %s: %v", addr, err)
+	}
+}
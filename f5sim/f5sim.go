@@ -0,0 +1,860 @@
+// Package f5sim simulates an F5 BIG-IP device speaking iControl REST,
+// keeping objects in memory.
+//
+// Implemented collections (stateful CRUD):
+//
+//	/mgmt/tm/ltm/node
+//	/mgmt/tm/ltm/pool
+//	/mgmt/tm/ltm/pool/<pool>/members
+//	/mgmt/tm/ltm/virtual
+//	/mgmt/tm/net/self
+//
+// Objects are addressed by name or by REST id: ~Common~name
+package f5sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultPartition is used for objects created without partition
+const DefaultPartition = "Common"
+
+// Node is an ltm node
+type Node struct {
+	Name            string `json:"name" yaml:"name"`
+	Partition       string `json:"partition,omitempty" yaml:"partition,omitempty"`
+	Address         string `json:"address" yaml:"address"`
+	Session         string `json:"session,omitempty" yaml:"session,omitempty"` // user-enabled, user-disabled
+	State           string `json:"state,omitempty" yaml:"state,omitempty"`     // up, user-down, unchecked
+	ConnectionLimit int64  `json:"connectionLimit" yaml:"connectionLimit"`
+	Ratio           int64  `json:"ratio,omitempty" yaml:"ratio,omitempty"`
+}
+
+// Member is an ltm pool member, named node:port
+type Member struct {
+	Name            string `json:"name" yaml:"name"`
+	Partition       string `json:"partition,omitempty" yaml:"partition,omitempty"`
+	Address         string `json:"address,omitempty" yaml:"address,omitempty"`
+	Session         string `json:"session,omitempty" yaml:"session,omitempty"`
+	State           string `json:"state,omitempty" yaml:"state,omitempty"`
+	ConnectionLimit int64  `json:"connectionLimit" yaml:"connectionLimit"`
+	Ratio           int64  `json:"ratio,omitempty" yaml:"ratio,omitempty"`
+	PriorityGroup   int64  `json:"priorityGroup" yaml:"priorityGroup"`
+}
+
+// Pool is an ltm pool
+type Pool struct {
+	Name              string   `json:"name" yaml:"name"`
+	Partition         string   `json:"partition,omitempty" yaml:"partition,omitempty"`
+	LoadBalancingMode string   `json:"loadBalancingMode,omitempty" yaml:"loadBalancingMode,omitempty"`
+	Monitor           string   `json:"monitor,omitempty" yaml:"monitor,omitempty"`
+	Members           []Member `json:"-" yaml:"members,omitempty"`
+}
+
+// Virtual is an ltm virtual server
+type Virtual struct {
+	Name        string `json:"name" yaml:"name"`
+	Partition   string `json:"partition,omitempty" yaml:"partition,omitempty"`
+	Destination string `json:"destination" yaml:"destination"` // /Common/10.0.0.1:80
+	Mask        string `json:"mask,omitempty" yaml:"mask,omitempty"`
+	IPProtocol  string `json:"ipProtocol,omitempty" yaml:"ipProtocol,omitempty"`
+	Pool        string `json:"pool,omitempty" yaml:"pool,omitempty"` // /Common/pool1
+	Source      string `json:"source,omitempty" yaml:"source,omitempty"`
+}
+
+// Self is a net self IP
+type Self struct {
+	Name         string `json:"name" yaml:"name"`
+	Partition    string `json:"partition,omitempty" yaml:"partition,omitempty"`
+	Address      string `json:"address" yaml:"address"` // 10.0.0.1/24
+	Vlan         string `json:"vlan,omitempty" yaml:"vlan,omitempty"`
+	TrafficGroup string `json:"trafficGroup,omitempty" yaml:"trafficGroup,omitempty"`
+	Floating     string `json:"floating,omitempty" yaml:"floating,omitempty"`
+}
+
+// State is the full device configuration
+type State struct {
+	Nodes    []Node    `json:"nodes" yaml:"nodes"`
+	Pools    []Pool    `json:"pools" yaml:"pools"`
+	Virtuals []Virtual `json:"virtuals" yaml:"virtuals"`
+	Selfs    []Self    `json:"selfs" yaml:"selfs"`
+}
+
+// Device is a simulated F5 device
+type Device struct {
+	mutex    sync.Mutex
+	users    map[string]string // username => password
+	nodes    map[string]*Node  // fullPath => node
+	pools    map[string]*Pool
+	virtuals map[string]*Virtual
+	selfs    map[string]*Self
+	faults   map[string]string     // "METHOD path" prefix => error message
+	calls    []string              // "METHOD path"
+	stats    map[string]MemberStat // "poolPath memberPath" => traffic
+}
+
+// MemberStat is the simulated traffic for a pool member
+type MemberStat struct {
+	CurConns int64
+	TotConns int64
+	BitsIn   int64
+	BitsOut  int64
+	Down     bool // failing health monitor
+}
+
+// New creates device with user admin:admin
+func New() *Device {
+	d := &Device{
+		users:    map[string]string{},
+		nodes:    map[string]*Node{},
+		pools:    map[string]*Pool{},
+		virtuals: map[string]*Virtual{},
+		selfs:    map[string]*Self{},
+		faults:   map[string]string{},
+		stats:    map[string]MemberStat{},
+	}
+	d.AddUser("admin", "admin")
+	return d
+}
+
+// AddUser adds admin user
+func (d *Device) AddUser(username, password string) {
+	d.mutex.Lock()
+	d.users[username] = password
+	d.mutex.Unlock()
+}
+
+func partition(p string) string {
+	if p == "" {
+		return DefaultPartition
+	}
+	return p
+}
+
+func fullPath(p, name string) string {
+	return "/" + partition(p) + "/" + name
+}
+
+// SetStat sets simulated traffic for pool member (node:port), reported by /members/stats
+func (d *Device) SetStat(pool, member string, stat MemberStat) {
+	d.mutex.Lock()
+	d.stats[fullPath("", pool)+" "+fullPath("", member)] = stat
+	d.mutex.Unlock()
+}
+
+// Load replaces device configuration
+func (d *Device) Load(s State) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.nodes = map[string]*Node{}
+	d.pools = map[string]*Pool{}
+	d.virtuals = map[string]*Virtual{}
+	d.selfs = map[string]*Self{}
+	for _, n := range s.Nodes {
+		n := n
+		n.Partition = partition(n.Partition)
+		defaultSession(&n.Session, &n.State)
+		d.nodes[fullPath(n.Partition, n.Name)] = &n
+	}
+	for _, p := range s.Pools {
+		p := p
+		p.Partition = partition(p.Partition)
+		p.Members = append([]Member{}, p.Members...)
+		for i := range p.Members {
+			m := &p.Members[i]
+			m.Partition = partition(m.Partition)
+			defaultSession(&m.Session, &m.State)
+		}
+		d.pools[fullPath(p.Partition, p.Name)] = &p
+	}
+	for _, v := range s.Virtuals {
+		v := v
+		v.Partition = partition(v.Partition)
+		d.virtuals[fullPath(v.Partition, v.Name)] = &v
+	}
+	for _, self := range s.Selfs {
+		self := self
+		self.Partition = partition(self.Partition)
+		d.selfs[fullPath(self.Partition, self.Name)] = &self
+	}
+}
+
+// State returns device configuration, sorted by name
+func (d *Device) State() State {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s := State{Nodes: []Node{}, Pools: []Pool{}, Virtuals: []Virtual{}, Selfs: []Self{}}
+	for _, k := range sortedKeys(d.nodes) {
+		s.Nodes = append(s.Nodes, *d.nodes[k])
+	}
+	for _, k := range sortedKeys(d.pools) {
+		p := *d.pools[k]
+		p.Members = append([]Member{}, p.Members...)
+		s.Pools = append(s.Pools, p)
+	}
+	for _, k := range sortedKeys(d.virtuals) {
+		s.Virtuals = append(s.Virtuals, *d.virtuals[k])
+	}
+	for _, k := range sortedKeys(d.selfs) {
+		s.Selfs = append(s.Selfs, *d.selfs[k])
+	}
+	return s
+}
+
+func sortedKeys(tab interface{}) []string {
+	var keys []string
+	switch t := tab.(type) {
+	case map[string]*Node:
+		for k := range t {
+			keys = append(keys, k)
+		}
+	case map[string]*Pool:
+		for k := range t {
+			keys = append(keys, k)
+		}
+	case map[string]*Virtual:
+		for k := range t {
+			keys = append(keys, k)
+		}
+	case map[string]*Self:
+		for k := range t {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Fail makes requests matching "METHOD path" prefix fail with message, until Heal is called.
+// Example: d.Fail("POST /mgmt/tm/ltm/pool/", "simulated failure")
+func (d *Device) Fail(prefix, msg string) {
+	d.mutex.Lock()
+	d.faults[prefix] = msg
+	d.mutex.Unlock()
+}
+
+// Heal removes failure set by Fail
+func (d *Device) Heal(prefix string) {
+	d.mutex.Lock()
+	delete(d.faults, prefix)
+	d.mutex.Unlock()
+}
+
+// Calls returns requests received so far, as "METHOD path"
+func (d *Device) Calls() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string{}, d.calls...)
+}
+
+// restError is iControl REST error response
+type restError struct {
+	Code       int      `json:"code"`
+	Message    string   `json:"message"`
+	ErrorStack []string `json:"errorStack"`
+}
+
+func fail(code int, format string, v ...interface{}) *restError {
+	return &restError{Code: code, Message: fmt.Sprintf(format, v...), ErrorStack: []string{}}
+}
+
+func notFound(kind, path string) *restError {
+	return fail(http.StatusNotFound, "01020036:3: The requested %s (%s) was not found.", kind, path)
+}
+
+// ServeHTTP implements iControl REST
+func (d *Device) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	username, password, authOK := r.BasicAuth()
+
+	body, errRead := ioutil.ReadAll(r.Body)
+	if errRead != nil {
+		send(w, http.StatusBadRequest, fail(http.StatusBadRequest, "%v", errRead))
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	call := r.Method + " " + r.URL.Path
+	d.calls = append(d.calls, call)
+
+	if pwd, found := d.users[username]; !authOK || !found || pwd != password {
+		send(w, http.StatusUnauthorized, fail(http.StatusUnauthorized, "Authorization failed: user=%s resource=%s", username, r.URL.Path))
+		return
+	}
+
+	for prefix, msg := range d.faults {
+		if strings.HasPrefix(call, prefix) {
+			log.Printf("f5sim: %s: simulated failure: %s", call, msg)
+			send(w, http.StatusBadRequest, fail(http.StatusBadRequest, "%s", msg))
+			return
+		}
+	}
+
+	status, resp := d.route(r.Method, r.URL.Path, body)
+	if e, isErr := resp.(*restError); isErr {
+		log.Printf("f5sim: %s: %d %s", call, e.Code, e.Message)
+	}
+	send(w, status, resp)
+}
+
+func send(w http.ResponseWriter, status int, v interface{}) {
+	buf, errMarshal := json.Marshal(v)
+	if errMarshal != nil {
+		http.Error(w, errMarshal.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// splitID converts REST id ~Common~name (or plain name) to full path /Common/name
+func splitID(id string) string {
+	if strings.HasPrefix(id, "~") {
+		return strings.Replace(id, "~", "/", -1)
+	}
+	return fullPath("", id)
+}
+
+func (d *Device) route(method, path string, body []byte) (int, interface{}) {
+
+	p := strings.Trim(path, "/")
+
+	if p == "mgmt/tm" {
+		return http.StatusOK, map[string]string{"kind": "tm:restgroupresolverviewstate", "selfLink": "https://localhost/mgmt/tm?ver=12.1.0"}
+	}
+
+	fields := strings.Split(p, "/")
+	if len(fields) < 4 || fields[0] != "mgmt" || fields[1] != "tm" {
+		return http.StatusNotFound, fail(http.StatusNotFound, "URI path %s not registered", path)
+	}
+
+	module := fields[2] + "/" + fields[3]
+	args := fields[4:]
+
+	switch module {
+	case "ltm/node":
+		return d.nodeRoute(method, args, body)
+	case "ltm/pool":
+		if len(args) >= 2 && args[1] == "members" {
+			return d.memberRoute(method, splitID(args[0]), args[2:], body)
+		}
+		return d.poolRoute(method, args, body)
+	case "ltm/virtual":
+		return d.virtualRoute(method, args, body)
+	case "net/self":
+		return d.selfRoute(method, args, body)
+	}
+
+	return http.StatusNotFound, fail(http.StatusNotFound, "URI path %s not registered", path)
+}
+
+func decode(body []byte, v interface{}) *restError {
+	if errJSON := json.Unmarshal(body, v); errJSON != nil {
+		return fail(http.StatusBadRequest, "Found invalid JSON body in the request: %v", errJSON)
+	}
+	return nil
+}
+
+// list wraps collection items
+func list(kind string, items interface{}) map[string]interface{} {
+	return map[string]interface{}{"kind": kind, "items": items}
+}
+
+// item adds REST metadata to object
+func item(kind string, obj interface{}, partition, name string) map[string]interface{} {
+	buf, _ := json.Marshal(obj)
+	tab := map[string]interface{}{}
+	json.Unmarshal(buf, &tab)
+	tab["kind"] = kind
+	tab["fullPath"] = fullPath(partition, name)
+	tab["generation"] = 1
+	return tab
+}
+
+func (d *Device) nodeRoute(method string, args []string, body []byte) (int, interface{}) {
+	const kind = "tm:ltm:node:nodestate"
+
+	if len(args) == 1 && args[0] == "stats" && method == http.MethodGet {
+		return http.StatusOK, d.nodeStats()
+	}
+
+	if len(args) == 0 {
+		switch method {
+		case http.MethodGet:
+			items := []interface{}{}
+			for _, k := range sortedKeys(d.nodes) {
+				n := d.nodes[k]
+				items = append(items, item(kind, n, n.Partition, n.Name))
+			}
+			return http.StatusOK, list("tm:ltm:node:nodecollectionstate", items)
+		case http.MethodPost:
+			var n Node
+			if errDecode := decode(body, &n); errDecode != nil {
+				return http.StatusBadRequest, errDecode
+			}
+			if n.Name == "" || n.Address == "" {
+				return http.StatusBadRequest, fail(http.StatusBadRequest, "node name and address are required")
+			}
+			n.Partition = partition(n.Partition)
+			path := fullPath(n.Partition, n.Name)
+			if _, found := d.nodes[path]; found {
+				return http.StatusConflict, fail(http.StatusConflict, "01020066:3: The requested Node (%s) already exists in partition %s.", path, n.Partition)
+			}
+			defaultSession(&n.Session, &n.State)
+			d.nodes[path] = &n
+			return http.StatusOK, item(kind, n, n.Partition, n.Name)
+		}
+		return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+	}
+
+	path := splitID(args[0])
+	n, found := d.nodes[path]
+	if !found {
+		return http.StatusNotFound, notFound("Node", path)
+	}
+
+	switch method {
+	case http.MethodGet:
+		return http.StatusOK, item(kind, n, n.Partition, n.Name)
+	case http.MethodPut, http.MethodPatch:
+		edit := *n
+		if errDecode := decode(body, &edit); errDecode != nil {
+			return http.StatusBadRequest, errDecode
+		}
+		if edit.Address != n.Address {
+			return http.StatusBadRequest, fail(http.StatusBadRequest, "01070603:3: Cannot modify the address of node %s.", path)
+		}
+		edit.Name, edit.Partition = n.Name, n.Partition
+		defaultSession(&edit.Session, &edit.State)
+		*n = edit
+		return http.StatusOK, item(kind, n, n.Partition, n.Name)
+	case http.MethodDelete:
+		for _, p := range d.pools {
+			for _, m := range p.Members {
+				if name, _ := splitMember(m.Name); fullPath(m.Partition, name) == path {
+					return http.StatusBadRequest, fail(http.StatusBadRequest, "01070110:3: Node address '%s' is referenced by a member of pool '%s'.", path, fullPath(p.Partition, p.Name))
+				}
+			}
+		}
+		delete(d.nodes, path)
+		return http.StatusOK, nil
+	}
+
+	return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+}
+
+func defaultSession(session, state *string) {
+	if *session == "" || *session == "user-enabled" {
+		*session = "monitor-enabled"
+	}
+	if *state == "" || *state == "user-up" {
+		*state = "unchecked"
+	}
+}
+
+func (d *Device) poolRoute(method string, args []string, body []byte) (int, interface{}) {
+	const kind = "tm:ltm:pool:poolstate"
+
+	if len(args) == 0 {
+		switch method {
+		case http.MethodGet:
+			items := []interface{}{}
+			for _, k := range sortedKeys(d.pools) {
+				p := d.pools[k]
+				items = append(items, item(kind, p, p.Partition, p.Name))
+			}
+			return http.StatusOK, list("tm:ltm:pool:poolcollectionstate", items)
+		case http.MethodPost:
+			var p Pool
+			if errDecode := decode(body, &p); errDecode != nil {
+				return http.StatusBadRequest, errDecode
+			}
+			if p.Name == "" {
+				return http.StatusBadRequest, fail(http.StatusBadRequest, "pool name is required")
+			}
+			p.Partition = partition(p.Partition)
+			path := fullPath(p.Partition, p.Name)
+			if _, found := d.pools[path]; found {
+				return http.StatusConflict, fail(http.StatusConflict, "01020066:3: The requested Pool (%s) already exists in partition %s.", path, p.Partition)
+			}
+			if p.LoadBalancingMode == "" {
+				p.LoadBalancingMode = "round-robin"
+			}
+			d.pools[path] = &p
+			return http.StatusOK, item(kind, p, p.Partition, p.Name)
+		}
+		return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+	}
+
+	path := splitID(args[0])
+	p, found := d.pools[path]
+	if !found {
+		return http.StatusNotFound, notFound("Pool", path)
+	}
+
+	switch method {
+	case http.MethodGet:
+		return http.StatusOK, item(kind, p, p.Partition, p.Name)
+	case http.MethodPut, http.MethodPatch:
+		edit := *p
+		if errDecode := decode(body, &edit); errDecode != nil {
+			return http.StatusBadRequest, errDecode
+		}
+		edit.Name, edit.Partition, edit.Members = p.Name, p.Partition, p.Members
+		*p = edit
+		return http.StatusOK, item(kind, p, p.Partition, p.Name)
+	case http.MethodDelete:
+		for _, v := range d.virtuals {
+			if v.Pool == path {
+				return http.StatusBadRequest, fail(http.StatusBadRequest, "01070265:3: The Pool (%s) cannot be deleted because it is in use by a Virtual Server (%s).", path, fullPath(v.Partition, v.Name))
+			}
+		}
+		delete(d.pools, path)
+		return http.StatusOK, nil
+	}
+
+	return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+}
+
+// splitMember splits member name node:port
+// IPv6 members use dot as port separator: 2001::1.80
+func splitMember(name string) (string, string) {
+	sep := ":"
+	if strings.Count(name, ":") > 1 {
+		sep = "."
+	}
+	i := strings.LastIndex(name, sep)
+	if i < 0 {
+		return name, ""
+	}
+	return name[:i], name[i+1:]
+}
+
+func (d *Device) memberRoute(method, poolPath string, args []string, body []byte) (int, interface{}) {
+	const kind = "tm:ltm:pool:members:membersstate"
+
+	p, found := d.pools[poolPath]
+	if !found {
+		return http.StatusNotFound, notFound("Pool", poolPath)
+	}
+
+	if len(args) == 1 && args[0] == "stats" && method == http.MethodGet {
+		return http.StatusOK, d.memberStats(poolPath, p)
+	}
+
+	if len(args) == 0 || args[0] == "" {
+		switch method {
+		case http.MethodGet:
+			items := []interface{}{}
+			for _, m := range p.Members {
+				items = append(items, item(kind, m, m.Partition, m.Name))
+			}
+			return http.StatusOK, list("tm:ltm:pool:members:memberscollectionstate", items)
+		case http.MethodPost:
+			var m Member
+			if errDecode := decode(body, &m); errDecode != nil {
+				return http.StatusBadRequest, errDecode
+			}
+			nodeName, port := splitMember(m.Name)
+			if nodeName == "" || port == "" {
+				return http.StatusBadRequest, fail(http.StatusBadRequest, "01070587:3: The requested pool member name (%s) is invalid - expecting node:port.", m.Name)
+			}
+			m.Partition = partition(m.Partition)
+			for _, old := range p.Members {
+				if old.Partition == m.Partition && old.Name == m.Name {
+					return http.StatusConflict, fail(http.StatusConflict, "01020066:3: The requested Pool Member (%s %s) already exists in partition %s.", poolPath, fullPath(m.Partition, m.Name), m.Partition)
+				}
+			}
+			nodePath := fullPath(m.Partition, nodeName)
+			n, nodeFound := d.nodes[nodePath]
+			switch {
+			case nodeFound:
+				m.Address = n.Address
+			case m.Address != "":
+				// member with address creates node, like BIG-IP does
+				n = &Node{Name: nodeName, Partition: m.Partition, Address: m.Address}
+				defaultSession(&n.Session, &n.State)
+				d.nodes[nodePath] = n
+			default:
+				return http.StatusBadRequest, notFound("Node", nodePath)
+			}
+			defaultSession(&m.Session, &m.State)
+			p.Members = append(p.Members, m)
+			return http.StatusOK, item(kind, m, m.Partition, m.Name)
+		}
+		return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+	}
+
+	memberPath := splitID(args[0])
+
+	for i := range p.Members {
+		m := &p.Members[i]
+		if fullPath(m.Partition, m.Name) != memberPath {
+			continue
+		}
+		switch method {
+		case http.MethodGet:
+			return http.StatusOK, item(kind, m, m.Partition, m.Name)
+		case http.MethodPut, http.MethodPatch:
+			edit := *m
+			if errDecode := decode(body, &edit); errDecode != nil {
+				return http.StatusBadRequest, errDecode
+			}
+			edit.Name, edit.Partition, edit.Address = m.Name, m.Partition, m.Address
+			defaultSession(&edit.Session, &edit.State)
+			*m = edit
+			return http.StatusOK, item(kind, m, m.Partition, m.Name)
+		case http.MethodDelete:
+			p.Members = append(p.Members[:i:i], p.Members[i+1:]...)
+			return http.StatusOK, nil
+		}
+		return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+	}
+
+	return http.StatusNotFound, notFound("Pool Member", memberPath)
+}
+
+// memberStats reports pool member statistics like BIG-IP: entries keyed by member stats URL
+func (d *Device) memberStats(poolPath string, p *Pool) map[string]interface{} {
+	value := func(v int64) map[string]interface{} { return map[string]interface{}{"value": v} }
+	description := func(s string) map[string]interface{} { return map[string]interface{}{"description": s} }
+	entries := map[string]interface{}{}
+	for _, m := range p.Members {
+		memberPath := fullPath(m.Partition, m.Name)
+		stat := d.stats[poolPath+" "+memberPath]
+		nodeName, port := splitMember(m.Name)
+		portNum, _ := strconv.ParseInt(port, 10, 64)
+		availability := "available"
+		if m.State == "user-down" || stat.Down {
+			availability = "offline"
+		}
+		enabled := "enabled"
+		if m.Session == "user-disabled" {
+			enabled = "disabled"
+		}
+		id := strings.Replace(memberPath, "/", "~", -1)
+		link := "https://localhost/mgmt/tm/ltm/pool/" + strings.Replace(poolPath, "/", "~", -1) + "/members/" + id + "/stats"
+		entries[link] = map[string]interface{}{
+			"nestedStats": map[string]interface{}{
+				"entries": map[string]interface{}{
+					"nodeName":                 description(fullPath(m.Partition, nodeName)),
+					"port":                     value(portNum),
+					"serverside.curConns":      value(stat.CurConns),
+					"serverside.totConns":      value(stat.TotConns),
+					"serverside.bitsIn":        value(stat.BitsIn),
+					"serverside.bitsOut":       value(stat.BitsOut),
+					"status.availabilityState": description(availability),
+					"status.enabledState":      description(enabled),
+				},
+			},
+		}
+	}
+	return map[string]interface{}{"kind": "tm:ltm:pool:members:membersstats", "entries": entries}
+}
+
+// nodeStats reports node statistics as the sum of statistics of node pool members.
+// A node is offline when user-down, or when every member of the node fails its health monitor.
+func (d *Device) nodeStats() map[string]interface{} {
+	value := func(v int64) map[string]interface{} { return map[string]interface{}{"value": v} }
+	description := func(s string) map[string]interface{} { return map[string]interface{}{"description": s} }
+	entries := map[string]interface{}{}
+	for _, n := range d.nodes {
+		nodePath := fullPath(n.Partition, n.Name)
+		var sum MemberStat
+		var members, down int
+		for poolPath, p := range d.pools {
+			for _, m := range p.Members {
+				if nodeName, _ := splitMember(m.Name); fullPath(m.Partition, nodeName) != nodePath {
+					continue
+				}
+				stat := d.stats[poolPath+" "+fullPath(m.Partition, m.Name)]
+				sum.CurConns += stat.CurConns
+				sum.TotConns += stat.TotConns
+				sum.BitsIn += stat.BitsIn
+				sum.BitsOut += stat.BitsOut
+				members++
+				if stat.Down {
+					down++
+				}
+			}
+		}
+		availability := "available"
+		if n.State == "user-down" || (members > 0 && down == members) {
+			availability = "offline"
+		}
+		enabled := "enabled"
+		if n.Session == "user-disabled" {
+			enabled = "disabled"
+		}
+		link := "https://localhost/mgmt/tm/ltm/node/" + strings.Replace(nodePath, "/", "~", -1) + "/stats"
+		entries[link] = map[string]interface{}{
+			"nestedStats": map[string]interface{}{
+				"entries": map[string]interface{}{
+					"tmName":                   description(nodePath),
+					"addr":                     description(n.Address),
+					"serverside.curConns":      value(sum.CurConns),
+					"serverside.totConns":      value(sum.TotConns),
+					"serverside.bitsIn":        value(sum.BitsIn),
+					"serverside.bitsOut":       value(sum.BitsOut),
+					"status.availabilityState": description(availability),
+					"status.enabledState":      description(enabled),
+				},
+			},
+		}
+	}
+	return map[string]interface{}{"kind": "tm:ltm:node:nodestats", "entries": entries}
+}
+
+func (d *Device) virtualRoute(method string, args []string, body []byte) (int, interface{}) {
+	const kind = "tm:ltm:virtual:virtualstate"
+
+	checkPool := func(v *Virtual) *restError {
+		if v.Pool == "" {
+			return nil
+		}
+		if !strings.HasPrefix(v.Pool, "/") {
+			v.Pool = fullPath(v.Partition, v.Pool)
+		}
+		if _, found := d.pools[v.Pool]; !found {
+			return notFound("Pool", v.Pool)
+		}
+		return nil
+	}
+
+	if len(args) == 0 {
+		switch method {
+		case http.MethodGet:
+			items := []interface{}{}
+			for _, k := range sortedKeys(d.virtuals) {
+				v := d.virtuals[k]
+				items = append(items, item(kind, v, v.Partition, v.Name))
+			}
+			return http.StatusOK, list("tm:ltm:virtual:virtualcollectionstate", items)
+		case http.MethodPost:
+			var v Virtual
+			if errDecode := decode(body, &v); errDecode != nil {
+				return http.StatusBadRequest, errDecode
+			}
+			if v.Name == "" || v.Destination == "" {
+				return http.StatusBadRequest, fail(http.StatusBadRequest, "virtual name and destination are required")
+			}
+			v.Partition = partition(v.Partition)
+			path := fullPath(v.Partition, v.Name)
+			if _, found := d.virtuals[path]; found {
+				return http.StatusConflict, fail(http.StatusConflict, "01020066:3: The requested Virtual Server (%s) already exists in partition %s.", path, v.Partition)
+			}
+			if errPool := checkPool(&v); errPool != nil {
+				return http.StatusBadRequest, errPool
+			}
+			if !strings.HasPrefix(v.Destination, "/") {
+				v.Destination = "/" + v.Partition + "/" + v.Destination
+			}
+			if v.IPProtocol == "" {
+				v.IPProtocol = "tcp"
+			}
+			d.virtuals[path] = &v
+			return http.StatusOK, item(kind, v, v.Partition, v.Name)
+		}
+		return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+	}
+
+	path := splitID(args[0])
+	v, found := d.virtuals[path]
+	if !found {
+		return http.StatusNotFound, notFound("Virtual Server", path)
+	}
+
+	switch method {
+	case http.MethodGet:
+		return http.StatusOK, item(kind, v, v.Partition, v.Name)
+	case http.MethodPut, http.MethodPatch:
+		edit := *v
+		if errDecode := decode(body, &edit); errDecode != nil {
+			return http.StatusBadRequest, errDecode
+		}
+		edit.Name, edit.Partition = v.Name, v.Partition
+		if errPool := checkPool(&edit); errPool != nil {
+			return http.StatusBadRequest, errPool
+		}
+		*v = edit
+		return http.StatusOK, item(kind, v, v.Partition, v.Name)
+	case http.MethodDelete:
+		delete(d.virtuals, path)
+		return http.StatusOK, nil
+	}
+
+	return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+}
+
+func (d *Device) selfRoute(method string, args []string, body []byte) (int, interface{}) {
+	const kind = "tm:net:self:selfstate"
+
+	if len(args) == 0 {
+		switch method {
+		case http.MethodGet:
+			items := []interface{}{}
+			for _, k := range sortedKeys(d.selfs) {
+				s := d.selfs[k]
+				items = append(items, item(kind, s, s.Partition, s.Name))
+			}
+			return http.StatusOK, list("tm:net:self:selfcollectionstate", items)
+		case http.MethodPost:
+			var s Self
+			if errDecode := decode(body, &s); errDecode != nil {
+				return http.StatusBadRequest, errDecode
+			}
+			if s.Name == "" || s.Address == "" {
+				return http.StatusBadRequest, fail(http.StatusBadRequest, "self name and address are required")
+			}
+			s.Partition = partition(s.Partition)
+			path := fullPath(s.Partition, s.Name)
+			if _, found := d.selfs[path]; found {
+				return http.StatusConflict, fail(http.StatusConflict, "01020066:3: The requested Self IP (%s) already exists in partition %s.", path, s.Partition)
+			}
+			if s.TrafficGroup == "" {
+				s.TrafficGroup = "/Common/traffic-group-local-only"
+			}
+			if s.Floating == "" {
+				s.Floating = "disabled"
+			}
+			d.selfs[path] = &s
+			return http.StatusOK, item(kind, s, s.Partition, s.Name)
+		}
+		return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+	}
+
+	path := splitID(args[0])
+	s, found := d.selfs[path]
+	if !found {
+		return http.StatusNotFound, notFound("Self IP", path)
+	}
+
+	switch method {
+	case http.MethodGet:
+		return http.StatusOK, item(kind, s, s.Partition, s.Name)
+	case http.MethodPut, http.MethodPatch:
+		edit := *s
+		if errDecode := decode(body, &edit); errDecode != nil {
+			return http.StatusBadRequest, errDecode
+		}
+		edit.Name, edit.Partition = s.Name, s.Partition
+		*s = edit
+		return http.StatusOK, item(kind, s, s.Partition, s.Name)
+	case http.MethodDelete:
+		delete(d.selfs, path)
+		return http.StatusOK, nil
+	}
+
+	return http.StatusMethodNotAllowed, fail(http.StatusMethodNotAllowed, "method not allowed: %s", method)
+}
@@ -0,0 +1,94 @@
+package f5sim
+
+import (
+	"testing"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+	"github.com/e-XpertSolutions/f5-rest-client/f5/ltm"
+	"github.com/e-XpertSolutions/f5-rest-client/f5/net"
+)
+
+func client(t *testing.T, host, password string) *f5.Client {
+	c, errOpen := f5.NewBasicClient("https://"+host, "admin", password)
+	if errOpen != nil {
+		t.Fatalf("client: %v", errOpen)
+	}
+	c.DisableCertCheck()
+	return c
+}
+
+func TestCRUD(t *testing.T) {
+	d := New()
+	d.Load(State{Selfs: []Self{{Name: "self1", Address: "10.0.0.1/24"}}})
+	server := NewTLSServer(d)
+	defer server.Close()
+
+	if errAuth := client(t, Host(server), "bad").CheckAuth(); errAuth == nil {
+		t.Errorf("auth with bad password: missing error")
+	}
+
+	c := client(t, Host(server), "admin")
+	if errAuth := c.CheckAuth(); errAuth != nil {
+		t.Fatalf("auth: %v", errAuth)
+	}
+
+	lb := ltm.New(c)
+
+	if errCreate := lb.Node().Create(ltm.Node{Name: "n1", Address: "1.1.1.1"}); errCreate != nil {
+		t.Errorf("node create: %v", errCreate)
+	}
+	if errCreate := lb.Node().Create(ltm.Node{Name: "n1", Address: "1.1.1.1"}); errCreate == nil {
+		t.Errorf("node create duplicate: missing error")
+	}
+	if errCreate := c.ModQuery("POST", ltm.BasePath+ltm.PoolEndpoint, Pool{Name: "p1"}); errCreate != nil {
+		t.Errorf("pool create: %v", errCreate)
+	}
+	if errCreate := lb.PoolMembers().Create("~Common~p1", ltm.PoolMembers{Name: "n1:80"}); errCreate != nil {
+		t.Errorf("member create: %v", errCreate)
+	}
+	if errCreate := lb.PoolMembers().Create("p1", ltm.PoolMembers{Name: "n2:80"}); errCreate == nil {
+		t.Errorf("member create for missing node: missing error")
+	}
+	if errCreate := lb.Virtual().Create(ltm.VirtualServer{Name: "v1", Destination: "2.2.2.2:80", Pool: "p1"}); errCreate != nil {
+		t.Errorf("virtual create: %v", errCreate)
+	}
+
+	members, errList := lb.PoolMembers().ListAll("~Common~p1")
+	if errList != nil {
+		t.Fatalf("member list: %v", errList)
+	}
+	if len(members.Items) != 1 || members.Items[0].Address != "1.1.1.1" || members.Items[0].FullPath != "/Common/n1:80" {
+		t.Errorf("unexpected members: %v", members.Items)
+	}
+
+	vs, errGet := lb.Virtual().Get("v1")
+	if errGet != nil {
+		t.Fatalf("virtual get: %v", errGet)
+	}
+	if vs.Destination != "/Common/2.2.2.2:80" || vs.Pool != "/Common/p1" {
+		t.Errorf("unexpected virtual: %v", vs)
+	}
+
+	if errDelete := lb.Node().Delete("n1"); errDelete == nil {
+		t.Errorf("delete node referenced by member: missing error")
+	}
+	if errDelete := lb.PoolMembers().Delete("~Common~p1", "~Common~n1:80"); errDelete != nil {
+		t.Errorf("member delete: %v", errDelete)
+	}
+	if errDelete := lb.Node().Delete("n1"); errDelete != nil {
+		t.Errorf("node delete: %v", errDelete)
+	}
+
+	selfs, errSelf := net.New(c).Self().ListAll()
+	if errSelf != nil {
+		t.Fatalf("self list: %v", errSelf)
+	}
+	if len(selfs.Items) != 1 || selfs.Items[0].Address != "10.0.0.1/24" {
+		t.Errorf("unexpected selfs: %v", selfs.Items)
+	}
+
+	state := d.State()
+	if len(state.Nodes) != 0 || len(state.Pools) != 1 || len(state.Pools[0].Members) != 0 || len(state.Virtuals) != 1 {
+		t.Errorf("unexpected state: %v", state)
+	}
+}
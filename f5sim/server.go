@@ -0,0 +1,64 @@
+package f5sim
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// f5-rest-client is used with https URLs, hence the simulator only serves TLS.
+
+// NewTLSServer starts device on a local TLS listener.
+// Device host for the balance service is Host(server).
+func NewTLSServer(d *Device) *httptest.Server {
+	return httptest.NewTLSServer(d)
+}
+
+// Host returns host:port for server, as expected by f5.NewBasicClient("https://"+host, ...)
+func Host(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+// ListenAndServeTLS serves device on addr.
+// If certFile or keyFile is empty, a self-signed certificate is generated.
+func ListenAndServeTLS(d *Device, addr, certFile, keyFile string) error {
+	server := &http.Server{Addr: addr, Handler: d}
+	if certFile != "" && keyFile != "" {
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+	cert, errCert := selfSigned()
+	if errCert != nil {
+		return errCert
+	}
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return server.ListenAndServeTLS("", "")
+}
+
+func selfSigned() (tls.Certificate, error) {
+	key, errKey := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		return tls.Certificate{}, errKey
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"f5sim"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	der, errCreate := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if errCreate != nil {
+		return tls.Certificate{}, errCreate
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -1,9 +1,17 @@
 module github.com/udhos/balance-api-service
 
+go 1.27.1
+
 require (
 	github.com/e-XpertSolutions/f5-rest-client v0.0.1-0.20180601080712-d7a337bfdf14
 	github.com/sanity-io/litter v1.1.0
 	github.com/udhos/a10-go-rest-client v0.0.0-20181120072316-fb69549e2127
-	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/yaml.v2 v2.2.1
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/testify v1.2.2 // indirect
+	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+)
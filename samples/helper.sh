@@ -14,22 +14,27 @@ if [ -z "$QUERY" ]; then
 	echo >&2 $0: missing empty env var QUERY
 fi
 
+if [ -z "$RESOURCE" ]; then
+	RESOURCE=backend
+fi
+
 if [ -z "$AUTH" ]; then
 	AUTH=admin:a10
 	echo >&2 $0: forcing empty env var AUTH="$AUTH"
 fi
 
 if [ -z "$URL" ]; then
-	URL="$BASE_URL"/at2/node/"$NODE"/backend"$QUERY"
+	URL="$BASE_URL"/at2/node/"$NODE"/"$RESOURCE""$QUERY"
 	echo >&2 $0: forcing empty env var URL="$URL"
 fi
 
 cat >&2 <<__EOF__
 
-BASE_URL, NODE, QUERY are used only when URL is not set.
+BASE_URL, NODE, RESOURCE, QUERY are used only when URL is not set.
 
 BASE_URL=$BASE_URL
 NODE=$NODE
+RESOURCE=$RESOURCE
 QUERY=$QUERY
 AUTH=$AUTH
 URL=$URL
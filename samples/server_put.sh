@@ -0,0 +1,7 @@
+#!/bin/bash
+
+. ./helper.sh
+
+set -x
+curl -u "$AUTH" --data-binary "@server_put.yaml" -X PUT -H "Accept: text/x-yaml" -H "Content-Type: text/x-yaml" "$URL"
+
@@ -0,0 +1,6 @@
+#!/bin/bash
+
+. ./helper.sh
+
+set -x
+curl -u "$AUTH" --data-binary "@server_state.yaml" -X PATCH -H "Accept: text/x-yaml" -H "Content-Type: text/x-yaml" "$URL"
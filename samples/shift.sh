@@ -0,0 +1,8 @@
+#!/bin/bash
+
+[ -z "$RESOURCE" ] && export RESOURCE=shift
+
+. ./helper.sh
+
+set -x
+curl -u "$AUTH" --data-binary "@shift.yaml" -X POST -H "Accept: text/x-yaml" -H "Content-Type: text/x-yaml" "$URL"
@@ -0,0 +1,9 @@
+#!/bin/bash
+
+[ -z "$RESOURCE" ] && export RESOURCE=virtual
+
+. ./helper.sh
+
+set -x
+curl -u "$AUTH" -X GET -H "Accept: text/x-yaml" -H "Content-Type: text/x-yaml" "$URL"
+
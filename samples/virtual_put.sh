@@ -0,0 +1,9 @@
+#!/bin/bash
+
+[ -z "$RESOURCE" ] && export RESOURCE=virtual
+
+. ./helper.sh
+
+set -x
+curl -u "$AUTH" --data-binary "@virtual_put.yaml" -X PUT -H "Accept: text/x-yaml" -H "Content-Type: text/x-yaml" "$URL"
+